@@ -14,6 +14,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -28,11 +29,9 @@ import (
 	"git.sr.ht/~emersion/soju/database"
 	"git.sr.ht/~emersion/soju/fileupload"
 	"git.sr.ht/~emersion/soju/identd"
+	"git.sr.ht/~emersion/soju/msgstore"
 )
 
-// TCP keep-alive interval for downstream TCP connections
-const downstreamKeepAlive = 1 * time.Hour
-
 type stringSliceFlag []string
 
 func (v *stringSliceFlag) String() string {
@@ -48,7 +47,8 @@ var (
 	configPath string
 	debug      bool
 
-	tlsCert atomic.Value // *tls.Certificate
+	tlsCert         atomic.Value // *tls.Certificate
+	listenerTLSCert atomic.Value // map[string]*tls.Certificate, indexed by listen address
 )
 
 func loadConfig() (*config.Server, *soju.Config, error) {
@@ -82,6 +82,19 @@ func loadConfig() (*config.Server, *soju.Config, error) {
 		return nil, nil, fmt.Errorf("failed to create authenticator: %v", err)
 	}
 
+	var msgStoreFSLayout *msgstore.FSLayout
+	if raw.MsgStore.Driver == "fs" {
+		template := raw.MsgStore.PathTemplate
+		if template == "" {
+			template = msgstore.DefaultFSTemplate
+		}
+		msgStoreFSLayout, err = msgstore.ParseFSLayout(template)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse message store path template: %v", err)
+		}
+		msgStoreFSLayout.Legacy = raw.MsgStore.LegacyLayout
+	}
+
 	if raw.TLS != nil {
 		cert, err := tls.LoadX509KeyPair(raw.TLS.CertPath, raw.TLS.KeyPath)
 		if err != nil {
@@ -90,6 +103,19 @@ func loadConfig() (*config.Server, *soju.Config, error) {
 		tlsCert.Store(&cert)
 	}
 
+	listenerCerts := make(map[string]*tls.Certificate)
+	for _, listen := range raw.Listen {
+		if listen.TLS == nil {
+			continue
+		}
+		cert, err := tls.LoadX509KeyPair(listen.TLS.CertPath, listen.TLS.KeyPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to load TLS certificate and key for listener %q: %v", listen.Addr, err)
+		}
+		listenerCerts[listen.Addr] = &cert
+	}
+	listenerTLSCert.Store(listenerCerts)
+
 	var fileUploader fileupload.Uploader
 	if raw.FileUpload != nil {
 		fileUploader, err = fileupload.New(raw.FileUpload.Driver, raw.FileUpload.Source)
@@ -99,20 +125,39 @@ func loadConfig() (*config.Server, *soju.Config, error) {
 	}
 
 	cfg := &soju.Config{
-		Hostname:                  raw.Hostname,
-		Title:                     raw.Title,
-		MsgStoreDriver:            raw.MsgStore.Driver,
-		MsgStorePath:              raw.MsgStore.Source,
-		HTTPOrigins:               raw.HTTPOrigins,
-		HTTPIngress:               raw.HTTPIngress,
-		AcceptProxyIPs:            raw.AcceptProxyIPs,
-		MaxUserNetworks:           raw.MaxUserNetworks,
-		UpstreamUserIPs:           raw.UpstreamUserIPs,
-		DisableInactiveUsersDelay: raw.DisableInactiveUsersDelay,
-		EnableUsersOnAuth:         raw.EnableUsersOnAuth,
-		MOTD:                      motd,
-		Auth:                      auth,
-		FileUploader:              fileUploader,
+		Hostname:                   raw.Hostname,
+		Title:                      raw.Title,
+		MsgStoreDriver:             raw.MsgStore.Driver,
+		MsgStorePath:               raw.MsgStore.Source,
+		MsgStoreFSLayout:           msgStoreFSLayout,
+		HTTPOrigins:                raw.HTTPOrigins,
+		HTTPIngress:                raw.HTTPIngress,
+		AcceptProxyIPs:             raw.AcceptProxyIPs,
+		AcceptProxyHosts:           raw.AcceptProxyHosts,
+		AcceptProxyResolveInterval: raw.AcceptProxyResolveInterval,
+		MaxUserNetworks:            raw.MaxUserNetworks,
+		UpstreamUserIPs:            raw.UpstreamUserIPs,
+		UpstreamResolver:           raw.UpstreamResolver,
+		UpstreamSocketOptions:      raw.SocketOptions,
+		DisableInactiveUsersDelay:  raw.DisableInactiveUsersDelay,
+		EnableUsersOnAuth:          raw.EnableUsersOnAuth,
+		OfflineEventMaxAge:         raw.OfflineEventMaxAge,
+		DefaultNick:                raw.DefaultNick,
+		DefaultUsername:            raw.DefaultUsername,
+		DefaultRealname:            raw.DefaultRealname,
+		UpstreamTLSMinVersion:      raw.TLSMinVersion,
+		UpstreamTLSCipherSuites:    raw.TLSCipherSuites,
+		DownstreamRegisterTimeout:  raw.DownstreamRegisterTimeout,
+		WebSocketReadTimeout:       raw.WebSocketReadTimeout,
+		UpstreamBanRetryDelay:      raw.UpstreamBanRetryDelay,
+		UpstreamPresenceCaps:       raw.UpstreamPresenceCaps,
+		Limits:                     raw.Limits,
+		Registration:               raw.Registration,
+		DCCRelay:                   raw.DCCRelay,
+		NetworkHealth:              raw.NetworkHealth,
+		MOTD:                       motd,
+		Auth:                       auth,
+		FileUploader:               fileUploader,
 	}
 	return raw, cfg, nil
 }
@@ -129,9 +174,11 @@ func main() {
 		log.Fatal(err)
 	}
 
-	cfg.Listen = append(cfg.Listen, listen...)
+	for _, addr := range listen {
+		cfg.Listen = append(cfg.Listen, config.Listener{Addr: addr})
+	}
 	if len(cfg.Listen) == 0 {
-		cfg.Listen = []string{":6697"}
+		cfg.Listen = []config.Listener{{Addr: ":6697"}}
 	}
 
 	db, err := database.Open(cfg.DB.Driver, cfg.DB.Source)
@@ -142,6 +189,8 @@ func main() {
 	var tlsCfg *tls.Config
 	if cfg.TLS != nil {
 		tlsCfg = &tls.Config{
+			MinVersion:   cfg.TLSMinVersion,
+			CipherSuites: cfg.TLSCipherSuites,
 			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 				return tlsCert.Load().(*tls.Certificate), nil
 			},
@@ -152,24 +201,37 @@ func main() {
 	srv.SetConfig(serverCfg)
 	srv.Logger = soju.NewLogger(log.Writer(), debug)
 
-	fileUploadHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg := srv.Config()
-		h := fileupload.Handler{
-			Uploader:    cfg.FileUploader,
-			DB:          db,
-			Auth:        cfg.Auth,
-			HTTPOrigins: cfg.HTTPOrigins,
-		}
-		h.ServeHTTP(w, r)
-	})
+	// TCP keep-alive interval for downstream TCP connections
+	downstreamKeepAlive := cfg.DownstreamKeepAlive
+	if downstreamKeepAlive == 0 {
+		downstreamKeepAlive = -1 // disabled
+	}
 
-	httpMux := http.NewServeMux()
-	httpMux.Handle("/socket", srv)
-	httpMux.Handle("/uploads", fileUploadHandler)
-	httpMux.Handle("/uploads/", fileUploadHandler)
+	newHTTPMux := func(wsHandler http.Handler, httpOrigins []string) *http.ServeMux {
+		fileUploadHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cfg := srv.Config()
+			h := fileupload.Handler{
+				Uploader:    cfg.FileUploader,
+				DB:          db,
+				Auth:        cfg.Auth,
+				HTTPOrigins: cfg.HTTPOrigins,
+			}
+			if httpOrigins != nil {
+				h.HTTPOrigins = httpOrigins
+			}
+			h.ServeHTTP(w, r)
+		})
+
+		httpMux := http.NewServeMux()
+		httpMux.Handle("/socket", wsHandler)
+		httpMux.Handle("/uploads", fileUploadHandler)
+		httpMux.Handle("/uploads/", fileUploadHandler)
+		return httpMux
+	}
 
-	for _, listen := range cfg.Listen {
-		listen := listen // copy
+	for _, listenCfg := range cfg.Listen {
+		listenCfg := listenCfg // copy
+		listen := listenCfg.Addr
 		listenURI := listen
 		if !strings.Contains(listenURI, ":/") {
 			// This is a raw domain name, make it an URL with an empty scheme
@@ -180,6 +242,51 @@ func main() {
 			log.Fatalf("failed to parse listen URI %q: %v", listen, err)
 		}
 
+		tlsCfg := tlsCfg
+		if listenCfg.TLS != nil {
+			tlsCfg = &tls.Config{
+				MinVersion:   cfg.TLSMinVersion,
+				CipherSuites: cfg.TLSCipherSuites,
+				GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+					return listenerTLSCert.Load().(map[string]*tls.Certificate)[listen], nil
+				},
+			}
+		}
+
+		wsHandler := &soju.WebSocketHandler{
+			Server:         srv,
+			HTTPOrigins:    listenCfg.HTTPOrigins,
+			AcceptProxy:    listenCfg.AcceptProxy,
+			AcceptProxyIPs: listenCfg.AcceptProxyIPs,
+		}
+
+		socketOpts := cfg.SocketOptions.Merge(listenCfg.SocketOptions)
+
+		// listenTCP starts a TCP listener with the socket options applied
+		listenTCP := func(addr string, keepAlive time.Duration) (net.Listener, error) {
+			lc := net.ListenConfig{
+				KeepAlive: keepAlive,
+				Control:   soju.SocketControl(socketOpts),
+			}
+			ln, err := lc.Listen(context.Background(), "tcp", addr)
+			if err != nil {
+				return nil, err
+			}
+			return soju.NewSocketOptionsListener(ln, socketOpts), nil
+		}
+
+		// wrapListener applies the per-listener settings to a listener. The
+		// PROXY protocol is only supported for raw connections.
+		wrapListener := func(ln net.Listener, proxyProto bool) net.Listener {
+			if listenCfg.MaxConnections > 0 {
+				ln = newLimitListener(ln, listenCfg.MaxConnections)
+			}
+			if proxyProto && listenCfg.AcceptProxy != config.ProxyOff {
+				ln = proxyProtoListener(ln, srv, &listenCfg)
+			}
+			return ln
+		}
+
 		switch u.Scheme {
 		case "ircs", "":
 			if tlsCfg == nil {
@@ -188,15 +295,12 @@ func main() {
 			addr := withDefaultPort(u.Host, "6697")
 			ircsTLSCfg := tlsCfg.Clone()
 			ircsTLSCfg.NextProtos = []string{"irc"}
-			lc := net.ListenConfig{
-				KeepAlive: downstreamKeepAlive,
-			}
-			l, err := lc.Listen(context.Background(), "tcp", addr)
+			l, err := listenTCP(addr, downstreamKeepAlive)
 			if err != nil {
 				log.Fatalf("failed to start TLS listener on %q: %v", listen, err)
 			}
 			ln := tls.NewListener(l, ircsTLSCfg)
-			ln = proxyProtoListener(ln, srv)
+			ln = wrapListener(ln, true)
 			go func() {
 				if err := srv.Serve(ln, srv.Handle); err != nil {
 					log.Printf("serving %q: %v", listen, err)
@@ -204,14 +308,11 @@ func main() {
 			}()
 		case "irc+insecure":
 			addr := withDefaultPort(u.Host, "6667")
-			lc := net.ListenConfig{
-				KeepAlive: downstreamKeepAlive,
-			}
-			ln, err := lc.Listen(context.Background(), "tcp", addr)
+			ln, err := listenTCP(addr, downstreamKeepAlive)
 			if err != nil {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
-			ln = proxyProtoListener(ln, srv)
+			ln = wrapListener(ln, true)
 			go func() {
 				if err := srv.Serve(ln, srv.Handle); err != nil {
 					log.Printf("serving %q: %v", listen, err)
@@ -222,7 +323,7 @@ func main() {
 			if err != nil {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
-			ln = proxyProtoListener(ln, srv)
+			ln = wrapListener(ln, true)
 			go func() {
 				if err := srv.Serve(ln, srv.Handle); err != nil {
 					log.Printf("serving %q: %v", listen, err)
@@ -237,7 +338,7 @@ func main() {
 			if err != nil {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
-			ln = proxyProtoListener(ln, srv)
+			ln = wrapListener(ln, true)
 			// TODO: this is racy
 			if err := os.Chmod(path, 0600); err != nil {
 				log.Fatalf("failed to chmod Unix admin socket: %v", err)
@@ -251,23 +352,33 @@ func main() {
 			if tlsCfg == nil {
 				log.Fatalf("failed to listen on %q: missing TLS configuration", listen)
 			}
+			ln, err := listenTCP(withDefaultPort(u.Host, "https"), 0)
+			if err != nil {
+				log.Fatalf("failed to start listener on %q: %v", listen, err)
+			}
+			ln = wrapListener(ln, false)
 			httpSrv := http.Server{
-				Addr:      withDefaultPort(u.Host, "https"),
-				TLSConfig: tlsCfg,
-				Handler:   srv,
+				TLSConfig:         tlsCfg,
+				Handler:           wsHandler,
+				ReadHeaderTimeout: cfg.WebSocketHandshakeTimeout,
 			}
 			go func() {
-				if err := httpSrv.ListenAndServeTLS("", ""); err != nil {
+				if err := httpSrv.ServeTLS(ln, "", ""); err != nil {
 					log.Fatalf("serving %q: %v", listen, err)
 				}
 			}()
 		case "ws+insecure":
+			ln, err := listenTCP(withDefaultPort(u.Host, "http"), 0)
+			if err != nil {
+				log.Fatalf("failed to start listener on %q: %v", listen, err)
+			}
+			ln = wrapListener(ln, false)
 			httpSrv := http.Server{
-				Addr:    withDefaultPort(u.Host, "http"),
-				Handler: srv,
+				Handler:           wsHandler,
+				ReadHeaderTimeout: cfg.WebSocketHandshakeTimeout,
 			}
 			go func() {
-				if err := httpSrv.ListenAndServe(); err != nil {
+				if err := httpSrv.Serve(ln); err != nil {
 					log.Fatalf("serving %q: %v", listen, err)
 				}
 			}()
@@ -276,8 +387,9 @@ func main() {
 			if err != nil {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
+			ln = wrapListener(ln, false)
 			go func() {
-				if err := http.Serve(ln, srv); err != nil {
+				if err := http.Serve(ln, wsHandler); err != nil {
 					log.Fatalf("serving %q: %v", listen, err)
 				}
 			}()
@@ -287,11 +399,11 @@ func main() {
 			}
 
 			addr := withDefaultPort(u.Host, "113")
-			ln, err := net.Listen("tcp", addr)
+			ln, err := listenTCP(addr, 0)
 			if err != nil {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
-			ln = proxyProtoListener(ln, srv)
+			ln = wrapListener(ln, true)
 			ln = soju.NewRetryListener(ln)
 			go func() {
 				if err := srv.Identd.Serve(ln); err != nil {
@@ -352,23 +464,33 @@ func main() {
 			if tlsCfg == nil {
 				log.Fatalf("failed to listen on %q: missing TLS configuration", listen)
 			}
+			ln, err := listenTCP(withDefaultPort(u.Host, "https"), 0)
+			if err != nil {
+				log.Fatalf("failed to start listener on %q: %v", listen, err)
+			}
+			ln = wrapListener(ln, false)
 			httpSrv := http.Server{
-				Addr:      withDefaultPort(u.Host, "https"),
-				TLSConfig: tlsCfg,
-				Handler:   httpMux,
+				TLSConfig:         tlsCfg,
+				Handler:           newHTTPMux(wsHandler, listenCfg.HTTPOrigins),
+				ReadHeaderTimeout: cfg.WebSocketHandshakeTimeout,
 			}
 			go func() {
-				if err := httpSrv.ListenAndServeTLS("", ""); err != nil {
+				if err := httpSrv.ServeTLS(ln, "", ""); err != nil {
 					log.Fatalf("serving %q: %v", listen, err)
 				}
 			}()
 		case "http+insecure":
+			ln, err := listenTCP(withDefaultPort(u.Host, "http"), 0)
+			if err != nil {
+				log.Fatalf("failed to start listener on %q: %v", listen, err)
+			}
+			ln = wrapListener(ln, false)
 			httpSrv := http.Server{
-				Addr:    withDefaultPort(u.Host, "http"),
-				Handler: httpMux,
+				Handler:           newHTTPMux(wsHandler, listenCfg.HTTPOrigins),
+				ReadHeaderTimeout: cfg.WebSocketHandshakeTimeout,
 			}
 			go func() {
-				if err := httpSrv.ListenAndServe(); err != nil {
+				if err := httpSrv.Serve(ln); err != nil {
 					log.Fatalf("serving %q: %v", listen, err)
 				}
 			}()
@@ -377,8 +499,9 @@ func main() {
 			if err != nil {
 				log.Fatalf("failed to start listener on %q: %v", listen, err)
 			}
+			ln = wrapListener(ln, false)
 			go func() {
-				if err := http.Serve(ln, httpMux); err != nil {
+				if err := http.Serve(ln, newHTTPMux(wsHandler, listenCfg.HTTPOrigins)); err != nil {
 					log.Fatalf("serving %q: %v", listen, err)
 				}
 			}()
@@ -387,6 +510,9 @@ func main() {
 		}
 
 		log.Printf("server listening on %q", listen)
+		if debug && tlsCfg != nil {
+			log.Printf("listener %q: using TLS minimum version %v and cipher suites %v", listen, config.FormatTLSVersion(tlsCfg.MinVersion), config.CipherSuiteNames(tlsCfg.CipherSuites))
+		}
 	}
 
 	if db, ok := db.(database.MetricsCollectorDatabase); ok && srv.MetricsRegistry != nil {
@@ -419,15 +545,20 @@ func main() {
 	}
 }
 
-func proxyProtoListener(ln net.Listener, srv *soju.Server) net.Listener {
+func proxyProtoListener(ln net.Listener, srv *soju.Server, listenCfg *config.Listener) net.Listener {
 	return &proxyproto.Listener{
 		Listener: ln,
 		Policy: func(upstream net.Addr) (proxyproto.Policy, error) {
+			// This includes Unix sockets, whose peer address is
+			// meaningless
+			if listenCfg.AcceptProxy == config.ProxyRequired {
+				return proxyproto.REQUIRE, nil
+			}
 			tcpAddr, ok := upstream.(*net.TCPAddr)
 			if !ok {
 				return proxyproto.IGNORE, nil
 			}
-			if srv.Config().AcceptProxyIPs.Contains(tcpAddr.IP) {
+			if srv.ListenerAcceptsProxy(listenCfg.AcceptProxyIPs, tcpAddr.IP) {
 				return proxyproto.USE, nil
 			}
 			return proxyproto.IGNORE, nil
@@ -436,6 +567,45 @@ func proxyProtoListener(ln net.Listener, srv *soju.Server) net.Listener {
 	}
 }
 
+// limitListener is a listener accepting at most a fixed number of
+// simultaneous connections. Extra connections are closed immediately.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func newLimitListener(ln net.Listener, n int) net.Listener {
+	return &limitListener{ln, make(chan struct{}, n)}
+}
+
+func (ln *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := ln.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		select {
+		case ln.sem <- struct{}{}:
+			return &limitConn{Conn: conn, release: func() { <-ln.sem }}, nil
+		default:
+			conn.Close()
+		}
+	}
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
 func withDefaultPort(addr, port string) string {
 	if _, _, err := net.SplitHostPort(addr); err != nil {
 		addr += ":" + port
@@ -26,7 +26,7 @@ func init() {
 func run(ctx context.Context, cfg *config.Server, words []string) error {
 	var path string
 	for _, listen := range cfg.Listen {
-		u, err := url.Parse(listen)
+		u, err := url.Parse(listen.Addr)
 		if err != nil {
 			continue
 		}
@@ -69,7 +69,9 @@ func main() {
 		}
 
 		user := database.NewUser(username)
-		user.Admin = *admin
+		if *admin {
+			user.Role = database.RoleAdmin
+		}
 		if err := user.SetPassword(password); err != nil {
 			log.Fatalf("failed to set user password: %v", err)
 		}
@@ -40,6 +40,27 @@ var loopbackIPs = IPSet{
 	},
 }
 
+// isHostname checks whether a string is a syntactically valid DNS hostname.
+func isHostname(s string) bool {
+	s = strings.TrimSuffix(s, ".")
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			switch {
+			case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9', ch == '-':
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
 func parseDuration(s string) (time.Duration, error) {
 	if !strings.HasSuffix(s, "d") {
 		return 0, fmt.Errorf("missing 'd' suffix in duration")
@@ -52,16 +73,79 @@ func parseDuration(s string) (time.Duration, error) {
 	return time.Duration(v * 24 * float64(time.Hour)), nil
 }
 
+// ParseResolverAddr parses the address of a DNS resolver, in the form
+// "host[:port]". The port defaults to 53.
+func ParseResolverAddr(s string) (string, error) {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		host, port = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"), "53"
+	}
+	if host == "" {
+		return "", fmt.Errorf("missing host in resolver address %q", s)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("invalid port in resolver address %q", s)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
 type TLS struct {
 	CertPath, KeyPath string
 }
 
+// ProxyPolicy describes how a listener handles the PROXY protocol and
+// forwarding HTTP header fields.
+type ProxyPolicy int
+
+const (
+	// Accepted from trusted proxy IPs only, other peers are used as-is
+	ProxyOptional ProxyPolicy = iota
+	// Always ignored
+	ProxyOff
+	// Required from all peers, a missing header is an error
+	ProxyRequired
+)
+
+func parseProxyPolicy(s string) (ProxyPolicy, error) {
+	switch s {
+	case "optional", "true":
+		return ProxyOptional, nil
+	case "off", "false":
+		return ProxyOff, nil
+	case "required":
+		return ProxyRequired, nil
+	default:
+		return 0, fmt.Errorf("unknown policy %q", s)
+	}
+}
+
+type Listener struct {
+	Addr string
+
+	// If non-nil, overrides the global TLS certificate
+	TLS *TLS
+	// How the PROXY protocol and forwarding HTTP header fields are handled
+	AcceptProxy ProxyPolicy
+	// If non-nil, overrides the global trusted proxy IPs
+	AcceptProxyIPs IPSet
+	// If non-nil, overrides the global allowed HTTP origins
+	HTTPOrigins []string
+	// Maximum number of simultaneous connections, zero means no limit
+	MaxConnections int
+	// Overrides the global socket options
+	SocketOptions SocketOptions
+}
+
 type DB struct {
 	Driver, Source string
 }
 
 type MsgStore struct {
 	Driver, Source string
+
+	// fs driver only
+	PathTemplate string // empty means the default template
+	LegacyLayout bool
 }
 
 type Auth struct {
@@ -73,7 +157,7 @@ type FileUpload struct {
 }
 
 type Server struct {
-	Listen   []string
+	Listen   []Listener
 	TLS      *TLS
 	Hostname string
 	Title    string
@@ -88,10 +172,51 @@ type Server struct {
 	HTTPIngress    string
 	AcceptProxyIPs IPSet
 
+	// Hostnames whose addresses are accepted as proxies, re-resolved
+	// periodically
+	AcceptProxyHosts           []string
+	AcceptProxyResolveInterval time.Duration
+
 	MaxUserNetworks           int
 	UpstreamUserIPs           []*net.IPNet
+	UpstreamResolver          string // empty means the system resolver
 	DisableInactiveUsersDelay time.Duration
 	EnableUsersOnAuth         bool
+	OfflineEventMaxAge        time.Duration
+
+	DefaultNick     NetworkTemplate
+	DefaultUsername NetworkTemplate
+	DefaultRealname NetworkTemplate
+
+	TLSMinVersion   uint16   // zero means the crypto/tls default
+	TLSCipherSuites []uint16 // nil means the crypto/tls default
+
+	// Zero disables the corresponding keep-alive or timeout
+	DownstreamKeepAlive       time.Duration
+	DownstreamRegisterTimeout time.Duration
+	WebSocketHandshakeTimeout time.Duration
+	WebSocketReadTimeout      time.Duration
+
+	// Delay before reconnecting after being banned from a network, zero
+	// means the usual reconnection delay
+	UpstreamBanRetryDelay time.Duration
+
+	// Whether to request away-notify, account-notify and similar
+	// capabilities from upstream servers
+	UpstreamPresenceCaps bool
+
+	Limits Limits
+
+	// Self-registration settings, nil if self-registration is disabled
+	Registration *Registration
+
+	// DCC relay settings, nil if DCC relaying is disabled
+	DCCRelay *DCCRelay
+
+	NetworkHealth NetworkHealth
+
+	// Applied to listeners and upstream connections
+	SocketOptions SocketOptions
 }
 
 func Defaults() *Server {
@@ -106,55 +231,142 @@ func Defaults() *Server {
 			Source: "soju.db",
 		},
 		MsgStore: MsgStore{
-			Driver: "memory",
+			Driver:       "memory",
+			LegacyLayout: true,
 		},
 		Auth: Auth{
 			Driver: "internal",
 		},
-		HTTPIngress:     "https://" + hostname,
-		MaxUserNetworks: -1,
+		HTTPIngress:        "https://" + hostname,
+		MaxUserNetworks:    -1,
+		OfflineEventMaxAge: 7 * 24 * time.Hour,
+
+		AcceptProxyResolveInterval: 5 * time.Minute,
+
+		DownstreamKeepAlive:       time.Hour,
+		DownstreamRegisterTimeout: 30 * time.Second,
+
+		UpstreamBanRetryDelay: 6 * time.Hour,
+		UpstreamPresenceCaps:  true,
+
+		Limits:        DefaultLimits(),
+		NetworkHealth: DefaultNetworkHealth(),
 	}
 }
 
 func Load(filename string) (*Server, error) {
 	var raw struct {
 		Listen []struct {
-			Addr string `scfg:",param"`
+			Addr           string     `scfg:",param"`
+			TLS            *[2]string `scfg:"tls"`
+			AcceptProxy    string     `scfg:"accept-proxy"`
+			AcceptProxyIP  []string   `scfg:"accept-proxy-ip"`
+			HTTPOrigin     []string   `scfg:"http-origin"`
+			MaxConnections int        `scfg:"max-connections"`
+
+			SocketOptions *rawSocketOptions `scfg:"socket-options"`
 		} `scfg:"listen"`
 		Hostname            string     `scfg:"hostname"`
 		Title               string     `scfg:"title"`
 		MOTD                string     `scfg:"motd"`
 		TLS                 *[2]string `scfg:"tls"`
 		DB                  *[2]string `scfg:"db"`
-		MessageStore        []string   `scfg:"message-store"`
 		Log                 []string   `scfg:"log"`
 		Auth                []string   `scfg:"auth"`
 		FileUpload          []string   `scfg:"file-upload"`
 		HTTPOrigin          []string   `scfg:"http-origin"`
 		HTTPIngress         string     `scfg:"http-ingress"`
 		AcceptProxyIP       []string   `scfg:"accept-proxy-ip"`
+		AcceptProxyResolve  string     `scfg:"accept-proxy-resolve-interval"`
 		MaxUserNetworks     int        `scfg:"max-user-networks"`
 		UpstreamUserIP      []string   `scfg:"upstream-user-ip"`
+		UpstreamResolver    string     `scfg:"upstream-resolver"`
 		DisableInactiveUser string     `scfg:"disable-inactive-user"`
 		EnableUserOnAuth    string     `scfg:"enable-user-on-auth"`
+		OfflineEventMaxAge  string     `scfg:"offline-event-max-age"`
+		DefaultNick         string     `scfg:"default-nick"`
+		DefaultUsername     string     `scfg:"default-username"`
+		DefaultRealname     string     `scfg:"default-realname"`
+		TLSMinVersion       string     `scfg:"tls-min-version"`
+		TLSCiphers          []string   `scfg:"tls-ciphers"`
+		UpstreamPresenceCap string     `scfg:"upstream-presence-caps"`
+
+		DownstreamKeepAlive       string `scfg:"downstream-keepalive"`
+		DownstreamRegisterTimeout string `scfg:"downstream-register-timeout"`
+		WebSocketHandshakeTimeout string `scfg:"websocket-handshake-timeout"`
+		WebSocketReadTimeout      string `scfg:"websocket-read-timeout"`
+		UpstreamBanRetryDelay     string `scfg:"upstream-ban-retry-delay"`
+
+		Limits        *rawLimits        `scfg:"limits"`
+		Registration  *rawRegistration  `scfg:"registration"`
+		DCCRelay      *rawDCCRelay      `scfg:"dcc-relay"`
+		NetworkHealth *rawNetworkHealth `scfg:"network-health"`
+		SocketOptions *rawSocketOptions `scfg:"socket-options"`
+
+		MessageStore *struct {
+			Params       []string `scfg:",param"`
+			PathTemplate string   `scfg:"path-template"`
+			LegacyLayout string   `scfg:"legacy-layout"`
+		} `scfg:"message-store"`
 	}
 
 	raw.MaxUserNetworks = -1
 
-	f, err := os.Open(filename)
-	if err != nil {
+	var p preprocessor
+	if err := p.readFile(filename, 0); err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	if err := scfg.NewDecoder(f).Decode(&raw); err != nil {
-		return nil, err
+	if err := scfg.NewDecoder(strings.NewReader(p.buf.String())).Decode(&raw); err != nil {
+		return nil, p.wrapError(err)
 	}
 
 	srv := Defaults()
 
 	for _, listen := range raw.Listen {
-		srv.Listen = append(srv.Listen, listen.Addr)
+		l := Listener{
+			Addr:           listen.Addr,
+			HTTPOrigins:    listen.HTTPOrigin,
+			MaxConnections: listen.MaxConnections,
+		}
+		if listen.TLS != nil {
+			l.TLS = &TLS{CertPath: listen.TLS[0], KeyPath: listen.TLS[1]}
+		}
+		if listen.AcceptProxy != "" {
+			policy, err := parseProxyPolicy(listen.AcceptProxy)
+			if err != nil {
+				return nil, fmt.Errorf("directive listen %q: directive accept-proxy: %v", listen.Addr, err)
+			}
+			l.AcceptProxy = policy
+		}
+		if listen.AcceptProxyIP != nil {
+			l.AcceptProxyIPs = IPSet{}
+		}
+		for _, s := range listen.AcceptProxyIP {
+			if s == "localhost" {
+				l.AcceptProxyIPs = append(l.AcceptProxyIPs, loopbackIPs...)
+				continue
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("directive listen %q: directive accept-proxy-ip: failed to parse CIDR: %v", listen.Addr, err)
+			}
+			l.AcceptProxyIPs = append(l.AcceptProxyIPs, n)
+		}
+		for _, origin := range listen.HTTPOrigin {
+			if _, err := path.Match(origin, origin); err != nil {
+				return nil, fmt.Errorf("directive listen %q: directive http-origin: %v", listen.Addr, err)
+			}
+		}
+		if listen.MaxConnections < 0 {
+			return nil, fmt.Errorf("directive listen %q: directive max-connections: limit must be positive", listen.Addr)
+		}
+		socketOpts, err := parseSocketOptions(listen.SocketOptions)
+		if err != nil {
+			return nil, fmt.Errorf("directive listen %q: directive socket-options: %v", listen.Addr, err)
+		}
+		l.SocketOptions = socketOpts
+		srv.Listen = append(srv.Listen, l)
 	}
 	if raw.Hostname != "" {
 		srv.Hostname = raw.Hostname
@@ -167,11 +379,12 @@ func Load(filename string) (*Server, error) {
 	if raw.DB != nil {
 		srv.DB = DB{Driver: raw.DB[0], Source: raw.DB[1]}
 	}
-	if raw.MessageStore == nil {
-		raw.MessageStore = raw.Log
-	}
+	msgStoreParams := raw.Log
 	if raw.MessageStore != nil {
-		driver, source, err := parseDriverSource("message-store", raw.MessageStore)
+		msgStoreParams = raw.MessageStore.Params
+	}
+	if msgStoreParams != nil {
+		driver, source, err := parseDriverSource("message-store", msgStoreParams)
 		if err != nil {
 			return nil, err
 		}
@@ -185,7 +398,21 @@ func Load(filename string) (*Server, error) {
 		default:
 			return nil, fmt.Errorf("directive message-store: unknown driver %q", driver)
 		}
-		srv.MsgStore = MsgStore{driver, source}
+		srv.MsgStore.Driver = driver
+		srv.MsgStore.Source = source
+	}
+	if raw.MessageStore != nil {
+		if (raw.MessageStore.PathTemplate != "" || raw.MessageStore.LegacyLayout != "") && srv.MsgStore.Driver != "fs" {
+			return nil, fmt.Errorf("directive message-store: path-template and legacy-layout require the %q driver", "fs")
+		}
+		srv.MsgStore.PathTemplate = raw.MessageStore.PathTemplate
+		if raw.MessageStore.LegacyLayout != "" {
+			b, err := strconv.ParseBool(raw.MessageStore.LegacyLayout)
+			if err != nil {
+				return nil, fmt.Errorf("directive message-store: directive legacy-layout: %v", err)
+			}
+			srv.MsgStore.LegacyLayout = b
+		}
 	}
 	if raw.Auth != nil {
 		driver, source, err := parseDriverSource("auth", raw.Auth)
@@ -237,10 +464,23 @@ func Load(filename string) (*Server, error) {
 		}
 		_, n, err := net.ParseCIDR(s)
 		if err != nil {
+			if net.ParseIP(s) == nil && isHostname(s) {
+				srv.AcceptProxyHosts = append(srv.AcceptProxyHosts, s)
+				continue
+			}
 			return nil, fmt.Errorf("directive accept-proxy-ip: failed to parse CIDR: %v", err)
 		}
 		srv.AcceptProxyIPs = append(srv.AcceptProxyIPs, n)
 	}
+	if raw.AcceptProxyResolve != "" {
+		dur, err := time.ParseDuration(raw.AcceptProxyResolve)
+		if err != nil {
+			return nil, fmt.Errorf("directive accept-proxy-resolve-interval: %v", err)
+		} else if dur <= 0 {
+			return nil, fmt.Errorf("directive accept-proxy-resolve-interval: duration must be positive")
+		}
+		srv.AcceptProxyResolveInterval = dur
+	}
 	srv.MaxUserNetworks = raw.MaxUserNetworks
 	var hasIPv4, hasIPv6 bool
 	for _, s := range raw.UpstreamUserIP {
@@ -261,6 +501,13 @@ func Load(filename string) (*Server, error) {
 		}
 		srv.UpstreamUserIPs = append(srv.UpstreamUserIPs, n)
 	}
+	if raw.UpstreamResolver != "" {
+		addr, err := ParseResolverAddr(raw.UpstreamResolver)
+		if err != nil {
+			return nil, fmt.Errorf("directive upstream-resolver: %v", err)
+		}
+		srv.UpstreamResolver = addr
+	}
 	if raw.DisableInactiveUser != "" {
 		dur, err := parseDuration(raw.DisableInactiveUser)
 		if err != nil {
@@ -277,6 +524,106 @@ func Load(filename string) (*Server, error) {
 		}
 		srv.EnableUsersOnAuth = b
 	}
+	if raw.UpstreamPresenceCap != "" {
+		b, err := strconv.ParseBool(raw.UpstreamPresenceCap)
+		if err != nil {
+			return nil, fmt.Errorf("directive upstream-presence-caps: %v", err)
+		}
+		srv.UpstreamPresenceCaps = b
+	}
+	if raw.OfflineEventMaxAge != "" {
+		dur, err := parseDuration(raw.OfflineEventMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("directive offline-event-max-age: %v", err)
+		} else if dur < 0 {
+			return nil, fmt.Errorf("directive offline-event-max-age: duration must be positive")
+		}
+		srv.OfflineEventMaxAge = dur
+	}
+	templates := []struct {
+		name  string
+		value string
+		dst   *NetworkTemplate
+	}{
+		{"default-nick", raw.DefaultNick, &srv.DefaultNick},
+		{"default-username", raw.DefaultUsername, &srv.DefaultUsername},
+		{"default-realname", raw.DefaultRealname, &srv.DefaultRealname},
+	}
+	for _, tmpl := range templates {
+		if err := NetworkTemplate(tmpl.value).Validate(); err != nil {
+			return nil, fmt.Errorf("directive %v: %v", tmpl.name, err)
+		}
+		*tmpl.dst = NetworkTemplate(tmpl.value)
+	}
+	if raw.TLSMinVersion != "" {
+		v, err := ParseTLSVersion(raw.TLSMinVersion)
+		if err != nil {
+			return nil, fmt.Errorf("directive tls-min-version: %v", err)
+		}
+		srv.TLSMinVersion = v
+	}
+	if raw.TLSCiphers != nil {
+		suites, err := ParseCipherSuites(raw.TLSCiphers)
+		if err != nil {
+			return nil, fmt.Errorf("directive tls-ciphers: %v", err)
+		}
+		srv.TLSCipherSuites = suites
+	}
+	timeouts := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"downstream-keepalive", raw.DownstreamKeepAlive, &srv.DownstreamKeepAlive},
+		{"downstream-register-timeout", raw.DownstreamRegisterTimeout, &srv.DownstreamRegisterTimeout},
+		{"websocket-handshake-timeout", raw.WebSocketHandshakeTimeout, &srv.WebSocketHandshakeTimeout},
+		{"websocket-read-timeout", raw.WebSocketReadTimeout, &srv.WebSocketReadTimeout},
+		{"upstream-ban-retry-delay", raw.UpstreamBanRetryDelay, &srv.UpstreamBanRetryDelay},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value == "" {
+			continue
+		}
+		dur, err := time.ParseDuration(timeout.value)
+		if err != nil {
+			return nil, fmt.Errorf("directive %v: %v", timeout.name, err)
+		} else if dur < 0 {
+			return nil, fmt.Errorf("directive %v: duration must be positive", timeout.name)
+		}
+		*timeout.dst = dur
+	}
+	limits, err := parseLimits(raw.Limits)
+	if err != nil {
+		return nil, fmt.Errorf("directive limits: %v", err)
+	}
+	srv.Limits = limits
+
+	registration, err := parseRegistration(raw.Registration)
+	if err != nil {
+		return nil, fmt.Errorf("directive registration: %v", err)
+	}
+	if registration != nil && srv.Auth.Driver != "internal" {
+		return nil, fmt.Errorf("directive registration: requires the internal auth driver")
+	}
+	srv.Registration = registration
+
+	dccRelay, err := parseDCCRelay(raw.DCCRelay)
+	if err != nil {
+		return nil, fmt.Errorf("directive dcc-relay: %v", err)
+	}
+	srv.DCCRelay = dccRelay
+
+	health, err := parseNetworkHealth(raw.NetworkHealth)
+	if err != nil {
+		return nil, fmt.Errorf("directive network-health: %v", err)
+	}
+	srv.NetworkHealth = health
+
+	socketOpts, err := parseSocketOptions(raw.SocketOptions)
+	if err != nil {
+		return nil, fmt.Errorf("directive socket-options: %v", err)
+	}
+	srv.SocketOptions = socketOpts
 
 	return srv, nil
 }
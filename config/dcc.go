@@ -0,0 +1,118 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DCCRelay contains the settings used to relay DCC connections between IRC
+// users. Relaying is disabled when the server's DCCRelay field is nil.
+type DCCRelay struct {
+	// Public IP address advertised in relayed DCC offers
+	PublicIP net.IP
+
+	// Range of ports to listen on for relayed connections
+	MinPort, MaxPort int
+
+	// Maximum number of bytes relayed per connection, in both directions,
+	// zero means no limit
+	MaxBytes int64
+
+	// Maximum duration of a relayed connection, zero means no limit
+	MaxDuration time.Duration
+
+	// How long to wait for the other party to connect
+	AcceptTimeout time.Duration
+
+	// Maximum number of simultaneous relayed connections per user, zero
+	// means no limit
+	MaxPerUser int
+}
+
+type rawDCCRelay struct {
+	PublicIP      string `scfg:"public-ip"`
+	Ports         string `scfg:"ports"`
+	MaxBytes      *int64 `scfg:"max-bytes"`
+	MaxDuration   string `scfg:"max-duration"`
+	AcceptTimeout string `scfg:"accept-timeout"`
+	MaxPerUser    *int   `scfg:"max-per-user"`
+}
+
+func parseDCCRelay(raw *rawDCCRelay) (*DCCRelay, error) {
+	if raw == nil {
+		return nil, nil
+	}
+
+	relay := &DCCRelay{
+		MaxDuration:   time.Hour,
+		AcceptTimeout: 2 * time.Minute,
+		MaxPerUser:    4,
+	}
+
+	if raw.PublicIP == "" {
+		return nil, fmt.Errorf("missing public-ip directive")
+	}
+	relay.PublicIP = net.ParseIP(raw.PublicIP)
+	if relay.PublicIP == nil {
+		return nil, fmt.Errorf("directive public-ip: invalid IP address %q", raw.PublicIP)
+	}
+
+	if raw.Ports == "" {
+		return nil, fmt.Errorf("missing ports directive")
+	}
+	minStr, maxStr, ok := strings.Cut(raw.Ports, "-")
+	if !ok {
+		maxStr = minStr
+	}
+	minPort, err := strconv.ParseUint(minStr, 10, 16)
+	if err != nil || minPort == 0 {
+		return nil, fmt.Errorf("directive ports: invalid port %q", minStr)
+	}
+	maxPort, err := strconv.ParseUint(maxStr, 10, 16)
+	if err != nil || maxPort < minPort {
+		return nil, fmt.Errorf("directive ports: invalid port %q", maxStr)
+	}
+	relay.MinPort, relay.MaxPort = int(minPort), int(maxPort)
+
+	if raw.MaxBytes != nil {
+		if *raw.MaxBytes < 0 {
+			return nil, fmt.Errorf("directive max-bytes: value must be positive")
+		}
+		relay.MaxBytes = *raw.MaxBytes
+	}
+	if raw.MaxPerUser != nil {
+		if *raw.MaxPerUser < 0 {
+			return nil, fmt.Errorf("directive max-per-user: value must be positive")
+		}
+		relay.MaxPerUser = *raw.MaxPerUser
+	}
+
+	timeouts := []struct {
+		name  string
+		value string
+		dst   *time.Duration
+	}{
+		{"max-duration", raw.MaxDuration, &relay.MaxDuration},
+		{"accept-timeout", raw.AcceptTimeout, &relay.AcceptTimeout},
+	}
+	for _, timeout := range timeouts {
+		if timeout.value == "" {
+			continue
+		}
+		dur, err := time.ParseDuration(timeout.value)
+		if err != nil {
+			return nil, fmt.Errorf("directive %v: %v", timeout.name, err)
+		} else if dur < 0 {
+			return nil, fmt.Errorf("directive %v: duration must be positive", timeout.name)
+		}
+		*timeout.dst = dur
+	}
+	if relay.AcceptTimeout == 0 {
+		return nil, fmt.Errorf("directive accept-timeout: duration must be non-zero")
+	}
+
+	return relay, nil
+}
@@ -0,0 +1,104 @@
+package config
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadDCCRelay(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  string
+		want    *DCCRelay
+		wantErr bool
+	}{
+		{
+			name:   "disabled",
+			config: "",
+			want:   nil,
+		},
+		{
+			name:   "defaults",
+			config: "dcc-relay {\n\tpublic-ip 203.0.113.1\n\tports 50000-50100\n}\n",
+			want: &DCCRelay{
+				PublicIP:      net.ParseIP("203.0.113.1"),
+				MinPort:       50000,
+				MaxPort:       50100,
+				MaxDuration:   time.Hour,
+				AcceptTimeout: 2 * time.Minute,
+				MaxPerUser:    4,
+			},
+		},
+		{
+			name: "all knobs",
+			config: `dcc-relay {
+	public-ip 2001:db8::1
+	ports 50000
+	max-bytes 1048576
+	max-duration 0
+	accept-timeout 30s
+	max-per-user 0
+}
+`,
+			want: &DCCRelay{
+				PublicIP:      net.ParseIP("2001:db8::1"),
+				MinPort:       50000,
+				MaxPort:       50000,
+				MaxBytes:      1048576,
+				AcceptTimeout: 30 * time.Second,
+			},
+		},
+		{
+			name:    "missing public IP",
+			config:  "dcc-relay {\n\tports 50000-50100\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "missing ports",
+			config:  "dcc-relay {\n\tpublic-ip 203.0.113.1\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid IP",
+			config:  "dcc-relay {\n\tpublic-ip example.org\n\tports 50000-50100\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "reversed range",
+			config:  "dcc-relay {\n\tpublic-ip 203.0.113.1\n\tports 50100-50000\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "zero accept timeout",
+			config:  "dcc-relay {\n\tpublic-ip 203.0.113.1\n\tports 50000-50100\n\taccept-timeout 0\n}\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(filename, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			srv, err := Load(filename)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got DCC relay %+v", srv.DCCRelay)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+			if !reflect.DeepEqual(srv.DCCRelay, tc.want) {
+				t.Errorf("got DCC relay %+v, want %+v", srv.DCCRelay, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// NetworkHealth contains the thresholds above which a connection to an
+// upstream network is considered degraded. Users can override them per
+// network.
+type NetworkHealth struct {
+	// Maximum smoothed lag, zero disables the check
+	MaxLag time.Duration
+
+	// Maximum number of reconnections in the last hour, zero disables the
+	// check
+	MaxReconnects int
+}
+
+func DefaultNetworkHealth() NetworkHealth {
+	return NetworkHealth{
+		MaxLag:        30 * time.Second,
+		MaxReconnects: 10,
+	}
+}
+
+type rawNetworkHealth struct {
+	MaxLag        string `scfg:"max-lag"`
+	MaxReconnects *int   `scfg:"max-reconnects-per-hour"`
+}
+
+func parseNetworkHealth(raw *rawNetworkHealth) (NetworkHealth, error) {
+	health := DefaultNetworkHealth()
+	if raw == nil {
+		return health, nil
+	}
+
+	if raw.MaxLag != "" {
+		dur, err := time.ParseDuration(raw.MaxLag)
+		if err != nil {
+			return health, fmt.Errorf("directive max-lag: %v", err)
+		} else if dur < 0 {
+			return health, fmt.Errorf("directive max-lag: duration must be positive")
+		}
+		health.MaxLag = dur
+	}
+	if raw.MaxReconnects != nil {
+		if *raw.MaxReconnects < 0 {
+			return health, fmt.Errorf("directive max-reconnects-per-hour: value must be positive")
+		}
+		health.MaxReconnects = *raw.MaxReconnects
+	}
+
+	return health, nil
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadNetworkHealth(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  string
+		want    NetworkHealth
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: "",
+			want:   DefaultNetworkHealth(),
+		},
+		{
+			name:   "all knobs",
+			config: "network-health {\n\tmax-lag 5s\n\tmax-reconnects-per-hour 3\n}\n",
+			want: NetworkHealth{
+				MaxLag:        5 * time.Second,
+				MaxReconnects: 3,
+			},
+		},
+		{
+			name:   "disabled",
+			config: "network-health {\n\tmax-lag 0\n\tmax-reconnects-per-hour 0\n}\n",
+			want:   NetworkHealth{},
+		},
+		{
+			name:    "negative lag",
+			config:  "network-health {\n\tmax-lag -1s\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative reconnects",
+			config:  "network-health {\n\tmax-reconnects-per-hour -1\n}\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(filename, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			srv, err := Load(filename)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got network health %+v", srv.NetworkHealth)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+			if srv.NetworkHealth != tc.want {
+				t.Errorf("got network health %+v, want %+v", srv.NetworkHealth, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"git.sr.ht/~emersion/go-scfg"
+)
+
+const (
+	maxIncludeDepth  = 10
+	includeDirective = "include"
+	globMetaChars    = "*?["
+)
+
+var (
+	envVarRegexp   = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	scfgLineRegexp = regexp.MustCompile(`^line ([0-9]+)`)
+)
+
+type sourceLine struct {
+	filename string
+	lineno   int
+}
+
+// preprocessor assembles a config file and its included files into a single
+// document, expanding environment variables along the way.
+type preprocessor struct {
+	buf   strings.Builder
+	lines []sourceLine // origin of each line in buf
+}
+
+func (p *preprocessor) readFile(filename string, depth int) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := scanner.Text()
+
+		words := strings.Fields(line)
+		if len(words) > 0 && words[0] == includeDirective {
+			if err := p.include(filename, line, depth); err != nil {
+				return fmt.Errorf("%v:%v: %v", filename, lineno, err)
+			}
+			continue
+		}
+
+		if len(words) > 0 && !strings.HasPrefix(words[0], "#") {
+			line, err = expandEnv(line, true)
+			if err != nil {
+				return fmt.Errorf("%v:%v: %v", filename, lineno, err)
+			}
+		}
+
+		p.buf.WriteString(line)
+		p.buf.WriteByte('\n')
+		p.lines = append(p.lines, sourceLine{filename, lineno})
+	}
+	return scanner.Err()
+}
+
+func (p *preprocessor) include(filename, line string, depth int) error {
+	if depth >= maxIncludeDepth {
+		return fmt.Errorf("directive include: exceeded max include depth")
+	}
+
+	block, err := scfg.Read(strings.NewReader(line))
+	if err != nil {
+		return err
+	}
+	dir := block.Get(includeDirective)
+	if dir == nil || len(dir.Params) != 1 || len(dir.Children) > 0 {
+		return fmt.Errorf("directive include requires exactly 1 parameter")
+	}
+
+	pattern, err := expandEnv(dir.Params[0], false)
+	if err != nil {
+		return err
+	}
+	if !filepath.IsAbs(pattern) {
+		pattern = filepath.Join(filepath.Dir(filename), pattern)
+	}
+
+	if !strings.ContainsAny(pattern, globMetaChars) {
+		return p.readFile(pattern, depth+1)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("directive include: %v", err)
+	}
+	for _, match := range matches {
+		if err := p.readFile(match, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// wrapError replaces the line number in an scfg error with the original file
+// name and line number.
+func (p *preprocessor) wrapError(err error) error {
+	msg := err.Error()
+	m := scfgLineRegexp.FindStringSubmatch(msg)
+	if m == nil {
+		return err
+	}
+	i, convErr := strconv.Atoi(m[1])
+	if convErr != nil || i < 1 || i > len(p.lines) {
+		return err
+	}
+	src := p.lines[i-1]
+	return fmt.Errorf("%v:%v%v", src.filename, src.lineno, msg[len(m[0]):])
+}
+
+// expandEnv replaces environment variable references in s. If escape is set,
+// values are escaped so that scfg parses them as literal text: special
+// characters can't add parameters, comments or blocks.
+func expandEnv(s string, escape bool) (string, error) {
+	var sb strings.Builder
+	last := 0
+	for _, m := range envVarRegexp.FindAllStringSubmatchIndex(s, -1) {
+		name := s[m[2]:m[3]]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %q is not set", name)
+		}
+
+		sb.WriteString(s[last:m[0]])
+		last = m[1]
+
+		if !escape {
+			sb.WriteString(value)
+			continue
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return "", fmt.Errorf("environment variable %q contains a line break", name)
+		}
+		sb.WriteString(escapeWord(value))
+		// scfg opens or closes a block when a line ends with a brace, even
+		// if escaped
+		if (strings.HasSuffix(value, "{") || strings.HasSuffix(value, "}")) && strings.TrimRight(s[last:], " \t") == "" {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteString(s[last:])
+	return sb.String(), nil
+}
+
+// escapeWord escapes the characters which have a special meaning in scfg.
+func escapeWord(s string) string {
+	var sb strings.Builder
+	for _, ch := range s {
+		switch ch {
+		case ' ', '\t', '"', '\'', '\\', '#', '{', '}':
+			sb.WriteByte('\\')
+		}
+		sb.WriteRune(ch)
+	}
+	return sb.String()
+}
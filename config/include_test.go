@@ -0,0 +1,124 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		filename := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(filename, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write config file: %v", err)
+		}
+	}
+}
+
+func TestLoadInclude(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]string{
+		"config":               "include conf.d/*.conf\ninclude \"with space/title\"\n",
+		"conf.d/a.conf":        "hostname a.example.org\n",
+		"conf.d/b.conf":        "motd motd.txt\n",
+		"conf.d/ignored.txt":   "title ignored\n",
+		"with space/title":     "title included\n",
+		"cycle/a":              "include b\n",
+		"cycle/b":              "include a\n",
+		"error/config":         "hostname example.org\ninclude included\n",
+		"error/included":       "\n\nmax-user-networks invalid\n",
+		"missing/config":       "include nope\n",
+		"env path dir/config":  "title ok\n",
+		"env/config":           "include ${SOJU_TEST_DIR}/config\n",
+		"emptyglob/config":     "include nope/*.conf\ntitle ok\n",
+		"emptyglob/nope/.keep": "",
+	})
+	t.Setenv("SOJU_TEST_DIR", filepath.Join(dir, "env path dir"))
+
+	srv, err := Load(filepath.Join(dir, "config"))
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+	if srv.Hostname != "a.example.org" || srv.MOTDPath != "motd.txt" || srv.Title != "included" {
+		t.Errorf("unexpected config: hostname %q, MOTD %q, title %q", srv.Hostname, srv.MOTDPath, srv.Title)
+	}
+
+	if _, err := Load(filepath.Join(dir, "cycle/a")); err == nil || !strings.Contains(err.Error(), "max include depth") {
+		t.Errorf("include cycle: got error %v, want max include depth error", err)
+	}
+
+	want := filepath.Join(dir, "error/included") + ":3"
+	if _, err := Load(filepath.Join(dir, "error/config")); err == nil || !strings.HasPrefix(err.Error(), want) {
+		t.Errorf("error in included file: got %v, want error starting with %q", err, want)
+	}
+
+	if _, err := Load(filepath.Join(dir, "missing/config")); err == nil {
+		t.Errorf("missing included file: expected an error")
+	}
+
+	if srv, err := Load(filepath.Join(dir, "env/config")); err != nil {
+		t.Errorf("include with environment variable: %v", err)
+	} else if srv.Title != "ok" {
+		t.Errorf("include with environment variable: got title %q, want %q", srv.Title, "ok")
+	}
+
+	if srv, err := Load(filepath.Join(dir, "emptyglob/config")); err != nil {
+		t.Errorf("include matching no file: %v", err)
+	} else if srv.Title != "ok" {
+		t.Errorf("include matching no file: got title %q, want %q", srv.Title, "ok")
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", config: "title ${SOJU_TEST_VALUE}", value: "soju", want: "soju"},
+		{name: "inside word", config: "title a-${SOJU_TEST_VALUE}-b", value: "soju", want: "a-soju-b"},
+		{name: "spaces", config: "title ${SOJU_TEST_VALUE}", value: "my bouncer", want: "my bouncer"},
+		{name: "quoted", config: `title "${SOJU_TEST_VALUE}"`, value: `my "bouncer"`, want: `my "bouncer"`},
+		{name: "quotes", config: "title ${SOJU_TEST_VALUE}", value: `'a' "b"`, want: `'a' "b"`},
+		{name: "backslash", config: "title ${SOJU_TEST_VALUE}", value: `a\b\`, want: `a\b\`},
+		{name: "comment", config: "title ${SOJU_TEST_VALUE}", value: "# not a comment", want: "# not a comment"},
+		{name: "leading comment", config: "${SOJU_TEST_VALUE}\ntitle soju", value: "#title", wantErr: true},
+		{name: "opening brace", config: "title ${SOJU_TEST_VALUE}", value: "{", want: "{"},
+		{name: "closing brace", config: "title ${SOJU_TEST_VALUE}", value: "}", want: "}"},
+		{name: "block", config: "title ${SOJU_TEST_VALUE}", value: "x {", want: "x {"},
+		{name: "newline", config: "title ${SOJU_TEST_VALUE}", value: "a\nhostname evil", wantErr: true},
+		{name: "commented out", config: "# title ${SOJU_TEST_UNSET}\ntitle soju", want: "soju"},
+		{name: "unset", config: "title ${SOJU_TEST_UNSET}", wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SOJU_TEST_VALUE", tc.value)
+
+			filename := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(filename, []byte(tc.config+"\n"), 0644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			srv, err := Load(filename)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got title %q", srv.Title)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+			if srv.Title != tc.want {
+				t.Errorf("got title %q, want %q", srv.Title, tc.want)
+			}
+		})
+	}
+}
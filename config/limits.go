@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Limits contains flood protection and rate limiting settings.
+type Limits struct {
+	// Outgoing messages sent to upstream servers are paced with a token
+	// bucket: up to UpstreamBurst messages can be sent at once, then one
+	// message every UpstreamMessageDelay. A zero delay disables pacing.
+	UpstreamBurst        int
+	UpstreamMessageDelay time.Duration
+
+	// Maximum number of bytes queued for a client connection, zero means no
+	// limit
+	DownstreamSendQueue int
+
+	// Maximum number of login attempts per IP address per minute, zero means
+	// no limit
+	LoginsPerMinute int
+
+	// Maximum number of BouncerServ commands per user per minute, zero means
+	// no limit
+	ServiceCommandsPerMinute int
+
+	// Maximum number of simultaneous upstream connection attempts across all
+	// users, zero means no limit
+	UpstreamConnectAttempts int
+}
+
+func DefaultLimits() Limits {
+	return Limits{
+		UpstreamBurst:           10,
+		UpstreamMessageDelay:    2 * time.Second,
+		UpstreamConnectAttempts: 20,
+	}
+}
+
+type rawLimits struct {
+	UpstreamBurst            *int   `scfg:"upstream-burst"`
+	UpstreamMessageDelay     string `scfg:"upstream-message-delay"`
+	DownstreamSendQueue      *int   `scfg:"downstream-send-queue"`
+	LoginsPerMinute          *int   `scfg:"max-logins-per-minute"`
+	ServiceCommandsPerMinute *int   `scfg:"max-service-commands-per-minute"`
+	UpstreamConnectAttempts  *int   `scfg:"max-upstream-connect-attempts"`
+}
+
+func parseLimits(raw *rawLimits) (Limits, error) {
+	limits := DefaultLimits()
+	if raw == nil {
+		return limits, nil
+	}
+
+	if raw.UpstreamBurst != nil {
+		if *raw.UpstreamBurst < 1 {
+			return limits, fmt.Errorf("directive upstream-burst: value must be at least 1")
+		}
+		limits.UpstreamBurst = *raw.UpstreamBurst
+	}
+	if raw.UpstreamMessageDelay != "" {
+		dur, err := time.ParseDuration(raw.UpstreamMessageDelay)
+		if err != nil {
+			return limits, fmt.Errorf("directive upstream-message-delay: %v", err)
+		} else if dur < 0 {
+			return limits, fmt.Errorf("directive upstream-message-delay: duration must be positive")
+		}
+		limits.UpstreamMessageDelay = dur
+	}
+
+	counts := []struct {
+		name  string
+		value *int
+		dst   *int
+	}{
+		{"downstream-send-queue", raw.DownstreamSendQueue, &limits.DownstreamSendQueue},
+		{"max-logins-per-minute", raw.LoginsPerMinute, &limits.LoginsPerMinute},
+		{"max-service-commands-per-minute", raw.ServiceCommandsPerMinute, &limits.ServiceCommandsPerMinute},
+		{"max-upstream-connect-attempts", raw.UpstreamConnectAttempts, &limits.UpstreamConnectAttempts},
+	}
+	for _, count := range counts {
+		if count.value == nil {
+			continue
+		}
+		if *count.value < 0 {
+			return limits, fmt.Errorf("directive %v: value must be positive", count.name)
+		}
+		*count.dst = *count.value
+	}
+
+	return limits, nil
+}
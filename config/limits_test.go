@@ -0,0 +1,127 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadLimits(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  string
+		want    Limits
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			config: "",
+			want:   DefaultLimits(),
+		},
+		{
+			name:   "empty block",
+			config: "limits {\n}\n",
+			want:   DefaultLimits(),
+		},
+		{
+			name: "all knobs",
+			config: `limits {
+	upstream-burst 5
+	upstream-message-delay 500ms
+	downstream-send-queue 1048576
+	max-logins-per-minute 10
+	max-service-commands-per-minute 30
+	max-upstream-connect-attempts 50
+}
+`,
+			want: Limits{
+				UpstreamBurst:            5,
+				UpstreamMessageDelay:     500 * time.Millisecond,
+				DownstreamSendQueue:      1048576,
+				LoginsPerMinute:          10,
+				ServiceCommandsPerMinute: 30,
+				UpstreamConnectAttempts:  50,
+			},
+		},
+		{
+			name:   "partial",
+			config: "limits {\n\tmax-logins-per-minute 3\n}\n",
+			want: Limits{
+				UpstreamBurst:           10,
+				UpstreamMessageDelay:    2 * time.Second,
+				LoginsPerMinute:         3,
+				UpstreamConnectAttempts: 20,
+			},
+		},
+		{
+			name:   "disabled upstream pacing",
+			config: "limits {\n\tupstream-message-delay 0\n}\n",
+			want: Limits{
+				UpstreamBurst:           10,
+				UpstreamConnectAttempts: 20,
+			},
+		},
+		{
+			name:    "zero burst",
+			config:  "limits {\n\tupstream-burst 0\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative delay",
+			config:  "limits {\n\tupstream-message-delay -1s\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid delay",
+			config:  "limits {\n\tupstream-message-delay 2\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative send queue",
+			config:  "limits {\n\tdownstream-send-queue -1\n}\n",
+			wantErr: true,
+		},
+		{
+			name:    "negative logins",
+			config:  "limits {\n\tmax-logins-per-minute -5\n}\n",
+			wantErr: true,
+		},
+		{
+			name:   "unlimited connect attempts",
+			config: "limits {\n\tmax-upstream-connect-attempts 0\n}\n",
+			want: Limits{
+				UpstreamBurst:        10,
+				UpstreamMessageDelay: 2 * time.Second,
+			},
+		},
+		{
+			name:    "non-integer commands",
+			config:  "limits {\n\tmax-service-commands-per-minute many\n}\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(filename, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			srv, err := Load(filename)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got limits %+v", srv.Limits)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+			if srv.Limits != tc.want {
+				t.Errorf("got limits %+v, want %+v", srv.Limits, tc.want)
+			}
+		})
+	}
+}
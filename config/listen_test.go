@@ -0,0 +1,57 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadListenAcceptProxy(t *testing.T) {
+	testCases := []struct {
+		name    string
+		config  string
+		want    ProxyPolicy
+		wantIPs int
+		wantErr bool
+	}{
+		{"default", "listen unix:///tmp/soju\n", ProxyOptional, -1, false},
+		{"off", "listen unix:///tmp/soju {\n\taccept-proxy off\n}\n", ProxyOff, -1, false},
+		{"false", "listen unix:///tmp/soju {\n\taccept-proxy false\n}\n", ProxyOff, -1, false},
+		{"true", "listen unix:///tmp/soju {\n\taccept-proxy true\n}\n", ProxyOptional, -1, false},
+		{"required", "listen unix:///tmp/soju {\n\taccept-proxy required\n}\n", ProxyRequired, -1, false},
+		{"ips", "listen :6697 {\n\taccept-proxy-ip 10.0.0.0/8 localhost\n}\n", ProxyOptional, 3, false},
+		{"invalid policy", "listen :6697 {\n\taccept-proxy maybe\n}\n", 0, 0, true},
+		{"hostname", "listen :6697 {\n\taccept-proxy-ip proxy.example.org\n}\n", 0, 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(filename, []byte(tc.config), 0644); err != nil {
+				t.Fatalf("failed to write config file: %v", err)
+			}
+
+			srv, err := Load(filename)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got listeners %+v", srv.Listen)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to load config: %v", err)
+			}
+			l := srv.Listen[0]
+			if l.AcceptProxy != tc.want {
+				t.Errorf("got policy %v, want %v", l.AcceptProxy, tc.want)
+			}
+			if tc.wantIPs < 0 {
+				if l.AcceptProxyIPs != nil {
+					t.Errorf("got proxy IPs %v, want none", l.AcceptProxyIPs)
+				}
+			} else if len(l.AcceptProxyIPs) != tc.wantIPs {
+				t.Errorf("got %v proxy IPs, want %v", len(l.AcceptProxyIPs), tc.wantIPs)
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SocketOptions contains TCP socket settings. Unset fields leave the Go and
+// operating system defaults unchanged.
+type SocketOptions struct {
+	NoDelay       *bool         // TCP_NODELAY, Go enables it by default
+	SendBuffer    int           // SO_SNDBUF in bytes, zero means unset
+	ReceiveBuffer int           // SO_RCVBUF in bytes, zero means unset
+	UserTimeout   time.Duration // TCP_USER_TIMEOUT, zero means unset
+}
+
+// IsZero checks whether no option is set.
+func (opts SocketOptions) IsZero() bool {
+	return opts == SocketOptions{}
+}
+
+// Merge returns a copy of opts where the fields set in override take
+// precedence.
+func (opts SocketOptions) Merge(override SocketOptions) SocketOptions {
+	if override.NoDelay != nil {
+		opts.NoDelay = override.NoDelay
+	}
+	if override.SendBuffer != 0 {
+		opts.SendBuffer = override.SendBuffer
+	}
+	if override.ReceiveBuffer != 0 {
+		opts.ReceiveBuffer = override.ReceiveBuffer
+	}
+	if override.UserTimeout != 0 {
+		opts.UserTimeout = override.UserTimeout
+	}
+	return opts
+}
+
+// String formats the options in the form accepted by ParseSocketOptions.
+func (opts SocketOptions) String() string {
+	var l []string
+	if opts.NoDelay != nil {
+		l = append(l, "nodelay="+strconv.FormatBool(*opts.NoDelay))
+	}
+	if opts.SendBuffer != 0 {
+		l = append(l, "send-buffer="+strconv.Itoa(opts.SendBuffer))
+	}
+	if opts.ReceiveBuffer != 0 {
+		l = append(l, "receive-buffer="+strconv.Itoa(opts.ReceiveBuffer))
+	}
+	if opts.UserTimeout != 0 {
+		l = append(l, "user-timeout="+opts.UserTimeout.String())
+	}
+	return strings.Join(l, ",")
+}
+
+// ParseSocketOptions parses a comma-separated list of socket options, e.g.
+// "nodelay=false,send-buffer=65536". An empty string leaves all options
+// unset.
+func ParseSocketOptions(s string) (SocketOptions, error) {
+	var raw rawSocketOptions
+	if s == "" {
+		return SocketOptions{}, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return SocketOptions{}, fmt.Errorf("invalid socket option %q: missing value", kv)
+		}
+		switch k {
+		case "nodelay":
+			raw.NoDelay = v
+		case "send-buffer", "receive-buffer":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return SocketOptions{}, fmt.Errorf("socket option %v: %v", k, err)
+			}
+			if k == "send-buffer" {
+				raw.SendBuffer = &n
+			} else {
+				raw.ReceiveBuffer = &n
+			}
+		case "user-timeout":
+			raw.UserTimeout = v
+		default:
+			return SocketOptions{}, fmt.Errorf("unknown socket option %q", k)
+		}
+	}
+	return parseSocketOptions(&raw)
+}
+
+type rawSocketOptions struct {
+	NoDelay       string `scfg:"nodelay"`
+	SendBuffer    *int   `scfg:"send-buffer"`
+	ReceiveBuffer *int   `scfg:"receive-buffer"`
+	UserTimeout   string `scfg:"user-timeout"`
+}
+
+func parseSocketOptions(raw *rawSocketOptions) (SocketOptions, error) {
+	var opts SocketOptions
+	if raw == nil {
+		return opts, nil
+	}
+
+	if raw.NoDelay != "" {
+		b, err := strconv.ParseBool(raw.NoDelay)
+		if err != nil {
+			return opts, fmt.Errorf("directive nodelay: %v", err)
+		}
+		opts.NoDelay = &b
+	}
+
+	sizes := []struct {
+		name  string
+		value *int
+		dst   *int
+	}{
+		{"send-buffer", raw.SendBuffer, &opts.SendBuffer},
+		{"receive-buffer", raw.ReceiveBuffer, &opts.ReceiveBuffer},
+	}
+	for _, size := range sizes {
+		if size.value == nil {
+			continue
+		}
+		if *size.value < 1 {
+			return opts, fmt.Errorf("directive %v: size must be positive", size.name)
+		}
+		*size.dst = *size.value
+	}
+
+	if raw.UserTimeout != "" {
+		dur, err := time.ParseDuration(raw.UserTimeout)
+		if err != nil {
+			return opts, fmt.Errorf("directive user-timeout: %v", err)
+		} else if dur < time.Millisecond {
+			return opts, fmt.Errorf("directive user-timeout: duration must be at least 1ms")
+		}
+		opts.UserTimeout = dur
+	}
+
+	return opts, nil
+}
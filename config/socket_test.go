@@ -0,0 +1,77 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	noDelay := false
+	testCases := []struct {
+		name    string
+		s       string
+		want    SocketOptions
+		wantErr bool
+	}{
+		{"empty", "", SocketOptions{}, false},
+		{"nodelay", "nodelay=false", SocketOptions{NoDelay: &noDelay}, false},
+		{"buffers", "send-buffer=65536,receive-buffer=131072", SocketOptions{SendBuffer: 65536, ReceiveBuffer: 131072}, false},
+		{"user timeout", "user-timeout=30s", SocketOptions{UserTimeout: 30 * time.Second}, false},
+		{"unknown", "keepalive=1", SocketOptions{}, true},
+		{"missing value", "nodelay", SocketOptions{}, true},
+		{"invalid bool", "nodelay=maybe", SocketOptions{}, true},
+		{"zero buffer", "send-buffer=0", SocketOptions{}, true},
+		{"negative timeout", "user-timeout=-1s", SocketOptions{}, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts, err := ParseSocketOptions(tc.s)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", opts)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to parse socket options: %v", err)
+			}
+			if opts.String() != tc.want.String() {
+				t.Errorf("got %q, want %q", opts.String(), tc.want.String())
+			}
+			if opts.String() != tc.s {
+				t.Errorf("options don't round-trip: got %q, want %q", opts.String(), tc.s)
+			}
+		})
+	}
+}
+
+func TestLoadSocketOptions(t *testing.T) {
+	config := `socket-options {
+	nodelay false
+	user-timeout 1m
+}
+listen :6697 {
+	socket-options {
+		nodelay true
+		send-buffer 65536
+	}
+}
+`
+	filename := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(filename, []byte(config), 0644); err != nil {
+		t.Fatalf("failed to write config file: %v", err)
+	}
+
+	srv, err := Load(filename)
+	if err != nil {
+		t.Fatalf("failed to load config: %v", err)
+	}
+
+	opts := srv.SocketOptions.Merge(srv.Listen[0].SocketOptions)
+	if want := "nodelay=true,send-buffer=65536,user-timeout=1m0s"; opts.String() != want {
+		t.Errorf("got merged options %q, want %q", opts.String(), want)
+	}
+}
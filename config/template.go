@@ -0,0 +1,50 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// NetworkTemplate is a template for a default network field, such as the
+// nickname. The following placeholders are supported:
+//
+//   - %u: the bouncer username
+//   - %n: the network name
+//   - %%: a literal percent sign
+type NetworkTemplate string
+
+// Validate checks that the template only contains known placeholders.
+func (tmpl NetworkTemplate) Validate() error {
+	_, err := tmpl.Expand("", "")
+	return err
+}
+
+// Expand replaces the placeholders in the template. Substituted values are not
+// expanded again, so they may contain placeholder characters.
+func (tmpl NetworkTemplate) Expand(username, network string) (string, error) {
+	var sb strings.Builder
+	s := string(tmpl)
+	for {
+		i := strings.IndexByte(s, '%')
+		if i < 0 {
+			sb.WriteString(s)
+			break
+		}
+		sb.WriteString(s[:i])
+		if i+1 >= len(s) {
+			return "", fmt.Errorf("template %q: trailing %%", tmpl)
+		}
+		switch c := s[i+1]; c {
+		case 'u':
+			sb.WriteString(username)
+		case 'n':
+			sb.WriteString(network)
+		case '%':
+			sb.WriteByte('%')
+		default:
+			return "", fmt.Errorf("template %q: unknown placeholder %%%c", tmpl, c)
+		}
+		s = s[i+2:]
+	}
+	return sb.String(), nil
+}
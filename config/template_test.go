@@ -0,0 +1,54 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestNetworkTemplateExpand(t *testing.T) {
+	testCases := []struct {
+		tmpl     NetworkTemplate
+		username string
+		network  string
+		want     string
+	}{
+		{"", "alice", "libera", ""},
+		{"plain", "alice", "libera", "plain"},
+		{"%u", "alice", "libera", "alice"},
+		{"%u-%n", "alice", "libera", "alice-libera"},
+		{"%u [%n]", "alice", "irc.libera.chat", "alice [irc.libera.chat]"},
+		{"100%%", "alice", "libera", "100%"},
+		{"%%u", "alice", "libera", "%u"},
+		// Substituted values must not be expanded again
+		{"%u", "%n", "libera", "%n"},
+		{"%u", "a%%b", "libera", "a%%b"},
+		{"%u|%n", "%u%n", "%u", "%u%n|%u"},
+		{"%n", "alice", "%", "%"},
+		{"%u", "", "libera", ""},
+	}
+	for _, tc := range testCases {
+		got, err := tc.tmpl.Expand(tc.username, tc.network)
+		if err != nil {
+			t.Errorf("%q.Expand(%q, %q): unexpected error: %v", tc.tmpl, tc.username, tc.network, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%q.Expand(%q, %q) = %q, want %q", tc.tmpl, tc.username, tc.network, got, tc.want)
+		}
+	}
+}
+
+func TestNetworkTemplateValidate(t *testing.T) {
+	valid := []NetworkTemplate{"", "%u", "%n", "%%", "%u_%n%%"}
+	for _, tmpl := range valid {
+		if err := tmpl.Validate(); err != nil {
+			t.Errorf("%q.Validate(): unexpected error: %v", tmpl, err)
+		}
+	}
+
+	invalid := []NetworkTemplate{"%", "%x", "%u%", "%U", "100% sure"}
+	for _, tmpl := range invalid {
+		if err := tmpl.Validate(); err == nil {
+			t.Errorf("%q.Validate(): expected an error", tmpl)
+		}
+	}
+}
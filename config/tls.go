@@ -0,0 +1,66 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion parses a TLS version such as "1.2".
+func ParseTLSVersion(s string) (uint16, error) {
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+	return v, nil
+}
+
+// FormatTLSVersion formats a TLS version, as accepted by ParseTLSVersion.
+func FormatTLSVersion(v uint16) string {
+	if v == 0 {
+		return "default"
+	}
+	for name, version := range tlsVersions {
+		if version == v {
+			return name
+		}
+	}
+	return fmt.Sprintf("0x%04X", v)
+}
+
+// ParseCipherSuites parses a list of cipher suite names, as defined in the
+// crypto/tls package (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256").
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	suites := make(map[string]uint16)
+	for _, cs := range tls.CipherSuites() {
+		suites[cs.Name] = cs.ID
+	}
+	for _, cs := range tls.InsecureCipherSuites() {
+		suites[cs.Name] = cs.ID
+	}
+
+	ids := make([]uint16, len(names))
+	for i, name := range names {
+		id, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids[i] = id
+	}
+	return ids, nil
+}
+
+// CipherSuiteNames returns the names of a list of cipher suites.
+func CipherSuiteNames(ids []uint16) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = tls.CipherSuiteName(id)
+	}
+	return names
+}
@@ -1,6 +1,8 @@
 package soju
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -8,14 +10,22 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode"
 
 	"golang.org/x/time/rate"
 	"gopkg.in/irc.v4"
 	"nhooyr.io/websocket"
+
+	"git.sr.ht/~emersion/soju/xirc"
 )
 
+// errLineTooLong is returned by ircConn.ReadMessage when an incoming line
+// exceeds the maximum line length. The line is discarded and the connection
+// remains usable.
+var errLineTooLong = errors.New("line too long")
+
 // ircConn is a generic IRC connection. It's similar to net.Conn but focuses on
 // reading and writing IRC messages.
 type ircConn interface {
@@ -26,24 +36,106 @@ type ircConn interface {
 	SetWriteDeadline(time.Time) error
 	RemoteAddr() net.Addr
 	LocalAddr() net.Addr
+	// SetMaxLineLength sets the maximum length of incoming messages,
+	// excluding their tags. It's safe to call from any goroutine.
+	SetMaxLineLength(n int)
+}
+
+type netIRCConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	writer     *irc.Writer
+	maxLineLen atomic.Int64
 }
 
 func newNetIRCConn(c net.Conn) ircConn {
-	type netConn net.Conn
-	return struct {
-		*irc.Conn
-		netConn
-	}{irc.NewConn(c), c}
+	nc := &netIRCConn{
+		Conn:   c,
+		reader: bufio.NewReader(c),
+		writer: irc.NewWriter(c),
+	}
+	nc.SetMaxLineLength(xirc.DefaultLineLength)
+	return nc
+}
+
+func (nc *netIRCConn) SetMaxLineLength(n int) {
+	nc.maxLineLen.Store(int64(n))
+}
+
+func (nc *netIRCConn) ReadMessage() (*irc.Message, error) {
+	for {
+		line, err := nc.readLine(int(nc.maxLineLen.Load()))
+		if err != nil {
+			return nil, err
+		}
+
+		msg, err := irc.ParseMessage(line)
+		if errors.Is(err, irc.ErrZeroLengthMessage) {
+			// Empty lines are valid and should be ignored
+			continue
+		}
+		return msg, err
+	}
+}
+
+// readLine reads a line including its line ending. The tags may use up to
+// xirc.MaxTagsLength bytes and the rest of the line up to maxLineLen bytes.
+// Longer lines are discarded without being buffered in full, and
+// errLineTooLong is returned.
+func (nc *netIRCConn) readLine(maxLineLen int) (string, error) {
+	var buf []byte
+	tooLong := false
+	for {
+		b, err := nc.reader.ReadSlice('\n')
+		if !tooLong {
+			if len(buf)+len(b) > xirc.MaxTagsLength+maxLineLen {
+				tooLong = true
+				buf = nil
+			} else {
+				buf = append(buf, b...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		break
+	}
+	if tooLong {
+		return "", errLineTooLong
+	}
+
+	line := buf
+	if len(line) > 0 && line[0] == '@' {
+		i := bytes.IndexByte(line, ' ')
+		if i < 0 {
+			i = len(line) - 1
+		}
+		if i+1 > xirc.MaxTagsLength {
+			return "", errLineTooLong
+		}
+		line = line[i+1:]
+	}
+	if len(line) > maxLineLen {
+		return "", errLineTooLong
+	}
+	return string(buf), nil
+}
+
+func (nc *netIRCConn) WriteMessage(msg *irc.Message) error {
+	return nc.writer.WriteMessage(msg)
 }
 
 type websocketIRCConn struct {
 	conn                        *websocket.Conn
 	readDeadline, writeDeadline time.Time
+	readTimeout                 time.Duration // zero means no timeout
 	remoteAddr                  string
 }
 
-func newWebsocketIRCConn(c *websocket.Conn, remoteAddr string) ircConn {
-	return &websocketIRCConn{conn: c, remoteAddr: remoteAddr}
+func newWebsocketIRCConn(c *websocket.Conn, remoteAddr string, readTimeout time.Duration) ircConn {
+	return &websocketIRCConn{conn: c, remoteAddr: remoteAddr, readTimeout: readTimeout}
 }
 
 func (wic *websocketIRCConn) ReadMessage() (*irc.Message, error) {
@@ -52,6 +144,10 @@ func (wic *websocketIRCConn) ReadMessage() (*irc.Message, error) {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithDeadline(ctx, wic.readDeadline)
 		defer cancel()
+	} else if wic.readTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, wic.readTimeout)
+		defer cancel()
 	}
 	_, b, err := wic.conn.Read(ctx)
 	if err != nil {
@@ -76,6 +172,11 @@ func (wic *websocketIRCConn) WriteMessage(msg *irc.Message) error {
 	return wic.conn.Write(ctx, websocket.MessageText, b)
 }
 
+func (wic *websocketIRCConn) SetMaxLineLength(n int) {
+	// WebSocket messages are already bounded by the read limit of the
+	// WebSocket connection, which is larger than any line length we accept
+}
+
 func (wic *websocketIRCConn) Close() error {
 	return wic.conn.Close(websocket.StatusNormalClosure, "")
 }
@@ -111,9 +212,14 @@ func (wa websocketAddr) String() string {
 }
 
 type connOptions struct {
-	Logger         Logger
-	RateLimitDelay time.Duration
-	RateLimitBurst int
+	Logger Logger
+	// If non-nil, returns the delay between outgoing messages and the burst
+	// size. It is called before each message is sent, so that changes are
+	// applied to existing connections.
+	RateLimit func() (delay time.Duration, burst int)
+	// Maximum number of bytes in the outgoing queue, zero means no limit. The
+	// connection is closed when exceeded.
+	SendQueueLimit int
 }
 
 type conn struct {
@@ -125,6 +231,9 @@ type conn struct {
 	outgoing chan<- *irc.Message
 	closed   bool
 	closedCh chan struct{}
+
+	sendQueueLimit int64
+	sendQueueLen   int64 // atomic
 }
 
 func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
@@ -135,18 +244,35 @@ func newConn(srv *Server, ic ircConn, options *connOptions) *conn {
 		outgoing: outgoing,
 		logger:   options.Logger,
 		closedCh: make(chan struct{}),
+
+		sendQueueLimit: int64(options.SendQueueLimit),
 	}
 
 	go func() {
 		ctx, cancel := c.NewContext(context.Background())
 		defer cancel()
 
-		rl := rate.NewLimiter(rate.Every(options.RateLimitDelay), options.RateLimitBurst)
+		rl := rate.NewLimiter(rate.Inf, 0)
+		if options.RateLimit != nil {
+			delay, burst := options.RateLimit()
+			rl = rate.NewLimiter(rate.Every(delay), burst)
+		}
 		for msg := range outgoing {
 			if msg == nil {
 				break
 			}
 
+			if c.sendQueueLimit > 0 {
+				atomic.AddInt64(&c.sendQueueLen, -int64(len(msg.String())))
+			}
+
+			if options.RateLimit != nil {
+				delay, burst := options.RateLimit()
+				if limit := rate.Every(delay); rl.Limit() != limit || rl.Burst() != burst {
+					rl.SetLimit(limit)
+					rl.SetBurst(burst)
+				}
+			}
 			if err := rl.Wait(ctx); err != nil {
 				break
 			}
@@ -183,7 +309,10 @@ func (c *conn) isClosed() bool {
 func (c *conn) Close() error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	return c.closeLocked()
+}
 
+func (c *conn) closeLocked() error {
 	if c.closed {
 		return fmt.Errorf("connection already closed")
 	}
@@ -220,11 +349,25 @@ func (c *conn) SendMessage(ctx context.Context, msg *irc.Message) {
 		return
 	}
 
+	if c.sendQueueLimit > 0 {
+		n := atomic.AddInt64(&c.sendQueueLen, int64(len(msg.String())))
+		if n > c.sendQueueLimit {
+			c.logger.Printf("send queue exceeded (%v bytes), closing connection", n)
+			if err := c.closeLocked(); err != nil && !errors.Is(err, net.ErrClosed) {
+				c.logger.Printf("failed to close connection: %v", err)
+			}
+			return
+		}
+	}
+
 	select {
 	case c.outgoing <- msg:
 		// Success
 	case <-ctx.Done():
 		c.logger.Printf("failed to send message: %v", ctx.Err())
+		if c.sendQueueLimit > 0 {
+			atomic.AddInt64(&c.sendQueueLen, -int64(len(msg.String())))
+		}
 	}
 }
 
@@ -249,6 +392,12 @@ func (c *conn) Shutdown(ctx context.Context) {
 	}
 }
 
+// SetMaxLineLength sets the maximum length of incoming messages, excluding
+// their tags. It is safe to call from any goroutine.
+func (c *conn) SetMaxLineLength(n int) {
+	c.conn.SetMaxLineLength(n)
+}
+
 func (c *conn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
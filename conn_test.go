@@ -0,0 +1,72 @@
+package soju
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+
+	"git.sr.ht/~emersion/soju/xirc"
+)
+
+func TestNetIRCConnReadMessage(t *testing.T) {
+	// Builds a PRIVMSG line of exactly n bytes, excluding tags
+	line := func(n int, ending string) string {
+		s := "PRIVMSG #soju :"
+		return s + strings.Repeat("a", n-len(s)-len(ending)) + ending
+	}
+	tags := "@+k=" + strings.Repeat("t", xirc.MaxTagsLength-len("@+k= ")) + " "
+
+	testCases := []struct {
+		name    string
+		lineLen int
+		line    string
+		tooLong bool
+	}{
+		{"atLimit", 512, line(512, "\r\n"), false},
+		{"overLimit", 512, line(513, "\r\n"), true},
+		{"atLimitLF", 512, line(512, "\n"), false},
+		{"overLimitLF", 512, line(513, "\n"), true},
+		{"extendedAtLimit", 2048, line(2048, "\r\n"), false},
+		{"extendedOverLimit", 2048, line(2049, "\r\n"), true},
+		{"tagsAtLimit", 512, tags + line(512, "\r\n"), false},
+		{"tagsOverLimit", 512, "@a" + tags[1:] + line(100, "\r\n"), true},
+		{"hugeLine", 512, line(1<<20, "\r\n"), true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			c1, c2 := net.Pipe()
+			defer c1.Close()
+			defer c2.Close()
+
+			ic := newNetIRCConn(c2)
+			ic.SetMaxLineLength(tc.lineLen)
+			go func() {
+				// The trailing message checks that the connection remains
+				// usable after a line is discarded
+				c1.Write([]byte(tc.line + "PING next\r\n"))
+			}()
+
+			msg, err := ic.ReadMessage()
+			if tc.tooLong {
+				if !errors.Is(err, errLineTooLong) {
+					t.Fatalf("ReadMessage() = %v, %v, want errLineTooLong", msg, err)
+				}
+			} else {
+				if err != nil {
+					t.Fatalf("ReadMessage() failed: %v", err)
+				}
+				if msg.Command != "PRIVMSG" || len(msg.Params[1]) != strings.Count(tc.line, "a") {
+					t.Fatalf("ReadMessage() returned a truncated message")
+				}
+			}
+
+			msg, err = ic.ReadMessage()
+			if err != nil {
+				t.Fatalf("ReadMessage() failed: %v", err)
+			} else if msg.Command != "PING" {
+				t.Fatalf("ReadMessage() = %v, want PING", msg)
+			}
+		})
+	}
+}
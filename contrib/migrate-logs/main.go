@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"flag"
 	"fmt"
@@ -41,7 +40,24 @@ func init() {
 func migrateNetwork(ctx context.Context, db database.Database, user *database.User, network *database.Network) error {
 	log.Printf("Migrating logs for network: %s\n", network.Name)
 
-	rootPath := filepath.Join(logRoot, msgstore.EscapeFilename(user.Username), msgstore.EscapeFilename(network.GetName()))
+	userPath := filepath.Join(logRoot, msgstore.EscapeFilename(user.Username))
+
+	rootPath := filepath.Join(userPath, msgstore.EscapePathComponent(network.GetName()))
+	if err := migrateNetworkDir(ctx, db, user, network, rootPath, msgstore.UnescapePathComponent); err != nil {
+		return err
+	}
+	// Logs written by older versions of soju use the lossy legacy escaping,
+	// migrate these as well
+	legacyRootPath := filepath.Join(userPath, msgstore.EscapeFilename(network.GetName()))
+	if legacyRootPath == rootPath {
+		return nil
+	}
+	return migrateNetworkDir(ctx, db, user, network, legacyRootPath, nil)
+}
+
+// migrateNetworkDir migrates the logs stored in a network directory. If
+// unescape is nil, target directory names are used as-is.
+func migrateNetworkDir(ctx context.Context, db database.Database, user *database.User, network *database.Network, rootPath string, unescape func(string) (string, error)) error {
 	root, err := os.Open(rootPath)
 	if os.IsNotExist(err) {
 		return nil
@@ -50,19 +66,25 @@ func migrateNetwork(ctx context.Context, db database.Database, user *database.Us
 		return fmt.Errorf("unable to open network folder: %s", rootPath)
 	}
 
-	// The returned targets are escaped, and there is no way to un-escape
 	// TODO: switch to ReadDir (Go 1.16+)
-	targets, err := root.Readdirnames(0)
+	entries, err := root.Readdirnames(0)
 	root.Close()
 	if err != nil {
 		return fmt.Errorf("unable to read network folder: %s", rootPath)
 	}
 
-	for _, target := range targets {
+	for _, entry := range entries {
+		target := entry
+		if unescape != nil {
+			target, err = unescape(entry)
+			if err != nil {
+				return fmt.Errorf("invalid target folder name: %s: %v", entry, err)
+			}
+		}
+
 		log.Printf("Migrating logs for target: %s\n", target)
 
-		// target is already escaped here
-		targetPath := filepath.Join(rootPath, target)
+		targetPath := filepath.Join(rootPath, entry)
 		targetDir, err := os.Open(targetPath)
 		if err != nil {
 			return fmt.Errorf("unable to open target folder: %s", targetPath)
@@ -89,7 +111,7 @@ func migrateNetwork(ctx context.Context, db database.Database, user *database.Us
 			if err != nil {
 				return fmt.Errorf("unable to open entry: %s", entryPath)
 			}
-			sc := bufio.NewScanner(entry)
+			sc := znclog.NewScanner(entry)
 			var msgs []*irc.Message
 			for sc.Scan() {
 				msg, _, err := znclog.UnmarshalLine(sc.Text(), user, network, target, ref, true)
@@ -111,7 +111,9 @@ func main() {
 			log.Printf("user %q: creating new user", username)
 		}
 
-		u.Admin = section.Values.Get("Admin") == "true"
+		if section.Values.Get("Admin") == "true" {
+			u.Role = database.RoleAdmin
+		}
 
 		if err := db.StoreUser(ctx, u); err != nil {
 			log.Fatalf("failed to store user %q: %v", username, err)
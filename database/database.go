@@ -19,16 +19,32 @@ type MessageTarget struct {
 }
 
 type MessageOptions struct {
-	AfterID    int64
-	AfterTime  time.Time
-	BeforeTime time.Time
-	Limit      int
-	Events     bool
-	Sender     string
-	Text       string
-	TakeLast   bool
+	AfterID       int64
+	AfterTime     time.Time
+	BeforeTime    time.Time
+	Limit         int
+	Events        bool
+	Sender        string
+	ExcludeSender string
+	Text          string
+	TakeLast      bool
+	// If set, only messages whose text contains one of these strings are
+	// returned. Matching may be case-insensitive.
+	TextContains []string
 }
 
+type MessageCountOptions struct {
+	AfterID       int64
+	ExcludeSender string
+}
+
+type MessageTargetCount struct {
+	Name     string
+	Messages int
+}
+
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 type Database interface {
 	Close() error
 	Stats(ctx context.Context) (*DatabaseStats, error)
@@ -49,6 +65,10 @@ type Database interface {
 	ListDeliveryReceipts(ctx context.Context, networkID int64) ([]DeliveryReceipt, error)
 	StoreClientDeliveryReceipts(ctx context.Context, networkID int64, client string, receipts []DeliveryReceipt) error
 
+	GetClient(ctx context.Context, userID int64, name string) (*Client, error)
+	ListClients(ctx context.Context, userID int64) ([]Client, error)
+	StoreClient(ctx context.Context, userID int64, client *Client) error
+
 	GetReadReceipt(ctx context.Context, networkID int64, name string) (*ReadReceipt, error)
 	StoreReadReceipt(ctx context.Context, networkID int64, receipt *ReadReceipt) error
 
@@ -59,10 +79,28 @@ type Database interface {
 	StoreWebPushSubscription(ctx context.Context, userID, networkID int64, sub *WebPushSubscription) error
 	DeleteWebPushSubscription(ctx context.Context, id int64) error
 
+	ListHighlights(ctx context.Context, userID int64) ([]Highlight, error)
+	StoreHighlight(ctx context.Context, networkID int64, highlight *Highlight) error
+	DeleteHighlight(ctx context.Context, id int64) error
+
+	ListOfflineEvents(ctx context.Context, networkID int64) ([]OfflineEvent, error)
+	StoreOfflineEvent(ctx context.Context, networkID int64, event *OfflineEvent) error
+	DeleteOfflineEvent(ctx context.Context, id int64) error
+
+	ListTrafficStats(ctx context.Context, networkID int64) ([]TrafficStats, error)
+	AddTrafficStats(ctx context.Context, networkID int64, stats *TrafficStats) error
+
+	ListAnnouncements(ctx context.Context) ([]Announcement, error)
+	StoreAnnouncement(ctx context.Context, announcement *Announcement) error
+	DeleteAnnouncement(ctx context.Context, id int64) error
+
 	GetMessageLastID(ctx context.Context, networkID int64, name string) (int64, error)
 	StoreMessages(ctx context.Context, networkID int64, name string, msgs []*irc.Message) ([]int64, error)
 	ListMessageLastPerTarget(ctx context.Context, networkID int64, options *MessageOptions) ([]MessageTarget, error)
 	ListMessages(ctx context.Context, networkID int64, name string, options *MessageOptions) ([]*irc.Message, error)
+	CountMessagesPerTarget(ctx context.Context, networkID int64, options *MessageCountOptions) ([]MessageTargetCount, error)
+	RedactMessage(ctx context.Context, networkID int64, name, msgID string) error
+	RenameMessageTarget(ctx context.Context, networkID int64, oldName, newName string) error
 }
 
 type MetricsCollectorDatabase interface {
@@ -93,11 +131,53 @@ type User struct {
 	Password               string // hashed
 	Nick                   string
 	Realname               string
-	Admin                  bool
+	Role                   Role
 	Enabled                bool
 	DownstreamInteractedAt time.Time
+
+	// Defaults for channels with FilterDefault or a zero DetachAfter
+	RelayDetached MessageFilter
+	ReattachOn    MessageFilter
+	DetachAfter   time.Duration
+	DetachOn      MessageFilter
+
+	// Detach channels without downstream interaction for this long, if
+	// non-zero
+	AutoDetachIdle time.Duration
+
+	// Language of BouncerServ messages, empty for the default (English)
+	Language string
+
+	// How DCC offers exchanged with other IRC users are handled
+	DCC DCCPolicy
 }
 
+// DCCPolicy describes how DCC offers sent by or to a user are handled.
+type DCCPolicy string
+
+const (
+	// Pass DCC offers through untouched (the default)
+	DCCPass DCCPolicy = ""
+	// Drop DCC offers
+	DCCBlock DCCPolicy = "block"
+	// Relay DCC connections through the bouncer, advertising its address
+	DCCRelay DCCPolicy = "relay"
+)
+
+// Role grants a set of bouncer-wide permissions to a user.
+type Role string
+
+const (
+	// Regular user, without any bouncer-wide permission
+	RoleUser Role = ""
+	// Full access to the bouncer
+	RoleAdmin Role = "admin"
+	// Can create users and reset their passwords
+	RoleUserManager Role = "user-manager"
+	// Read-only access to the bouncer status
+	RoleObserver Role = "observer"
+)
+
 func NewUser(username string) *User {
 	return &User{
 		Username: username,
@@ -165,8 +245,41 @@ type Network struct {
 	SASL            SASL
 	AutoAway        bool
 	Enabled         bool
+	// Minimum TLS version ("1.0", "1.1", "1.2" or "1.3"), overriding the
+	// server default if non-empty
+	TLSMinVersion string
+	SASLFailure   SASLFailurePolicy
+	// DNS resolver used to look up the upstream server: "system" for the
+	// system resolver, or empty for the server default
+	Resolver string
+	// Socket options overriding the server defaults, in the form accepted
+	// by config.ParseSocketOptions
+	SocketOptions string
+	// Upstream capabilities which must not be requested
+	DisabledCaps []string
+	// Trust the server's TLS certificate on first use if it doesn't chain to
+	// a trusted root
+	TOFU bool
+	// Fingerprint of the certificate trusted on first use, in the same form
+	// as CertFP, empty if none yet
+	TOFUCertFP string
+	// Health thresholds overriding the server defaults: zero means the
+	// server default, negative values disable the check
+	HealthMaxLag        time.Duration
+	HealthMaxReconnects int
 }
 
+// SASLFailurePolicy describes what to do when SASL authentication with the
+// upstream server fails.
+type SASLFailurePolicy string
+
+const (
+	// Finish registration without SASL (the default)
+	SASLFailureContinue SASLFailurePolicy = ""
+	// Disconnect and retry later
+	SASLFailureAbort SASLFailurePolicy = "abort"
+)
+
 func NewNetwork(addr string) *Network {
 	return &Network{
 		Addr:     addr,
@@ -227,13 +340,59 @@ func GetRealname(user *User, net *Network) string {
 type MessageFilter int
 
 const (
-	// TODO: use customizable user defaults for FilterDefault
+	// FilterDefault resolves to the user default, see GetRelayDetached and
+	// friends
 	FilterDefault MessageFilter = iota
 	FilterNone
 	FilterHighlight
 	FilterMessage
 )
 
+// GetRelayDetached returns the effective RelayDetached filter for a channel,
+// falling back to the user default.
+func GetRelayDetached(user *User, ch *Channel) MessageFilter {
+	if ch != nil && ch.RelayDetached != FilterDefault {
+		return ch.RelayDetached
+	}
+	if user.RelayDetached != FilterDefault {
+		return user.RelayDetached
+	}
+	return FilterHighlight
+}
+
+// GetReattachOn returns the effective ReattachOn filter for a channel,
+// falling back to the user default.
+func GetReattachOn(user *User, ch *Channel) MessageFilter {
+	if ch != nil && ch.ReattachOn != FilterDefault {
+		return ch.ReattachOn
+	}
+	if user.ReattachOn != FilterDefault {
+		return user.ReattachOn
+	}
+	return FilterNone
+}
+
+// GetDetachAfter returns the effective DetachAfter duration for a channel,
+// falling back to the user default.
+func GetDetachAfter(user *User, ch *Channel) time.Duration {
+	if ch != nil && ch.DetachAfter != 0 {
+		return ch.DetachAfter
+	}
+	return user.DetachAfter
+}
+
+// GetDetachOn returns the effective DetachOn filter for a channel, falling
+// back to the user default.
+func GetDetachOn(user *User, ch *Channel) MessageFilter {
+	if ch != nil && ch.DetachOn != FilterDefault {
+		return ch.DetachOn
+	}
+	if user.DetachOn != FilterDefault {
+		return user.DetachOn
+	}
+	return FilterMessage
+}
+
 type Channel struct {
 	ID   int64
 	Name string
@@ -246,6 +405,14 @@ type Channel struct {
 	ReattachOn    MessageFilter
 	DetachAfter   time.Duration
 	DetachOn      MessageFilter
+
+	// Extra keywords considered as highlights for this channel
+	Highlights []string
+	// If set, our nickname isn't considered as a highlight for this channel
+	DisableNickHighlight   bool
+	DownstreamInteractedAt time.Time
+	// Last known topic
+	Topic string
 }
 
 type DeliveryReceipt struct {
@@ -255,6 +422,62 @@ type DeliveryReceipt struct {
 	InternalMsgID string
 }
 
+// Client contains per-client settings, identified by the client name.
+type Client struct {
+	ID            int64
+	Name          string
+	Summary       bool // send a summary of missed activity on connection
+	PlaybackStyle PlaybackStyle
+}
+
+// PlaybackStyle describes how history is replayed to clients which don't
+// support server-time.
+type PlaybackStyle string
+
+const (
+	// Replay history as regular PRIVMSG messages (the default)
+	PlaybackPRIVMSG PlaybackStyle = ""
+	// Replay history as NOTICE messages
+	PlaybackNotice PlaybackStyle = "notice"
+	// Prepend a timestamp to the text of replayed messages
+	PlaybackPrefixed PlaybackStyle = "prefixed"
+)
+
+// trafficStatsDayLayout is the layout used to store the day of traffic
+// statistics.
+const trafficStatsDayLayout = "2006-01-02"
+
+// TrafficStats contains the traffic exchanged with an upstream server during
+// a day.
+type TrafficStats struct {
+	Day         time.Time // midnight UTC
+	MessagesIn  int64
+	MessagesOut int64
+	BytesIn     int64
+	BytesOut    int64
+}
+
+// Highlight references a message which mentioned the user while they were
+// away.
+type Highlight struct {
+	ID        int64
+	NetworkID int64
+	Target    string // channel
+	Sender    string
+	Time      time.Time
+	Text      string // snippet of the message
+	MsgID     string // msgid tag of the message, if any
+}
+
+// OfflineEvent is an upstream message received while no client was connected
+// to the network, kept to be replayed to the next client.
+type OfflineEvent struct {
+	ID        int64
+	NetworkID int64
+	Time      time.Time
+	Message   *irc.Message
+}
+
 type ReadReceipt struct {
 	ID        int64
 	Target    string // channel or nick
@@ -268,6 +491,12 @@ type WebPushConfig struct {
 	}
 }
 
+type Announcement struct {
+	ID        int64
+	Text      string
+	CreatedAt time.Time // read-only
+}
+
 type WebPushSubscription struct {
 	ID                   int64
 	Endpoint             string
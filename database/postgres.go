@@ -113,6 +113,97 @@ var postgresMigrations = []string{
 		CREATE INDEX "MessageIndex" ON "Message" (target, time);
 		CREATE INDEX "MessageSearchIndex" ON "Message" USING GIN (text_search);
 	`,
+	`
+		ALTER TABLE "User"
+			ADD COLUMN relay_detached INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN reattach_on INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN detach_after INTEGER NOT NULL DEFAULT 0,
+			ADD COLUMN detach_on INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE "Channel"
+			ADD COLUMN highlights TEXT,
+			ADD COLUMN disable_nick_highlight BOOLEAN NOT NULL DEFAULT FALSE;
+	`,
+	`
+		ALTER TABLE "User" ADD COLUMN auto_detach_idle INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Channel" ADD COLUMN downstream_interacted_at TIMESTAMP WITH TIME ZONE;
+	`,
+	`ALTER TABLE "Channel" ADD COLUMN topic TEXT`,
+	`ALTER TABLE "Network" ADD COLUMN tls_min_version VARCHAR(255)`,
+	`
+		CREATE TABLE "Announcement" (
+			id SERIAL PRIMARY KEY,
+			created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+			text TEXT NOT NULL
+		);
+	`,
+	`ALTER TABLE "Network" ADD COLUMN sasl_failure VARCHAR(255)`,
+	`
+		ALTER TABLE "Message"
+			ADD COLUMN msgid TEXT,
+			ADD COLUMN redacted BOOLEAN NOT NULL DEFAULT FALSE;
+		CREATE INDEX "MessageMsgIDIndex" ON "Message" (target, msgid);
+	`,
+	`ALTER TABLE "Network" ADD COLUMN resolver VARCHAR(255)`,
+	`ALTER TABLE "Network" ADD COLUMN socket_options VARCHAR(255)`,
+	`
+		CREATE TABLE "Client" (
+			id SERIAL PRIMARY KEY,
+			"user" INTEGER NOT NULL REFERENCES "User"(id) ON DELETE CASCADE,
+			name VARCHAR(255) NOT NULL,
+			summary BOOLEAN NOT NULL DEFAULT FALSE,
+			UNIQUE("user", name)
+		);
+	`,
+	`
+		CREATE TABLE "Highlight" (
+			id SERIAL PRIMARY KEY,
+			network INTEGER NOT NULL REFERENCES "Network"(id) ON DELETE CASCADE,
+			target VARCHAR(255) NOT NULL,
+			sender VARCHAR(255) NOT NULL,
+			time TIMESTAMP WITH TIME ZONE NOT NULL,
+			text TEXT NOT NULL,
+			msgid VARCHAR(255)
+		);
+	`,
+	`ALTER TABLE "Client" ADD COLUMN playback_style VARCHAR(255)`,
+	`
+		ALTER TABLE "User" ADD COLUMN role VARCHAR(255);
+		UPDATE "User" SET role = 'admin' WHERE admin;
+		ALTER TABLE "User" DROP COLUMN admin;
+	`,
+	`ALTER TABLE "Network" ADD COLUMN disabled_caps VARCHAR(1023)`,
+	`
+		CREATE TABLE "TrafficStats" (
+			id SERIAL PRIMARY KEY,
+			network INTEGER NOT NULL REFERENCES "Network"(id) ON DELETE CASCADE,
+			day DATE NOT NULL,
+			messages_in BIGINT NOT NULL DEFAULT 0,
+			messages_out BIGINT NOT NULL DEFAULT 0,
+			bytes_in BIGINT NOT NULL DEFAULT 0,
+			bytes_out BIGINT NOT NULL DEFAULT 0,
+			UNIQUE(network, day)
+		);
+	`,
+	`ALTER TABLE "User" ADD COLUMN language VARCHAR(255)`,
+	`ALTER TABLE "User" ADD COLUMN dcc_policy VARCHAR(255)`,
+	`
+		ALTER TABLE "Network" ADD COLUMN tofu BOOLEAN NOT NULL DEFAULT FALSE;
+		ALTER TABLE "Network" ADD COLUMN tofu_certfp TEXT;
+	`,
+	`
+		ALTER TABLE "Network" ADD COLUMN health_max_lag INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE "Network" ADD COLUMN health_max_reconnects INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		CREATE TABLE "OfflineEvent" (
+			id SERIAL PRIMARY KEY,
+			network INTEGER NOT NULL REFERENCES "Network"(id) ON DELETE CASCADE,
+			time TIMESTAMP WITH TIME ZONE NOT NULL,
+			raw TEXT NOT NULL
+		);
+	`,
 }
 
 type PostgresDB struct {
@@ -256,8 +347,9 @@ func (db *PostgresDB) ListUsers(ctx context.Context) ([]User, error) {
 	defer cancel()
 
 	rows, err := db.db.QueryContext(ctx,
-		`SELECT id, username, password, admin, nick, realname, enabled,
-			downstream_interacted_at
+		`SELECT id, username, password, role, nick, realname, enabled,
+			downstream_interacted_at, relay_detached, reattach_on,
+			detach_after, detach_on, auto_detach_idle, language, dcc_policy
 		FROM "User"`)
 	if err != nil {
 		return nil, err
@@ -267,15 +359,21 @@ func (db *PostgresDB) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		var password, nick, realname sql.NullString
+		var password, role, nick, realname, language, dccPolicy sql.NullString
 		var downstreamInteractedAt sql.NullTime
-		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &nick, &realname, &user.Enabled, &downstreamInteractedAt); err != nil {
+		var detachAfter, autoDetachIdle int64
+		if err := rows.Scan(&user.ID, &user.Username, &password, &role, &nick, &realname, &user.Enabled, &downstreamInteractedAt, &user.RelayDetached, &user.ReattachOn, &detachAfter, &user.DetachOn, &autoDetachIdle, &language, &dccPolicy); err != nil {
 			return nil, err
 		}
 		user.Password = password.String
+		user.Role = Role(role.String)
 		user.Nick = nick.String
 		user.Realname = realname.String
 		user.DownstreamInteractedAt = downstreamInteractedAt.Time
+		user.DetachAfter = time.Duration(detachAfter) * time.Second
+		user.AutoDetachIdle = time.Duration(autoDetachIdle) * time.Second
+		user.Language = language.String
+		user.DCC = DCCPolicy(dccPolicy.String)
 		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
@@ -291,20 +389,28 @@ func (db *PostgresDB) GetUser(ctx context.Context, username string) (*User, erro
 
 	user := &User{Username: username}
 
-	var password, nick, realname sql.NullString
+	var password, role, nick, realname, language, dccPolicy sql.NullString
 	var downstreamInteractedAt sql.NullTime
+	var detachAfter, autoDetachIdle int64
 	row := db.db.QueryRowContext(ctx,
-		`SELECT id, password, admin, nick, realname, enabled, downstream_interacted_at
+		`SELECT id, password, role, nick, realname, enabled, downstream_interacted_at,
+			relay_detached, reattach_on, detach_after, detach_on, auto_detach_idle,
+			language, dcc_policy
 		FROM "User"
 		WHERE username = $1`,
 		username)
-	if err := row.Scan(&user.ID, &password, &user.Admin, &nick, &realname, &user.Enabled, &downstreamInteractedAt); err != nil {
+	if err := row.Scan(&user.ID, &password, &role, &nick, &realname, &user.Enabled, &downstreamInteractedAt, &user.RelayDetached, &user.ReattachOn, &detachAfter, &user.DetachOn, &autoDetachIdle, &language, &dccPolicy); err != nil {
 		return nil, err
 	}
 	user.Password = password.String
+	user.Role = Role(role.String)
 	user.Nick = nick.String
 	user.Realname = realname.String
 	user.DownstreamInteractedAt = downstreamInteractedAt.Time
+	user.DetachAfter = time.Duration(detachAfter) * time.Second
+	user.AutoDetachIdle = time.Duration(autoDetachIdle) * time.Second
+	user.Language = language.String
+	user.DCC = DCCPolicy(dccPolicy.String)
 	return user, nil
 }
 
@@ -340,27 +446,38 @@ func (db *PostgresDB) StoreUser(ctx context.Context, user *User) error {
 	defer cancel()
 
 	password := toNullString(user.Password)
+	role := toNullString(string(user.Role))
 	nick := toNullString(user.Nick)
 	realname := toNullString(user.Realname)
 	downstreamInteractedAt := toNullTime(user.DownstreamInteractedAt)
+	detachAfter := int64(math.Ceil(user.DetachAfter.Seconds()))
+	autoDetachIdle := int64(math.Ceil(user.AutoDetachIdle.Seconds()))
+	language := toNullString(user.Language)
+	dccPolicy := toNullString(string(user.DCC))
 
 	var err error
 	if user.ID == 0 {
 		err = db.db.QueryRowContext(ctx, `
-			INSERT INTO "User" (username, password, admin, nick, realname,
-				enabled, downstream_interacted_at)
-			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			INSERT INTO "User" (username, password, role, nick, realname,
+				enabled, downstream_interacted_at, relay_detached, reattach_on,
+				detach_after, detach_on, auto_detach_idle, language, dcc_policy)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
 			RETURNING id`,
-			user.Username, password, user.Admin, nick, realname, user.Enabled,
-			downstreamInteractedAt).Scan(&user.ID)
+			user.Username, password, role, nick, realname, user.Enabled,
+			downstreamInteractedAt, user.RelayDetached, user.ReattachOn,
+			detachAfter, user.DetachOn, autoDetachIdle, language, dccPolicy).Scan(&user.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "User"
-			SET password = $1, admin = $2, nick = $3, realname = $4,
-				enabled = $5, downstream_interacted_at = $6
-			WHERE id = $7`,
-			password, user.Admin, nick, realname, user.Enabled,
-			downstreamInteractedAt, user.ID)
+			SET password = $1, role = $2, nick = $3, realname = $4,
+				enabled = $5, downstream_interacted_at = $6,
+				relay_detached = $7, reattach_on = $8, detach_after = $9,
+				detach_on = $10, auto_detach_idle = $11, language = $12,
+				dcc_policy = $13
+			WHERE id = $14`,
+			password, role, nick, realname, user.Enabled,
+			downstreamInteractedAt, user.RelayDetached, user.ReattachOn,
+			detachAfter, user.DetachOn, autoDetachIdle, language, dccPolicy, user.ID)
 	}
 	return err
 }
@@ -379,7 +496,9 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, addr, nick, username, realname, certfp, pass, connect_commands, sasl_mechanism,
-			sasl_plain_username, sasl_plain_password, sasl_external_cert, sasl_external_key, auto_away, enabled
+			sasl_plain_username, sasl_plain_password, sasl_external_cert, sasl_external_key, auto_away, enabled,
+			tls_min_version, sasl_failure, resolver, socket_options, disabled_caps, tofu, tofu_certfp,
+			health_max_lag, health_max_reconnects
 		FROM "Network"
 		WHERE "user" = $1`, userID)
 	if err != nil {
@@ -390,11 +509,14 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 	var networks []Network
 	for rows.Next() {
 		var net Network
+		var healthMaxLag int64
 		var name, nick, username, realname, certfp, pass, connectCommands sql.NullString
-		var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+		var saslMechanism, saslPlainUsername, saslPlainPassword, tlsMinVersion, saslFailure, resolver, socketOptions, disabledCaps, tofuCertFP sql.NullString
 		err := rows.Scan(&net.ID, &name, &net.Addr, &nick, &username, &realname, &certfp,
 			&pass, &connectCommands, &saslMechanism, &saslPlainUsername, &saslPlainPassword,
-			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.AutoAway, &net.Enabled)
+			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.AutoAway, &net.Enabled,
+			&tlsMinVersion, &saslFailure, &resolver, &socketOptions, &disabledCaps, &net.TOFU, &tofuCertFP,
+			&healthMaxLag, &net.HealthMaxReconnects)
 		if err != nil {
 			return nil, err
 		}
@@ -410,6 +532,15 @@ func (db *PostgresDB) ListNetworks(ctx context.Context, userID int64) ([]Network
 		net.SASL.Mechanism = saslMechanism.String
 		net.SASL.Plain.Username = saslPlainUsername.String
 		net.SASL.Plain.Password = saslPlainPassword.String
+		net.TLSMinVersion = tlsMinVersion.String
+		net.SASLFailure = SASLFailurePolicy(saslFailure.String)
+		net.Resolver = resolver.String
+		net.SocketOptions = socketOptions.String
+		if disabledCaps.Valid {
+			net.DisabledCaps = strings.Fields(disabledCaps.String)
+		}
+		net.TOFUCertFP = tofuCertFP.String
+		net.HealthMaxLag = time.Duration(healthMaxLag) * time.Second
 		networks = append(networks, net)
 	}
 	if err := rows.Err(); err != nil {
@@ -430,6 +561,9 @@ func (db *PostgresDB) StoreNetwork(ctx context.Context, userID int64, network *N
 	certfp := toNullString(network.CertFP)
 	pass := toNullString(network.Pass)
 	connectCommands := toNullString(strings.Join(network.ConnectCommands, "\r\n"))
+	disabledCaps := toNullString(strings.Join(network.DisabledCaps, " "))
+	tofuCertFP := toNullString(network.TOFUCertFP)
+	healthMaxLag := int64(math.Ceil(network.HealthMaxLag.Seconds()))
 
 	var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
 	if network.SASL.Mechanism != "" {
@@ -452,23 +586,33 @@ func (db *PostgresDB) StoreNetwork(ctx context.Context, userID int64, network *N
 		err = db.db.QueryRowContext(ctx, `
 			INSERT INTO "Network" ("user", name, addr, nick, username, realname, certfp, pass, connect_commands,
 				sasl_mechanism, sasl_plain_username, sasl_plain_password, sasl_external_cert,
-				sasl_external_key, auto_away, enabled)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16)
+				sasl_external_key, auto_away, enabled, tls_min_version, sasl_failure, resolver,
+				socket_options, disabled_caps, tofu, tofu_certfp, health_max_lag, health_max_reconnects)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21,
+				$22, $23, $24, $25)
 			RETURNING id`,
 			userID, netName, network.Addr, nick, netUsername, realname, certfp, pass, connectCommands,
 			saslMechanism, saslPlainUsername, saslPlainPassword, network.SASL.External.CertBlob,
-			network.SASL.External.PrivKeyBlob, network.AutoAway, network.Enabled).Scan(&network.ID)
+			network.SASL.External.PrivKeyBlob, network.AutoAway, network.Enabled,
+			toNullString(network.TLSMinVersion), toNullString(string(network.SASLFailure)),
+			toNullString(network.Resolver), toNullString(network.SocketOptions), disabledCaps,
+			network.TOFU, tofuCertFP, healthMaxLag, network.HealthMaxReconnects).Scan(&network.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "Network"
 			SET name = $2, addr = $3, nick = $4, username = $5, realname = $6, certfp = $7, pass = $8,
 				connect_commands = $9, sasl_mechanism = $10, sasl_plain_username = $11,
 				sasl_plain_password = $12, sasl_external_cert = $13, sasl_external_key = $14,
-				auto_away = $15, enabled = $16
+				auto_away = $15, enabled = $16, tls_min_version = $17, sasl_failure = $18,
+				resolver = $19, socket_options = $20, disabled_caps = $21, tofu = $22,
+				tofu_certfp = $23, health_max_lag = $24, health_max_reconnects = $25
 			WHERE id = $1`,
 			network.ID, netName, network.Addr, nick, netUsername, realname, certfp, pass, connectCommands,
 			saslMechanism, saslPlainUsername, saslPlainPassword, network.SASL.External.CertBlob,
-			network.SASL.External.PrivKeyBlob, network.AutoAway, network.Enabled)
+			network.SASL.External.PrivKeyBlob, network.AutoAway, network.Enabled,
+			toNullString(network.TLSMinVersion), toNullString(string(network.SASLFailure)),
+			toNullString(network.Resolver), toNullString(network.SocketOptions), disabledCaps,
+			network.TOFU, tofuCertFP, healthMaxLag, network.HealthMaxReconnects)
 	}
 	return err
 }
@@ -487,7 +631,7 @@ func (db *PostgresDB) ListChannels(ctx context.Context, networkID int64) ([]Chan
 
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, key, detached, detached_internal_msgid, relay_detached, reattach_on, detach_after,
-			detach_on
+			detach_on, highlights, disable_nick_highlight, downstream_interacted_at, topic
 		FROM "Channel"
 		WHERE network = $1`, networkID)
 	if err != nil {
@@ -498,14 +642,20 @@ func (db *PostgresDB) ListChannels(ctx context.Context, networkID int64) ([]Chan
 	var channels []Channel
 	for rows.Next() {
 		var ch Channel
-		var key, detachedInternalMsgID sql.NullString
+		var key, detachedInternalMsgID, highlights, topic sql.NullString
 		var detachAfter int64
-		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn); err != nil {
+		var downstreamInteractedAt sql.NullTime
+		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn, &highlights, &ch.DisableNickHighlight, &downstreamInteractedAt, &topic); err != nil {
 			return nil, err
 		}
 		ch.Key = key.String
+		ch.Topic = topic.String
 		ch.DetachedInternalMsgID = detachedInternalMsgID.String
 		ch.DetachAfter = time.Duration(detachAfter) * time.Second
+		ch.DownstreamInteractedAt = downstreamInteractedAt.Time
+		if highlights.Valid {
+			ch.Highlights = strings.Split(highlights.String, "\n")
+		}
 		channels = append(channels, ch)
 	}
 	if err := rows.Err(); err != nil {
@@ -521,24 +671,29 @@ func (db *PostgresDB) StoreChannel(ctx context.Context, networkID int64, ch *Cha
 
 	key := toNullString(ch.Key)
 	detachAfter := int64(math.Ceil(ch.DetachAfter.Seconds()))
+	highlights := toNullString(strings.Join(ch.Highlights, "\n"))
 
 	var err error
 	if ch.ID == 0 {
 		err = db.db.QueryRowContext(ctx, `
 			INSERT INTO "Channel" (network, name, key, detached, detached_internal_msgid, relay_detached, reattach_on,
-				detach_after, detach_on)
-			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+				detach_after, detach_on, highlights, disable_nick_highlight, downstream_interacted_at, topic)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
 			RETURNING id`,
 			networkID, ch.Name, key, ch.Detached, toNullString(ch.DetachedInternalMsgID),
-			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn).Scan(&ch.ID)
+			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn, highlights,
+			ch.DisableNickHighlight, toNullTime(ch.DownstreamInteractedAt), toNullString(ch.Topic)).Scan(&ch.ID)
 	} else {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE "Channel"
 			SET name = $2, key = $3, detached = $4, detached_internal_msgid = $5,
-				relay_detached = $6, reattach_on = $7, detach_after = $8, detach_on = $9
+				relay_detached = $6, reattach_on = $7, detach_after = $8, detach_on = $9,
+				highlights = $10, disable_nick_highlight = $11, downstream_interacted_at = $12,
+				topic = $13
 			WHERE id = $1`,
 			ch.ID, ch.Name, key, ch.Detached, toNullString(ch.DetachedInternalMsgID),
-			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn)
+			ch.RelayDetached, ch.ReattachOn, detachAfter, ch.DetachOn, highlights,
+			ch.DisableNickHighlight, toNullTime(ch.DownstreamInteractedAt), toNullString(ch.Topic))
 	}
 	return err
 }
@@ -618,6 +773,79 @@ func (db *PostgresDB) StoreClientDeliveryReceipts(ctx context.Context, networkID
 	return tx.Commit()
 }
 
+func (db *PostgresDB) GetClient(ctx context.Context, userID int64, name string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	client := &Client{
+		Name: name,
+	}
+
+	var playbackStyle sql.NullString
+	row := db.db.QueryRowContext(ctx,
+		`SELECT id, summary, playback_style FROM "Client" WHERE "user" = $1 AND name = $2`,
+		userID, name)
+	if err := row.Scan(&client.ID, &client.Summary, &playbackStyle); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	client.PlaybackStyle = PlaybackStyle(playbackStyle.String)
+	return client, nil
+}
+
+func (db *PostgresDB) ListClients(ctx context.Context, userID int64) ([]Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx,
+		`SELECT id, name, summary, playback_style FROM "Client" WHERE "user" = $1 ORDER BY name`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []Client
+	for rows.Next() {
+		var client Client
+		var playbackStyle sql.NullString
+		if err := rows.Scan(&client.ID, &client.Name, &client.Summary, &playbackStyle); err != nil {
+			return nil, err
+		}
+		client.PlaybackStyle = PlaybackStyle(playbackStyle.String)
+		clients = append(clients, client)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func (db *PostgresDB) StoreClient(ctx context.Context, userID int64, client *Client) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	var err error
+	if client.ID != 0 {
+		_, err = db.db.ExecContext(ctx, `
+			UPDATE "Client"
+			SET summary = $1, playback_style = $2
+			WHERE id = $3`,
+			client.Summary, toNullString(string(client.PlaybackStyle)), client.ID)
+	} else {
+		err = db.db.QueryRowContext(ctx, `
+			INSERT INTO "Client" ("user", name, summary, playback_style)
+			VALUES ($1, $2, $3, $4)
+			RETURNING id`,
+			userID, client.Name, client.Summary,
+			toNullString(string(client.PlaybackStyle))).Scan(&client.ID)
+	}
+	return err
+}
+
 func (db *PostgresDB) GetReadReceipt(ctx context.Context, networkID int64, name string) (*ReadReceipt, error) {
 	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
 	defer cancel()
@@ -797,6 +1025,204 @@ func (db *PostgresDB) DeleteWebPushSubscription(ctx context.Context, id int64) e
 	return err
 }
 
+func (db *PostgresDB) ListHighlights(ctx context.Context, userID int64) ([]Highlight, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT h.id, h.network, h.target, h.sender, h.time, h.text, h.msgid
+		FROM "Highlight" AS h
+		JOIN "Network" AS n ON h.network = n.id
+		WHERE n."user" = $1
+		ORDER BY h.time`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var highlights []Highlight
+	for rows.Next() {
+		var highlight Highlight
+		var msgID sql.NullString
+		if err := rows.Scan(&highlight.ID, &highlight.NetworkID, &highlight.Target, &highlight.Sender, &highlight.Time, &highlight.Text, &msgID); err != nil {
+			return nil, err
+		}
+		highlight.MsgID = msgID.String
+		highlights = append(highlights, highlight)
+	}
+
+	return highlights, rows.Err()
+}
+
+func (db *PostgresDB) StoreHighlight(ctx context.Context, networkID int64, highlight *Highlight) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO "Highlight" (network, target, sender, time, text, msgid)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id`,
+		networkID, highlight.Target, highlight.Sender, highlight.Time, highlight.Text,
+		toNullString(highlight.MsgID)).Scan(&highlight.ID)
+	highlight.NetworkID = networkID
+	return err
+}
+
+func (db *PostgresDB) DeleteHighlight(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Highlight" WHERE id = $1`, id)
+	return err
+}
+
+func (db *PostgresDB) ListOfflineEvents(ctx context.Context, networkID int64) ([]OfflineEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, time, raw
+		FROM "OfflineEvent"
+		WHERE network = $1
+		ORDER BY time, id`, networkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OfflineEvent
+	for rows.Next() {
+		var event OfflineEvent
+		var raw string
+		if err := rows.Scan(&event.ID, &event.Time, &raw); err != nil {
+			return nil, err
+		}
+		msg, err := irc.ParseMessage(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse offline event: %v", err)
+		}
+		event.NetworkID = networkID
+		event.Message = msg
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func (db *PostgresDB) StoreOfflineEvent(ctx context.Context, networkID int64, event *OfflineEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO "OfflineEvent" (network, time, raw)
+		VALUES ($1, $2, $3)
+		RETURNING id`,
+		networkID, event.Time, event.Message.String()).Scan(&event.ID)
+	event.NetworkID = networkID
+	return err
+}
+
+func (db *PostgresDB) DeleteOfflineEvent(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "OfflineEvent" WHERE id = $1`, id)
+	return err
+}
+
+func (db *PostgresDB) ListTrafficStats(ctx context.Context, networkID int64) ([]TrafficStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT day, messages_in, messages_out, bytes_in, bytes_out
+		FROM "TrafficStats"
+		WHERE network = $1
+		ORDER BY day`, networkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var l []TrafficStats
+	for rows.Next() {
+		var stats TrafficStats
+		if err := rows.Scan(&stats.Day, &stats.MessagesIn, &stats.MessagesOut, &stats.BytesIn, &stats.BytesOut); err != nil {
+			return nil, err
+		}
+		stats.Day = stats.Day.UTC()
+		l = append(l, stats)
+	}
+
+	return l, rows.Err()
+}
+
+func (db *PostgresDB) AddTrafficStats(ctx context.Context, networkID int64, stats *TrafficStats) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `
+		INSERT INTO "TrafficStats" (network, day, messages_in, messages_out, bytes_in, bytes_out)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT (network, day) DO UPDATE SET
+			messages_in = "TrafficStats".messages_in + EXCLUDED.messages_in,
+			messages_out = "TrafficStats".messages_out + EXCLUDED.messages_out,
+			bytes_in = "TrafficStats".bytes_in + EXCLUDED.bytes_in,
+			bytes_out = "TrafficStats".bytes_out + EXCLUDED.bytes_out`,
+		networkID, stats.Day.UTC().Format(trafficStatsDayLayout), stats.MessagesIn, stats.MessagesOut,
+		stats.BytesIn, stats.BytesOut)
+	return err
+}
+
+func (db *PostgresDB) ListAnnouncements(ctx context.Context) ([]Announcement, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, created_at, text
+		FROM "Announcement"
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var announcements []Announcement
+	for rows.Next() {
+		var announcement Announcement
+		if err := rows.Scan(&announcement.ID, &announcement.CreatedAt, &announcement.Text); err != nil {
+			return nil, err
+		}
+		announcements = append(announcements, announcement)
+	}
+
+	return announcements, rows.Err()
+}
+
+func (db *PostgresDB) StoreAnnouncement(ctx context.Context, announcement *Announcement) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	if announcement.ID != 0 {
+		return fmt.Errorf("cannot update an Announcement")
+	}
+
+	err := db.db.QueryRowContext(ctx, `
+		INSERT INTO "Announcement" (created_at, text)
+		VALUES (NOW(), $1)
+		RETURNING id, created_at`,
+		announcement.Text).Scan(&announcement.ID, &announcement.CreatedAt)
+	return err
+}
+
+func (db *PostgresDB) DeleteAnnouncement(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `DELETE FROM "Announcement" WHERE id = $1`, id)
+	return err
+}
+
 func (db *PostgresDB) GetMessageLastID(ctx context.Context, networkID int64, name string) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
 	defer cancel()
@@ -844,10 +1270,10 @@ func (db *PostgresDB) StoreMessages(ctx context.Context, networkID int64, name s
 	}
 
 	insertStmt, err := tx.PrepareContext(ctx, `
-		INSERT INTO "Message" (target, raw, time, sender, text)
-		SELECT id, $1, $2, $3, $4
+		INSERT INTO "Message" (target, raw, time, sender, text, msgid)
+		SELECT id, $1, $2, $3, $4, $5
 		FROM "MessageTarget" as t
-		WHERE network = $5 AND target = $6
+		WHERE network = $6 AND target = $7
 		RETURNING id`)
 	if err != nil {
 		return nil, err
@@ -880,6 +1306,7 @@ func (db *PostgresDB) StoreMessages(ctx context.Context, networkID int64, name s
 			t,
 			msg.Name,
 			text,
+			toNullString(msg.Tags["msgid"]),
 			networkID,
 			name,
 		).Scan(&ids[i])
@@ -902,7 +1329,7 @@ func (db *PostgresDB) ListMessageLastPerTarget(ctx context.Context, networkID in
 	query := `
 		SELECT t.target, MAX(m.time) AS latest
 		FROM "Message" m, "MessageTarget" t
-		WHERE m.target = t.id AND t.network = $1
+		WHERE m.target = t.id AND t.network = $1 AND NOT m.redacted
 	`
 	if !options.Events {
 		query += `AND m.text IS NOT NULL `
@@ -959,6 +1386,44 @@ func (db *PostgresDB) ListMessageLastPerTarget(ctx context.Context, networkID in
 	return l, nil
 }
 
+func (db *PostgresDB) CountMessagesPerTarget(ctx context.Context, networkID int64, options *MessageCountOptions) ([]MessageTargetCount, error) {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	parameters := []interface{}{
+		networkID,
+		options.AfterID,
+		options.ExcludeSender,
+	}
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT t.target, COUNT(*)
+		FROM "Message" AS m, "MessageTarget" AS t
+		WHERE m.target = t.id AND t.network = $1
+			AND NOT m.redacted AND m.text IS NOT NULL
+			AND m.id > $2 AND m.sender != $3
+		GROUP BY t.target`,
+		parameters...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var l []MessageTargetCount
+	for rows.Next() {
+		var count MessageTargetCount
+		if err := rows.Scan(&count.Name, &count.Messages); err != nil {
+			return nil, err
+		}
+		l = append(l, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
 func (db *PostgresDB) ListMessages(ctx context.Context, networkID int64, name string, options *MessageOptions) ([]*irc.Message, error) {
 	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
 	defer cancel()
@@ -970,7 +1435,8 @@ func (db *PostgresDB) ListMessages(ctx context.Context, networkID int64, name st
 	query := `
 		SELECT m.raw
 		FROM "Message" AS m, "MessageTarget" AS t
-		WHERE m.target = t.id AND t.network = $1 AND t.target = $2 `
+		WHERE m.target = t.id AND t.network = $1 AND t.target = $2
+			AND NOT m.redacted `
 	if options.AfterID > 0 {
 		parameters = append(parameters, options.AfterID)
 		query += fmt.Sprintf(`AND m.id > $%d `, len(parameters))
@@ -989,10 +1455,22 @@ func (db *PostgresDB) ListMessages(ctx context.Context, networkID int64, name st
 		parameters = append(parameters, options.Sender)
 		query += fmt.Sprintf(`AND m.sender = $%d `, len(parameters))
 	}
+	if options.ExcludeSender != "" {
+		parameters = append(parameters, options.ExcludeSender)
+		query += fmt.Sprintf(`AND m.sender != $%d `, len(parameters))
+	}
 	if options.Text != "" {
 		parameters = append(parameters, options.Text)
 		query += fmt.Sprintf(`AND text_search @@ plainto_tsquery('search_simple', $%d) `, len(parameters))
 	}
+	if len(options.TextContains) > 0 {
+		var conds []string
+		for _, s := range options.TextContains {
+			parameters = append(parameters, "%"+likePatternEscaper.Replace(s)+"%")
+			conds = append(conds, fmt.Sprintf(`m.text LIKE $%d`, len(parameters)))
+		}
+		query += `AND (` + strings.Join(conds, " OR ") + `) `
+	}
 	if !options.Events {
 		query += `AND m.text IS NOT NULL `
 	}
@@ -1039,6 +1517,67 @@ func (db *PostgresDB) ListMessages(ctx context.Context, networkID int64, name st
 	return l, nil
 }
 
+func (db *PostgresDB) RedactMessage(ctx context.Context, networkID int64, name, msgID string) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `
+		UPDATE "Message" SET redacted = TRUE
+		WHERE msgid = $3 AND target = (
+			SELECT id FROM "MessageTarget"
+			WHERE network = $1 AND target = $2
+		)`,
+		networkID, name, msgID)
+	return err
+}
+
+func (db *PostgresDB) RenameMessageTarget(ctx context.Context, networkID int64, oldName, newName string) error {
+	ctx, cancel := context.WithTimeout(ctx, postgresQueryTimeout)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The new target may already exist: move the messages instead of renaming
+	// the target, to merge both histories
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO "MessageTarget" (network, target)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`,
+		networkID, newName)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE "Message"
+		SET target = (
+			SELECT id FROM "MessageTarget"
+			WHERE network = $1 AND target = $3
+		)
+		WHERE target = (
+			SELECT id FROM "MessageTarget"
+			WHERE network = $1 AND target = $2
+		)`,
+		networkID, oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM "MessageTarget"
+		WHERE network = $1 AND target = $2`,
+		networkID, oldName)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 var postgresNetworksTotalDesc = prometheus.NewDesc("soju_networks_total", "Number of networks", []string{"hostname"}, nil)
 
 type postgresMetricsCollector struct {
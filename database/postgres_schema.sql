@@ -2,12 +2,19 @@ CREATE TABLE "User" (
 	id SERIAL PRIMARY KEY,
 	username VARCHAR(255) NOT NULL UNIQUE,
 	password VARCHAR(255),
-	admin BOOLEAN NOT NULL DEFAULT FALSE,
+	role VARCHAR(255),
 	nick VARCHAR(255),
 	realname VARCHAR(255),
 	created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT now(),
 	enabled BOOLEAN NOT NULL DEFAULT TRUE,
-	downstream_interacted_at TIMESTAMP WITH TIME ZONE
+	downstream_interacted_at TIMESTAMP WITH TIME ZONE,
+	relay_detached INTEGER NOT NULL DEFAULT 0,
+	reattach_on INTEGER NOT NULL DEFAULT 0,
+	detach_after INTEGER NOT NULL DEFAULT 0,
+	detach_on INTEGER NOT NULL DEFAULT 0,
+	auto_detach_idle INTEGER NOT NULL DEFAULT 0,
+	language VARCHAR(255),
+	dcc_policy VARCHAR(255)
 );
 
 CREATE TYPE sasl_mechanism AS ENUM ('PLAIN', 'EXTERNAL');
@@ -30,6 +37,15 @@ CREATE TABLE "Network" (
 	sasl_external_key BYTEA,
 	auto_away BOOLEAN NOT NULL DEFAULT TRUE,
 	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	tls_min_version VARCHAR(255),
+	sasl_failure VARCHAR(255),
+	resolver VARCHAR(255),
+	socket_options VARCHAR(255),
+	disabled_caps VARCHAR(1023),
+	tofu BOOLEAN NOT NULL DEFAULT FALSE,
+	tofu_certfp TEXT,
+	health_max_lag INTEGER NOT NULL DEFAULT 0,
+	health_max_reconnects INTEGER NOT NULL DEFAULT 0,
 	UNIQUE("user", addr, nick),
 	UNIQUE("user", name)
 );
@@ -45,6 +61,10 @@ CREATE TABLE "Channel" (
 	reattach_on INTEGER NOT NULL DEFAULT 0,
 	detach_after INTEGER NOT NULL DEFAULT 0,
 	detach_on INTEGER NOT NULL DEFAULT 0,
+	highlights TEXT,
+	disable_nick_highlight BOOLEAN NOT NULL DEFAULT FALSE,
+	downstream_interacted_at TIMESTAMP WITH TIME ZONE,
+	topic TEXT,
 	UNIQUE(network, name)
 );
 
@@ -57,6 +77,15 @@ CREATE TABLE "DeliveryReceipt" (
 	UNIQUE(network, target, client)
 );
 
+CREATE TABLE "Client" (
+	id SERIAL PRIMARY KEY,
+	"user" INTEGER NOT NULL REFERENCES "User"(id) ON DELETE CASCADE,
+	name VARCHAR(255) NOT NULL,
+	summary BOOLEAN NOT NULL DEFAULT FALSE,
+	playback_style VARCHAR(255),
+	UNIQUE("user", name)
+);
+
 CREATE TABLE "ReadReceipt" (
 	id SERIAL PRIMARY KEY,
 	network INTEGER NOT NULL REFERENCES "Network"(id) ON DELETE CASCADE,
@@ -105,7 +134,44 @@ CREATE TABLE "Message" (
 	time TIMESTAMP WITH TIME ZONE NOT NULL,
 	sender TEXT NOT NULL,
 	text TEXT,
-	text_search tsvector GENERATED ALWAYS AS (to_tsvector('@SCHEMA_PREFIX@search_simple', text)) STORED
+	text_search tsvector GENERATED ALWAYS AS (to_tsvector('@SCHEMA_PREFIX@search_simple', text)) STORED,
+	msgid TEXT,
+	redacted BOOLEAN NOT NULL DEFAULT FALSE
 );
 CREATE INDEX "MessageIndex" ON "Message" (target, time);
+CREATE INDEX "MessageMsgIDIndex" ON "Message" (target, msgid);
 CREATE INDEX "MessageSearchIndex" ON "Message" USING GIN (text_search);
+
+CREATE TABLE "Announcement" (
+	id SERIAL PRIMARY KEY,
+	created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	text TEXT NOT NULL
+);
+
+CREATE TABLE "Highlight" (
+	id SERIAL PRIMARY KEY,
+	network INTEGER NOT NULL REFERENCES "Network"(id) ON DELETE CASCADE,
+	target VARCHAR(255) NOT NULL,
+	sender VARCHAR(255) NOT NULL,
+	time TIMESTAMP WITH TIME ZONE NOT NULL,
+	text TEXT NOT NULL,
+	msgid VARCHAR(255)
+);
+
+CREATE TABLE "OfflineEvent" (
+	id SERIAL PRIMARY KEY,
+	network INTEGER NOT NULL REFERENCES "Network"(id) ON DELETE CASCADE,
+	time TIMESTAMP WITH TIME ZONE NOT NULL,
+	raw TEXT NOT NULL
+);
+
+CREATE TABLE "TrafficStats" (
+	id SERIAL PRIMARY KEY,
+	network INTEGER NOT NULL REFERENCES "Network"(id) ON DELETE CASCADE,
+	day DATE NOT NULL,
+	messages_in BIGINT NOT NULL DEFAULT 0,
+	messages_out BIGINT NOT NULL DEFAULT 0,
+	bytes_in BIGINT NOT NULL DEFAULT 0,
+	bytes_out BIGINT NOT NULL DEFAULT 0,
+	UNIQUE(network, day)
+);
@@ -242,6 +242,98 @@ var sqliteMigrations = []string{
 			INSERT INTO MessageFTS(rowid, text) VALUES (new.id, new.text);
 		END;
 	`,
+	`
+		ALTER TABLE User ADD COLUMN relay_detached INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN reattach_on INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN detach_after INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE User ADD COLUMN detach_on INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE Channel ADD COLUMN highlights TEXT;
+		ALTER TABLE Channel ADD COLUMN disable_nick_highlight INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		ALTER TABLE User ADD COLUMN auto_detach_idle INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Channel ADD COLUMN downstream_interacted_at TEXT;
+	`,
+	"ALTER TABLE Channel ADD COLUMN topic TEXT",
+	"ALTER TABLE Network ADD COLUMN tls_min_version TEXT",
+	`
+		CREATE TABLE Announcement (
+			id INTEGER PRIMARY KEY,
+			created_at TEXT NOT NULL,
+			text TEXT NOT NULL
+		);
+	`,
+	"ALTER TABLE Network ADD COLUMN sasl_failure TEXT",
+	`
+		ALTER TABLE Message ADD COLUMN msgid TEXT;
+		ALTER TABLE Message ADD COLUMN redacted INTEGER NOT NULL DEFAULT 0;
+		CREATE INDEX MessageMsgIDIndex ON Message(target, msgid);
+	`,
+	"ALTER TABLE Network ADD COLUMN resolver TEXT",
+	"ALTER TABLE Network ADD COLUMN socket_options TEXT",
+	`
+		CREATE TABLE Client (
+			id INTEGER PRIMARY KEY,
+			user INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			summary INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY(user) REFERENCES User(id),
+			UNIQUE(user, name)
+		);
+	`,
+	`
+		CREATE TABLE Highlight (
+			id INTEGER PRIMARY KEY,
+			network INTEGER NOT NULL,
+			target TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			time TEXT NOT NULL,
+			text TEXT NOT NULL,
+			msgid TEXT,
+			FOREIGN KEY(network) REFERENCES Network(id)
+		);
+	`,
+	"ALTER TABLE Client ADD COLUMN playback_style TEXT",
+	`
+		ALTER TABLE User ADD COLUMN role TEXT;
+		UPDATE User SET role = 'admin' WHERE admin = 1;
+		ALTER TABLE User DROP COLUMN admin;
+	`,
+	"ALTER TABLE Network ADD COLUMN disabled_caps TEXT",
+	`
+		CREATE TABLE TrafficStats (
+			id INTEGER PRIMARY KEY,
+			network INTEGER NOT NULL,
+			day TEXT NOT NULL,
+			messages_in INTEGER NOT NULL DEFAULT 0,
+			messages_out INTEGER NOT NULL DEFAULT 0,
+			bytes_in INTEGER NOT NULL DEFAULT 0,
+			bytes_out INTEGER NOT NULL DEFAULT 0,
+			FOREIGN KEY(network) REFERENCES Network(id),
+			UNIQUE(network, day)
+		);
+	`,
+	"ALTER TABLE User ADD COLUMN language TEXT",
+	"ALTER TABLE User ADD COLUMN dcc_policy TEXT",
+	`
+		ALTER TABLE Network ADD COLUMN tofu INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN tofu_certfp TEXT;
+	`,
+	`
+		ALTER TABLE Network ADD COLUMN health_max_lag INTEGER NOT NULL DEFAULT 0;
+		ALTER TABLE Network ADD COLUMN health_max_reconnects INTEGER NOT NULL DEFAULT 0;
+	`,
+	`
+		CREATE TABLE OfflineEvent (
+			id INTEGER PRIMARY KEY,
+			network INTEGER NOT NULL,
+			time TEXT NOT NULL,
+			raw TEXT NOT NULL,
+			FOREIGN KEY(network) REFERENCES Network(id)
+		);
+	`,
 }
 
 type SqliteDB struct {
@@ -341,8 +433,9 @@ func (db *SqliteDB) ListUsers(ctx context.Context) ([]User, error) {
 	defer cancel()
 
 	rows, err := db.db.QueryContext(ctx,
-		`SELECT id, username, password, admin, nick, realname, enabled,
-			downstream_interacted_at
+		`SELECT id, username, password, role, nick, realname, enabled,
+			downstream_interacted_at, relay_detached, reattach_on,
+			detach_after, detach_on, auto_detach_idle, language, dcc_policy
 		FROM User`)
 	if err != nil {
 		return nil, err
@@ -352,15 +445,21 @@ func (db *SqliteDB) ListUsers(ctx context.Context) ([]User, error) {
 	var users []User
 	for rows.Next() {
 		var user User
-		var password, nick, realname sql.NullString
+		var password, role, nick, realname, language, dccPolicy sql.NullString
 		var downstreamInteractedAt sqliteTime
-		if err := rows.Scan(&user.ID, &user.Username, &password, &user.Admin, &nick, &realname, &user.Enabled, &downstreamInteractedAt); err != nil {
+		var detachAfter, autoDetachIdle int64
+		if err := rows.Scan(&user.ID, &user.Username, &password, &role, &nick, &realname, &user.Enabled, &downstreamInteractedAt, &user.RelayDetached, &user.ReattachOn, &detachAfter, &user.DetachOn, &autoDetachIdle, &language, &dccPolicy); err != nil {
 			return nil, err
 		}
 		user.Password = password.String
+		user.Role = Role(role.String)
 		user.Nick = nick.String
 		user.Realname = realname.String
 		user.DownstreamInteractedAt = downstreamInteractedAt.Time
+		user.DetachAfter = time.Duration(detachAfter) * time.Second
+		user.AutoDetachIdle = time.Duration(autoDetachIdle) * time.Second
+		user.Language = language.String
+		user.DCC = DCCPolicy(dccPolicy.String)
 		users = append(users, user)
 	}
 	if err := rows.Err(); err != nil {
@@ -376,21 +475,28 @@ func (db *SqliteDB) GetUser(ctx context.Context, username string) (*User, error)
 
 	user := &User{Username: username}
 
-	var password, nick, realname sql.NullString
+	var password, role, nick, realname, language, dccPolicy sql.NullString
 	var downstreamInteractedAt sqliteTime
+	var detachAfter, autoDetachIdle int64
 	row := db.db.QueryRowContext(ctx,
-		`SELECT id, password, admin, nick, realname, enabled,
-			downstream_interacted_at
+		`SELECT id, password, role, nick, realname, enabled,
+			downstream_interacted_at, relay_detached, reattach_on,
+			detach_after, detach_on, auto_detach_idle, language, dcc_policy
 		FROM User
 		WHERE username = ?`,
 		username)
-	if err := row.Scan(&user.ID, &password, &user.Admin, &nick, &realname, &user.Enabled, &downstreamInteractedAt); err != nil {
+	if err := row.Scan(&user.ID, &password, &role, &nick, &realname, &user.Enabled, &downstreamInteractedAt, &user.RelayDetached, &user.ReattachOn, &detachAfter, &user.DetachOn, &autoDetachIdle, &language, &dccPolicy); err != nil {
 		return nil, err
 	}
 	user.Password = password.String
+	user.Role = Role(role.String)
 	user.Nick = nick.String
 	user.Realname = realname.String
 	user.DownstreamInteractedAt = downstreamInteractedAt.Time
+	user.DetachAfter = time.Duration(detachAfter) * time.Second
+	user.AutoDetachIdle = time.Duration(autoDetachIdle) * time.Second
+	user.Language = language.String
+	user.DCC = DCCPolicy(dccPolicy.String)
 	return user, nil
 }
 
@@ -428,31 +534,46 @@ func (db *SqliteDB) StoreUser(ctx context.Context, user *User) error {
 	args := []interface{}{
 		sql.Named("username", user.Username),
 		sql.Named("password", toNullString(user.Password)),
-		sql.Named("admin", user.Admin),
+		sql.Named("role", toNullString(string(user.Role))),
 		sql.Named("nick", toNullString(user.Nick)),
 		sql.Named("realname", toNullString(user.Realname)),
 		sql.Named("enabled", user.Enabled),
 		sql.Named("now", sqliteTime{time.Now()}),
 		sql.Named("downstream_interacted_at", sqliteTime{user.DownstreamInteractedAt}),
+		sql.Named("relay_detached", user.RelayDetached),
+		sql.Named("reattach_on", user.ReattachOn),
+		sql.Named("detach_after", int64(math.Ceil(user.DetachAfter.Seconds()))),
+		sql.Named("detach_on", user.DetachOn),
+		sql.Named("auto_detach_idle", int64(math.Ceil(user.AutoDetachIdle.Seconds()))),
+		sql.Named("language", toNullString(user.Language)),
+		sql.Named("dcc_policy", toNullString(string(user.DCC))),
 	}
 
 	var err error
 	if user.ID != 0 {
 		_, err = db.db.ExecContext(ctx, `
 			UPDATE User
-			SET password = :password, admin = :admin, nick = :nick,
+			SET password = :password, role = :role, nick = :nick,
 				realname = :realname, enabled = :enabled,
-				downstream_interacted_at = :downstream_interacted_at
+				downstream_interacted_at = :downstream_interacted_at,
+				relay_detached = :relay_detached, reattach_on = :reattach_on,
+				detach_after = :detach_after, detach_on = :detach_on,
+				auto_detach_idle = :auto_detach_idle, language = :language,
+				dcc_policy = :dcc_policy
 			WHERE username = :username`,
 			args...)
 	} else {
 		var res sql.Result
 		res, err = db.db.ExecContext(ctx, `
 			INSERT INTO
-			User(username, password, admin, nick, realname, created_at,
-				enabled, downstream_interacted_at)
-			VALUES (:username, :password, :admin, :nick, :realname, :now,
-				:enabled, :downstream_interacted_at)`,
+			User(username, password, role, nick, realname, created_at,
+				enabled, downstream_interacted_at, relay_detached,
+				reattach_on, detach_after, detach_on, auto_detach_idle,
+				language, dcc_policy)
+			VALUES (:username, :password, :role, :nick, :realname, :now,
+				:enabled, :downstream_interacted_at, :relay_detached,
+				:reattach_on, :detach_after, :detach_on, :auto_detach_idle,
+				:language, :dcc_policy)`,
 			args...)
 		if err != nil {
 			return err
@@ -524,6 +645,44 @@ func (db *SqliteDB) DeleteUser(ctx context.Context, id int64) error {
 		return err
 	}
 
+	_, err = tx.ExecContext(ctx, "DELETE FROM Client WHERE user = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM Highlight
+		WHERE id IN (
+			SELECT Highlight.id
+			FROM Highlight
+			JOIN Network ON Highlight.network = Network.id
+			WHERE Network.user = ?
+		)`, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM OfflineEvent
+		WHERE id IN (
+			SELECT OfflineEvent.id
+			FROM OfflineEvent
+			JOIN Network ON OfflineEvent.network = Network.id
+			WHERE Network.user = ?
+		)`, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM TrafficStats
+		WHERE id IN (
+			SELECT TrafficStats.id
+			FROM TrafficStats
+			JOIN Network ON TrafficStats.network = Network.id
+			WHERE Network.user = ?
+		)`, id)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.ExecContext(ctx, `DELETE FROM Channel
 		WHERE id IN (
 			SELECT Channel.id
@@ -555,7 +714,9 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 	rows, err := db.db.QueryContext(ctx, `
 		SELECT id, name, addr, nick, username, realname, certfp, pass,
 			connect_commands, sasl_mechanism, sasl_plain_username, sasl_plain_password,
-			sasl_external_cert, sasl_external_key, auto_away, enabled
+			sasl_external_cert, sasl_external_key, auto_away, enabled, tls_min_version,
+			sasl_failure, resolver, socket_options, disabled_caps, tofu, tofu_certfp,
+			health_max_lag, health_max_reconnects
 		FROM Network
 		WHERE user = ?`,
 		userID)
@@ -567,11 +728,14 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 	var networks []Network
 	for rows.Next() {
 		var net Network
+		var healthMaxLag int64
 		var name, nick, username, realname, certfp, pass, connectCommands sql.NullString
-		var saslMechanism, saslPlainUsername, saslPlainPassword sql.NullString
+		var saslMechanism, saslPlainUsername, saslPlainPassword, tlsMinVersion, saslFailure, resolver, socketOptions, disabledCaps, tofuCertFP sql.NullString
 		err := rows.Scan(&net.ID, &name, &net.Addr, &nick, &username, &realname, &certfp,
 			&pass, &connectCommands, &saslMechanism, &saslPlainUsername, &saslPlainPassword,
-			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.AutoAway, &net.Enabled)
+			&net.SASL.External.CertBlob, &net.SASL.External.PrivKeyBlob, &net.AutoAway, &net.Enabled,
+			&tlsMinVersion, &saslFailure, &resolver, &socketOptions, &disabledCaps, &net.TOFU, &tofuCertFP,
+			&healthMaxLag, &net.HealthMaxReconnects)
 		if err != nil {
 			return nil, err
 		}
@@ -587,6 +751,15 @@ func (db *SqliteDB) ListNetworks(ctx context.Context, userID int64) ([]Network,
 		net.SASL.Mechanism = saslMechanism.String
 		net.SASL.Plain.Username = saslPlainUsername.String
 		net.SASL.Plain.Password = saslPlainPassword.String
+		net.TLSMinVersion = tlsMinVersion.String
+		net.SASLFailure = SASLFailurePolicy(saslFailure.String)
+		net.Resolver = resolver.String
+		net.SocketOptions = socketOptions.String
+		if disabledCaps.Valid {
+			net.DisabledCaps = strings.Fields(disabledCaps.String)
+		}
+		net.TOFUCertFP = tofuCertFP.String
+		net.HealthMaxLag = time.Duration(healthMaxLag) * time.Second
 		networks = append(networks, net)
 	}
 	if err := rows.Err(); err != nil {
@@ -632,6 +805,15 @@ func (db *SqliteDB) StoreNetwork(ctx context.Context, userID int64, network *Net
 		sql.Named("sasl_external_key", network.SASL.External.PrivKeyBlob),
 		sql.Named("auto_away", network.AutoAway),
 		sql.Named("enabled", network.Enabled),
+		sql.Named("tls_min_version", toNullString(network.TLSMinVersion)),
+		sql.Named("sasl_failure", toNullString(string(network.SASLFailure))),
+		sql.Named("resolver", toNullString(network.Resolver)),
+		sql.Named("socket_options", toNullString(network.SocketOptions)),
+		sql.Named("disabled_caps", toNullString(strings.Join(network.DisabledCaps, " "))),
+		sql.Named("tofu", network.TOFU),
+		sql.Named("tofu_certfp", toNullString(network.TOFUCertFP)),
+		sql.Named("health_max_lag", int64(math.Ceil(network.HealthMaxLag.Seconds()))),
+		sql.Named("health_max_reconnects", network.HealthMaxReconnects),
 
 		sql.Named("id", network.ID), // only for UPDATE
 		sql.Named("user", userID),   // only for INSERT
@@ -645,17 +827,24 @@ func (db *SqliteDB) StoreNetwork(ctx context.Context, userID int64, network *Net
 				realname = :realname, certfp = :certfp, pass = :pass, connect_commands = :connect_commands,
 				sasl_mechanism = :sasl_mechanism, sasl_plain_username = :sasl_plain_username, sasl_plain_password = :sasl_plain_password,
 				sasl_external_cert = :sasl_external_cert, sasl_external_key = :sasl_external_key,
-				auto_away = :auto_away, enabled = :enabled
+				auto_away = :auto_away, enabled = :enabled, tls_min_version = :tls_min_version,
+				sasl_failure = :sasl_failure, resolver = :resolver, socket_options = :socket_options,
+				disabled_caps = :disabled_caps, tofu = :tofu, tofu_certfp = :tofu_certfp,
+				health_max_lag = :health_max_lag, health_max_reconnects = :health_max_reconnects
 			WHERE id = :id`, args...)
 	} else {
 		var res sql.Result
 		res, err = db.db.ExecContext(ctx, `
 			INSERT INTO Network(user, name, addr, nick, username, realname, certfp, pass,
 				connect_commands, sasl_mechanism, sasl_plain_username,
-				sasl_plain_password, sasl_external_cert, sasl_external_key, auto_away, enabled)
+				sasl_plain_password, sasl_external_cert, sasl_external_key, auto_away, enabled,
+				tls_min_version, sasl_failure, resolver, socket_options, disabled_caps,
+				tofu, tofu_certfp, health_max_lag, health_max_reconnects)
 			VALUES (:user, :name, :addr, :nick, :username, :realname, :certfp, :pass,
 				:connect_commands, :sasl_mechanism, :sasl_plain_username,
-				:sasl_plain_password, :sasl_external_cert, :sasl_external_key, :auto_away, :enabled)`,
+				:sasl_plain_password, :sasl_external_cert, :sasl_external_key, :auto_away, :enabled,
+				:tls_min_version, :sasl_failure, :resolver, :socket_options, :disabled_caps,
+				:tofu, :tofu_certfp, :health_max_lag, :health_max_reconnects)`,
 			args...)
 		if err != nil {
 			return err
@@ -700,6 +889,21 @@ func (db *SqliteDB) DeleteNetwork(ctx context.Context, id int64) error {
 		return err
 	}
 
+	_, err = tx.ExecContext(ctx, "DELETE FROM Highlight WHERE network = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM OfflineEvent WHERE network = ?", id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM TrafficStats WHERE network = ?", id)
+	if err != nil {
+		return err
+	}
+
 	_, err = tx.ExecContext(ctx, "DELETE FROM Channel WHERE network = ?", id)
 	if err != nil {
 		return err
@@ -719,7 +923,8 @@ func (db *SqliteDB) ListChannels(ctx context.Context, networkID int64) ([]Channe
 
 	rows, err := db.db.QueryContext(ctx, `SELECT
 			id, name, key, detached, detached_internal_msgid,
-			relay_detached, reattach_on, detach_after, detach_on
+			relay_detached, reattach_on, detach_after, detach_on,
+			highlights, disable_nick_highlight, downstream_interacted_at, topic
 		FROM Channel
 		WHERE network = ?`, networkID)
 	if err != nil {
@@ -730,14 +935,20 @@ func (db *SqliteDB) ListChannels(ctx context.Context, networkID int64) ([]Channe
 	var channels []Channel
 	for rows.Next() {
 		var ch Channel
-		var key, detachedInternalMsgID sql.NullString
+		var key, detachedInternalMsgID, highlights, topic sql.NullString
 		var detachAfter int64
-		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn); err != nil {
+		var downstreamInteractedAt sqliteTime
+		if err := rows.Scan(&ch.ID, &ch.Name, &key, &ch.Detached, &detachedInternalMsgID, &ch.RelayDetached, &ch.ReattachOn, &detachAfter, &ch.DetachOn, &highlights, &ch.DisableNickHighlight, &downstreamInteractedAt, &topic); err != nil {
 			return nil, err
 		}
 		ch.Key = key.String
+		ch.Topic = topic.String
 		ch.DetachedInternalMsgID = detachedInternalMsgID.String
 		ch.DetachAfter = time.Duration(detachAfter) * time.Second
+		ch.DownstreamInteractedAt = downstreamInteractedAt.Time
+		if highlights.Valid {
+			ch.Highlights = strings.Split(highlights.String, "\n")
+		}
 		channels = append(channels, ch)
 	}
 	if err := rows.Err(); err != nil {
@@ -761,6 +972,10 @@ func (db *SqliteDB) StoreChannel(ctx context.Context, networkID int64, ch *Chann
 		sql.Named("reattach_on", ch.ReattachOn),
 		sql.Named("detach_after", int64(math.Ceil(ch.DetachAfter.Seconds()))),
 		sql.Named("detach_on", ch.DetachOn),
+		sql.Named("highlights", toNullString(strings.Join(ch.Highlights, "\n"))),
+		sql.Named("disable_nick_highlight", ch.DisableNickHighlight),
+		sql.Named("downstream_interacted_at", sqliteTime{ch.DownstreamInteractedAt}),
+		sql.Named("topic", toNullString(ch.Topic)),
 
 		sql.Named("id", ch.ID), // only for UPDATE
 	}
@@ -770,12 +985,14 @@ func (db *SqliteDB) StoreChannel(ctx context.Context, networkID int64, ch *Chann
 		_, err = db.db.ExecContext(ctx, `UPDATE Channel
 			SET network = :network, name = :name, key = :key, detached = :detached,
 				detached_internal_msgid = :detached_internal_msgid, relay_detached = :relay_detached,
-				reattach_on = :reattach_on, detach_after = :detach_after, detach_on = :detach_on
+				reattach_on = :reattach_on, detach_after = :detach_after, detach_on = :detach_on,
+				highlights = :highlights, disable_nick_highlight = :disable_nick_highlight,
+				downstream_interacted_at = :downstream_interacted_at, topic = :topic
 			WHERE id = :id`, args...)
 	} else {
 		var res sql.Result
-		res, err = db.db.ExecContext(ctx, `INSERT INTO Channel(network, name, key, detached, detached_internal_msgid, relay_detached, reattach_on, detach_after, detach_on)
-			VALUES (:network, :name, :key, :detached, :detached_internal_msgid, :relay_detached, :reattach_on, :detach_after, :detach_on)`, args...)
+		res, err = db.db.ExecContext(ctx, `INSERT INTO Channel(network, name, key, detached, detached_internal_msgid, relay_detached, reattach_on, detach_after, detach_on, highlights, disable_nick_highlight, downstream_interacted_at, topic)
+			VALUES (:network, :name, :key, :detached, :detached_internal_msgid, :relay_detached, :reattach_on, :detach_after, :detach_on, :highlights, :disable_nick_highlight, :downstream_interacted_at, :topic)`, args...)
 		if err != nil {
 			return err
 		}
@@ -860,6 +1077,92 @@ func (db *SqliteDB) StoreClientDeliveryReceipts(ctx context.Context, networkID i
 	return tx.Commit()
 }
 
+func (db *SqliteDB) GetClient(ctx context.Context, userID int64, name string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	client := &Client{
+		Name: name,
+	}
+
+	var playbackStyle sql.NullString
+	row := db.db.QueryRowContext(ctx, `
+		SELECT id, summary, playback_style FROM Client WHERE user = :user AND name = :name`,
+		sql.Named("user", userID),
+		sql.Named("name", name),
+	)
+	if err := row.Scan(&client.ID, &client.Summary, &playbackStyle); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	client.PlaybackStyle = PlaybackStyle(playbackStyle.String)
+	return client, nil
+}
+
+func (db *SqliteDB) ListClients(ctx context.Context, userID int64) ([]Client, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, name, summary, playback_style FROM Client WHERE user = ? ORDER BY name`,
+		userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []Client
+	for rows.Next() {
+		var client Client
+		var playbackStyle sql.NullString
+		if err := rows.Scan(&client.ID, &client.Name, &client.Summary, &playbackStyle); err != nil {
+			return nil, err
+		}
+		client.PlaybackStyle = PlaybackStyle(playbackStyle.String)
+		clients = append(clients, client)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func (db *SqliteDB) StoreClient(ctx context.Context, userID int64, client *Client) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	args := []interface{}{
+		sql.Named("id", client.ID),
+		sql.Named("user", userID),
+		sql.Named("name", client.Name),
+		sql.Named("summary", client.Summary),
+		sql.Named("playback_style", toNullString(string(client.PlaybackStyle))),
+	}
+
+	var err error
+	if client.ID != 0 {
+		_, err = db.db.ExecContext(ctx, `
+			UPDATE Client SET summary = :summary, playback_style = :playback_style
+			WHERE id = :id`,
+			args...)
+	} else {
+		var res sql.Result
+		res, err = db.db.ExecContext(ctx, `
+			INSERT INTO Client(user, name, summary, playback_style)
+			VALUES (:user, :name, :summary, :playback_style)`,
+			args...)
+		if err != nil {
+			return err
+		}
+		client.ID, err = res.LastInsertId()
+	}
+
+	return err
+}
+
 func (db *SqliteDB) GetReadReceipt(ctx context.Context, networkID int64, name string) (*ReadReceipt, error) {
 	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
 	defer cancel()
@@ -1046,6 +1349,239 @@ func (db *SqliteDB) DeleteWebPushSubscription(ctx context.Context, id int64) err
 	return err
 }
 
+func (db *SqliteDB) ListHighlights(ctx context.Context, userID int64) ([]Highlight, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT h.id, h.network, h.target, h.sender, h.time, h.text, h.msgid
+		FROM Highlight AS h
+		JOIN Network AS n ON h.network = n.id
+		WHERE n.user = ?
+		ORDER BY h.time`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var highlights []Highlight
+	for rows.Next() {
+		var highlight Highlight
+		var t sqliteTime
+		var msgID sql.NullString
+		if err := rows.Scan(&highlight.ID, &highlight.NetworkID, &highlight.Target, &highlight.Sender, &t, &highlight.Text, &msgID); err != nil {
+			return nil, err
+		}
+		highlight.Time = t.Time
+		highlight.MsgID = msgID.String
+		highlights = append(highlights, highlight)
+	}
+
+	return highlights, rows.Err()
+}
+
+func (db *SqliteDB) StoreHighlight(ctx context.Context, networkID int64, highlight *Highlight) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	res, err := db.db.ExecContext(ctx, `
+		INSERT INTO Highlight(network, target, sender, time, text, msgid)
+		VALUES (:network, :target, :sender, :time, :text, :msgid)`,
+		sql.Named("network", networkID),
+		sql.Named("target", highlight.Target),
+		sql.Named("sender", highlight.Sender),
+		sql.Named("time", sqliteTime{highlight.Time}),
+		sql.Named("text", highlight.Text),
+		sql.Named("msgid", toNullString(highlight.MsgID)),
+	)
+	if err != nil {
+		return err
+	}
+	highlight.ID, err = res.LastInsertId()
+	highlight.NetworkID = networkID
+	return err
+}
+
+func (db *SqliteDB) DeleteHighlight(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, "DELETE FROM Highlight WHERE id = ?", id)
+	return err
+}
+
+func (db *SqliteDB) ListOfflineEvents(ctx context.Context, networkID int64) ([]OfflineEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, time, raw
+		FROM OfflineEvent
+		WHERE network = ?
+		ORDER BY time, id`, networkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []OfflineEvent
+	for rows.Next() {
+		var event OfflineEvent
+		var t sqliteTime
+		var raw string
+		if err := rows.Scan(&event.ID, &t, &raw); err != nil {
+			return nil, err
+		}
+		msg, err := irc.ParseMessage(raw)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse offline event: %v", err)
+		}
+		event.NetworkID = networkID
+		event.Time = t.Time
+		event.Message = msg
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func (db *SqliteDB) StoreOfflineEvent(ctx context.Context, networkID int64, event *OfflineEvent) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	res, err := db.db.ExecContext(ctx, `
+		INSERT INTO OfflineEvent(network, time, raw)
+		VALUES (:network, :time, :raw)`,
+		sql.Named("network", networkID),
+		sql.Named("time", sqliteTime{event.Time}),
+		sql.Named("raw", event.Message.String()),
+	)
+	if err != nil {
+		return err
+	}
+	event.ID, err = res.LastInsertId()
+	event.NetworkID = networkID
+	return err
+}
+
+func (db *SqliteDB) DeleteOfflineEvent(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, "DELETE FROM OfflineEvent WHERE id = ?", id)
+	return err
+}
+
+func (db *SqliteDB) ListTrafficStats(ctx context.Context, networkID int64) ([]TrafficStats, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT day, messages_in, messages_out, bytes_in, bytes_out
+		FROM TrafficStats
+		WHERE network = ?
+		ORDER BY day`, networkID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var l []TrafficStats
+	for rows.Next() {
+		var stats TrafficStats
+		var day string
+		if err := rows.Scan(&day, &stats.MessagesIn, &stats.MessagesOut, &stats.BytesIn, &stats.BytesOut); err != nil {
+			return nil, err
+		}
+		stats.Day, err = time.Parse(trafficStatsDayLayout, day)
+		if err != nil {
+			return nil, fmt.Errorf("invalid traffic stats day %q: %v", day, err)
+		}
+		l = append(l, stats)
+	}
+
+	return l, rows.Err()
+}
+
+func (db *SqliteDB) AddTrafficStats(ctx context.Context, networkID int64, stats *TrafficStats) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `
+		INSERT INTO TrafficStats(network, day, messages_in, messages_out, bytes_in, bytes_out)
+		VALUES (:network, :day, :messages_in, :messages_out, :bytes_in, :bytes_out)
+		ON CONFLICT(network, day) DO UPDATE SET
+			messages_in = messages_in + excluded.messages_in,
+			messages_out = messages_out + excluded.messages_out,
+			bytes_in = bytes_in + excluded.bytes_in,
+			bytes_out = bytes_out + excluded.bytes_out`,
+		sql.Named("network", networkID),
+		sql.Named("day", stats.Day.UTC().Format(trafficStatsDayLayout)),
+		sql.Named("messages_in", stats.MessagesIn),
+		sql.Named("messages_out", stats.MessagesOut),
+		sql.Named("bytes_in", stats.BytesIn),
+		sql.Named("bytes_out", stats.BytesOut),
+	)
+	return err
+}
+
+func (db *SqliteDB) ListAnnouncements(ctx context.Context) ([]Announcement, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT id, created_at, text
+		FROM Announcement
+		ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var announcements []Announcement
+	for rows.Next() {
+		var announcement Announcement
+		var createdAt sqliteTime
+		if err := rows.Scan(&announcement.ID, &createdAt, &announcement.Text); err != nil {
+			return nil, err
+		}
+		announcement.CreatedAt = createdAt.Time
+		announcements = append(announcements, announcement)
+	}
+
+	return announcements, rows.Err()
+}
+
+func (db *SqliteDB) StoreAnnouncement(ctx context.Context, announcement *Announcement) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	if announcement.ID != 0 {
+		return fmt.Errorf("cannot update an Announcement")
+	}
+
+	now := time.Now()
+	res, err := db.db.ExecContext(ctx, `
+		INSERT INTO Announcement(created_at, text)
+		VALUES (:now, :text)`,
+		sql.Named("text", announcement.Text),
+		sql.Named("now", sqliteTime{now}))
+	if err != nil {
+		return err
+	}
+	announcement.ID, err = res.LastInsertId()
+	announcement.CreatedAt = now
+	return err
+}
+
+func (db *SqliteDB) DeleteAnnouncement(ctx context.Context, id int64) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, "DELETE FROM Announcement WHERE id = ?", id)
+	return err
+}
+
 func (db *SqliteDB) GetMessageLastID(ctx context.Context, networkID int64, name string) (int64, error) {
 	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
 	defer cancel()
@@ -1093,8 +1629,8 @@ func (db *SqliteDB) StoreMessages(ctx context.Context, networkID int64, name str
 	}
 
 	insertStmt, err := tx.PrepareContext(ctx, `
-		INSERT INTO Message(target, raw, time, sender, text)
-		SELECT id, :raw, :time, :sender, :text
+		INSERT INTO Message(target, raw, time, sender, text, msgid)
+		SELECT id, :raw, :time, :sender, :text, :msgid
 		FROM MessageTarget as t
 		WHERE network = :network AND target = :target`)
 	if err != nil {
@@ -1130,6 +1666,7 @@ func (db *SqliteDB) StoreMessages(ctx context.Context, networkID int64, name str
 			sql.Named("time", sqliteTime{t}),
 			sql.Named("sender", msg.Name),
 			sql.Named("text", text),
+			sql.Named("msgid", toNullString(msg.Tags["msgid"])),
 		)
 		if err != nil {
 			return nil, err
@@ -1151,7 +1688,7 @@ func (db *SqliteDB) ListMessageLastPerTarget(ctx context.Context, networkID int6
 	innerQuery := `
 		SELECT time
 		FROM Message
-		WHERE target = MessageTarget.id `
+		WHERE target = MessageTarget.id AND redacted = 0 `
 	if !options.Events {
 		innerQuery += `AND text IS NOT NULL `
 	}
@@ -1223,7 +1760,8 @@ func (db *SqliteDB) ListMessages(ctx context.Context, networkID int64, name stri
 	query := `
 		SELECT m.raw
 		FROM Message AS m, MessageTarget AS t
-		WHERE m.target = t.id AND t.network = :network AND t.target = :target `
+		WHERE m.target = t.id AND t.network = :network AND t.target = :target
+			AND m.redacted = 0 `
 	if options.AfterID > 0 {
 		query += `AND m.id > :afterID `
 	}
@@ -1238,9 +1776,22 @@ func (db *SqliteDB) ListMessages(ctx context.Context, networkID int64, name stri
 	if options.Sender != "" {
 		query += `AND m.sender = :sender `
 	}
+	if options.ExcludeSender != "" {
+		query += `AND m.sender != :excludeSender `
+	}
 	if options.Text != "" {
 		query += `AND m.id IN (SELECT ROWID FROM MessageFTS WHERE MessageFTS MATCH :text) `
 	}
+	var textContainsArgs []interface{}
+	if len(options.TextContains) > 0 {
+		var conds []string
+		for i, s := range options.TextContains {
+			name := fmt.Sprintf("textContains%d", i)
+			conds = append(conds, `m.text LIKE :`+name+` ESCAPE '\'`)
+			textContainsArgs = append(textContainsArgs, sql.Named(name, "%"+likePatternEscaper.Replace(s)+"%"))
+		}
+		query += `AND (` + strings.Join(conds, " OR ") + `) `
+	}
 	if !options.Events {
 		query += `AND m.text IS NOT NULL `
 	}
@@ -1251,16 +1802,18 @@ func (db *SqliteDB) ListMessages(ctx context.Context, networkID int64, name stri
 	}
 	query += `LIMIT :limit`
 
-	rows, err := db.db.QueryContext(ctx, query,
+	args := append([]interface{}{
 		sql.Named("network", networkID),
 		sql.Named("target", name),
 		sql.Named("afterID", options.AfterID),
 		sql.Named("after", sqliteTime{options.AfterTime}),
 		sql.Named("before", sqliteTime{options.BeforeTime}),
 		sql.Named("sender", options.Sender),
+		sql.Named("excludeSender", options.ExcludeSender),
 		sql.Named("text", quoteFTSQuery(options.Text)),
 		sql.Named("limit", options.Limit),
-	)
+	}, textContainsArgs...)
+	rows, err := db.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -1297,6 +1850,112 @@ func (db *SqliteDB) ListMessages(ctx context.Context, networkID int64, name stri
 
 var ftsQueryTokenEscaper = strings.NewReplacer(`"`, `""`)
 
+func (db *SqliteDB) CountMessagesPerTarget(ctx context.Context, networkID int64, options *MessageCountOptions) ([]MessageTargetCount, error) {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	rows, err := db.db.QueryContext(ctx, `
+		SELECT t.target, COUNT(*)
+		FROM Message AS m, MessageTarget AS t
+		WHERE m.target = t.id AND t.network = :network
+			AND m.redacted = 0 AND m.text IS NOT NULL
+			AND m.id > :afterID AND m.sender != :sender
+		GROUP BY t.target`,
+		sql.Named("network", networkID),
+		sql.Named("afterID", options.AfterID),
+		sql.Named("sender", options.ExcludeSender),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var l []MessageTargetCount
+	for rows.Next() {
+		var count MessageTargetCount
+		if err := rows.Scan(&count.Name, &count.Messages); err != nil {
+			return nil, err
+		}
+		l = append(l, count)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (db *SqliteDB) RedactMessage(ctx context.Context, networkID int64, name, msgID string) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	_, err := db.db.ExecContext(ctx, `
+		UPDATE Message SET redacted = 1
+		WHERE msgid = :msgid AND target = (
+			SELECT id FROM MessageTarget
+			WHERE network = :network AND target = :target
+		)`,
+		sql.Named("network", networkID),
+		sql.Named("target", name),
+		sql.Named("msgid", msgID),
+	)
+	return err
+}
+
+func (db *SqliteDB) RenameMessageTarget(ctx context.Context, networkID int64, oldName, newName string) error {
+	ctx, cancel := context.WithTimeout(ctx, sqliteQueryTimeout)
+	defer cancel()
+
+	tx, err := db.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// The new target may already exist: move the messages instead of renaming
+	// the target, to merge both histories
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO MessageTarget(network, target)
+		VALUES (:network, :new)
+		ON CONFLICT DO NOTHING`,
+		sql.Named("network", networkID),
+		sql.Named("new", newName),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE Message
+		SET target = (
+			SELECT id FROM MessageTarget
+			WHERE network = :network AND target = :new
+		)
+		WHERE target = (
+			SELECT id FROM MessageTarget
+			WHERE network = :network AND target = :old
+		)`,
+		sql.Named("network", networkID),
+		sql.Named("old", oldName),
+		sql.Named("new", newName),
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		DELETE FROM MessageTarget
+		WHERE network = :network AND target = :old`,
+		sql.Named("network", networkID),
+		sql.Named("old", oldName),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func quoteFTSQuery(query string) string {
 	// By default, FTS5 queries have a specific syntax, can include logical operators, ...
 	// In order to mirror the behavior of the other stores, we quote the query so that the string is matched as is.
@@ -2,12 +2,19 @@ CREATE TABLE User (
 	id INTEGER PRIMARY KEY,
 	username TEXT NOT NULL UNIQUE,
 	password TEXT,
-	admin INTEGER NOT NULL DEFAULT 0,
+	role TEXT,
 	realname TEXT,
 	nick TEXT,
 	created_at TEXT NOT NULL,
 	enabled INTEGER NOT NULL DEFAULT 1,
-	downstream_interacted_at TEXT
+	downstream_interacted_at TEXT,
+	relay_detached INTEGER NOT NULL DEFAULT 0,
+	reattach_on INTEGER NOT NULL DEFAULT 0,
+	detach_after INTEGER NOT NULL DEFAULT 0,
+	detach_on INTEGER NOT NULL DEFAULT 0,
+	auto_detach_idle INTEGER NOT NULL DEFAULT 0,
+	language TEXT,
+	dcc_policy TEXT
 );
 
 CREATE TABLE Network (
@@ -28,6 +35,15 @@ CREATE TABLE Network (
 	sasl_external_key BLOB,
 	auto_away INTEGER NOT NULL DEFAULT 1,
 	enabled INTEGER NOT NULL DEFAULT 1,
+	tls_min_version TEXT,
+	sasl_failure TEXT,
+	resolver TEXT,
+	socket_options TEXT,
+	disabled_caps TEXT,
+	tofu INTEGER NOT NULL DEFAULT 0,
+	tofu_certfp TEXT,
+	health_max_lag INTEGER NOT NULL DEFAULT 0,
+	health_max_reconnects INTEGER NOT NULL DEFAULT 0,
 	FOREIGN KEY(user) REFERENCES User(id),
 	UNIQUE(user, addr, nick),
 	UNIQUE(user, name)
@@ -44,6 +60,10 @@ CREATE TABLE Channel (
 	reattach_on INTEGER NOT NULL DEFAULT 0,
 	detach_after INTEGER NOT NULL DEFAULT 0,
 	detach_on INTEGER NOT NULL DEFAULT 0,
+	highlights TEXT,
+	disable_nick_highlight INTEGER NOT NULL DEFAULT 0,
+	downstream_interacted_at TEXT,
+	topic TEXT,
 	FOREIGN KEY(network) REFERENCES Network(id),
 	UNIQUE(network, name)
 );
@@ -58,6 +78,16 @@ CREATE TABLE DeliveryReceipt (
 	UNIQUE(network, target, client)
 );
 
+CREATE TABLE Client (
+	id INTEGER PRIMARY KEY,
+	user INTEGER NOT NULL,
+	name TEXT NOT NULL,
+	summary INTEGER NOT NULL DEFAULT 0,
+	playback_style TEXT,
+	FOREIGN KEY(user) REFERENCES User(id),
+	UNIQUE(user, name)
+);
+
 CREATE TABLE ReadReceipt (
 	id INTEGER PRIMARY KEY,
 	network INTEGER NOT NULL,
@@ -97,9 +127,12 @@ CREATE TABLE Message (
 	time TEXT NOT NULL,
 	sender TEXT NOT NULL,
 	text TEXT,
+	msgid TEXT,
+	redacted INTEGER NOT NULL DEFAULT 0,
 	FOREIGN KEY(target) REFERENCES MessageTarget(id)
 );
 CREATE INDEX MessageIndex ON Message(target, time);
+CREATE INDEX MessageMsgIDIndex ON Message(target, msgid);
 
 CREATE TABLE MessageTarget (
 	id INTEGER PRIMARY KEY,
@@ -124,3 +157,40 @@ CREATE TRIGGER MessageFTSUpdate AFTER UPDATE ON Message BEGIN
 	INSERT INTO MessageFTS(MessageFTS, rowid, text) VALUES ('delete', old.id, old.text);
 	INSERT INTO MessageFTS(rowid, text) VALUES (new.id, new.text);
 END;
+
+CREATE TABLE Announcement (
+	id INTEGER PRIMARY KEY,
+	created_at TEXT NOT NULL,
+	text TEXT NOT NULL
+);
+
+CREATE TABLE Highlight (
+	id INTEGER PRIMARY KEY,
+	network INTEGER NOT NULL,
+	target TEXT NOT NULL,
+	sender TEXT NOT NULL,
+	time TEXT NOT NULL,
+	text TEXT NOT NULL,
+	msgid TEXT,
+	FOREIGN KEY(network) REFERENCES Network(id)
+);
+
+CREATE TABLE OfflineEvent (
+	id INTEGER PRIMARY KEY,
+	network INTEGER NOT NULL,
+	time TEXT NOT NULL,
+	raw TEXT NOT NULL,
+	FOREIGN KEY(network) REFERENCES Network(id)
+);
+
+CREATE TABLE TrafficStats (
+	id INTEGER PRIMARY KEY,
+	network INTEGER NOT NULL,
+	day TEXT NOT NULL,
+	messages_in INTEGER NOT NULL DEFAULT 0,
+	messages_out INTEGER NOT NULL DEFAULT 0,
+	bytes_in INTEGER NOT NULL DEFAULT 0,
+	bytes_out INTEGER NOT NULL DEFAULT 0,
+	FOREIGN KEY(network) REFERENCES Network(id),
+	UNIQUE(network, day)
+);
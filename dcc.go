@@ -0,0 +1,362 @@
+package soju
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/irc.v4"
+
+	"git.sr.ht/~emersion/soju/config"
+	"git.sr.ht/~emersion/soju/database"
+	"git.sr.ht/~emersion/soju/xirc"
+)
+
+// dccDialTimeout is the maximum time to connect to the party which offered a
+// relayed DCC connection.
+const dccDialTimeout = 30 * time.Second
+
+// maxDCCRelaysPerSender is the maximum number of simultaneous relayed DCC
+// offers received from a single IRC user.
+const maxDCCRelaysPerSender = 2
+
+var errDCCByteLimit = errors.New("byte limit reached")
+
+// dccSender identifies the IRC user who sent DCC offers to a bouncer user.
+type dccSender struct {
+	username string
+	nick     string // casemapped
+}
+
+// dccRelay keeps track of the DCC connections relayed by the bouncer. The
+// zero value is ready to use.
+type dccRelay struct {
+	lock     sync.Mutex
+	ports    map[int]struct{}  // listening ports in use
+	sessions map[string]int    // number of relayed connections per username
+	senders  map[dccSender]int // number of relayed incoming offers per sender
+}
+
+// reserve allocates a listening port for a relayed connection of a user.
+// sender is the casemapped nickname of the IRC user who sent the offer, or
+// empty if the offer was sent by the user.
+func (r *dccRelay) reserve(cfg *config.DCCRelay, username, sender string) (net.Listener, int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if r.ports == nil {
+		r.ports = make(map[int]struct{})
+		r.sessions = make(map[string]int)
+		r.senders = make(map[dccSender]int)
+	}
+
+	if cfg.MaxPerUser > 0 && r.sessions[username] >= cfg.MaxPerUser {
+		return nil, 0, serviceErrorf("too many relayed DCC connections")
+	}
+	key := dccSender{username, sender}
+	if sender != "" && r.senders[key] >= maxDCCRelaysPerSender {
+		return nil, 0, serviceErrorf("too many relayed DCC offers from %v", sender)
+	}
+
+	n := cfg.MaxPort - cfg.MinPort + 1
+	offset := rand.Intn(n)
+	for i := 0; i < n; i++ {
+		port := cfg.MinPort + (offset+i)%n
+		if _, ok := r.ports[port]; ok {
+			continue
+		}
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		r.ports[port] = struct{}{}
+		r.sessions[username]++
+		if sender != "" {
+			r.senders[key]++
+		}
+		return ln, port, nil
+	}
+
+	return nil, 0, serviceErrorf("no DCC relay port available")
+}
+
+func (r *dccRelay) release(username, sender string, port int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.ports, port)
+	r.sessions[username]--
+	if r.sessions[username] <= 0 {
+		delete(r.sessions, username)
+	}
+	if sender != "" {
+		key := dccSender{username, sender}
+		r.senders[key]--
+		if r.senders[key] <= 0 {
+			delete(r.senders, key)
+		}
+	}
+}
+
+// relayDCC opens a listening port on behalf of a user. The first connection
+// accepted on the port is relayed to target. The returned address should be
+// advertised in place of target.
+//
+// sender is the casemapped nickname of the IRC user who sent the offer, empty
+// if the offer was sent by the user. If allowed is non-nil, connections from
+// other IP addresses are refused.
+func (s *Server) relayDCC(username, sender, target string, allowed []net.IP, logger Logger) (*net.TCPAddr, error) {
+	cfg := s.Config().DCCRelay
+	if cfg == nil {
+		return nil, serviceErrorf("DCC relaying is disabled on this server")
+	}
+
+	ln, port, err := s.dccRelay.reserve(cfg, username, sender)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Printf("relaying DCC connections from port %v to %v", port, target)
+	go func() {
+		defer s.dccRelay.release(username, sender, port)
+		if err := s.serveDCCRelay(ln, cfg, target, allowed, logger); err != nil {
+			logger.Printf("DCC relay on port %v closed: %v", port, err)
+		} else {
+			logger.Printf("DCC relay on port %v closed", port)
+		}
+	}()
+
+	return &net.TCPAddr{IP: cfg.PublicIP, Port: port}, nil
+}
+
+func (s *Server) serveDCCRelay(ln net.Listener, cfg *config.DCCRelay, target string, allowed []net.IP, logger Logger) error {
+	ln.(*net.TCPListener).SetDeadline(time.Now().Add(cfg.AcceptTimeout))
+	accepted, err := acceptDCCRelay(ln, allowed, logger)
+	ln.Close()
+	if err != nil {
+		return fmt.Errorf("failed to accept connection: %v", err)
+	}
+	defer accepted.Close()
+
+	dialer := net.Dialer{Timeout: dccDialTimeout}
+	dialed, err := dialer.Dial("tcp", target)
+	if err != nil {
+		return fmt.Errorf("failed to connect to %v: %v", target, err)
+	}
+	defer dialed.Close()
+
+	if cfg.MaxDuration > 0 {
+		deadline := time.Now().Add(cfg.MaxDuration)
+		accepted.SetDeadline(deadline)
+		dialed.SetDeadline(deadline)
+	}
+
+	var remaining *atomic.Int64
+	if cfg.MaxBytes > 0 {
+		remaining = new(atomic.Int64)
+		remaining.Store(cfg.MaxBytes)
+	}
+
+	done := make(chan error, 2)
+	copyHalf := func(dst, src net.Conn) {
+		_, err := io.Copy(dst, &dccLimitReader{r: src, remaining: remaining})
+		if err == nil {
+			// Forward the end of the stream, but keep relaying the
+			// other direction
+			if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+				cw.CloseWrite()
+			}
+		}
+		done <- err
+	}
+	go copyHalf(dialed, accepted)
+	go copyHalf(accepted, dialed)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				return err
+			}
+		case <-s.stopCh:
+			return fmt.Errorf("server is shutting down")
+		}
+	}
+	return nil
+}
+
+// acceptDCCRelay accepts the first connection coming from one of the allowed
+// IP addresses. Other connections are closed.
+func acceptDCCRelay(ln net.Listener, allowed []net.IP, logger Logger) (net.Conn, error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil || allowed == nil {
+			return conn, err
+		}
+
+		addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if ok {
+			for _, ip := range allowed {
+				if ip.Equal(addr.IP) {
+					return conn, nil
+				}
+			}
+		}
+
+		logger.Printf("refusing DCC relay connection from unexpected address %v", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// downstreamIPs returns the IP addresses of the downstream connections bound
+// to the network.
+func (uc *upstreamConn) downstreamIPs() []net.IP {
+	var l []net.IP
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		if ip := remoteIP(dc.conn.RemoteAddr()); ip != nil {
+			l = append(l, ip)
+		}
+	})
+	return l
+}
+
+// remoteIP returns the IP address of a remote network address, or nil if
+// there is none.
+func remoteIP(addr net.Addr) net.IP {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+// dccLimitReader reads from r until the shared byte budget is exhausted.
+type dccLimitReader struct {
+	r         io.Reader
+	remaining *atomic.Int64 // nil means no limit
+}
+
+func (lr *dccLimitReader) Read(p []byte) (int, error) {
+	if lr.remaining == nil {
+		return lr.r.Read(p)
+	}
+	left := lr.remaining.Load()
+	if left <= 0 {
+		return 0, errDCCByteLimit
+	}
+	if int64(len(p)) > left {
+		p = p[:left]
+	}
+	n, err := lr.r.Read(p)
+	lr.remaining.Add(-int64(n))
+	return n, err
+}
+
+// isPublicIP checks whether an IP address is globally routable.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate()
+}
+
+func formatDCC(offer *xirc.DCCOffer) string {
+	return "\x01DCC " + offer.String() + "\x01"
+}
+
+// filterIncomingDCC applies the user's DCC policy to a CTCP DCC request
+// received from another IRC user. It returns nil if the message must be
+// dropped.
+func (uc *upstreamConn) filterIncomingDCC(msg *irc.Message, params string) *irc.Message {
+	switch uc.user.DCC {
+	case database.DCCBlock:
+		uc.logger.Printf("dropping DCC request from %q: blocked by user policy", msg.Prefix.Name)
+		return nil
+	case database.DCCRelay:
+		// Handled below
+	default:
+		return msg
+	}
+
+	offer, err := xirc.ParseDCCOffer(params)
+	if err != nil || offer.Port == 0 {
+		// Nothing to connect to, e.g. DCC RESUME or a passive offer
+		return msg
+	}
+
+	// Only the user's clients may connect to the relay: anyone else could
+	// hijack the transfer, or use the bouncer as a proxy to the offered
+	// address
+	allowed := uc.downstreamIPs()
+
+	var addr *net.TCPAddr
+	if !isPublicIP(offer.IP) {
+		err = serviceErrorf("refusing to connect to non-public address %v", offer.IP)
+	} else if len(allowed) == 0 {
+		uc.logger.Printf("dropping DCC request from %q: no client connected", msg.Prefix.Name)
+		return nil
+	} else {
+		target := &net.TCPAddr{IP: offer.IP, Port: offer.Port}
+		addr, err = uc.user.srv.relayDCC(uc.user.Username, uc.network.casemap(msg.Prefix.Name), target.String(), allowed, uc.logger)
+	}
+	if err != nil {
+		uc.logger.Printf("failed to relay DCC %v offer from %q: %v", offer.Type, msg.Prefix.Name, err)
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			sendServiceNOTICE(dc, "failed to relay DCC %v offer from %v: %v", offer.Type, msg.Prefix.Name, err)
+		})
+		return nil
+	}
+
+	offer.IP, offer.Port = addr.IP, addr.Port
+	msg = msg.Copy()
+	msg.Params[1] = formatDCC(offer)
+	return msg
+}
+
+// filterOutgoingDCC applies the user's DCC policy to a CTCP DCC request sent
+// by the client to another IRC user. text is the whole CTCP message and params
+// its parameters. It returns the CTCP message to send.
+func (dc *downstreamConn) filterOutgoingDCC(text, params string) (string, error) {
+	switch dc.user.DCC {
+	case database.DCCBlock:
+		return "", serviceErrorf("DCC requests are blocked by your settings (see user update -dcc)")
+	case database.DCCRelay:
+		// Handled below
+	default:
+		return text, nil
+	}
+
+	offer, err := xirc.ParseDCCOffer(params)
+	if err != nil {
+		// Not an offer, e.g. DCC RESUME
+		return text, nil
+	}
+	cfg := dc.srv.Config().DCCRelay
+	if cfg == nil {
+		return "", serviceErrorf("DCC relaying is disabled on this server")
+	}
+	if offer.Port == 0 {
+		// Passive offer: the address is unused, but hide it anyways
+		offer.IP = cfg.PublicIP
+		return formatDCC(offer), nil
+	}
+
+	// Clients often advertise a private address, connect to the one the
+	// client connected from instead
+	ip := remoteIP(dc.conn.RemoteAddr())
+	if ip == nil {
+		return "", serviceErrorf("cannot determine the client address")
+	}
+
+	target := &net.TCPAddr{IP: ip, Port: offer.Port}
+	addr, err := dc.srv.relayDCC(dc.user.Username, "", target.String(), nil, dc.logger)
+	if err != nil {
+		return "", err
+	}
+
+	offer.IP, offer.Port = addr.IP, addr.Port
+	return formatDCC(offer), nil
+}
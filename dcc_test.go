@@ -0,0 +1,189 @@
+package soju
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+func getFreeTCPPort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to create TCP listener: %v", err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func setTestDCCRelay(srv *Server, relay *config.DCCRelay) {
+	cfg := *srv.Config()
+	cfg.DCCRelay = relay
+	srv.SetConfig(&cfg)
+}
+
+// waitDCCRelayIdle waits for all relayed DCC connections to be closed.
+func waitDCCRelayIdle(t *testing.T, srv *Server) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		srv.dccRelay.lock.Lock()
+		n := len(srv.dccRelay.ports)
+		srv.dccRelay.lock.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v DCC relays to close", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_relayDCC(t *testing.T) {
+	srv := NewServer(nil)
+	srv.Logger = testingLogger{t}
+
+	port := getFreeTCPPort(t)
+	setTestDCCRelay(srv, &config.DCCRelay{
+		PublicIP:      net.IPv4(127, 0, 0, 1),
+		MinPort:       port,
+		MaxPort:       port,
+		MaxBytes:      10,
+		AcceptTimeout: 5 * time.Second,
+		MaxPerUser:    1,
+	})
+
+	target, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to create TCP listener: %v", err)
+	}
+	defer target.Close()
+
+	addr, err := srv.relayDCC("alice", "", target.Addr().String(), nil, srv.Logger)
+	if err != nil {
+		t.Fatalf("failed to relay DCC: %v", err)
+	}
+	defer waitDCCRelayIdle(t, srv)
+	if addr.Port != port {
+		t.Errorf("relay port: got %v, want %v", addr.Port, port)
+	}
+
+	if _, err := srv.relayDCC("alice", "", target.Addr().String(), nil, srv.Logger); err == nil {
+		t.Errorf("relaying more DCC connections than allowed per user succeeded")
+	}
+	if _, err := srv.relayDCC("bob", "", target.Addr().String(), nil, srv.Logger); err == nil {
+		t.Errorf("relaying DCC without an available port succeeded")
+	}
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to connect to relay: %v", err)
+	}
+	defer c.Close()
+
+	relayed, err := target.Accept()
+	if err != nil {
+		t.Fatalf("failed to accept relayed connection: %v", err)
+	}
+	defer relayed.Close()
+
+	exchange := func(src, dst net.Conn, s string) {
+		if _, err := src.Write([]byte(s)); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+		buf := make([]byte, len(s))
+		if _, err := io.ReadFull(dst, buf); err != nil {
+			t.Fatalf("failed to read: %v", err)
+		} else if string(buf) != s {
+			t.Errorf("relayed data: got %q, want %q", buf, s)
+		}
+	}
+	exchange(c, relayed, "hello")
+	exchange(relayed, c, "world")
+
+	// The byte limit is reached, the relay should close both connections
+	relayed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := relayed.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF after reaching the byte limit, got %v", err)
+	}
+}
+
+func TestServer_relayDCCAllowed(t *testing.T) {
+	srv := NewServer(nil)
+	srv.Logger = testingLogger{t}
+
+	port := getFreeTCPPort(t)
+	setTestDCCRelay(srv, &config.DCCRelay{
+		PublicIP:      net.IPv4(127, 0, 0, 1),
+		MinPort:       port,
+		MaxPort:       port,
+		AcceptTimeout: 500 * time.Millisecond,
+	})
+
+	target, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to create TCP listener: %v", err)
+	}
+	defer target.Close()
+
+	allowed := []net.IP{net.IPv4(192, 0, 2, 1)}
+	addr, err := srv.relayDCC("alice", "mallory", target.Addr().String(), allowed, srv.Logger)
+	if err != nil {
+		t.Fatalf("failed to relay DCC: %v", err)
+	}
+	defer waitDCCRelayIdle(t, srv)
+
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatalf("failed to connect to relay: %v", err)
+	}
+	defer c.Close()
+
+	// The connection doesn't come from an allowed address
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF for a connection from an unexpected address, got %v", err)
+	}
+
+	target.(*net.TCPListener).SetDeadline(time.Now().Add(time.Second))
+	if relayed, err := target.Accept(); err == nil {
+		relayed.Close()
+		t.Errorf("connection from an unexpected address relayed")
+	}
+}
+
+func TestDCCRelay_reserve(t *testing.T) {
+	minPort := getFreeTCPPort(t)
+	cfg := &config.DCCRelay{MinPort: minPort, MaxPort: minPort + 10}
+
+	var r dccRelay
+	var ports []int
+	for i := 0; i < maxDCCRelaysPerSender; i++ {
+		ln, port, err := r.reserve(cfg, "alice", "mallory")
+		if err != nil {
+			t.Fatalf("failed to reserve DCC relay port: %v", err)
+		}
+		defer ln.Close()
+		ports = append(ports, port)
+	}
+
+	if _, _, err := r.reserve(cfg, "alice", "mallory"); err == nil {
+		t.Errorf("relaying more DCC offers than allowed per sender succeeded")
+	}
+	ln, port, err := r.reserve(cfg, "alice", "bob")
+	if err != nil {
+		t.Fatalf("failed to reserve DCC relay port for another sender: %v", err)
+	}
+	ln.Close()
+	r.release("alice", "bob", port)
+
+	r.release("alice", "mallory", ports[0])
+	ln, port, err = r.reserve(cfg, "alice", "mallory")
+	if err != nil {
+		t.Fatalf("failed to reserve DCC relay port after release: %v", err)
+	}
+	ln.Close()
+	r.release("alice", "mallory", port)
+}
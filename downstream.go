@@ -18,6 +18,7 @@ import (
 	"gopkg.in/irc.v4"
 
 	"git.sr.ht/~emersion/soju/auth"
+	"git.sr.ht/~emersion/soju/config"
 	"git.sr.ht/~emersion/soju/database"
 	"git.sr.ht/~emersion/soju/msgstore"
 	"git.sr.ht/~emersion/soju/xirc"
@@ -96,7 +97,7 @@ func fillNetworkAddrAttrs(attrs irc.Tags, network *database.Network) {
 
 	hasHostPort := true
 	switch u.Scheme {
-	case "ircs":
+	case "ircs", "irc+starttls":
 		attrs["tls"] = "1"
 	case "irc+insecure":
 		attrs["tls"] = "0"
@@ -187,6 +188,10 @@ func updateNetworkAttrs(record *database.Network, attrs irc.Tags, subcommand str
 	}
 
 	if updateAddr {
+		// The tls attribute can't distinguish STARTTLS from implicit TLS,
+		// keep using STARTTLS unless the client disables TLS
+		starttls := string(addrAttrs["tls"]) == "1" && strings.HasPrefix(record.Addr, "irc+starttls://")
+
 		record.Addr = networkAddrFromAttrs(addrAttrs)
 		if record.Addr == "" {
 			return ircError{&irc.Message{
@@ -194,6 +199,9 @@ func updateNetworkAttrs(record *database.Network, attrs irc.Tags, subcommand str
 				Params:  []string{"BOUNCER", "NEED_ATTRIBUTE", subcommand, "host", "Missing required host attribute"},
 			}}
 		}
+		if starttls {
+			record.Addr = "irc+starttls://" + record.Addr
+		}
 	}
 
 	return nil
@@ -227,6 +235,7 @@ var permanentDownstreamCaps = map[string]string{
 	"server-time":   "",
 	"setname":       "",
 
+	"draft/channel-rename":    "",
 	"draft/pre-away":          "",
 	"draft/read-marker":       "",
 	"draft/no-implicit-names": "",
@@ -234,11 +243,20 @@ var permanentDownstreamCaps = map[string]string{
 	"soju.im/account-required":        "",
 	"soju.im/bouncer-networks":        "",
 	"soju.im/bouncer-networks-notify": "",
+	"soju.im/linelen":                 "",
 	"soju.im/no-implicit-names":       "",
 	"soju.im/read":                    "",
 	"soju.im/webpush":                 "",
+
+	"draft/multiline": fmt.Sprintf("max-bytes=%v,max-lines=%v", maxMultilineBytes, maxMultilineLines),
 }
 
+// Limits of draft/multiline batches sent by clients.
+const (
+	maxMultilineBytes = 4096
+	maxMultilineLines = 100
+)
+
 // needAllDownstreamCaps is the list of downstream capabilities that
 // require support from all upstreams to be enabled.
 var needAllDownstreamCaps = map[string]string{
@@ -251,7 +269,8 @@ var needAllDownstreamCaps = map[string]string{
 	"message-tags":     "",
 	"multi-prefix":     "",
 
-	"draft/extended-monitor": "",
+	"draft/extended-monitor":  "",
+	"draft/message-redaction": "",
 }
 
 // passthroughIsupport is the set of ISUPPORT tokens that are directly passed
@@ -273,7 +292,6 @@ var passthroughIsupport = map[string]bool{
 	"HOSTLEN":       true,
 	"INVEX":         true,
 	"KICKLEN":       true,
-	"LINELEN":       true,
 	"MAXLIST":       true,
 	"MAXTARGETS":    true,
 	"MODES":         true,
@@ -333,10 +351,11 @@ type downstreamConn struct {
 	id uint64
 
 	// These don't change after connection registration
-	registered bool
-	user       *user
-	network    *network // can be nil
-	clientName string
+	registered    bool
+	user          *user
+	network       *network // can be nil
+	clientName    string
+	playbackStyle database.PlaybackStyle
 
 	nick     string
 	nickCM   string
@@ -353,6 +372,11 @@ type downstreamConn struct {
 
 	lastBatchRef uint64
 
+	// draft/multiline batch sent by the client: multilineRef is empty if
+	// none is underway, multiline is nil if the batch has been rejected
+	multiline    *multilineBuffer
+	multilineRef string
+
 	casemap   xirc.CaseMapping
 	monitored xirc.CaseMappingMap[struct{}]
 }
@@ -360,7 +384,10 @@ type downstreamConn struct {
 func newDownstreamConn(srv *Server, ic ircConn, id uint64) *downstreamConn {
 	remoteAddr := ic.RemoteAddr().String()
 	logger := &prefixLogger{srv.Logger, fmt.Sprintf("downstream %q: ", remoteAddr)}
-	options := connOptions{Logger: logger}
+	options := connOptions{
+		Logger:         logger,
+		SendQueueLimit: srv.Config().Limits.DownstreamSendQueue,
+	}
 	cm := xirc.CaseMappingASCII
 	dc := &downstreamConn{
 		conn:         *newConn(srv, ic, &options),
@@ -382,6 +409,13 @@ func newDownstreamConn(srv *Server, ic ircConn, id uint64) *downstreamConn {
 		dc.caps.Available[k] = v
 	}
 	dc.caps.Available["sasl"] = strings.Join(serverSASLMechanisms(dc.srv), ",")
+	if reg := srv.Config().Registration; reg != nil {
+		v := "before-connect,custom-account-name"
+		if reg.Verification != nil {
+			v += ",email-required"
+		}
+		dc.caps.Available["draft/account-registration"] = v
+	}
 	// TODO: this is racy, we should only enable chathistory after
 	// authentication and then check that user.msgStore implements
 	// chatHistoryMessageStore
@@ -389,6 +423,7 @@ func newDownstreamConn(srv *Server, ic ircConn, id uint64) *downstreamConn {
 	case "fs", "db":
 		dc.caps.Available["draft/chathistory"] = ""
 		dc.caps.Available["soju.im/search"] = ""
+		dc.caps.Available["znc.in/playback"] = ""
 	}
 	return dc
 }
@@ -451,12 +486,23 @@ func isOurNick(net *network, nick string) bool {
 }
 
 func (dc *downstreamConn) ReadMessage() (*irc.Message, error) {
-	msg, err := dc.conn.ReadMessage()
-	if err != nil {
-		return nil, err
+	for {
+		msg, err := dc.conn.ReadMessage()
+		if errors.Is(err, errLineTooLong) {
+			// This runs outside of the user goroutine, so we can't access
+			// the current nickname
+			dc.conn.SendMessage(context.TODO(), &irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: xirc.ERR_INPUTTOOLONG,
+				Params:  []string{"*", "Input line was too long"},
+			})
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		dc.srv.metrics.downstreamInMessagesTotal.Inc()
+		return msg, nil
 	}
-	dc.srv.metrics.downstreamInMessagesTotal.Inc()
-	return msg, nil
 }
 
 func (dc *downstreamConn) readMessages(ch chan<- event) error {
@@ -478,6 +524,10 @@ func (dc *downstreamConn) readMessages(ch chan<- event) error {
 //
 // This can only called from the user goroutine.
 func (dc *downstreamConn) SendMessage(ctx context.Context, msg *irc.Message) {
+	if isMultilineMessage(msg) {
+		dc.sendMultiline(ctx, msg)
+		return
+	}
 	if !dc.caps.IsEnabled("message-tags") {
 		if msg.Command == "TAGMSG" {
 			return
@@ -524,6 +574,9 @@ func (dc *downstreamConn) SendMessage(ctx context.Context, msg *irc.Message) {
 	if msg.Command == "READ" && !dc.caps.IsEnabled("soju.im/read") {
 		return
 	}
+	if msg.Command == "REDACT" && !dc.caps.IsEnabled("draft/message-redaction") {
+		return
+	}
 	if msg.Prefix != nil && msg.Prefix.Name == "*" {
 		// We use "*" as a sentinel value to simplify upstream message handling
 		msgCopy := *msg
@@ -537,10 +590,75 @@ func (dc *downstreamConn) SendMessage(ctx context.Context, msg *irc.Message) {
 		msg.Prefix = dc.srv.prefix()
 	}
 
+	if dc.registered {
+		for _, msg := range dc.fitMessage(msg) {
+			dc.srv.metrics.downstreamOutMessagesTotal.Inc()
+			dc.conn.SendMessage(ctx, msg)
+		}
+		return
+	}
+
 	dc.srv.metrics.downstreamOutMessagesTotal.Inc()
 	dc.conn.SendMessage(ctx, msg)
 }
 
+// lineLen returns the maximum length of messages exchanged with the client,
+// excluding their tags. Clients bound to a network which have enabled
+// soju.im/linelen get the upstream limit, other clients get the standard
+// limit.
+func (dc *downstreamConn) lineLen() int {
+	if uc := dc.upstream(); uc != nil && dc.caps.IsEnabled("soju.im/linelen") {
+		return uc.lineLen()
+	}
+	return xirc.DefaultLineLength
+}
+
+// fitMessage makes a message relayed from an upstream server with a larger
+// line length limit than the client's fit in the client's limit. PRIVMSG and
+// NOTICE messages are split, only the first message keeps the msgid tag. The
+// last parameter of other messages is truncated.
+func (dc *downstreamConn) fitMessage(msg *irc.Message) []*irc.Message {
+	lineLen := dc.lineLen()
+	withoutTags := irc.Message{Prefix: msg.Prefix, Command: msg.Command, Params: msg.Params}
+	n := len(withoutTags.String()) + 2
+	if n <= lineLen || len(msg.Params) == 0 {
+		return []*irc.Message{msg}
+	}
+
+	if (msg.Command != "PRIVMSG" && msg.Command != "NOTICE") || len(msg.Params) != 2 {
+		msg = msg.Copy()
+		last := len(msg.Params) - 1
+		msg.Params[last] = xirc.TruncateText(msg.Params[last], len(msg.Params[last])-(n-lineLen))
+		return []*irc.Message{msg}
+	}
+
+	maxLen := xirc.MaxTextLength(msg.Prefix, msg.Command, msg.Params[0], lineLen)
+	chunks := splitText(msg.Params[1], maxLen)
+	msgs := make([]*irc.Message, len(chunks))
+	for i, chunk := range chunks {
+		msgs[i] = msg.Copy()
+		msgs[i].Params[1] = chunk
+		if i > 0 {
+			delete(msgs[i].Tags, "msgid")
+		}
+	}
+	return msgs
+}
+
+// updateLineLen applies a change of the client's line length limit, and
+// advertises it to the client.
+func (dc *downstreamConn) updateLineLen(ctx context.Context) {
+	dc.conn.SetMaxLineLength(dc.lineLen())
+
+	token := "-LINELEN"
+	if lineLen := dc.lineLen(); lineLen != xirc.DefaultLineLength {
+		token = fmt.Sprintf("LINELEN=%v", lineLen)
+	}
+	for _, msg := range xirc.GenerateIsupport([]string{token}) {
+		dc.SendMessage(ctx, msg)
+	}
+}
+
 func (dc *downstreamConn) SendBatch(ctx context.Context, typ string, params []string, tags irc.Tags, f func(batchRef string)) {
 	dc.lastBatchRef++
 	ref := fmt.Sprintf("%v", dc.lastBatchRef)
@@ -563,11 +681,34 @@ func (dc *downstreamConn) SendBatch(ctx context.Context, typ string, params []st
 	}
 }
 
+// sendMultiline sends a message whose text contains line breaks, as a
+// draft/multiline batch if supported by the client, or as one message per line
+// otherwise.
+func (dc *downstreamConn) sendMultiline(ctx context.Context, msg *irc.Message) {
+	var msgs []*irc.Message
+	if dc.caps.IsEnabled("draft/multiline") && dc.caps.IsEnabled("batch") {
+		dc.lastBatchRef++
+		ref := fmt.Sprintf("%v", dc.lastBatchRef)
+		msgs = xirc.GenerateMultilineBatch(ref, msg, 0)
+	} else {
+		msgs = flattenMultilineMessage(msg)
+	}
+	for _, msg := range msgs {
+		dc.SendMessage(ctx, msg)
+	}
+}
+
+// fetchesHistory checks whether the client fetches history on its own, in
+// which case backlog isn't sent automatically.
+func (dc *downstreamConn) fetchesHistory() bool {
+	return dc.caps.IsEnabled("draft/chathistory") || dc.caps.IsEnabled("znc.in/playback")
+}
+
 // sendMessageWithID sends an outgoing message with the specified internal ID.
 func (dc *downstreamConn) sendMessageWithID(ctx context.Context, msg *irc.Message, id string) {
 	dc.SendMessage(ctx, msg)
 
-	if id == "" || !dc.messageSupportsBacklog(msg) || dc.caps.IsEnabled("draft/chathistory") {
+	if id == "" || !dc.messageSupportsBacklog(msg) || dc.fetchesHistory() {
 		return
 	}
 
@@ -578,7 +719,7 @@ func (dc *downstreamConn) sendMessageWithID(ctx context.Context, msg *irc.Messag
 // sending a message. This is useful e.g. for self-messages when echo-message
 // isn't enabled.
 func (dc *downstreamConn) advanceMessageWithID(ctx context.Context, msg *irc.Message, id string) {
-	if id == "" || !dc.messageSupportsBacklog(msg) || dc.caps.IsEnabled("draft/chathistory") {
+	if id == "" || !dc.messageSupportsBacklog(msg) || dc.fetchesHistory() {
 		return
 	}
 
@@ -662,6 +803,15 @@ func (dc *downstreamConn) handleMessageUnregistered(ctx context.Context, msg *ir
 			break
 		}
 
+		if !dc.srv.allowLogin(dc.conn.RemoteAddr()) {
+			dc.logger.Printf("SASL %v authentication error for nick %q: too many login attempts", credentials.mechanism, dc.registration.nick)
+			dc.endSASL(ctx, &irc.Message{
+				Command: irc.ERR_SASLFAIL,
+				Params:  []string{dc.nick, "Too many login attempts, try again later"},
+			})
+			break
+		}
+
 		var username, clientName, networkName string
 		switch credentials.mechanism {
 		case "PLAIN":
@@ -757,6 +907,13 @@ func (dc *downstreamConn) handleMessageUnregistered(ctx context.Context, msg *ir
 		}
 
 		dc.SendMessage(ctx, generateAwayReply(dc.away != nil))
+	case "REGISTER", "VERIFY":
+		reg := dc.srv.Config().Registration
+		if reg == nil {
+			dc.logger.Debugf("unhandled message: %v", msg)
+			return newUnknownCommandError(msg.Command)
+		}
+		return dc.handleAccountRegistration(ctx, reg, msg)
 	default:
 		dc.logger.Debugf("unhandled message: %v", msg)
 		return newUnknownCommandError(msg.Command)
@@ -764,6 +921,95 @@ func (dc *downstreamConn) handleMessageUnregistered(ctx context.Context, msg *ir
 	return nil
 }
 
+// handleAccountRegistration handles REGISTER and VERIFY commands sent before
+// connection registration, used to create a new bouncer account.
+func (dc *downstreamConn) handleAccountRegistration(ctx context.Context, reg *config.Registration, msg *irc.Message) error {
+	var account string
+	if err := parseMessageParams(msg, &account); err != nil {
+		return err
+	}
+	if account == "*" {
+		account = dc.registration.nick
+	}
+	if account == "" || account == "*" {
+		return ircError{&irc.Message{
+			Command: "FAIL",
+			Params:  []string{msg.Command, "NEED_NICK", "*", "Missing nickname"},
+		}}
+	}
+
+	if dc.registration.authUsername != "" {
+		return ircError{&irc.Message{
+			Command: "FAIL",
+			Params:  []string{msg.Command, "ALREADY_AUTHENTICATED", account, "Already authenticated"},
+		}}
+	}
+
+	var err error
+	switch msg.Command {
+	case "REGISTER":
+		var email, password string
+		if err := parseMessageParams(msg, nil, &email, &password); err != nil {
+			return err
+		}
+
+		if !dc.srv.allowRegistration(dc.conn.RemoteAddr(), reg) {
+			dc.logger.Printf("too many registration attempts")
+			err = &accountRegistrationError{"TEMPORARILY_UNAVAILABLE", "Too many registration attempts, try again later"}
+			break
+		}
+
+		var verified bool
+		verified, err = dc.srv.registerUser(ctx, reg, account, email, password)
+		if err != nil {
+			break
+		}
+		if !verified {
+			dc.logger.Printf("registered user %q, pending verification", account)
+			dc.SendMessage(ctx, &irc.Message{
+				Prefix:  dc.srv.prefix(),
+				Command: "REGISTER",
+				Params:  []string{"VERIFICATION_REQUIRED", account, fmt.Sprintf("Account created, pending verification: a code has been sent to %v", email)},
+			})
+			return nil
+		}
+	case "VERIFY":
+		var code string
+		if err := parseMessageParams(msg, nil, &code); err != nil {
+			return err
+		}
+
+		if !dc.srv.allowLogin(dc.conn.RemoteAddr()) {
+			dc.logger.Printf("too many verification attempts")
+			err = &accountRegistrationError{"TEMPORARILY_UNAVAILABLE", "Too many verification attempts, try again later"}
+			break
+		}
+
+		err = dc.srv.verifyRegistration(ctx, account, code)
+	}
+
+	if err != nil {
+		var regErr *accountRegistrationError
+		if !errors.As(err, &regErr) {
+			dc.logger.Printf("%v for user %q failed: %v", msg.Command, account, err)
+			regErr = &accountRegistrationError{"TEMPORARILY_UNAVAILABLE", "Internal server error"}
+		}
+		return ircError{&irc.Message{
+			Command: "FAIL",
+			Params:  []string{msg.Command, regErr.code, account, regErr.message},
+		}}
+	}
+
+	dc.logger.Printf("registered user %q", account)
+	dc.setAuthUsername(account, "", "")
+	dc.SendMessage(ctx, &irc.Message{
+		Prefix:  dc.srv.prefix(),
+		Command: msg.Command,
+		Params:  []string{"SUCCESS", account, "Account successfully registered"},
+	})
+	return nil
+}
+
 func (dc *downstreamConn) handleCap(ctx context.Context, msg *irc.Message) error {
 	var cmd string
 	if err := parseMessageParams(msg, &cmd); err != nil {
@@ -883,6 +1129,10 @@ func (dc *downstreamConn) handleCap(ctx context.Context, msg *irc.Message) error
 			Params:  []string{dc.nick, reply, args[0]},
 		})
 
+		if _, ok := m["soju.im/linelen"]; ok && ack && dc.registered {
+			dc.updateLineLen(ctx)
+		}
+
 		if !dc.registered {
 			dc.registration.negotiatingCaps = true
 		}
@@ -1304,6 +1554,14 @@ func (dc *downstreamConn) register(ctx context.Context) error {
 			}}
 		}
 
+		if !dc.srv.allowLogin(dc.conn.RemoteAddr()) {
+			dc.logger.Printf("too many login attempts")
+			return ircError{&irc.Message{
+				Command: irc.ERR_PASSWDMISMATCH,
+				Params:  []string{dc.nick, "Too many login attempts, try again later"},
+			}}
+		}
+
 		username, clientName, networkName := unmarshalUsername(dc.registration.username)
 		if err := plainAuth.AuthPlain(ctx, dc.srv.db, username, password); err != nil {
 			dc.logger.Printf("PASS authentication error for user %q: %v", dc.registration.username, err)
@@ -1477,6 +1735,10 @@ func (dc *downstreamConn) welcome(ctx context.Context, user *user) error {
 			isupport = append(isupport, "CLIENTTAGDENY=*")
 		}
 
+		if lineLen := dc.lineLen(); lineLen != xirc.DefaultLineLength {
+			isupport = append(isupport, fmt.Sprintf("LINELEN=%v", lineLen))
+		}
+
 		for k := range passthroughIsupport {
 			v, ok := uc.isupport[k]
 			if !ok {
@@ -1505,13 +1767,14 @@ func (dc *downstreamConn) welcome(ctx context.Context, user *user) error {
 	for _, msg := range xirc.GenerateIsupport(isupport) {
 		dc.SendMessage(ctx, msg)
 	}
+	dc.conn.SetMaxLineLength(dc.lineLen())
 	if uc := dc.upstream(); uc != nil {
 		dc.SendMessage(ctx, &irc.Message{
 			Command: irc.RPL_UMODEIS,
 			Params:  []string{dc.nick, "+" + string(uc.modes)},
 		})
 	}
-	if dc.network == nil && dc.user.Admin {
+	if dc.network == nil && hasPermission(dc.user.Role, permissionOperator) {
 		dc.SendMessage(ctx, &irc.Message{
 			Command: irc.RPL_UMODEIS,
 			Params:  []string{dc.nick, "+o"},
@@ -1523,18 +1786,14 @@ func (dc *downstreamConn) welcome(ctx context.Context, user *user) error {
 	dc.updateAccount(ctx)
 	dc.updateCasemapping()
 
-	if motd := dc.user.srv.Config().MOTD; motd != "" && dc.network == nil {
-		for _, msg := range xirc.GenerateMOTD(motd) {
+	if dc.network == nil {
+		for _, msg := range xirc.GenerateMOTD(dc.user.motd()) {
 			dc.SendMessage(ctx, msg)
 		}
 	} else {
-		motdHint := "No MOTD"
-		if dc.network != nil {
-			motdHint = "Use /motd to read the message of the day"
-		}
 		dc.SendMessage(ctx, &irc.Message{
 			Command: irc.ERR_NOMOTD,
-			Params:  []string{dc.nick, motdHint},
+			Params:  []string{dc.nick, "Use /motd to read the message of the day"},
 		})
 	}
 
@@ -1572,8 +1831,20 @@ func (dc *downstreamConn) welcome(ctx context.Context, user *user) error {
 		})
 	})
 
+	// Computed before the backlog fast-forwards delivery receipts
+	summary := dc.summarizeMissedActivity(ctx)
+
+	if dc.clientName != "" && dc.user.msgStore != nil && !dc.fetchesHistory() {
+		client, err := dc.srv.db.GetClient(ctx, dc.user.ID, dc.clientName)
+		if err != nil {
+			dc.logger.Printf("failed to get client settings: %v", err)
+		} else if client != nil {
+			dc.playbackStyle = client.PlaybackStyle
+		}
+	}
+
 	dc.forEachNetwork(func(net *network) {
-		if dc.caps.IsEnabled("draft/chathistory") || dc.user.msgStore == nil {
+		if dc.fetchesHistory() || dc.user.msgStore == nil {
 			return
 		}
 
@@ -1606,6 +1877,10 @@ func (dc *downstreamConn) welcome(ctx context.Context, user *user) error {
 		}
 	})
 
+	for _, line := range summary {
+		sendServiceNOTICE(dc, "%v", line)
+	}
+
 	return nil
 }
 
@@ -1623,7 +1898,7 @@ func (dc *downstreamConn) messageSupportsBacklog(msg *irc.Message) bool {
 }
 
 func (dc *downstreamConn) sendTargetBacklog(ctx context.Context, net *network, target, msgID string) {
-	if dc.caps.IsEnabled("draft/chathistory") || dc.user.msgStore == nil {
+	if dc.fetchesHistory() || dc.user.msgStore == nil {
 		return
 	}
 
@@ -1651,6 +1926,7 @@ func (dc *downstreamConn) sendTargetBacklog(ctx context.Context, net *network, t
 					dc.relayDetachedMessage(net, msg)
 				}
 			} else {
+				msg = dc.applyPlaybackStyle(msg)
 				msg.Tags["batch"] = batchRef
 				dc.SendMessage(ctx, msg)
 			}
@@ -1658,22 +1934,83 @@ func (dc *downstreamConn) sendTargetBacklog(ctx context.Context, net *network, t
 	})
 }
 
+// replayHistory sends messages requested via BouncerServ to the client.
+func (dc *downstreamConn) replayHistory(ctx context.Context, target string, history []*irc.Message) {
+	dc.SendBatch(ctx, "chathistory", []string{target}, nil, func(batchRef string) {
+		for _, msg := range history {
+			msg = dc.applyPlaybackStyle(msg)
+			msg.Tags["batch"] = batchRef
+			dc.SendMessage(ctx, msg)
+		}
+	})
+}
+
+// applyPlaybackStyle adjusts a replayed message so that clients which don't
+// support server-time can tell it apart from live messages.
+func (dc *downstreamConn) applyPlaybackStyle(msg *irc.Message) *irc.Message {
+	if dc.caps.IsEnabled("server-time") || len(msg.Params) < 2 {
+		return msg
+	}
+
+	switch dc.playbackStyle {
+	case database.PlaybackNotice:
+		if msg.Command != "PRIVMSG" {
+			return msg
+		}
+		msg = msg.Copy()
+		msg.Command = "NOTICE"
+	case database.PlaybackPrefixed:
+		t, err := time.Parse(xirc.ServerTimeLayout, string(msg.Tags["time"]))
+		if err != nil {
+			return msg
+		}
+		prefix := "[" + t.Local().Format("15:04:05") + "] "
+
+		msg = msg.Copy()
+		text := msg.Params[1]
+		if strings.HasPrefix(text, "\x01ACTION ") {
+			text = "\x01ACTION " + prefix + strings.TrimPrefix(text, "\x01ACTION ")
+		} else if !strings.HasPrefix(text, "\x01") {
+			text = prefix + text
+		}
+		msg.Params[1] = text
+	}
+	return msg
+}
+
 func (dc *downstreamConn) relayDetachedMessage(net *network, msg *irc.Message) {
+	if msg.Command == "TOPIC" {
+		channel := msg.Params[0]
+		if len(msg.Params) > 1 && msg.Params[1] != "" {
+			sendServiceNOTICE(dc, "topic in %v changed by %v: %v", channel, msg.Prefix.Name, msg.Params[1])
+		} else {
+			sendServiceNOTICE(dc, "topic in %v cleared by %v", channel, msg.Prefix.Name)
+		}
+		return
+	}
 	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
 		return
 	}
 
 	sender := msg.Prefix.Name
 	target, text := msg.Params[0], msg.Params[1]
-	if net.isHighlight(msg) {
-		sendServiceNOTICE(dc, fmt.Sprintf("highlight in %v: <%v> %v", target, sender, text))
+	if net.isChannelHighlight(net.channels.Get(target), msg) {
+		sendServiceNOTICE(dc, "highlight in %v: <%v> %v", target, sender, text)
 	} else {
-		sendServiceNOTICE(dc, fmt.Sprintf("message in %v: <%v> %v", target, sender, text))
+		sendServiceNOTICE(dc, "message in %v: <%v> %v", target, sender, text)
 	}
 }
 
 func (dc *downstreamConn) runUntilRegistered() error {
-	ctx, cancel := context.WithTimeout(context.TODO(), downstreamRegisterTimeout)
+	var (
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+	if timeout := dc.srv.Config().DownstreamRegisterTimeout; timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.TODO(), timeout)
+	} else {
+		ctx, cancel = context.WithCancel(context.TODO())
+	}
 	defer cancel()
 
 	// Close the connection with an error if the deadline is exceeded
@@ -1714,8 +2051,96 @@ func (dc *downstreamConn) runUntilRegistered() error {
 	return nil
 }
 
+func newMultilineError(code string, params ...string) ircError {
+	return ircError{&irc.Message{
+		Command: "FAIL",
+		Params:  append([]string{"BATCH", code}, params...),
+	}}
+}
+
+func (dc *downstreamConn) handleBatch(ctx context.Context, msg *irc.Message) error {
+	var tag string
+	if err := parseMessageParams(msg, &tag); err != nil {
+		return err
+	}
+
+	if strings.HasPrefix(tag, "+") {
+		var batchType, target string
+		if err := parseMessageParams(msg, nil, &batchType); err != nil {
+			return err
+		}
+		if batchType != "draft/multiline" || !dc.caps.IsEnabled("draft/multiline") {
+			return newMultilineError("UNKNOWN_TYPE", batchType, "Unsupported batch type")
+		}
+		if err := parseMessageParams(msg, nil, nil, &target); err != nil {
+			return err
+		}
+		if dc.multilineRef != "" {
+			dc.multiline = nil
+			return newMultilineError("MULTILINE_INVALID", "Nested multiline batches are not supported")
+		}
+		dc.multilineRef = tag[1:]
+		dc.multiline = &multilineBuffer{target: target, tags: msg.Tags}
+		return nil
+	} else if strings.HasPrefix(tag, "-") {
+		if dc.multilineRef == "" || tag[1:] != dc.multilineRef {
+			return newMultilineError("MULTILINE_INVALID", "Unknown batch reference tag")
+		}
+		buf := dc.multiline
+		dc.multiline = nil
+		dc.multilineRef = ""
+		if buf == nil {
+			return nil // batch already rejected
+		}
+		logical := buf.message()
+		if logical == nil {
+			return newMultilineError("MULTILINE_INVALID", "Empty multiline batch")
+		}
+		return dc.handleMessageRegistered(ctx, logical)
+	} else {
+		return newMultilineError("MULTILINE_INVALID", "Missing +/- prefix in batch reference tag")
+	}
+}
+
+// handleMultilineMessage handles a message which is part of a draft/multiline
+// batch sent by the client.
+func (dc *downstreamConn) handleMultilineMessage(msg *irc.Message) error {
+	buf := dc.multiline
+	if buf == nil {
+		return nil // batch already rejected
+	}
+
+	var target string
+	if len(msg.Params) > 0 {
+		target = msg.Params[0]
+	}
+	if target != buf.target {
+		dc.multiline = nil
+		return newMultilineError("MULTILINE_INVALID_TARGET", buf.target, target, "Invalid multiline target")
+	}
+	if err := buf.add(msg); err != nil {
+		dc.multiline = nil
+		return newMultilineError("MULTILINE_INVALID", err.Error())
+	}
+	if buf.lines > maxMultilineLines {
+		dc.multiline = nil
+		return newMultilineError("MULTILINE_MAX_LINES", strconv.Itoa(maxMultilineLines), "Multiline batch max-lines exceeded")
+	}
+	if buf.text.Len() > maxMultilineBytes {
+		dc.multiline = nil
+		return newMultilineError("MULTILINE_MAX_BYTES", strconv.Itoa(maxMultilineBytes), "Multiline batch max-bytes exceeded")
+	}
+	return nil
+}
+
 func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.Message) error {
+	if dc.multilineRef != "" && msg.Tags["batch"] == dc.multilineRef {
+		return dc.handleMultilineMessage(msg)
+	}
+
 	switch msg.Command {
+	case "BATCH":
+		return dc.handleBatch(ctx, msg)
 	case "CAP":
 		return dc.handleCap(ctx, msg)
 	case "PING":
@@ -1931,6 +2356,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				}
 				uc.network.channels.Set(ch.Name, ch)
 			}
+			ch.DownstreamInteractedAt = time.Now()
 			if err := dc.srv.db.StoreChannel(ctx, uc.network.ID, ch); err != nil {
 				dc.logger.Printf("failed to create or update channel %q: %v", name, err)
 			}
@@ -2156,7 +2582,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 		if dc.network == nil && maskCM == dc.nickCM {
 			// TODO: support AWAY (H/G) in self WHO reply
 			flags := "H"
-			if dc.user.Admin {
+			if hasPermission(dc.user.Role, permissionOperator) {
 				flags += "*"
 			}
 			info := xirc.WHOXInfo{
@@ -2269,7 +2695,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				Command: irc.RPL_WHOISSERVER,
 				Params:  []string{dc.nick, dc.nick, dc.srv.Config().Hostname, "soju"},
 			})
-			if dc.user.Admin {
+			if hasPermission(dc.user.Role, permissionOperator) {
 				dc.SendMessage(ctx, &irc.Message{
 					Command: irc.RPL_WHOISOPERATOR,
 					Params:  []string{dc.nick, dc.nick, "is a bouncer administrator"},
@@ -2342,7 +2768,7 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			if name == "$"+dc.srv.Config().Hostname || (name == "$*" && dc.network == nil) {
 				// "$" means a server mask follows. If it's the bouncer's
 				// hostname, broadcast the message to all bouncer users.
-				if !dc.user.Admin {
+				if !hasPermission(dc.user.Role, permissionBroadcast) {
 					return ircError{&irc.Message{
 						Command: irc.ERR_BADMASK,
 						Params:  []string{dc.nick, name, "Permission denied to broadcast message to all bouncer users"},
@@ -2375,6 +2801,23 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				continue
 			}
 
+			if dc.caps.IsEnabled("znc.in/playback") && dc.casemap(name) == playbackNickCM {
+				if msg.Command == "PRIVMSG" {
+					if err := dc.handlePlaybackPRIVMSG(ctx, text); err != nil {
+						sendPlaybackPRIVMSG(dc, fmt.Sprintf("error: %v", err))
+					}
+				}
+				continue
+			}
+
+			if strings.HasPrefix(name, "*") {
+				// ZNC module pseudo-users, e.g. *status
+				if msg.Command == "PRIVMSG" {
+					dc.handleStatusPRIVMSG(ctx, name, text)
+				}
+				continue
+			}
+
 			if dc.casemap(name) == serviceNickCM {
 				if dc.caps.IsEnabled("echo-message") {
 					echoTags := tags.Copy()
@@ -2386,19 +2829,32 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 						Params:  params,
 					})
 				}
+				if cmd, _, ok := xirc.ParseCTCPMessage(&irc.Message{Command: msg.Command, Params: params}); ok && cmd == "PING" {
+					// Reply immediately, so that clients can measure the lag
+					// to the bouncer
+					if msg.Command == "PRIVMSG" {
+						sendServiceNOTICE(dc, "%v", text)
+					}
+					continue
+				}
 				if msg.Command == "PRIVMSG" {
-					if err := handleServicePRIVMSG(&serviceContext{
-						Context: ctx,
-						nick:    dc.nick,
-						network: dc.network,
-						user:    dc.user,
-						srv:     dc.user.srv,
-						admin:   dc.user.Admin,
-						print: func(text string) {
-							sendServicePRIVMSG(dc, text)
-						},
-					}, text); err != nil {
-						sendServicePRIVMSG(dc, fmt.Sprintf("error: %v", err))
+					reply := func(text string) {
+						sendServicePRIVMSG(dc, text)
+					}
+					svcCtx := &serviceContext{
+						Context:    ctx,
+						nick:       dc.nick,
+						network:    dc.network,
+						user:       dc.user,
+						downstream: dc,
+						srv:        dc.user.srv,
+						role:       dc.user.Role,
+						print:      reply,
+						printLater: reply,
+						catalog:    catalogs[dc.user.Language],
+					}
+					if err := handleServicePRIVMSG(svcCtx, text); err != nil {
+						sendServicePRIVMSG(dc, svcCtx.sprintf("error: %v", err))
 					}
 				}
 				continue
@@ -2413,21 +2869,23 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				dc.handleNickServPRIVMSG(ctx, uc, text)
 			}
 
-			upstreamParams := []string{name}
-			if msg.Command != "TAGMSG" {
-				upstreamParams = append(upstreamParams, text)
+			text := text
+			if cmd, dccParams, ok := xirc.ParseCTCPMessage(&irc.Message{Command: msg.Command, Params: params}); ok && cmd == "DCC" && msg.Command == "PRIVMSG" {
+				text, err = dc.filterOutgoingDCC(text, dccParams)
+				if err != nil {
+					sendServiceNOTICE(dc, "cannot send DCC request to %v: %v", name, err)
+					continue
+				}
 			}
 
-			uc.SendMessageLabeled(ctx, dc.id, &irc.Message{
-				Tags:    tags,
-				Command: msg.Command,
-				Params:  upstreamParams,
-			})
-
 			// If the upstream supports echo message, we'll produce the message
 			// when it is echoed from the upstream.
 			// Otherwise, produce/log it here because it's the last time we'll see it.
-			if !uc.caps.IsEnabled("echo-message") {
+			echo := func(text string) {
+				if uc.caps.IsEnabled("echo-message") {
+					return
+				}
+
 				echoParams := []string{name}
 				if msg.Command != "TAGMSG" {
 					echoParams = append(echoParams, text)
@@ -2451,7 +2909,79 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				uc.produce(name, echoMsg, dc.id)
 			}
 
+			if msg.Command != "TAGMSG" && strings.Contains(text, "\n") && uc.sendMultilineLabeled(ctx, dc.id, &irc.Message{
+				Tags:    tags.Copy(),
+				Command: msg.Command,
+				Params:  []string{name, text},
+			}) {
+				echo(text)
+			} else {
+				// Long messages are split so that the server doesn't
+				// truncate them, multiline messages are sent line by line
+				chunks := []string{text}
+				if msg.Command != "TAGMSG" {
+					chunks = nil
+					for _, line := range strings.Split(text, "\n") {
+						if line != "" {
+							chunks = append(chunks, uc.splitText(msg.Command, name, line)...)
+						}
+					}
+				}
+
+				for _, chunk := range chunks {
+					upstreamParams := []string{name}
+					if msg.Command != "TAGMSG" {
+						upstreamParams = append(upstreamParams, chunk)
+					}
+
+					uc.SendMessageLabeled(ctx, dc.id, &irc.Message{
+						Tags:    tags.Copy(),
+						Command: msg.Command,
+						Params:  upstreamParams,
+					})
+					echo(chunk)
+				}
+			}
+
 			uc.updateChannelAutoDetach(name)
+			uc.network.bumpChannelInteractionTime(ctx, name)
+		}
+	case "REDACT":
+		var target, redactedID string
+		if err := parseMessageParams(msg, &target, &redactedID); err != nil {
+			return err
+		}
+
+		uc, err := dc.upstreamForCommand(msg.Command)
+		if err != nil {
+			return err
+		}
+		if !uc.caps.IsEnabled("draft/message-redaction") {
+			return ircError{&irc.Message{
+				Command: "FAIL",
+				Params:  []string{"REDACT", "REDACT_FORBIDDEN", target, redactedID, "Message redaction is not supported by the server"},
+			}}
+		}
+
+		uc.SendMessageLabeled(ctx, dc.id, &irc.Message{
+			Command: "REDACT",
+			Params:  msg.Params,
+		})
+
+		// Without echo-message, the server won't send the REDACT back: apply
+		// it right away
+		if !uc.caps.IsEnabled("echo-message") {
+			uc.redactMessage(target, redactedID)
+			uc.produce(target, &irc.Message{
+				Tags: irc.Tags{"time": dc.user.FormatServerTime(time.Now())},
+				Prefix: &irc.Prefix{
+					Name: uc.nick,
+					User: uc.username,
+					Host: uc.hostname,
+				},
+				Command: "REDACT",
+				Params:  msg.Params,
+			}, dc.id)
 		}
 	case "INVITE":
 		uc, err := dc.upstreamForCommand(msg.Command)
@@ -2884,6 +3414,11 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 			}
 		}
 
+		if broadcast {
+			network.bumpChannelInteractionTime(ctx, target)
+			dc.user.clearReadHighlights(ctx, network, target, r.Timestamp)
+		}
+
 		timestampStr := "*"
 		if !r.Timestamp.IsZero() {
 			timestampStr = fmt.Sprintf("timestamp=%s", xirc.FormatServerTime(r.Timestamp))
@@ -3267,6 +3802,9 @@ func (dc *downstreamConn) handleMessageRegistered(ctx context.Context, msg *irc.
 				Params:  []string{"WEBPUSH", "INVALID_PARAMS", subcommand, "Unknown command"},
 			}}
 		}
+	case "ZNC":
+		// Sent by clients for "/znc <command>"
+		dc.handleStatusPRIVMSG(ctx, statusNick, strings.Join(msg.Params, " "))
 	default:
 		dc.logger.Debugf("unhandled message: %v", msg)
 
@@ -0,0 +1,145 @@
+package soju
+
+import (
+	"strings"
+	"time"
+)
+
+// healthNoticeInterval is the minimum delay between two notices warning the
+// user about a degraded network.
+const healthNoticeInterval = time.Hour
+
+// healthReconnectWindow is the period over which reconnections are counted.
+const healthReconnectWindow = time.Hour
+
+// networkHealth tracks the state of the connection to a network. It is only
+// accessed from the user goroutine.
+type networkHealth struct {
+	// Times at which an established connection was lost, oldest first
+	reconnects []time.Time
+
+	// Last evaluation, zero fields mean the corresponding check passed
+	report healthReport
+
+	// Whether the user has been told the network is degraded
+	notified   bool
+	lastNotice time.Time
+}
+
+// healthReport describes the problems found with a network connection.
+type healthReport struct {
+	lag, maxLag               time.Duration // set if the lag is too high
+	reconnects, maxReconnects int           // set if reconnecting too often
+}
+
+func (r *healthReport) degraded() bool {
+	return r.lag != 0 || r.reconnects != 0
+}
+
+func (r *healthReport) String() string {
+	return r.text(nil)
+}
+
+// text describes the problems of the report, translated with cat.
+func (r *healthReport) text(cat catalog) string {
+	var problems []string
+	if r.lag != 0 {
+		problems = append(problems, cat.sprintf("lag of %v exceeds %v", r.lag.Round(time.Millisecond), r.maxLag))
+	}
+	if r.reconnects != 0 {
+		problems = append(problems, cat.sprintf("reconnected %v times in the last hour (limit %v)", r.reconnects, r.maxReconnects))
+	}
+	return strings.Join(problems, ", ")
+}
+
+// healthThresholds returns the thresholds applying to the network, zero
+// values mean the corresponding check is disabled.
+func (net *network) healthThresholds() (maxLag time.Duration, maxReconnects int) {
+	defaults := net.user.srv.Config().NetworkHealth
+
+	maxLag = net.HealthMaxLag
+	if maxLag == 0 {
+		maxLag = defaults.MaxLag
+	} else if maxLag < 0 {
+		maxLag = 0
+	}
+
+	maxReconnects = net.HealthMaxReconnects
+	if maxReconnects == 0 {
+		maxReconnects = defaults.MaxReconnects
+	} else if maxReconnects < 0 {
+		maxReconnects = 0
+	}
+
+	return maxLag, maxReconnects
+}
+
+func (net *network) recordReconnect() {
+	net.health.reconnects = append(net.health.reconnects, time.Now())
+	net.checkHealth()
+}
+
+// checkHealth evaluates the network health and notifies the user when the
+// network becomes degraded or recovers.
+func (net *network) checkHealth() {
+	now := time.Now()
+	health := &net.health
+
+	i := 0
+	for i < len(health.reconnects) && now.Sub(health.reconnects[i]) > healthReconnectWindow {
+		i++
+	}
+	health.reconnects = health.reconnects[i:]
+
+	maxLag, maxReconnects := net.healthThresholds()
+
+	// The lag can't be measured until connected, keep the last known value
+	// meanwhile
+	lag := health.report.lag
+	if uc := net.conn; uc != nil && uc.lag != 0 {
+		lag = uc.lag
+	}
+
+	var report healthReport
+	if maxLag > 0 && lag > maxLag {
+		report.lag, report.maxLag = lag, maxLag
+	}
+	if maxReconnects > 0 && len(health.reconnects) > maxReconnects {
+		report.reconnects, report.maxReconnects = len(health.reconnects), maxReconnects
+	}
+
+	wasDegraded := health.report.degraded()
+	health.report = report
+
+	switch {
+	case !wasDegraded && report.degraded():
+		net.logger.Printf("connection degraded: %v", &report)
+		net.user.srv.metrics.degradedUpstreams.Add(1)
+		if now.Sub(health.lastNotice) < healthNoticeInterval {
+			break
+		}
+		health.notified = true
+		health.lastNotice = now
+		net.forEachDownstream(func(dc *downstreamConn) {
+			sendServiceNOTICE(dc, "connection to %s is degraded: %v", net.GetName(), report.text(catalogs[dc.user.Language]))
+		})
+	case wasDegraded && !report.degraded():
+		net.logger.Printf("connection back to normal")
+		net.user.srv.metrics.degradedUpstreams.Add(-1)
+		if !health.notified {
+			break
+		}
+		health.notified = false
+		net.forEachDownstream(func(dc *downstreamConn) {
+			sendServiceNOTICE(dc, "connection to %s is back to normal", net.GetName())
+		})
+	}
+}
+
+// resetHealth forgets the network health, e.g. when the network is removed.
+func (net *network) resetHealth() {
+	if net.health.report.degraded() {
+		net.user.srv.metrics.degradedUpstreams.Add(-1)
+	}
+	net.health = networkHealth{}
+}
@@ -0,0 +1,107 @@
+package soju
+
+import (
+	"context"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/irc.v4"
+
+	"git.sr.ht/~emersion/soju/database"
+	"git.sr.ht/~emersion/soju/xirc"
+)
+
+const (
+	// maxHighlights is the maximum number of pending highlights kept per user
+	maxHighlights = 100
+	// highlightMaxAge is the duration after which pending highlights expire
+	highlightMaxAge = 14 * 24 * time.Hour
+	// maxHighlightSnippetLen is the maximum length of the stored message text
+	maxHighlightSnippetLen = 200
+)
+
+// hasActiveDownstream checks whether a client which isn't away is connected
+// to the network.
+func (net *network) hasActiveDownstream() bool {
+	active := false
+	net.forEachDownstream(func(dc *downstreamConn) {
+		if dc.away == nil {
+			active = true
+		}
+	})
+	return active
+}
+
+// queueHighlight stores a reference to a highlight which happened while no
+// client was around to see it.
+func (u *user) queueHighlight(ctx context.Context, net *network, target string, msg *irc.Message) {
+	t := time.Now()
+	if ts, err := time.Parse(xirc.ServerTimeLayout, string(msg.Tags["time"])); err == nil {
+		t = ts
+	}
+
+	text := msg.Params[1]
+	if len(text) > maxHighlightSnippetLen {
+		text = text[:maxHighlightSnippetLen]
+		for !utf8.ValidString(text) {
+			text = text[:len(text)-1]
+		}
+		text += "…"
+	}
+
+	highlight := database.Highlight{
+		Target: target,
+		Sender: msg.Prefix.Name,
+		Time:   t,
+		Text:   text,
+		MsgID:  string(msg.Tags["msgid"]),
+	}
+	if err := u.srv.db.StoreHighlight(ctx, net.ID, &highlight); err != nil {
+		net.logger.Printf("failed to store highlight in %q: %v", target, err)
+		return
+	}
+	u.highlights = append(u.highlights, highlight)
+
+	u.expireHighlights(ctx)
+}
+
+// deleteHighlights deletes the pending highlights for which f returns true,
+// and returns the number of deleted highlights.
+func (u *user) deleteHighlights(ctx context.Context, f func(highlight *database.Highlight) bool) int {
+	var kept []database.Highlight
+	n := 0
+	for i := range u.highlights {
+		highlight := &u.highlights[i]
+		if !f(highlight) {
+			kept = append(kept, *highlight)
+			continue
+		}
+		if err := u.srv.db.DeleteHighlight(ctx, highlight.ID); err != nil {
+			u.logger.Printf("failed to delete highlight: %v", err)
+			kept = append(kept, *highlight)
+			continue
+		}
+		n++
+	}
+	u.highlights = kept
+	return n
+}
+
+// expireHighlights drops old highlights and the oldest ones above the limit.
+func (u *user) expireHighlights(ctx context.Context) {
+	minTime := time.Now().Add(-highlightMaxAge)
+	excess := len(u.highlights) - maxHighlights
+	i := 0
+	u.deleteHighlights(ctx, func(highlight *database.Highlight) bool {
+		i++
+		return i <= excess || highlight.Time.Before(minTime)
+	})
+}
+
+// clearReadHighlights drops the highlights of a buffer which are older than
+// its read marker.
+func (u *user) clearReadHighlights(ctx context.Context, net *network, target string, readTime time.Time) {
+	u.deleteHighlights(ctx, func(highlight *database.Highlight) bool {
+		return highlight.NetworkID == net.ID && net.equalCasemap(highlight.Target, target) && !highlight.Time.After(readTime)
+	})
+}
@@ -2,6 +2,7 @@ package soju
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 	"unicode"
@@ -82,11 +83,18 @@ var stdChannelModes = map[byte]channelModeType{
 
 type channelModes map[byte]string
 
+// maxPendingMembers is the maximum number of users who aren't channel members
+// yet for which memberships are tracked.
+const maxPendingMembers = 100
+
 // applyChannelModes parses a mode string and mode arguments from a MODE message,
 // and applies the corresponding channel mode and user membership changes on that channel.
 //
 // If ch.modes is nil, channel modes are not updated.
-func applyChannelModes(ch *upstreamChannel, modeStr string, arguments []string) error {
+//
+// If the channel key is changed, the new key is returned (an empty string
+// indicates that the key has been removed).
+func applyChannelModes(ch *upstreamChannel, modeStr string, arguments []string) (key *string, err error) {
 	nextArgument := 0
 	var plusMinus byte
 outer:
@@ -97,16 +105,25 @@ outer:
 			continue
 		}
 		if plusMinus != '+' && plusMinus != '-' {
-			return fmt.Errorf("malformed modestring %q: missing plus/minus", modeStr)
+			return nil, fmt.Errorf("malformed modestring %q: missing plus/minus", modeStr)
 		}
 
 		for _, membership := range ch.conn.availableMemberships {
 			if membership.Mode == mode {
 				if nextArgument >= len(arguments) {
-					return fmt.Errorf("malformed modestring %q: missing mode argument for %c%c", modeStr, plusMinus, mode)
+					return nil, fmt.Errorf("malformed modestring %q: missing mode argument for %c%c", modeStr, plusMinus, mode)
 				}
 				member := arguments[nextArgument]
 				m := ch.Members.Get(member)
+				if m == nil {
+					// The user may not have joined yet, e.g. when the
+					// server grants a prefix before relaying the JOIN
+					m = ch.pendingMembers.Get(member)
+					if m == nil && plusMinus == '+' && ch.pendingMembers.Len() < maxPendingMembers {
+						m = &xirc.MembershipSet{}
+						ch.pendingMembers.Set(member, m)
+					}
+				}
 				if m != nil {
 					if plusMinus == '+' {
 						m.Add(ch.conn.availableMemberships, membership)
@@ -137,8 +154,15 @@ outer:
 				if ch.modes != nil {
 					ch.modes[mode] = argument
 				}
+				if mode == 'k' {
+					key = &argument
+				}
 			} else {
 				delete(ch.modes, mode)
+				if mode == 'k' {
+					empty := ""
+					key = &empty
+				}
 			}
 			nextArgument++
 		} else if mt == modeTypeC || mt == modeTypeD {
@@ -151,7 +175,7 @@ outer:
 			}
 		}
 	}
-	return nil
+	return key, nil
 }
 
 func (cm channelModes) Format() (modeString string, parameters []string) {
@@ -216,6 +240,109 @@ func copyClientTags(tags irc.Tags) irc.Tags {
 	return t
 }
 
+// multilineBuffer accumulates the lines of a draft/multiline batch into a
+// single logical message, whose text contains line breaks.
+type multilineBuffer struct {
+	target  string
+	tags    irc.Tags // tags of the BATCH command
+	prefix  *irc.Prefix
+	command string
+	text    strings.Builder
+	lines   int
+}
+
+func (buf *multilineBuffer) add(msg *irc.Message) error {
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
+		return fmt.Errorf("unexpected %v command in multiline batch", msg.Command)
+	}
+	if buf.command != "" && msg.Command != buf.command {
+		return fmt.Errorf("mixed %v and %v commands in multiline batch", buf.command, msg.Command)
+	}
+
+	var target, text string
+	if err := parseMessageParams(msg, &target, &text); err != nil {
+		return err
+	}
+	if target != buf.target {
+		return fmt.Errorf("unexpected target %q in multiline batch for %q", target, buf.target)
+	}
+
+	if _, concat := msg.Tags["draft/multiline-concat"]; buf.lines > 0 && !concat {
+		buf.text.WriteByte('\n')
+	}
+	buf.text.WriteString(text)
+	buf.lines++
+	buf.command = msg.Command
+	if buf.prefix == nil {
+		buf.prefix = msg.Prefix
+	}
+	return nil
+}
+
+// message returns the logical message, or nil if the batch is empty.
+func (buf *multilineBuffer) message() *irc.Message {
+	if buf.lines == 0 {
+		return nil
+	}
+	return &irc.Message{
+		Tags:    buf.tags.Copy(),
+		Prefix:  buf.prefix,
+		Command: buf.command,
+		Params:  []string{buf.target, buf.text.String()},
+	}
+}
+
+// isMultilineMessage returns true if msg is a PRIVMSG or NOTICE whose text
+// contains line breaks.
+func isMultilineMessage(msg *irc.Message) bool {
+	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
+		return false
+	}
+	return len(msg.Params) >= 2 && strings.Contains(msg.Params[1], "\n")
+}
+
+// flattenMultilineMessage splits a message whose text contains line breaks
+// into one message per non-empty line. Only the first message keeps the
+// message ID.
+func flattenMultilineMessage(msg *irc.Message) []*irc.Message {
+	var msgs []*irc.Message
+	for _, line := range strings.Split(msg.Params[1], "\n") {
+		if line == "" {
+			continue
+		}
+		tags := msg.Tags.Copy()
+		if len(msgs) > 0 {
+			delete(tags, "msgid")
+		}
+		msgs = append(msgs, &irc.Message{
+			Tags:    tags,
+			Prefix:  msg.Prefix,
+			Command: msg.Command,
+			Params:  []string{msg.Params[0], line},
+		})
+	}
+	return msgs
+}
+
+// parseMultilineLimits parses the value of the draft/multiline capability.
+// Zero is returned for missing limits.
+func parseMultilineLimits(s string) (maxBytes, maxLines int) {
+	for _, kv := range strings.Split(s, ",") {
+		k, v, _ := strings.Cut(kv, "=")
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			continue
+		}
+		switch k {
+		case "max-bytes":
+			maxBytes = n
+		case "max-lines":
+			maxLines = n
+		}
+	}
+	return maxBytes, maxLines
+}
+
 var stdCaseMapping = xirc.CaseMappingRFC1459
 
 func isWordBoundary(r rune) bool {
@@ -1,7 +1,10 @@
 package soju
 
 import (
+	"reflect"
 	"testing"
+
+	"git.sr.ht/~emersion/soju/xirc"
 )
 
 func TestIsHighlight(t *testing.T) {
@@ -38,3 +41,133 @@ func TestIsHighlight(t *testing.T) {
 		})
 	}
 }
+
+func formatMemberships(ms xirc.MembershipSet) string {
+	prefixes := make([]byte, len(ms))
+	for i, m := range ms {
+		prefixes[i] = m.Prefix
+	}
+	return string(prefixes)
+}
+
+func TestApplyChannelModes(t *testing.T) {
+	testCases := []struct {
+		name    string
+		modes   [][]string // mode string followed by arguments
+		members map[string]string
+		pending map[string]string
+		modeMap channelModes
+	}{
+		{
+			name:    "single",
+			modes:   [][]string{{"+o", "alice"}},
+			members: map[string]string{"alice": "@", "bob": "", "carol": "+"},
+		},
+		{
+			name:    "multiplePrefixes",
+			modes:   [][]string{{"+ov", "alice", "alice"}, {"+h", "bob"}},
+			members: map[string]string{"alice": "@+", "bob": "%", "carol": "+"},
+		},
+		{
+			name:    "orderedByRank",
+			modes:   [][]string{{"+vqo", "bob", "bob", "bob"}},
+			members: map[string]string{"alice": "", "bob": "~@+", "carol": "+"},
+		},
+		{
+			name:    "removal",
+			modes:   [][]string{{"+o", "carol"}, {"-v", "carol"}},
+			members: map[string]string{"alice": "", "bob": "", "carol": "@"},
+		},
+		{
+			name:    "mixedWithChannelModes",
+			modes:   [][]string{{"+bo-v+kl", "*!*@example.org", "alice", "carol", "secret", "42"}},
+			members: map[string]string{"alice": "@", "bob": "", "carol": ""},
+			modeMap: channelModes{'k': "secret", 'l': "42"},
+		},
+		{
+			name:    "caseMapping",
+			modes:   [][]string{{"+o", "ALICE"}, {"+v", "Bob"}},
+			members: map[string]string{"alice": "@", "bob": "+", "carol": "+"},
+		},
+		{
+			name:    "unknownMember",
+			modes:   [][]string{{"+ov", "dave", "dave"}, {"-v", "erin"}},
+			members: map[string]string{"alice": "", "bob": "", "carol": "+"},
+			pending: map[string]string{"dave": "@+"},
+		},
+		{
+			name:    "unknownMemberRemoval",
+			modes:   [][]string{{"+ov", "dave", "dave"}, {"-o", "dave"}},
+			members: map[string]string{"alice": "", "bob": "", "carol": "+"},
+			pending: map[string]string{"dave": "+"},
+		},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			uc := &upstreamConn{
+				availableChannelModes: stdChannelModes,
+				availableMemberships:  stdMemberships,
+			}
+			ch := &upstreamChannel{
+				Name:           "#soju",
+				conn:           uc,
+				modes:          make(channelModes),
+				Members:        xirc.NewCaseMappingMap[*xirc.MembershipSet](xirc.CaseMappingRFC1459),
+				pendingMembers: xirc.NewCaseMappingMap[*xirc.MembershipSet](xirc.CaseMappingRFC1459),
+			}
+			ch.Members.Set("alice", &xirc.MembershipSet{})
+			ch.Members.Set("bob", &xirc.MembershipSet{})
+			ch.Members.Set("carol", &xirc.MembershipSet{{Mode: 'v', Prefix: '+'}})
+
+			for _, modes := range tc.modes {
+				if _, err := applyChannelModes(ch, modes[0], modes[1:]); err != nil {
+					t.Fatalf("applyChannelModes(%q) = %v", modes, err)
+				}
+			}
+
+			members := make(map[string]string)
+			ch.Members.ForEach(func(nick string, ms *xirc.MembershipSet) {
+				members[nick] = formatMemberships(*ms)
+			})
+			if !reflect.DeepEqual(members, tc.members) {
+				t.Errorf("got members %v, want %v", members, tc.members)
+			}
+
+			pending := make(map[string]string)
+			ch.pendingMembers.ForEach(func(nick string, ms *xirc.MembershipSet) {
+				pending[nick] = formatMemberships(*ms)
+			})
+			if tc.pending == nil {
+				tc.pending = make(map[string]string)
+			}
+			if !reflect.DeepEqual(pending, tc.pending) {
+				t.Errorf("got pending members %v, want %v", pending, tc.pending)
+			}
+
+			if tc.modeMap == nil {
+				tc.modeMap = make(channelModes)
+			}
+			if !reflect.DeepEqual(ch.modes, tc.modeMap) {
+				t.Errorf("got channel modes %v, want %v", ch.modes, tc.modeMap)
+			}
+		})
+	}
+}
+
+func TestApplyChannelModes_missingArgument(t *testing.T) {
+	uc := &upstreamConn{
+		availableChannelModes: stdChannelModes,
+		availableMemberships:  stdMemberships,
+	}
+	ch := &upstreamChannel{
+		Name:           "#soju",
+		conn:           uc,
+		Members:        xirc.NewCaseMappingMap[*xirc.MembershipSet](xirc.CaseMappingRFC1459),
+		pendingMembers: xirc.NewCaseMappingMap[*xirc.MembershipSet](xirc.CaseMappingRFC1459),
+	}
+	if _, err := applyChannelModes(ch, "+oo", []string{"alice"}); err == nil {
+		t.Errorf("applyChannelModes(+oo alice): expected an error")
+	}
+}
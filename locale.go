@@ -0,0 +1,170 @@
+package soju
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultLanguage is the language of the BouncerServ strings in the source
+// code. It's used when a message has no translation.
+const defaultLanguage = "en"
+
+//go:embed locales/*.po
+var localesFS embed.FS
+
+// catalog maps BouncerServ source strings to their translation in a
+// language. A nil catalog leaves strings untranslated.
+//
+// Source strings are fmt format strings. Translations may reorder the format
+// arguments with explicit argument indexes, e.g. "%[2]v ... %[1]v".
+type catalog map[string]string
+
+// catalogs contains the translations of BouncerServ messages, indexed by
+// language.
+var catalogs = loadCatalogs()
+
+func loadCatalogs() map[string]catalog {
+	entries, err := localesFS.ReadDir("locales")
+	if err != nil {
+		panic(fmt.Sprintf("failed to list message catalogs: %v", err))
+	}
+
+	catalogs := make(map[string]catalog, len(entries))
+	for _, entry := range entries {
+		b, err := localesFS.ReadFile(path.Join("locales", entry.Name()))
+		if err != nil {
+			panic(fmt.Sprintf("failed to read message catalog %q: %v", entry.Name(), err))
+		}
+		cat, err := parseCatalog(string(b))
+		if err != nil {
+			panic(fmt.Sprintf("failed to parse message catalog %q: %v", entry.Name(), err))
+		}
+		catalogs[strings.TrimSuffix(entry.Name(), ".po")] = cat
+	}
+	return catalogs
+}
+
+// parseCatalog parses the msgid and msgstr entries of a gettext PO file.
+// Untranslated entries are skipped.
+func parseCatalog(s string) (catalog, error) {
+	cat := make(catalog)
+
+	var msgid, msgstr *string
+	var cur *string
+	flush := func() {
+		if msgid != nil && msgstr != nil && *msgid != "" && *msgstr != "" {
+			cat[*msgid] = *msgstr
+		}
+		msgid, msgstr, cur = nil, nil, nil
+	}
+
+	for i, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		keyword, quoted := "", line
+		if !strings.HasPrefix(line, `"`) {
+			var ok bool
+			keyword, quoted, ok = strings.Cut(line, " ")
+			if !ok {
+				return nil, fmt.Errorf("line %v: missing string", i+1)
+			}
+		}
+		str, err := strconv.Unquote(strings.TrimSpace(quoted))
+		if err != nil {
+			return nil, fmt.Errorf("line %v: invalid string: %v", i+1, err)
+		}
+
+		switch keyword {
+		case "msgid":
+			flush()
+			msgid = &str
+			cur = msgid
+		case "msgstr":
+			if msgid == nil || msgstr != nil {
+				return nil, fmt.Errorf("line %v: msgstr without msgid", i+1)
+			}
+			msgstr = &str
+			cur = msgstr
+		case "":
+			// Continuation of the previous string
+			if cur == nil {
+				return nil, fmt.Errorf("line %v: unexpected string", i+1)
+			}
+			*cur += str
+		default:
+			return nil, fmt.Errorf("line %v: unsupported keyword %q", i+1, keyword)
+		}
+	}
+	flush()
+
+	return cat, nil
+}
+
+// supportedLanguages returns the list of languages BouncerServ messages are
+// available in.
+func supportedLanguages() []string {
+	l := []string{defaultLanguage}
+	for lang := range catalogs {
+		l = append(l, lang)
+	}
+	sort.Strings(l)
+	return l
+}
+
+func isSupportedLanguage(lang string) bool {
+	_, ok := catalogs[lang]
+	return ok || lang == defaultLanguage
+}
+
+// translate returns the translation of a string, or the string itself if it
+// isn't translated.
+func (cat catalog) translate(s string) string {
+	if t, ok := cat[s]; ok {
+		return t
+	}
+	return s
+}
+
+// sprintf formats a translated message. Arguments which are service errors
+// are translated as well.
+func (cat catalog) sprintf(format string, args ...interface{}) string {
+	translated := make([]interface{}, len(args))
+	for i, arg := range args {
+		if err, ok := arg.(*serviceError); ok {
+			arg = cat.sprintf(err.format, err.args...)
+		}
+		translated[i] = arg
+	}
+	return fmt.Sprintf(cat.translate(format), translated...)
+}
+
+// errorText returns the translated message of an error.
+func (cat catalog) errorText(err error) string {
+	if err, ok := err.(*serviceError); ok {
+		return cat.sprintf(err.format, err.args...)
+	}
+	return err.Error()
+}
+
+// serviceError is a BouncerServ error whose message can be translated.
+type serviceError struct {
+	format string
+	args   []interface{}
+}
+
+// serviceErrorf returns an error with a translatable message. The message is
+// translated when displayed to the user.
+func serviceErrorf(format string, args ...interface{}) error {
+	return &serviceError{format, args}
+}
+
+func (err *serviceError) Error() string {
+	return fmt.Sprintf(err.format, err.args...)
+}
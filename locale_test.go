@@ -0,0 +1,114 @@
+package soju
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestParseCatalog(t *testing.T) {
+	const s = `# Comment
+msgid ""
+msgstr "Content-Type: text/plain; charset=UTF-8\n"
+
+msgid "created network %q"
+msgstr "Netzwerk %q angelegt"
+
+msgid "a long "
+"message"
+msgstr "eine lange "
+"Nachricht"
+
+msgid "untranslated"
+msgstr ""
+`
+	want := catalog{
+		"created network %q": "Netzwerk %q angelegt",
+		"a long message":     "eine lange Nachricht",
+	}
+	cat, err := parseCatalog(s)
+	if err != nil {
+		t.Fatalf("parseCatalog() failed: %v", err)
+	}
+	if !reflect.DeepEqual(cat, want) {
+		t.Errorf("parseCatalog() = %v, want %v", cat, want)
+	}
+
+	for _, s := range []string{
+		`msgstr "orphan"`,
+		`msgid "unterminated`,
+		`msgctxt "unsupported"`,
+	} {
+		if _, err := parseCatalog(s); err == nil {
+			t.Errorf("parseCatalog(%q) succeeded", s)
+		}
+	}
+}
+
+func TestCatalogSprintf(t *testing.T) {
+	cat := catalog{
+		"error: %v":                 "Fehler: %v",
+		"unknown network %q":        "unbekanntes Netzwerk %q",
+		"%v channels on network %v": "Netzwerk %[2]v: %[1]v Kanäle",
+	}
+
+	if got, want := cat.sprintf("%v channels on network %v", 3, "libera"), "Netzwerk libera: 3 Kanäle"; got != want {
+		t.Errorf("sprintf() = %q, want %q", got, want)
+	}
+
+	err := serviceErrorf("unknown network %q", "libera")
+	if got, want := err.Error(), `unknown network "libera"`; got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if got, want := cat.sprintf("error: %v", err), `Fehler: unbekanntes Netzwerk "libera"`; got != want {
+		t.Errorf("sprintf() = %q, want %q", got, want)
+	}
+	if got, want := catalog(nil).sprintf("error: %v", err), `error: unknown network "libera"`; got != want {
+		t.Errorf("sprintf() with nil catalog = %q, want %q", got, want)
+	}
+}
+
+var formatVerbRegexp = regexp.MustCompile(`%(\[\d+\])?[-+# 0]*\d*(\.\d+)?[a-zA-Z%]`)
+
+// testFormatArg formats as its name with any verb.
+type testFormatArg string
+
+func (arg testFormatArg) Format(f fmt.State, verb rune) {
+	f.Write([]byte(arg))
+}
+
+func TestCatalogs(t *testing.T) {
+	if len(catalogs) == 0 {
+		t.Fatalf("no message catalog loaded")
+	}
+
+	for lang, cat := range catalogs {
+		if !isSupportedLanguage(lang) {
+			t.Errorf("language %q isn't supported", lang)
+		}
+		for msgid, msgstr := range cat {
+			n := 0
+			for _, verb := range formatVerbRegexp.FindAllString(msgid, -1) {
+				if verb != "%%" {
+					n++
+				}
+			}
+			args := make([]interface{}, n)
+			for i := range args {
+				args[i] = testFormatArg(fmt.Sprintf("arg%v", i))
+			}
+
+			s := fmt.Sprintf(msgstr, args...)
+			if strings.Contains(s, "%!") {
+				t.Errorf("%v: translation of %q has mismatched format verbs: %q", lang, msgid, s)
+			}
+			for _, arg := range args {
+				if !strings.Contains(s, string(arg.(testFormatArg))) {
+					t.Errorf("%v: translation of %q is missing a format argument: %q", lang, msgid, s)
+				}
+			}
+		}
+	}
+}
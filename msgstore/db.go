@@ -38,9 +38,12 @@ type dbMessageStore struct {
 }
 
 var (
-	_ Store            = (*dbMessageStore)(nil)
-	_ ChatHistoryStore = (*dbMessageStore)(nil)
-	_ SearchStore      = (*dbMessageStore)(nil)
+	_ Store             = (*dbMessageStore)(nil)
+	_ ChatHistoryStore  = (*dbMessageStore)(nil)
+	_ SearchStore       = (*dbMessageStore)(nil)
+	_ RedactStore       = (*dbMessageStore)(nil)
+	_ RenameTargetStore = (*dbMessageStore)(nil)
+	_ SummaryStore      = (*dbMessageStore)(nil)
 )
 
 func NewDBStore(db database.Database) *dbMessageStore {
@@ -88,6 +91,14 @@ func (ms *dbMessageStore) Append(network *database.Network, entity string, msg *
 	return formatDBMsgID(network.ID, entity, ids[0]), nil
 }
 
+func (ms *dbMessageStore) RedactMessage(network *database.Network, entity, msgID string) error {
+	return ms.db.RedactMessage(context.TODO(), network.ID, entity, msgID)
+}
+
+func (ms *dbMessageStore) RenameTarget(network *database.Network, oldName, newName string) error {
+	return ms.db.RenameMessageTarget(context.TODO(), network.ID, oldName, newName)
+}
+
 func (ms *dbMessageStore) ListTargets(ctx context.Context, network *database.Network, start, end time.Time, limit int, events bool) ([]ChatHistoryTarget, error) {
 	var opts *database.MessageOptions
 	if start.Before(end) {
@@ -161,3 +172,56 @@ func (ms *dbMessageStore) Search(ctx context.Context, network *database.Network,
 	}
 	return l, nil
 }
+
+func (ms *dbMessageStore) CountMissedMessages(ctx context.Context, network *database.Network, ids []string, nick string, highlights *HighlightMatcher) ([]TargetSummary, error) {
+	// Message IDs are increasing across targets, so the latest delivered
+	// message marks the start of the missed messages for all targets
+	var afterID int64
+	for _, id := range ids {
+		msgID, err := parseDBMsgID(id)
+		if err != nil {
+			return nil, err
+		}
+		if msgID > afterID {
+			afterID = msgID
+		}
+	}
+	if afterID == 0 {
+		return nil, nil
+	}
+
+	counts, err := ms.db.CountMessagesPerTarget(ctx, network.ID, &database.MessageCountOptions{
+		AfterID:       afterID,
+		ExcludeSender: nick,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	l := make([]TargetSummary, len(counts))
+	for i, count := range counts {
+		l[i] = TargetSummary{Name: count.Name, Messages: count.Messages}
+
+		keywords := highlights.Keywords[count.Name]
+		if len(keywords) == 0 {
+			continue
+		}
+		// The database only narrows down the candidates, the matcher has
+		// the final say
+		msgs, err := ms.db.ListMessages(ctx, network.ID, count.Name, &database.MessageOptions{
+			AfterID:       afterID,
+			Limit:         count.Messages,
+			TextContains:  keywords,
+			ExcludeSender: nick,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			if highlights.IsHighlight(count.Name, msg) {
+				l[i].Highlights++
+			}
+		}
+	}
+	return l, nil
+}
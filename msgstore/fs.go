@@ -1,10 +1,10 @@
 package msgstore
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
@@ -24,6 +24,8 @@ const (
 	fsMessageStoreMaxTries = 100
 )
 
+// EscapeFilename escapes a name for use as a path component in the legacy
+// layout. This escaping is lossy, see EscapePathComponent.
 func EscapeFilename(unsafe string) (safe string) {
 	if unsafe == "." {
 		return "-"
@@ -80,11 +82,13 @@ type fsMessageStoreFile struct {
 
 // fsMessageStore is a per-user on-disk store for IRC messages.
 //
-// It mimicks the ZNC log layout and format. See the ZNC source:
+// It mimicks the ZNC log format, and by default the ZNC log layout. See the
+// ZNC source:
 // https://github.com/znc/znc/blob/master/modules/log.cpp
 type fsMessageStore struct {
-	root string
-	user *database.User
+	root   string
+	layout *FSLayout
+	user   *database.User
 
 	// Write-only files used by Append
 	files map[string]*fsMessageStoreFile // indexed by entity
@@ -95,6 +99,7 @@ var (
 	_ ChatHistoryStore   = (*fsMessageStore)(nil)
 	_ SearchStore        = (*fsMessageStore)(nil)
 	_ RenameNetworkStore = (*fsMessageStore)(nil)
+	_ RenameTargetStore  = (*fsMessageStore)(nil)
 )
 
 func IsFSStore(store Store) bool {
@@ -102,18 +107,45 @@ func IsFSStore(store Store) bool {
 	return ok
 }
 
-func NewFSStore(root string, user *database.User) *fsMessageStore {
+// NewFSStore creates a new fs message store. If layout is nil, the default
+// layout is used, with legacy layout compatibility enabled.
+func NewFSStore(root string, layout *FSLayout, user *database.User) *fsMessageStore {
+	if layout == nil {
+		var err error
+		layout, err = ParseFSLayout(DefaultFSTemplate)
+		if err != nil {
+			panic(err)
+		}
+		layout.Legacy = true
+	}
 	return &fsMessageStore{
-		root:  filepath.Join(root, EscapeFilename(user.Username)),
-		user:  user,
-		files: make(map[string]*fsMessageStoreFile),
+		root:   filepath.Join(root, EscapeFilename(user.Username)),
+		layout: layout,
+		user:   user,
+		files:  make(map[string]*fsMessageStoreFile),
 	}
 }
 
+// logPath returns the path of the log file for an entity and a day. If the
+// legacy layout is enabled and the file only exists in the legacy layout, the
+// legacy path is returned.
 func (ms *fsMessageStore) logPath(network *database.Network, entity string, t time.Time) string {
-	year, month, day := t.Date()
-	filename := fmt.Sprintf("%04d-%02d-%02d.log", year, month, day)
-	return filepath.Join(ms.root, EscapeFilename(network.GetName()), EscapeFilename(entity), filename)
+	p := ms.layout.path(ms.root, network.GetName(), entity, t)
+	if !ms.layout.Legacy {
+		return p
+	}
+
+	lp := legacyPath(ms.root, network.GetName(), entity, t)
+	if lp == p {
+		return p
+	}
+	if _, err := os.Stat(p); err == nil {
+		return p
+	}
+	if _, err := os.Stat(lp); err == nil {
+		return lp
+	}
+	return p
 }
 
 // nextMsgID queries the message ID for the next message to be written to f.
@@ -235,7 +267,7 @@ func (ms *fsMessageStore) parseMessagesBefore(ref time.Time, end time.Time, opti
 	historyRing := make([]*irc.Message, options.Limit)
 	cur := 0
 
-	sc := bufio.NewScanner(f)
+	sc := znclog.NewScanner(f)
 
 	if afterOffset >= 0 {
 		if _, err := f.Seek(afterOffset, io.SeekStart); err != nil {
@@ -292,7 +324,7 @@ func (ms *fsMessageStore) parseMessagesAfter(ref time.Time, end time.Time, optio
 	defer f.Close()
 
 	var history []*irc.Message
-	sc := bufio.NewScanner(f)
+	sc := znclog.NewScanner(f)
 	for sc.Scan() && len(history) < options.Limit {
 		msg, t, err := ms.parseMessage(sc.Text(), options.Network, options.Entity, ref, options.Events)
 		if err != nil {
@@ -445,45 +477,29 @@ func (ms *fsMessageStore) LoadLatestID(ctx context.Context, id string, options *
 func (ms *fsMessageStore) ListTargets(ctx context.Context, network *database.Network, start, end time.Time, limit int, events bool) ([]ChatHistoryTarget, error) {
 	start = start.In(time.Local)
 	end = end.In(time.Local)
-	rootPath := filepath.Join(ms.root, EscapeFilename(network.GetName()))
-	root, err := os.Open(rootPath)
-	if os.IsNotExist(err) {
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
 
-	// The returned targets are escaped, and there is no way to un-escape
-	// TODO: switch to ReadDir (Go 1.16+)
-	targetNames, err := root.Readdirnames(0)
-	root.Close()
+	latest := make(map[string]time.Time)
+	targetsDir := ms.layout.targetsDir(ms.root, network.GetName())
+	err := listTargetDirs(ctx, targetsDir, func(name string) string {
+		if target, err := UnescapePathComponent(name); err == nil {
+			return target
+		}
+		return name
+	}, latest)
 	if err != nil {
 		return nil, err
 	}
-
-	var targets []ChatHistoryTarget
-	for _, target := range targetNames {
-		// target is already escaped here
-		targetPath := filepath.Join(rootPath, target)
-		targetDir, err := os.Open(targetPath)
-		if err != nil {
+	if legacyDir := legacyNetworkDir(ms.root, network.GetName()); ms.layout.Legacy && legacyDir != targetsDir {
+		// The legacy escaping can't be reversed, return names as-is
+		if err := listTargetDirs(ctx, legacyDir, func(name string) string {
+			return name
+		}, latest); err != nil {
 			return nil, err
 		}
+	}
 
-		entries, err := targetDir.Readdir(0)
-		targetDir.Close()
-		if err != nil {
-			return nil, err
-		}
-
-		// We use mtime here, which may give imprecise or incorrect results
-		var t time.Time
-		for _, entry := range entries {
-			if entry.ModTime().After(t) {
-				t = entry.ModTime()
-			}
-		}
-
+	var targets []ChatHistoryTarget
+	for target, t := range latest {
 		// The timestamps we get from logs have second granularity
 		t = truncateSecond(t)
 
@@ -496,10 +512,6 @@ func (ms *fsMessageStore) ListTargets(ctx context.Context, network *database.Net
 			Name:          target,
 			LatestMessage: t,
 		})
-
-		if err := ctx.Err(); err != nil {
-			return nil, err
-		}
 	}
 
 	// Sort targets by latest message time, backwards or forwards depending on
@@ -545,8 +557,51 @@ func (ms *fsMessageStore) Search(ctx context.Context, network *database.Network,
 }
 
 func (ms *fsMessageStore) RenameNetwork(oldNet, newNet *database.Network) error {
-	oldDir := filepath.Join(ms.root, EscapeFilename(oldNet.GetName()))
-	newDir := filepath.Join(ms.root, EscapeFilename(newNet.GetName()))
+	oldDir := ms.layout.networkDir(ms.root, oldNet.GetName())
+	newDir := ms.layout.networkDir(ms.root, newNet.GetName())
+	if err := renameDir(oldDir, newDir); err != nil {
+		return err
+	}
+
+	if !ms.layout.Legacy {
+		return nil
+	}
+	oldDir = legacyNetworkDir(ms.root, oldNet.GetName())
+	newDir = legacyNetworkDir(ms.root, newNet.GetName())
+	if _, err := os.Stat(oldDir); os.IsNotExist(err) {
+		return nil
+	}
+	return renameDir(oldDir, newDir)
+}
+
+func (ms *fsMessageStore) RenameTarget(network *database.Network, oldName, newName string) error {
+	if f := ms.files[oldName]; f != nil {
+		f.Close()
+		delete(ms.files, oldName)
+	}
+
+	targetsDir := ms.layout.targetsDir(ms.root, network.GetName())
+	oldDir := filepath.Join(targetsDir, EscapePathComponent(oldName))
+	newDir := filepath.Join(targetsDir, EscapePathComponent(newName))
+	if _, err := os.Stat(oldDir); err == nil {
+		if err := renameDir(oldDir, newDir); err != nil {
+			return err
+		}
+	}
+
+	if !ms.layout.Legacy {
+		return nil
+	}
+	legacyDir := legacyNetworkDir(ms.root, network.GetName())
+	oldDir = filepath.Join(legacyDir, EscapeFilename(oldName))
+	newDir = filepath.Join(legacyDir, EscapeFilename(newName))
+	if _, err := os.Stat(oldDir); os.IsNotExist(err) {
+		return nil
+	}
+	return renameDir(oldDir, newDir)
+}
+
+func renameDir(oldDir, newDir string) error {
 	// Avoid loosing data by overwriting an existing directory
 	if _, err := os.Stat(newDir); err == nil {
 		return fmt.Errorf("destination %q already exists", newDir)
@@ -554,6 +609,54 @@ func (ms *fsMessageStore) RenameNetwork(oldNet, newNet *database.Network) error
 	return os.Rename(oldDir, newDir)
 }
 
+// listTargetDirs lists the target directories in dir, and records the latest
+// modification time of the files they contain into latest, indexed by the
+// target name returned by nameFunc.
+func listTargetDirs(ctx context.Context, dir string, nameFunc func(string) string, latest map[string]time.Time) error {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		// We use mtime here, which may give imprecise or incorrect results
+		var t time.Time
+		err := filepath.WalkDir(filepath.Join(dir, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if fi.ModTime().After(t) {
+				t = fi.ModTime()
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		name := nameFunc(entry.Name())
+		if t.After(latest[name]) {
+			latest[name] = t
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func truncateDay(t time.Time) time.Time {
 	year, month, day := t.Date()
 	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
@@ -0,0 +1,407 @@
+package msgstore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/irc.v4"
+
+	"git.sr.ht/~emersion/soju/database"
+	"git.sr.ht/~emersion/soju/xirc"
+)
+
+var weirdTargets = []string{
+	"#soju",
+	"#a/b",
+	"#a-b",
+	"#a\\b",
+	"/",
+	".",
+	"..",
+	"../..",
+	"..#evil",
+	".hidden",
+	"#dots.in.name",
+	"#100%",
+	"#100%25",
+	"%2F",
+	"#café",
+	"#日本語",
+	"#emoji😀",
+	"#tab\there",
+	"nick",
+	"Nick",
+	"#Soju",
+}
+
+func TestEscapePathComponent(t *testing.T) {
+	seen := make(map[string]string)
+	for _, target := range weirdTargets {
+		escaped := EscapePathComponent(target)
+
+		if escaped == "." || escaped == ".." || strings.HasPrefix(escaped, ".") {
+			t.Errorf("EscapePathComponent(%q) = %q: leading dot", target, escaped)
+		}
+		if strings.ContainsAny(escaped, "/\\\t") {
+			t.Errorf("EscapePathComponent(%q) = %q: contains unsafe characters", target, escaped)
+		}
+		if other, ok := seen[escaped]; ok {
+			t.Errorf("EscapePathComponent(%q) = EscapePathComponent(%q) = %q", target, other, escaped)
+		}
+		seen[escaped] = target
+
+		unescaped, err := UnescapePathComponent(escaped)
+		if err != nil {
+			t.Errorf("UnescapePathComponent(%q): %v", escaped, err)
+		} else if unescaped != target {
+			t.Errorf("UnescapePathComponent(EscapePathComponent(%q)) = %q", target, unescaped)
+		}
+	}
+
+	// Unicode is kept as-is
+	if got := EscapePathComponent("#café"); got != "#café" {
+		t.Errorf("EscapePathComponent(%q) = %q, want unchanged", "#café", got)
+	}
+	// Invalid UTF-8 is escaped
+	if got := EscapePathComponent("#\xff"); got != "#%FF" {
+		t.Errorf("EscapePathComponent(%q) = %q, want %q", "#\xff", got, "#%FF")
+	}
+}
+
+func TestEscapeFilenameCollisions(t *testing.T) {
+	// The legacy escaping maps these to the same name, the new one doesn't
+	names := []string{"#a/b", "#a-b", "#a\\b"}
+	if EscapeFilename(names[0]) != EscapeFilename(names[1]) {
+		t.Fatalf("expected legacy escaping to collide")
+	}
+	for i := range names {
+		for j := range names {
+			if i != j && EscapePathComponent(names[i]) == EscapePathComponent(names[j]) {
+				t.Errorf("EscapePathComponent(%q) = EscapePathComponent(%q)", names[i], names[j])
+			}
+		}
+	}
+}
+
+func TestFSLayoutCaseMapping(t *testing.T) {
+	layout, err := ParseFSLayout(DefaultFSTemplate)
+	if err != nil {
+		t.Fatalf("ParseFSLayout() = %v", err)
+	}
+
+	root := t.TempDir()
+	date := time.Date(2024, 3, 9, 12, 0, 0, 0, time.Local)
+
+	casemaps := map[string]xirc.CaseMapping{
+		"ascii":   xirc.CaseMappingASCII,
+		"rfc1459": xirc.CaseMappingRFC1459,
+	}
+	pairs := [][2]string{
+		{"#Soju", "#soju"},
+		{"#SOJU", "#soju"},
+		{"#foo[]", "#foo{}"},
+		{"#foo\\", "#foo|"},
+		{"#foo~", "#foo^"},
+		{"Nick", "nICK"},
+		{"#café", "#CAFÉ"},
+		{"#a/b", "#A/B"},
+	}
+	for name, cm := range casemaps {
+		for _, pair := range pairs {
+			a, b := cm(pair[0]), cm(pair[1])
+			pathA := layout.path(root, "net", a, date)
+			pathB := layout.path(root, "net", b, date)
+			if (a == b) != (pathA == pathB) {
+				t.Errorf("%v: %q and %q map to %q and %q", name, pair[0], pair[1], pathA, pathB)
+			}
+			for _, p := range []string{pathA, pathB} {
+				if rel, err := filepath.Rel(root, p); err != nil || strings.HasPrefix(rel, "..") {
+					t.Errorf("%v: path %q escapes root %q", name, p, root)
+				}
+			}
+		}
+	}
+}
+
+func TestParseFSLayout(t *testing.T) {
+	valid := []string{
+		DefaultFSTemplate,
+		"%n/%t/%Y/%m/%d.log",
+		"logs/%n/targets/%t/%Y-%m-%d.txt",
+		"%n/%t/100%%-%Y%m%d",
+	}
+	for _, template := range valid {
+		if _, err := ParseFSLayout(template); err != nil {
+			t.Errorf("ParseFSLayout(%q) = %v", template, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"%n/%Y-%m-%d.log",
+		"%t/%Y-%m-%d.log",
+		"%t/%n/%Y-%m-%d.log",
+		"%n/%t",
+		"%n/%t/%Y-%m.log",
+		"%n/%t/%x.log",
+		"%n/%t/%Y-%m-%d%",
+		"%n-%t/%Y-%m-%d.log",
+		"%n/%Y/%t/%m-%d.log",
+		"%n//%t/%Y-%m-%d.log",
+		"%n/../%t/%Y-%m-%d.log",
+		"%n/%t/%n/%Y-%m-%d.log",
+	}
+	for _, template := range invalid {
+		if _, err := ParseFSLayout(template); err == nil {
+			t.Errorf("ParseFSLayout(%q): expected an error", template)
+		}
+	}
+}
+
+func TestFSLayoutPath(t *testing.T) {
+	layout, err := ParseFSLayout("logs/%n/targets/%t/%Y/%m/%d.log")
+	if err != nil {
+		t.Fatalf("ParseFSLayout() = %v", err)
+	}
+	date := time.Date(2024, 3, 9, 12, 0, 0, 0, time.Local)
+	got := layout.path("/root", "libera/chat", "#a/b", date)
+	want := filepath.Join("/root", "logs", "libera%2Fchat", "targets", "#a%2Fb", "2024", "03", "09.log")
+	if got != want {
+		t.Errorf("path() = %q, want %q", got, want)
+	}
+}
+
+func TestFSStoreLegacyLayout(t *testing.T) {
+	root := t.TempDir()
+	user := &database.User{Username: "user"}
+	network := &database.Network{ID: 1, Name: "net"}
+	now := time.Now()
+
+	// Write a log file using the legacy layout
+	legacyFile := legacyPath(filepath.Join(root, "user"), "net", "#a/b", now)
+	if err := os.MkdirAll(filepath.Dir(legacyFile), 0750); err != nil {
+		t.Fatal(err)
+	}
+	line := "[00:00:00] <nick> hello\n"
+	if err := os.WriteFile(legacyFile, []byte(line), 0640); err != nil {
+		t.Fatal(err)
+	}
+
+	layout, err := ParseFSLayout(DefaultFSTemplate)
+	if err != nil {
+		t.Fatalf("ParseFSLayout() = %v", err)
+	}
+
+	layout.Legacy = false
+	ms := NewFSStore(root, layout, user)
+	if p := ms.logPath(network, "#a/b", now); p == legacyFile {
+		t.Errorf("logPath() = %q, legacy file used with legacy layout disabled", p)
+	}
+
+	layout.Legacy = true
+	ms = NewFSStore(root, layout, user)
+	if p := ms.logPath(network, "#a/b", now); p != legacyFile {
+		t.Errorf("logPath() = %q, want legacy file %q", p, legacyFile)
+	}
+
+	msgs, err := ms.LoadLatestID(context.Background(), "", &LoadMessageOptions{
+		Network: network,
+		Entity:  "#a/b",
+		Limit:   10,
+	})
+	if err != nil {
+		t.Fatalf("LoadLatestID() = %v", err)
+	}
+	if len(msgs) != 1 || msgs[0].Params[1] != "hello" {
+		t.Errorf("LoadLatestID() = %v, want the legacy message", msgs)
+	}
+
+	// Without the legacy layout, "#a/b" no longer reads the legacy "#a-b"
+	// directory, which now only belongs to "#a-b"
+	layout.Legacy = false
+	ms = NewFSStore(root, layout, user)
+	if _, err := ms.Append(network, "#a-b", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick"},
+		Command: "PRIVMSG",
+		Params:  []string{"#a-b", "other"},
+	}); err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+	ms.Close()
+	msgs, err = ms.LoadLatestID(context.Background(), "", &LoadMessageOptions{
+		Network: network,
+		Entity:  "#a/b",
+		Limit:   10,
+	})
+	if err != nil {
+		t.Fatalf("LoadLatestID() = %v", err)
+	}
+	if len(msgs) != 0 {
+		t.Errorf("LoadLatestID() = %v, want no message with legacy layout disabled", msgs)
+	}
+}
+
+func TestFSStoreEvents(t *testing.T) {
+	user := &database.User{Username: "user"}
+	network := &database.Network{ID: 1, Name: "net"}
+	ms := NewFSStore(t.TempDir(), nil, user)
+	defer ms.Close()
+
+	start := time.Date(2024, 3, 9, 12, 0, 0, 0, time.Local)
+	msgs := []*irc.Message{
+		{Prefix: &irc.Prefix{Name: "alice", User: "a", Host: "example.org"}, Command: "JOIN", Params: []string{"#soju"}},
+		{Prefix: &irc.Prefix{Name: "alice"}, Command: "PRIVMSG", Params: []string{"#soju", "hi"}},
+		{Prefix: &irc.Prefix{Name: "alice"}, Command: "NICK", Params: []string{"alicia"}},
+		{Prefix: &irc.Prefix{Name: "alicia"}, Command: "PRIVMSG", Params: []string{"#soju", "it's me again"}},
+		{Prefix: &irc.Prefix{Name: "alicia"}, Command: "MODE", Params: []string{"#soju", "+o", "bob"}},
+		{Prefix: &irc.Prefix{Name: "bob"}, Command: "TOPIC", Params: []string{"#soju", "Nick changes (and more)"}},
+		{Prefix: &irc.Prefix{Name: "bob"}, Command: "KICK", Params: []string{"#soju", "carol", "flood"}},
+		{Prefix: &irc.Prefix{Name: "alicia", User: "a", Host: "example.org"}, Command: "PART", Params: []string{"#soju", "see you (later)"}},
+		{Prefix: &irc.Prefix{Name: "bob", User: "b", Host: "example.org"}, Command: "QUIT", Params: []string{"Ping timeout"}},
+	}
+	for i, msg := range msgs {
+		msg.Tags = irc.Tags{"time": xirc.FormatServerTime(start.Add(time.Duration(i) * time.Second))}
+		if _, err := ms.Append(network, "#soju", msg); err != nil {
+			t.Fatalf("Append(%v) = %v", msg, err)
+		}
+	}
+
+	for _, events := range []bool{true, false} {
+		got, err := ms.LoadAfterTime(context.Background(), start.Add(-time.Second), start.Add(time.Hour), &LoadMessageOptions{
+			Network: network,
+			Entity:  "#soju",
+			Limit:   100,
+			Events:  events,
+		})
+		if err != nil {
+			t.Fatalf("LoadAfterTime() = %v", err)
+		}
+
+		var want []*irc.Message
+		for _, msg := range msgs {
+			if events || msg.Command == "PRIVMSG" {
+				want = append(want, msg)
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("events=%v: got %v messages, want %v", events, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Command != want[i].Command || got[i].Prefix.Name != want[i].Prefix.Name || strings.Join(got[i].Params, " ") != strings.Join(want[i].Params, " ") {
+				t.Errorf("events=%v: got %v, want %v", events, got[i], want[i])
+			}
+			if got[i].Tags["time"] != want[i].Tags["time"] {
+				t.Errorf("events=%v: got time %v, want %v", events, got[i].Tags["time"], want[i].Tags["time"])
+			}
+		}
+	}
+}
+
+func TestFSStoreMultiline(t *testing.T) {
+	user := &database.User{Username: "user"}
+	network := &database.Network{ID: 1, Name: "net"}
+	ms := NewFSStore(t.TempDir(), nil, user)
+	defer ms.Close()
+
+	start := truncateSecond(time.Now().Add(-time.Minute))
+	msgs := []*irc.Message{
+		{Prefix: &irc.Prefix{Name: "alice"}, Command: "PRIVMSG", Params: []string{"#soju", "before"}},
+		{Prefix: &irc.Prefix{Name: "alice"}, Command: "PRIVMSG", Params: []string{"#soju", "first\n\n+ third"}},
+		{Prefix: &irc.Prefix{Name: "bob"}, Command: "NOTICE", Params: []string{"#soju", "one\ntwo"}},
+		{Prefix: &irc.Prefix{Name: "bob"}, Command: "PRIVMSG", Params: []string{"#soju", "\x01ACTION waves\nand leaves\x01"}},
+		{Prefix: &irc.Prefix{Name: "alice"}, Command: "PRIVMSG", Params: []string{"#soju", "after"}},
+	}
+	var ids []string
+	for i, msg := range msgs {
+		msg.Tags = irc.Tags{"time": xirc.FormatServerTime(start.Add(time.Duration(i) * time.Second))}
+		id, err := ms.Append(network, "#soju", msg)
+		if err != nil {
+			t.Fatalf("Append(%v) = %v", msg, err)
+		}
+		ids = append(ids, id)
+	}
+
+	checkMessages := func(name string, got, want []*irc.Message) {
+		if len(got) != len(want) {
+			t.Fatalf("%v: got %v messages, want %v", name, len(got), len(want))
+		}
+		for i := range want {
+			if got[i].Command != want[i].Command || got[i].Prefix.Name != want[i].Prefix.Name || got[i].Params[1] != want[i].Params[1] {
+				t.Errorf("%v: got %q, want %q", name, got[i], want[i])
+			}
+		}
+	}
+
+	options := &LoadMessageOptions{Network: network, Entity: "#soju", Limit: 100}
+	got, err := ms.LoadAfterTime(context.Background(), start.Add(-time.Second), start.Add(time.Hour), options)
+	if err != nil {
+		t.Fatalf("LoadAfterTime() = %v", err)
+	}
+	checkMessages("LoadAfterTime", got, msgs)
+
+	got, err = ms.LoadBeforeTime(context.Background(), start.Add(time.Hour), start.Add(-time.Second), options)
+	if err != nil {
+		t.Fatalf("LoadBeforeTime() = %v", err)
+	}
+	checkMessages("LoadBeforeTime", got, msgs)
+
+	// Loading after a multiline message must skip all of its lines
+	got, err = ms.LoadLatestID(context.Background(), ids[1], options)
+	if err != nil {
+		t.Fatalf("LoadLatestID() = %v", err)
+	}
+	checkMessages("LoadLatestID", got, msgs[2:])
+}
+
+func TestFSStoreRenameTarget(t *testing.T) {
+	user := &database.User{Username: "user"}
+	network := &database.Network{ID: 1, Name: "net"}
+	ms := NewFSStore(t.TempDir(), nil, user)
+	defer ms.Close()
+
+	if _, err := ms.Append(network, "#old", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick"},
+		Command: "PRIVMSG",
+		Params:  []string{"#old", "hello"},
+	}); err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+
+	if err := ms.RenameTarget(network, "#old", "#new"); err != nil {
+		t.Fatalf("RenameTarget() = %v", err)
+	}
+
+	for _, entity := range []string{"#old", "#new"} {
+		lastID, err := ms.LastMsgID(network, entity, time.Unix(0, 0))
+		if err != nil {
+			t.Fatalf("LastMsgID() = %v", err)
+		}
+		msgs, err := ms.LoadLatestID(context.Background(), lastID, &LoadMessageOptions{
+			Network: network,
+			Entity:  entity,
+			Limit:   10,
+		})
+		if err != nil {
+			t.Fatalf("LoadLatestID() = %v", err)
+		}
+		if want := entity == "#new"; want != (len(msgs) == 1) {
+			t.Errorf("%v: got %v messages", entity, len(msgs))
+		}
+	}
+
+	// Renaming onto an existing target must not lose history
+	if _, err := ms.Append(network, "#old", &irc.Message{
+		Prefix:  &irc.Prefix{Name: "nick"},
+		Command: "PRIVMSG",
+		Params:  []string{"#old", "hello again"},
+	}); err != nil {
+		t.Fatalf("Append() = %v", err)
+	}
+	if err := ms.RenameTarget(network, "#old", "#new"); err == nil {
+		t.Errorf("RenameTarget() onto an existing target: expected an error")
+	}
+}
@@ -0,0 +1,211 @@
+package msgstore
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// DefaultFSTemplate is the default path template of the fs message store. It
+// matches the ZNC log layout.
+const DefaultFSTemplate = "%n/%t/%Y-%m-%d.log"
+
+// FSLayout describes how the fs message store derives file paths from the
+// network name, the target name and the date.
+//
+// A layout is created from a template made of slash-separated components. The
+// placeholder %n (network name) and %t (target name) must each appear exactly
+// once as a whole component, with %n before %t. Components after %t must
+// contain the date placeholders %Y (year), %m (month) and %d (day), and may
+// contain %% for a literal percent sign. Other components are literal.
+//
+// Network and target names are escaped with EscapePathComponent.
+type FSLayout struct {
+	template   string
+	components []string
+	network    int // index of the %n component
+	target     int // index of the %t component
+
+	// If true, files using the legacy layout (DefaultFSTemplate with
+	// EscapeFilename) are read when the file doesn't exist in this layout
+	Legacy bool
+}
+
+// ParseFSLayout parses a path template.
+func ParseFSLayout(template string) (*FSLayout, error) {
+	layout := &FSLayout{
+		template:   template,
+		components: strings.Split(template, "/"),
+		network:    -1,
+		target:     -1,
+	}
+
+	var hasYear, hasMonth, hasDay bool
+	for i, comp := range layout.components {
+		switch comp {
+		case "":
+			return nil, fmt.Errorf("template %q: empty path component", template)
+		case ".", "..":
+			return nil, fmt.Errorf("template %q: invalid path component %q", template, comp)
+		case "%n":
+			if layout.network >= 0 {
+				return nil, fmt.Errorf("template %q: %%n specified multiple times", template)
+			}
+			layout.network = i
+			continue
+		case "%t":
+			if layout.target >= 0 {
+				return nil, fmt.Errorf("template %q: %%t specified multiple times", template)
+			}
+			layout.target = i
+			continue
+		}
+
+		dateAllowed := layout.target >= 0
+		for j := 0; j < len(comp); j++ {
+			if comp[j] != '%' {
+				continue
+			}
+			if j+1 >= len(comp) {
+				return nil, fmt.Errorf("template %q: trailing %%", template)
+			}
+			j++
+			switch c := comp[j]; c {
+			case '%':
+				// literal percent sign
+			case 'Y', 'm', 'd':
+				if !dateAllowed {
+					return nil, fmt.Errorf("template %q: %%%c must come after %%t", template, c)
+				}
+				hasYear = hasYear || c == 'Y'
+				hasMonth = hasMonth || c == 'm'
+				hasDay = hasDay || c == 'd'
+			case 'n', 't':
+				return nil, fmt.Errorf("template %q: %%%c must be a whole path component", template, c)
+			default:
+				return nil, fmt.Errorf("template %q: unknown placeholder %%%c", template, c)
+			}
+		}
+	}
+
+	if layout.network < 0 || layout.target < 0 {
+		return nil, fmt.Errorf("template %q: both %%n and %%t are required", template)
+	}
+	if layout.network > layout.target {
+		return nil, fmt.Errorf("template %q: %%n must come before %%t", template)
+	}
+	if layout.target == len(layout.components)-1 {
+		return nil, fmt.Errorf("template %q: %%t must be followed by a file name", template)
+	}
+	if !hasYear || !hasMonth || !hasDay {
+		return nil, fmt.Errorf("template %q: %%Y, %%m and %%d are required", template)
+	}
+
+	return layout, nil
+}
+
+// String returns the template of the layout.
+func (layout *FSLayout) String() string {
+	return layout.template
+}
+
+func (layout *FSLayout) literal(comps []string) []string {
+	l := make([]string, len(comps))
+	for i, comp := range comps {
+		l[i] = strings.ReplaceAll(comp, "%%", "%")
+	}
+	return l
+}
+
+// networkDir returns the directory containing the logs of a network.
+func (layout *FSLayout) networkDir(root, network string) string {
+	elems := []string{root}
+	elems = append(elems, layout.literal(layout.components[:layout.network])...)
+	elems = append(elems, EscapePathComponent(network))
+	return filepath.Join(elems...)
+}
+
+// targetsDir returns the directory containing one sub-directory per target.
+func (layout *FSLayout) targetsDir(root, network string) string {
+	elems := []string{layout.networkDir(root, network)}
+	elems = append(elems, layout.literal(layout.components[layout.network+1:layout.target])...)
+	return filepath.Join(elems...)
+}
+
+// path returns the path of the log file of a target for the day of t.
+func (layout *FSLayout) path(root, network, target string, t time.Time) string {
+	year, month, day := t.Date()
+	r := strings.NewReplacer(
+		"%%", "%",
+		"%Y", fmt.Sprintf("%04d", year),
+		"%m", fmt.Sprintf("%02d", month),
+		"%d", fmt.Sprintf("%02d", day),
+	)
+
+	elems := []string{layout.targetsDir(root, network), EscapePathComponent(target)}
+	for _, comp := range layout.components[layout.target+1:] {
+		elems = append(elems, r.Replace(comp))
+	}
+	return filepath.Join(elems...)
+}
+
+// legacyNetworkDir returns the directory containing the logs of a network in
+// the legacy layout.
+func legacyNetworkDir(root, network string) string {
+	return filepath.Join(root, EscapeFilename(network))
+}
+
+// legacyPath returns the path of a log file in the legacy layout.
+func legacyPath(root, network, target string, t time.Time) string {
+	year, month, day := t.Date()
+	filename := fmt.Sprintf("%04d-%02d-%02d.log", year, month, day)
+	return filepath.Join(legacyNetworkDir(root, network), EscapeFilename(target), filename)
+}
+
+// EscapePathComponent escapes a name so that it can be safely used as a path
+// component. Unlike EscapeFilename, the escaping is reversible: distinct names
+// always result in distinct path components.
+//
+// The percent sign, path separators, control characters and invalid UTF-8
+// bytes are replaced with "%XX", where XX is the hexadecimal byte value. A
+// leading dot is escaped as well, so that "." and ".." can't be produced and
+// no file is hidden.
+func EscapePathComponent(name string) string {
+	var sb strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		if r == '%' || r == '/' || r == '\\' || r < 0x20 || r == 0x7F || (r == utf8.RuneError && size == 1) || (i == 0 && r == '.') {
+			for j := 0; j < size; j++ {
+				fmt.Fprintf(&sb, "%%%02X", name[i+j])
+			}
+		} else {
+			sb.WriteString(name[i : i+size])
+		}
+		i += size
+	}
+	return sb.String()
+}
+
+// UnescapePathComponent reverses EscapePathComponent.
+func UnescapePathComponent(s string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			sb.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		b, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape sequence in %q", s)
+		}
+		sb.WriteByte(byte(b))
+		i += 2
+	}
+	return sb.String(), nil
+}
@@ -49,7 +49,11 @@ type memoryMessageStore struct {
 	buffers map[ringBufferKey]*messageRingBuffer
 }
 
-var _ Store = (*memoryMessageStore)(nil)
+var (
+	_ Store             = (*memoryMessageStore)(nil)
+	_ RedactStore       = (*memoryMessageStore)(nil)
+	_ RenameTargetStore = (*memoryMessageStore)(nil)
+)
 
 func NewMemoryStore() *memoryMessageStore {
 	return &memoryMessageStore{
@@ -101,6 +105,29 @@ func (ms *memoryMessageStore) Append(network *database.Network, entity string, m
 	return formatMemoryMsgID(network.ID, entity, seq), nil
 }
 
+func (ms *memoryMessageStore) RedactMessage(network *database.Network, entity, msgID string) error {
+	k := ringBufferKey{networkID: network.ID, entity: entity}
+	if rb, ok := ms.buffers[k]; ok {
+		rb.Redact(msgID)
+	}
+	return nil
+}
+
+func (ms *memoryMessageStore) RenameTarget(network *database.Network, oldName, newName string) error {
+	oldKey := ringBufferKey{networkID: network.ID, entity: oldName}
+	newKey := ringBufferKey{networkID: network.ID, entity: newName}
+	rb, ok := ms.buffers[oldKey]
+	if !ok {
+		return nil
+	}
+	if _, ok := ms.buffers[newKey]; ok {
+		return fmt.Errorf("target %q already exists", newName)
+	}
+	delete(ms.buffers, oldKey)
+	ms.buffers[newKey] = rb
+	return nil
+}
+
 func (ms *memoryMessageStore) LoadLatestID(ctx context.Context, id string, options *LoadMessageOptions) ([]*irc.Message, error) {
 	if options.Events {
 		return nil, fmt.Errorf("events are unsupported for memory message store")
@@ -161,11 +188,25 @@ func (rb *messageRingBuffer) LoadLatestSeq(seq uint64, limit int) ([]*irc.Messag
 		diff = uint64(limit)
 	}
 
-	l := make([]*irc.Message, int(diff))
+	l := make([]*irc.Message, 0, int(diff))
 	for i := 0; i < int(diff); i++ {
 		j := int((rb.cur - diff + uint64(i)) % rb.cap())
-		l[i] = rb.buf[j]
+		if rb.buf[j] != nil {
+			l = append(l, rb.buf[j])
+		}
 	}
 
 	return l, nil
 }
+
+// Redact removes the message with the specified msgid tag from the buffer.
+func (rb *messageRingBuffer) Redact(msgID string) {
+	if msgID == "" {
+		return
+	}
+	for i, msg := range rb.buf {
+		if msg != nil && msg.Tags["msgid"] == msgID {
+			rb.buf[i] = nil
+		}
+	}
+}
@@ -84,6 +84,52 @@ type RenameNetworkStore interface {
 	RenameNetwork(oldNet, newNet *database.Network) error
 }
 
+// RenameTargetStore is a message store which supports renaming targets, so
+// that the history of a renamed channel remains reachable under its new name.
+type RenameTargetStore interface {
+	Store
+
+	RenameTarget(network *database.Network, oldName, newName string) error
+}
+
+// RedactStore is a message store which supports message redaction.
+type RedactStore interface {
+	Store
+
+	// RedactMessage marks the message with the specified msgid tag as
+	// redacted, so that it's omitted from history queries. Unknown message
+	// IDs are ignored.
+	RedactMessage(network *database.Network, entity, msgID string) error
+}
+
+type TargetSummary struct {
+	Name       string
+	Messages   int
+	Highlights int
+}
+
+// HighlightMatcher detects the highlights counted in a summary.
+type HighlightMatcher struct {
+	// Keywords contains, for each target, strings such that the text of
+	// any highlight contains at least one of them. Targets without keywords
+	// have no highlights.
+	Keywords map[string][]string
+	// IsHighlight reports whether a message of a target is a highlight.
+	IsHighlight func(target string, msg *irc.Message) bool
+}
+
+// SummaryStore is a message store which can count messages without loading
+// them all.
+type SummaryStore interface {
+	Store
+
+	// CountMissedMessages counts the messages of each target stored after
+	// the latest of the provided message IDs. Messages sent by nick are
+	// skipped. Only messages containing keywords are loaded to count
+	// highlights.
+	CountMissedMessages(ctx context.Context, network *database.Network, ids []string, nick string, highlights *HighlightMatcher) ([]TargetSummary, error)
+}
+
 type msgIDType uint
 
 const (
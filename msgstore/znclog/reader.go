@@ -1,7 +1,9 @@
 package znclog
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"strings"
 	"time"
 
@@ -13,7 +15,80 @@ import (
 
 var timestampPrefixLen = len("[01:02:03] ")
 
-func UnmarshalLine(line string, user *database.User, network *database.Network, entity string, ref time.Time, events bool) (*irc.Message, time.Time, error) {
+// continuationPrefix marks a line holding the next text line of the previous
+// multiline message.
+const continuationPrefix = "+ "
+
+func isContinuationLine(line string) bool {
+	return len(line) >= timestampPrefixLen && strings.HasPrefix(line[timestampPrefixLen:], continuationPrefix)
+}
+
+// Scanner reads log records, each record being a log line followed by its
+// continuation lines, if any.
+type Scanner struct {
+	sc      *bufio.Scanner
+	record  string
+	next    string
+	hasNext bool
+}
+
+func NewScanner(r io.Reader) *Scanner {
+	return &Scanner{sc: bufio.NewScanner(r)}
+}
+
+// Scan advances to the next record.
+func (s *Scanner) Scan() bool {
+	if s.hasNext {
+		s.record, s.hasNext = s.next, false
+	} else if s.sc.Scan() {
+		s.record = s.sc.Text()
+	} else {
+		return false
+	}
+
+	var lines []string
+	for s.sc.Scan() {
+		line := s.sc.Text()
+		if !isContinuationLine(line) {
+			s.next, s.hasNext = line, true
+			break
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > 0 {
+		s.record += "\n" + strings.Join(lines, "\n")
+	}
+	return true
+}
+
+// Text returns the current record, suitable for UnmarshalLine.
+func (s *Scanner) Text() string {
+	return s.record
+}
+
+func (s *Scanner) Err() error {
+	return s.sc.Err()
+}
+
+// UnmarshalLine parses a log record, as returned by Scanner.
+func UnmarshalLine(record string, user *database.User, network *database.Network, entity string, ref time.Time, events bool) (*irc.Message, time.Time, error) {
+	line, rest, _ := strings.Cut(record, "\n")
+
+	// Text lines of a multiline message, after the first one
+	var textLines []string
+	for rest != "" {
+		var cont string
+		cont, rest, _ = strings.Cut(rest, "\n")
+		if !isContinuationLine(cont) {
+			return nil, time.Time{}, fmt.Errorf("malformed continuation line")
+		}
+		textLines = append(textLines, cont[timestampPrefixLen+len(continuationPrefix):])
+	}
+	var textSuffix string
+	if len(textLines) > 0 {
+		textSuffix = "\n" + strings.Join(textLines, "\n")
+	}
+
 	var hour, minute, second int
 	_, err := fmt.Sscanf(line, "[%02d:%02d:%02d] ", &hour, &minute, &second)
 	if err != nil {
@@ -117,21 +192,21 @@ func UnmarshalLine(line string, user *database.User, network *database.Network,
 			if len(parts) != 2 {
 				return nil, time.Time{}, nil
 			}
-			sender, text = parts[0], parts[1]
+			sender, text = parts[0], parts[1]+textSuffix
 		} else if strings.HasPrefix(line, "-") {
 			cmd = "NOTICE"
 			parts := strings.SplitN(line[1:], "- ", 2)
 			if len(parts) != 2 {
 				return nil, time.Time{}, nil
 			}
-			sender, text = parts[0], parts[1]
+			sender, text = parts[0], parts[1]+textSuffix
 		} else if strings.HasPrefix(line, "* ") {
 			cmd = "PRIVMSG"
 			parts := strings.SplitN(line[2:], " ", 2)
 			if len(parts) != 2 {
 				return nil, time.Time{}, nil
 			}
-			sender, text = parts[0], "\x01ACTION "+parts[1]+"\x01"
+			sender, text = parts[0], "\x01ACTION "+parts[1]+textSuffix+"\x01"
 		} else {
 			return nil, time.Time{}, nil
 		}
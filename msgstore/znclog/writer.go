@@ -10,12 +10,43 @@ import (
 	"git.sr.ht/~emersion/soju/xirc"
 )
 
+// MarshalLine formats a message as a log line. Logs can't contain line breaks,
+// so a PRIVMSG or NOTICE with a multiline text is written as one line per text
+// line: the first one is a regular log line, the next ones are continuation
+// lines whose text is prefixed with "+ ".
 func MarshalLine(msg *irc.Message, t time.Time) string {
+	timestamp := fmt.Sprintf("[%02d:%02d:%02d] ", t.Hour(), t.Minute(), t.Second())
+
+	if (msg.Command == "PRIVMSG" || msg.Command == "NOTICE") && len(msg.Params) >= 2 && strings.Contains(msg.Params[1], "\n") {
+		text := msg.Params[1]
+		cmd, params, isCTCP := xirc.ParseCTCPMessage(msg)
+		if isCTCP && cmd == "ACTION" {
+			text = params
+		}
+
+		lines := strings.Split(text, "\n")
+		firstMsg := msg.Copy()
+		firstMsg.Params = []string{msg.Params[0], lines[0]}
+		if isCTCP && cmd == "ACTION" {
+			firstMsg.Params[1] = "\x01ACTION " + lines[0] + "\x01"
+		}
+		s := formatMessage(firstMsg)
+		if s == "" {
+			return ""
+		}
+
+		records := []string{timestamp + s}
+		for _, line := range lines[1:] {
+			records = append(records, timestamp+continuationPrefix+line)
+		}
+		return strings.Join(records, "\n")
+	}
+
 	s := formatMessage(msg)
 	if s == "" {
 		return ""
 	}
-	return fmt.Sprintf("[%02d:%02d:%02d] %s", t.Hour(), t.Minute(), t.Second(), s)
+	return timestamp + s
 }
 
 // formatMessage formats a message log line. It assumes a well-formed IRC
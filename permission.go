@@ -0,0 +1,67 @@
+package soju
+
+import (
+	"git.sr.ht/~emersion/soju/database"
+)
+
+// permission is a bouncer-wide privilege granted by user roles.
+type permission int
+
+const (
+	// Granted to everybody
+	permissionNone permission = iota
+	// View the list of users and server statistics
+	permissionViewStatus
+	// Create new users
+	permissionCreateUsers
+	// Reset the password of other users
+	permissionResetPasswords
+	// Update roles, enable, disable, delete and impersonate other users
+	permissionManageUsers
+	// Send notices and announcements to all users
+	permissionBroadcast
+	// Appear as an IRC operator to clients
+	permissionOperator
+)
+
+var rolePermissions = map[database.Role][]permission{
+	database.RoleObserver: {
+		permissionViewStatus,
+	},
+	database.RoleUserManager: {
+		permissionViewStatus,
+		permissionCreateUsers,
+		permissionResetPasswords,
+	},
+}
+
+// hasPermission checks whether a role grants a permission. All authorization
+// checks must go through this function.
+func hasPermission(role database.Role, perm permission) bool {
+	if perm == permissionNone || role == database.RoleAdmin {
+		return true
+	}
+	for _, p := range rolePermissions[role] {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRole(s string) (database.Role, error) {
+	switch role := database.Role(s); role {
+	case database.RoleAdmin, database.RoleUserManager, database.RoleObserver:
+		return role, nil
+	case "user":
+		return database.RoleUser, nil
+	}
+	return "", serviceErrorf("unknown role: %q", s)
+}
+
+func formatRole(role database.Role) string {
+	if role == database.RoleUser {
+		return "user"
+	}
+	return string(role)
+}
@@ -0,0 +1,61 @@
+package soju
+
+import (
+	"testing"
+
+	"git.sr.ht/~emersion/soju/database"
+)
+
+func TestHasPermission(t *testing.T) {
+	roles := []database.Role{
+		database.RoleUser,
+		database.RoleObserver,
+		database.RoleUserManager,
+		database.RoleAdmin,
+	}
+
+	testCases := []struct {
+		name       string
+		permission permission
+		granted    []database.Role
+	}{
+		{"none", permissionNone, roles},
+		{"view-status", permissionViewStatus, []database.Role{database.RoleObserver, database.RoleUserManager, database.RoleAdmin}},
+		{"create-users", permissionCreateUsers, []database.Role{database.RoleUserManager, database.RoleAdmin}},
+		{"reset-passwords", permissionResetPasswords, []database.Role{database.RoleUserManager, database.RoleAdmin}},
+		{"manage-users", permissionManageUsers, []database.Role{database.RoleAdmin}},
+		{"broadcast", permissionBroadcast, []database.Role{database.RoleAdmin}},
+		{"operator", permissionOperator, []database.Role{database.RoleAdmin}},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			for _, role := range roles {
+				want := false
+				for _, r := range tc.granted {
+					if r == role {
+						want = true
+					}
+				}
+				if got := hasPermission(role, tc.permission); got != want {
+					t.Errorf("hasPermission(%q) = %v, want %v", formatRole(role), got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseRole(t *testing.T) {
+	for _, s := range []string{"user", "admin", "user-manager", "observer"} {
+		role, err := parseRole(s)
+		if err != nil {
+			t.Errorf("parseRole(%q) failed: %v", s, err)
+		} else if formatRole(role) != s {
+			t.Errorf("formatRole(parseRole(%q)) = %q", s, formatRole(role))
+		}
+	}
+	if _, err := parseRole("root"); err == nil {
+		t.Errorf("parseRole(%q) succeeded", "root")
+	}
+}
@@ -0,0 +1,213 @@
+package soju
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v4"
+
+	"git.sr.ht/~emersion/soju/msgstore"
+)
+
+// The znc.in/playback capability lets clients fetch history by sending
+// commands to the *playback pseudo-user, see:
+// https://wiki.znc.in/Playback
+
+const playbackNick = "*playback"
+const playbackNickCM = "*playback"
+
+var playbackPrefix = &irc.Prefix{
+	Name: playbackNick,
+	User: "znc",
+	Host: "znc.in",
+}
+
+func sendPlaybackPRIVMSG(dc *downstreamConn, text string) {
+	dc.SendMessage(context.TODO(), &irc.Message{
+		Prefix:  playbackPrefix,
+		Command: "PRIVMSG",
+		Params:  []string{dc.nick, text},
+	})
+}
+
+// parsePlaybackTime parses a ZNC timestamp, which is a number of seconds
+// since the Unix epoch with an optional fractional part.
+func parsePlaybackTime(s string) (time.Time, error) {
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 || math.IsInf(f, 0) || math.IsNaN(f) {
+		return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*1e9)), nil
+}
+
+func formatPlaybackTime(t time.Time) string {
+	return fmt.Sprintf("%d.%03d", t.Unix(), t.Nanosecond()/int(time.Millisecond))
+}
+
+// matchPlaybackBuffer checks whether a buffer name matches a pattern, where
+// "*" matches any sequence of characters and "?" matches any character.
+//
+// Patterns are sent by clients, so this only ever backtracks to the last "*"
+// to keep the matching time linear in the length of both strings.
+func matchPlaybackBuffer(pattern, name string) bool {
+	p, n := 0, 0
+	starP, starN := -1, 0
+	for n < len(name) {
+		switch {
+		case p < len(pattern) && pattern[p] == '*':
+			starP, starN = p, n
+			p++
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == name[n]):
+			p++
+			n++
+		case starP >= 0:
+			// Let the last "*" swallow one more character
+			starN++
+			p, n = starP+1, starN
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func (dc *downstreamConn) handlePlaybackPRIVMSG(ctx context.Context, text string) error {
+	network := dc.network
+	if network == nil {
+		return fmt.Errorf("cannot fetch chat history on bouncer connection")
+	}
+
+	store, ok := dc.user.msgStore.(msgstore.ChatHistoryStore)
+	if !ok {
+		return fmt.Errorf("chat history disabled")
+	}
+
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return fmt.Errorf("missing command")
+	}
+	cmd, args := strings.ToUpper(words[0]), words[1:]
+
+	switch cmd {
+	case "PLAY":
+		if len(args) < 1 || len(args) > 3 {
+			return fmt.Errorf("usage: PLAY <buffer(s)> [from] [to]")
+		}
+		var from, to time.Time
+		var err error
+		if len(args) > 1 {
+			if from, err = parsePlaybackTime(args[1]); err != nil {
+				return err
+			}
+		}
+		if len(args) > 2 {
+			if to, err = parsePlaybackTime(args[2]); err != nil {
+				return err
+			}
+		} else {
+			to = time.Now()
+		}
+
+		targets, err := dc.listPlaybackBuffers(ctx, store, args[0], from, to)
+		if err != nil {
+			return err
+		}
+		for _, target := range targets {
+			options := msgstore.LoadMessageOptions{
+				Network: &network.Network,
+				Entity:  network.casemap(target),
+				Limit:   backlogLimit,
+			}
+			// Load backwards from the end of the range, so that the most
+			// recent messages are sent if there are more than the limit
+			history, err := store.LoadBeforeTime(ctx, to, from, &options)
+			if err != nil {
+				dc.logger.Printf("failed fetching %q messages for playback: %v", target, err)
+				return fmt.Errorf("failed to retrieve messages for %v", target)
+			}
+			if len(history) == 0 {
+				continue
+			}
+
+			dc.SendBatch(ctx, "znc.in/playback", []string{target}, nil, func(batchRef string) {
+				for _, msg := range history {
+					msg.Tags["batch"] = batchRef
+					dc.SendMessage(ctx, msg)
+				}
+			})
+		}
+	case "LIST":
+		pattern := "*"
+		if len(args) > 0 {
+			pattern = args[0]
+		}
+		targets, err := store.ListTargets(ctx, &network.Network, time.Now(), time.Time{}, chatHistoryLimit, false)
+		if err != nil {
+			dc.logger.Printf("failed fetching targets for playback: %v", err)
+			return fmt.Errorf("failed to retrieve buffers")
+		}
+		for _, target := range targets {
+			if playbackBuffersMatch(network, pattern, target.Name) {
+				sendPlaybackPRIVMSG(dc, fmt.Sprintf("%v %v", target.Name, formatPlaybackTime(target.LatestMessage)))
+			}
+		}
+	case "CLEAR":
+		// Clients use this to drop messages they've already received, but the
+		// message store is shared with other clients and CHATHISTORY: keep it
+		// untouched
+		if len(args) != 1 {
+			return fmt.Errorf("usage: CLEAR <buffer(s)>")
+		}
+	default:
+		return fmt.Errorf("unknown command %q", words[0])
+	}
+
+	return nil
+}
+
+// playbackBuffersMatch checks whether a buffer name matches a comma-separated
+// list of patterns.
+func playbackBuffersMatch(network *network, patterns, name string) bool {
+	nameCM := network.casemap(name)
+	for _, pattern := range strings.Split(patterns, ",") {
+		if matchPlaybackBuffer(network.casemap(pattern), nameCM) {
+			return true
+		}
+	}
+	return false
+}
+
+// listPlaybackBuffers returns the buffers matching a comma-separated list of
+// patterns, with messages between from and to.
+func (dc *downstreamConn) listPlaybackBuffers(ctx context.Context, store msgstore.ChatHistoryStore, patterns string, from, to time.Time) ([]string, error) {
+	network := dc.network
+
+	if !strings.ContainsAny(patterns, "*?") {
+		return strings.Split(patterns, ","), nil
+	}
+
+	targets, err := store.ListTargets(ctx, &network.Network, to, from, chatHistoryLimit, false)
+	if err != nil {
+		dc.logger.Printf("failed fetching targets for playback: %v", err)
+		return nil, fmt.Errorf("failed to retrieve buffers")
+	}
+
+	var names []string
+	for _, target := range targets {
+		if ch := network.channels.Get(target.Name); ch != nil && ch.Detached {
+			continue
+		}
+		if playbackBuffersMatch(network, patterns, target.Name) {
+			names = append(names, target.Name)
+		}
+	}
+	return names, nil
+}
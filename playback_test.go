@@ -0,0 +1,69 @@
+package soju
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePlaybackTime(t *testing.T) {
+	testCases := []struct {
+		s    string
+		want time.Time
+		err  bool
+	}{
+		{"0", time.Unix(0, 0), false},
+		{"1700000000", time.Unix(1700000000, 0), false},
+		{"1700000000.25", time.Unix(1700000000, 250000000), false},
+		{"-1", time.Time{}, true},
+		{"NaN", time.Time{}, true},
+		{"Inf", time.Time{}, true},
+		{"soju", time.Time{}, true},
+	}
+	for _, tc := range testCases {
+		got, err := parsePlaybackTime(tc.s)
+		if tc.err {
+			if err == nil {
+				t.Errorf("parsePlaybackTime(%q) = %v, want error", tc.s, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parsePlaybackTime(%q) failed: %v", tc.s, err)
+		} else if !got.Equal(tc.want) {
+			t.Errorf("parsePlaybackTime(%q) = %v, want %v", tc.s, got, tc.want)
+		}
+	}
+
+	if s := formatPlaybackTime(time.Unix(1700000000, 250000000)); s != "1700000000.250" {
+		t.Errorf("formatPlaybackTime() = %q, want %q", s, "1700000000.250")
+	}
+}
+
+func TestMatchPlaybackBuffer(t *testing.T) {
+	testCases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*", "#soju", true},
+		{"*", "", true},
+		{"#soju", "#soju", true},
+		{"#soju", "#sojuu", false},
+		{"#*", "#soju", true},
+		{"#*", "emersion", false},
+		{"#s?ju", "#soju", true},
+		{"#s?ju", "#sju", false},
+		{"*ju", "#soju", true},
+		{"#*o*", "#soju", true},
+		{"#**", "#soju", true},
+		{"*o*o", "#soju", false},
+		{"#?", "#", false},
+		{strings.Repeat("*a", 32) + "*b", strings.Repeat("a", 256), false},
+		{strings.Repeat("*a", 32) + "*b", strings.Repeat("a", 256) + "b", true},
+	}
+	for _, tc := range testCases {
+		if got := matchPlaybackBuffer(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("matchPlaybackBuffer(%q, %q) = %v, want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package soju
 
 import (
+	"context"
 	"math/rand"
+	"sync"
 	"time"
+
+	"golang.org/x/time/rate"
 )
 
 // backoffer implements a simple exponential backoff.
@@ -38,3 +42,172 @@ func (b *backoffer) Next() time.Duration {
 
 	return d
 }
+
+// maxKeyedLimiters is the number of keys above which fully replenished
+// limiters are pruned.
+const maxKeyedLimiters = 1024
+
+// keyedLimiter rate-limits events per key (e.g. per IP address) with a token
+// bucket. The zero value is ready to use.
+type keyedLimiter struct {
+	lock     sync.Mutex
+	limiters map[string]*rate.Limiter
+}
+
+// Allow reports whether an event may happen now for the specified key, with
+// at most perMinute events per minute. If perMinute is zero or negative, all
+// events are allowed. Existing limiters are adjusted if perMinute changes.
+func (kl *keyedLimiter) Allow(key string, perMinute int) bool {
+	return kl.AllowPer(key, perMinute, time.Minute)
+}
+
+// AllowPer is like Allow, but with at most n events per period.
+func (kl *keyedLimiter) AllowPer(key string, n int, period time.Duration) bool {
+	if n <= 0 {
+		return true
+	}
+
+	kl.lock.Lock()
+	defer kl.lock.Unlock()
+
+	if kl.limiters == nil {
+		kl.limiters = make(map[string]*rate.Limiter)
+	}
+
+	limit := rate.Every(period / time.Duration(n))
+	rl, ok := kl.limiters[key]
+	if !ok {
+		if len(kl.limiters) >= maxKeyedLimiters {
+			kl.pruneLocked()
+		}
+		rl = rate.NewLimiter(limit, n)
+		kl.limiters[key] = rl
+	} else if rl.Limit() != limit || rl.Burst() != n {
+		rl.SetLimit(limit)
+		rl.SetBurst(n)
+	}
+
+	return rl.Allow()
+}
+
+// pruneLocked removes limiters which are fully replenished, since they are
+// equivalent to fresh ones.
+func (kl *keyedLimiter) pruneLocked() {
+	for key, rl := range kl.limiters {
+		if rl.Tokens() >= float64(rl.Burst()) {
+			delete(kl.limiters, key)
+		}
+	}
+}
+
+// dialQueue limits the number of concurrent upstream connection attempts.
+// Waiting attempts are served round-robin across keys (e.g. usernames), so
+// that a key with many attempts can't starve others. The zero value is ready
+// to use.
+type dialQueue struct {
+	lock    sync.Mutex
+	limit   int
+	active  int
+	waiting int
+	queues  map[string][]chan struct{} // FIFO per key
+	order   []string                   // keys with waiting attempts
+}
+
+// Acquire waits until an attempt may start for the specified key, with at
+// most limit concurrent attempts. If limit is zero or negative, attempts
+// start immediately. The returned function must be called when the attempt
+// is over.
+func (q *dialQueue) Acquire(ctx context.Context, key string, limit int) (release func(), err error) {
+	q.lock.Lock()
+	q.limit = limit
+	if q.waiting == 0 && (limit <= 0 || q.active < limit) {
+		q.active++
+		q.lock.Unlock()
+		return q.release, nil
+	}
+
+	if q.queues == nil {
+		q.queues = make(map[string][]chan struct{})
+	}
+	ch := make(chan struct{})
+	if len(q.queues[key]) == 0 {
+		q.order = append(q.order, key)
+	}
+	q.queues[key] = append(q.queues[key], ch)
+	q.waiting++
+	q.lock.Unlock()
+
+	select {
+	case <-ch:
+		return q.release, nil
+	case <-ctx.Done():
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	select {
+	case <-ch:
+		// The slot has been granted concurrently, hand it over
+		q.active--
+		q.grantLocked()
+	default:
+		q.removeLocked(key, ch)
+	}
+	return nil, ctx.Err()
+}
+
+// Len returns the number of waiting attempts.
+func (q *dialQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.waiting
+}
+
+func (q *dialQueue) release() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.active--
+	q.grantLocked()
+}
+
+func (q *dialQueue) grantLocked() {
+	for len(q.order) > 0 && (q.limit <= 0 || q.active < q.limit) {
+		key := q.order[0]
+		q.order = q.order[1:]
+
+		queue := q.queues[key]
+		ch := queue[0]
+		if len(queue) > 1 {
+			q.queues[key] = queue[1:]
+			q.order = append(q.order, key)
+		} else {
+			delete(q.queues, key)
+		}
+
+		q.waiting--
+		q.active++
+		close(ch)
+	}
+}
+
+func (q *dialQueue) removeLocked(key string, ch chan struct{}) {
+	queue := q.queues[key]
+	for i, c := range queue {
+		if c == ch {
+			queue = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	q.waiting--
+	if len(queue) > 0 {
+		q.queues[key] = queue
+		return
+	}
+	delete(q.queues, key)
+	for i, k := range q.order {
+		if k == key {
+			q.order = append(q.order[:i], q.order[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package soju
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDialQueue(t *testing.T) {
+	var q dialQueue
+	ctx := context.Background()
+
+	release, err := q.Acquire(ctx, "first", 1)
+	if err != nil {
+		t.Fatalf("Acquire() = %v", err)
+	}
+
+	var (
+		mu    sync.Mutex
+		order []string
+		wg    sync.WaitGroup
+	)
+	enqueue := func(key string) {
+		n := q.Len()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := q.Acquire(ctx, key, 1)
+			if err != nil {
+				t.Errorf("Acquire() = %v", err)
+				return
+			}
+			mu.Lock()
+			order = append(order, key)
+			mu.Unlock()
+			release()
+		}()
+		for q.Len() == n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	enqueue("a")
+	enqueue("a")
+	enqueue("a")
+	enqueue("b")
+
+	// A cancelled attempt is removed from the queue
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := q.Acquire(cancelCtx, "c", 1); err == nil {
+		t.Errorf("Acquire() with a cancelled context succeeded")
+	}
+	if n := q.Len(); n != 4 {
+		t.Errorf("Len() = %v, want 4", n)
+	}
+
+	release()
+	wg.Wait()
+
+	want := []string{"a", "b", "a", "a"}
+	if len(order) != len(want) {
+		t.Fatalf("got order %v, want %v", order, want)
+	}
+	for i := range want {
+		if order[i] != want[i] {
+			t.Fatalf("got order %v, want %v", order, want)
+		}
+	}
+	if n := q.Len(); n != 0 {
+		t.Errorf("Len() = %v, want 0", n)
+	}
+}
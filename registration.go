@@ -0,0 +1,288 @@
+package soju
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"git.sr.ht/~emersion/soju/config"
+	"git.sr.ht/~emersion/soju/database"
+)
+
+const (
+	// registrationMinPasswordLen is the minimum length of passwords chosen
+	// by self-registered users
+	registrationMinPasswordLen = 8
+	// registrationCodeTTL is the duration after which unverified
+	// registrations expire
+	registrationCodeTTL = 24 * time.Hour
+	// registrationCallbackTimeout is the maximum time spent sending a
+	// verification code
+	registrationCallbackTimeout = 30 * time.Second
+)
+
+// accountRegistrationError is an error reported to clients with a FAIL
+// message, as described in the draft/account-registration specification.
+type accountRegistrationError struct {
+	code    string
+	message string
+}
+
+func (err *accountRegistrationError) Error() string {
+	return err.message
+}
+
+// pendingRegistration is a user account waiting for its email address to be
+// verified. Registrations without a code are being created: they keep the
+// username reserved until the account is stored.
+type pendingRegistration struct {
+	user    *database.User
+	code    string
+	expires time.Time
+}
+
+// allowRegistration checks whether a registration attempt from the specified
+// remote address is allowed by the rate limit.
+func (s *Server) allowRegistration(addr net.Addr, reg *config.Registration) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return s.registerLimiter.AllowPer(host, reg.PerIPPerHour, time.Hour)
+}
+
+// registerUser creates a new user account on behalf of an unauthenticated
+// client. If email verification is enabled, the account is only created once
+// verifyRegistration is called with the code sent to the email address, and
+// verified is false.
+func (s *Server) registerUser(ctx context.Context, reg *config.Registration, username, email, password string) (verified bool, err error) {
+	if err := checkRegistrationUsername(reg, username); err != nil {
+		return false, err
+	}
+	if len(password) < registrationMinPasswordLen {
+		return false, &accountRegistrationError{"WEAK_PASSWORD", fmt.Sprintf("Password must be at least %v characters long", registrationMinPasswordLen)}
+	}
+	if reg.Verification != nil {
+		if email == "*" || email == "" {
+			return false, &accountRegistrationError{"INVALID_EMAIL", "An email address is required"}
+		}
+		addr, err := mail.ParseAddress(email)
+		if err != nil || addr.Address != email {
+			return false, &accountRegistrationError{"INVALID_EMAIL", "Invalid email address"}
+		}
+	}
+
+	record := &database.User{
+		Username: username,
+		Enabled:  true,
+	}
+	if err := record.SetPassword(password); err != nil {
+		return false, err
+	}
+
+	if reg.Verification == nil {
+		pending := &pendingRegistration{user: record}
+		if err := s.reserveRegistration(reg, username, pending); err != nil {
+			return false, err
+		}
+		if err := s.createRegisteredUser(ctx, pending); err != nil {
+			return false, err
+		}
+		return true, nil
+	}
+
+	code, err := generateRegistrationCode()
+	if err != nil {
+		return false, err
+	}
+	pending := &pendingRegistration{
+		user:    record,
+		code:    code,
+		expires: time.Now().Add(registrationCodeTTL),
+	}
+	if err := s.reserveRegistration(reg, username, pending); err != nil {
+		return false, err
+	}
+	if err := sendRegistrationCode(ctx, reg.Verification, username, email, code); err != nil {
+		s.lock.Lock()
+		if s.pendingRegistrations[username] == pending {
+			delete(s.pendingRegistrations, username)
+		}
+		s.lock.Unlock()
+		return false, fmt.Errorf("failed to send verification code: %v", err)
+	}
+	return false, nil
+}
+
+// reserveRegistration checks that the username is available and that the
+// maximum number of users isn't reached, and reserves the username until the
+// registration is created or expires.
+func (s *Server) reserveRegistration(reg *config.Registration, username string, pending *pendingRegistration) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now()
+	for name, p := range s.pendingRegistrations {
+		if p.code != "" && now.After(p.expires) {
+			delete(s.pendingRegistrations, name)
+		}
+	}
+
+	if _, ok := s.users[username]; ok {
+		return &accountRegistrationError{"ACCOUNT_EXISTS", "Username is already taken"}
+	}
+	if _, ok := s.pendingRegistrations[username]; ok {
+		return &accountRegistrationError{"ACCOUNT_EXISTS", "Username is already taken"}
+	}
+	if reg.MaxUsers > 0 && len(s.users)+len(s.pendingRegistrations) >= reg.MaxUsers {
+		return &accountRegistrationError{"TEMPORARILY_UNAVAILABLE", "Registration is closed: maximum number of users reached"}
+	}
+
+	if s.pendingRegistrations == nil {
+		s.pendingRegistrations = make(map[string]*pendingRegistration)
+	}
+	s.pendingRegistrations[username] = pending
+	return nil
+}
+
+// createRegisteredUser creates the user account of a registration, and then
+// releases its reservation.
+func (s *Server) createRegisteredUser(ctx context.Context, pending *pendingRegistration) error {
+	username := pending.user.Username
+	_, err := s.createUser(ctx, pending.user)
+
+	s.lock.Lock()
+	if s.pendingRegistrations[username] == pending {
+		delete(s.pendingRegistrations, username)
+	}
+	_, exists := s.users[username]
+	s.lock.Unlock()
+
+	if err != nil && exists {
+		return &accountRegistrationError{"ACCOUNT_EXISTS", "Username is already taken"}
+	}
+	return err
+}
+
+// verifyRegistration creates the user account of a pending registration if
+// the code matches.
+func (s *Server) verifyRegistration(ctx context.Context, username, code string) error {
+	s.lock.Lock()
+	pending, ok := s.pendingRegistrations[username]
+	if ok && pending.code != "" && time.Now().After(pending.expires) {
+		delete(s.pendingRegistrations, username)
+		ok = false
+	}
+	if !ok || pending.code == "" || subtle.ConstantTimeCompare([]byte(pending.code), []byte(code)) != 1 {
+		s.lock.Unlock()
+		return &accountRegistrationError{"INVALID_CODE", "Invalid verification code"}
+	}
+	// Keep the username reserved while the account is created
+	pending.code = ""
+	s.lock.Unlock()
+
+	return s.createRegisteredUser(ctx, pending)
+}
+
+func checkRegistrationUsername(reg *config.Registration, username string) error {
+	if username == "" || strings.ContainsAny(username, "/@*?!:") || strings.IndexFunc(username, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) >= 0 {
+		return &accountRegistrationError{"BAD_ACCOUNT_NAME", "Invalid username"}
+	}
+	if !reg.AllowsUsername(username) {
+		return &accountRegistrationError{"BAD_ACCOUNT_NAME", "Username not allowed"}
+	}
+	return nil
+}
+
+func generateRegistrationCode() (string, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	var sb strings.Builder
+	for i := 0; i < 8; i++ {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(alphabet))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(alphabet[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+func sendRegistrationCode(ctx context.Context, verif *config.Verification, username, email, code string) error {
+	if verif.CallbackURL != "" {
+		return postRegistrationCode(ctx, verif.CallbackURL, username, email, code)
+	}
+	return mailRegistrationCode(verif, username, email, code)
+}
+
+func postRegistrationCode(ctx context.Context, callbackURL, username, email, code string) error {
+	ctx, cancel := context.WithTimeout(ctx, registrationCallbackTimeout)
+	defer cancel()
+
+	form := url.Values{
+		"username": {username},
+		"email":    {email},
+		"code":     {code},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("HTTP error: %v", resp.Status)
+	}
+	return nil
+}
+
+func mailRegistrationCode(verif *config.Verification, username, email, code string) error {
+	u, err := url.Parse(verif.SMTP)
+	if err != nil {
+		return err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "25")
+	}
+
+	var auth smtp.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = smtp.PlainAuth("", u.User.Username(), password, u.Hostname())
+	}
+
+	body := fmt.Sprintf("From: %v\r\n"+
+		"To: %v\r\n"+
+		"Subject: Verification code for %v\r\n"+
+		"Date: %v\r\n"+
+		"Content-Type: text/plain; charset=utf-8\r\n"+
+		"\r\n"+
+		"Your verification code for the account %q is: %v\r\n"+
+		"\r\n"+
+		"If you didn't request this account, you can ignore this email.\r\n",
+		verif.From, email, username, time.Now().Format(time.RFC1123Z), username, code)
+
+	from, err := mail.ParseAddress(verif.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(host, auth, from.Address, []string{email}, []byte(body))
+}
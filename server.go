@@ -25,23 +25,31 @@ import (
 	"git.sr.ht/~emersion/soju/database"
 	"git.sr.ht/~emersion/soju/fileupload"
 	"git.sr.ht/~emersion/soju/identd"
+	"git.sr.ht/~emersion/soju/msgstore"
 )
 
 var (
 	retryConnectMinDelay           = time.Minute
 	retryConnectMaxDelay           = 10 * time.Minute
 	retryConnectJitter             = time.Minute
+	retrySASLDelay                 = 15 * time.Minute
 	connectTimeout                 = 15 * time.Second
 	writeTimeout                   = 10 * time.Second
-	upstreamMessageDelay           = 2 * time.Second
-	upstreamMessageBurst           = 10
 	backlogTimeout                 = 10 * time.Second
 	handleDownstreamMessageTimeout = 10 * time.Second
-	downstreamRegisterTimeout      = 30 * time.Second
 	webpushCheckSubscriptionDelay  = 24 * time.Hour
 	webpushPruneSubscriptionDelay  = 30 * 24 * time.Hour
+	idleChannelsCheckInterval      = time.Hour
+	upstreamLagCheckInterval       = time.Minute
+	trafficStatsFlushInterval      = time.Minute
+	upstreamQuitTimeout            = 10 * time.Second
+	joinRetryMinDelay              = time.Minute
+	joinRetryMaxDelay              = time.Hour
+	joinRetryJitter                = time.Minute
+	proxyHostResolveTimeout        = 30 * time.Second
 	chatHistoryLimit               = 1000
 	backlogLimit                   = 4000
+	upstreamMaxLineLength          = 16384
 )
 
 var errWebPushSubscriptionExpired = fmt.Errorf("Web Push subscription expired")
@@ -138,20 +146,39 @@ func (ln *retryListener) Accept() (net.Conn, error) {
 }
 
 type Config struct {
-	Hostname                  string
-	Title                     string
-	MsgStoreDriver            string
-	MsgStorePath              string
-	HTTPOrigins               []string
-	HTTPIngress               string
-	AcceptProxyIPs            config.IPSet
-	MaxUserNetworks           int
-	MOTD                      string
-	UpstreamUserIPs           []*net.IPNet
-	DisableInactiveUsersDelay time.Duration
-	EnableUsersOnAuth         bool
-	Auth                      auth.Authenticator
-	FileUploader              fileupload.Uploader
+	Hostname                   string
+	Title                      string
+	MsgStoreDriver             string
+	MsgStorePath               string
+	MsgStoreFSLayout           *msgstore.FSLayout
+	HTTPOrigins                []string
+	HTTPIngress                string
+	AcceptProxyIPs             config.IPSet
+	AcceptProxyHosts           []string
+	AcceptProxyResolveInterval time.Duration
+	MaxUserNetworks            int
+	MOTD                       string
+	UpstreamUserIPs            []*net.IPNet
+	UpstreamResolver           string
+	UpstreamSocketOptions      config.SocketOptions
+	DisableInactiveUsersDelay  time.Duration
+	EnableUsersOnAuth          bool
+	OfflineEventMaxAge         time.Duration
+	DefaultNick                config.NetworkTemplate
+	DefaultUsername            config.NetworkTemplate
+	DefaultRealname            config.NetworkTemplate
+	UpstreamTLSMinVersion      uint16
+	UpstreamTLSCipherSuites    []uint16
+	DownstreamRegisterTimeout  time.Duration
+	WebSocketReadTimeout       time.Duration
+	UpstreamBanRetryDelay      time.Duration
+	UpstreamPresenceCaps       bool
+	Limits                     config.Limits
+	Registration               *config.Registration // nil if disabled
+	DCCRelay                   *config.DCCRelay     // nil if disabled
+	NetworkHealth              config.NetworkHealth
+	Auth                       auth.Authenticator
+	FileUploader               fileupload.Uploader
 }
 
 type Server struct {
@@ -169,17 +196,35 @@ type Server struct {
 	users     map[string]*user
 	shutdown  bool
 
+	announcement *database.Announcement // protected by lock
+
+	proxyHostIPs atomic.Value // map[string]config.IPSet
+	proxyHostsCh chan struct{}
+
+	loginLimiter    keyedLimiter // per IP address
+	serviceLimiter  keyedLimiter // per username
+	registerLimiter keyedLimiter // per IP address
+	dialQueue       dialQueue    // per username
+	dccRelay        dccRelay
+
+	pendingRegistrations map[string]*pendingRegistration // protected by lock
+
 	metrics struct {
-		downstreams int64Gauge
-		upstreams   int64Gauge
+		downstreams       int64Gauge
+		upstreams         int64Gauge
+		degradedUpstreams int64Gauge
 
 		upstreamOutMessagesTotal   prometheus.Counter
 		upstreamInMessagesTotal    prometheus.Counter
+		upstreamOutBytesTotal      prometheus.Counter
+		upstreamInBytesTotal       prometheus.Counter
 		downstreamOutMessagesTotal prometheus.Counter
 		downstreamInMessagesTotal  prometheus.Counter
 
 		upstreamConnectErrorsTotal prometheus.Counter
 		workerPanicsTotal          prometheus.Counter
+
+		upstreamLag prometheus.Histogram
 	}
 
 	webPush *database.WebPushConfig
@@ -192,11 +237,19 @@ func NewServer(db database.Database) *Server {
 		listeners: make(map[net.Listener]struct{}),
 		users:     make(map[string]*user),
 		stopCh:    make(chan struct{}),
+
+		proxyHostsCh: make(chan struct{}, 1),
 	}
 	srv.config.Store(&Config{
 		Hostname:        "localhost",
 		MaxUserNetworks: -1,
 		Auth:            auth.NewInternal(),
+		Limits:          config.DefaultLimits(),
+		NetworkHealth:   config.DefaultNetworkHealth(),
+
+		DownstreamRegisterTimeout: 30 * time.Second,
+
+		UpstreamPresenceCaps: true,
 	})
 	return srv
 }
@@ -210,7 +263,48 @@ func (s *Server) Config() *Config {
 }
 
 func (s *Server) SetConfig(cfg *Config) {
-	s.config.Store(cfg)
+	old := s.config.Swap(cfg).(*Config)
+	if !stringSlicesEqual(old.AcceptProxyHosts, cfg.AcceptProxyHosts) {
+		select {
+		case s.proxyHostsCh <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// allowLogin checks whether a login attempt from the specified remote address
+// is allowed by the rate limit.
+func (s *Server) allowLogin(addr net.Addr) bool {
+	host := addr.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return s.loginLimiter.Allow(host, s.Config().Limits.LoginsPerMinute)
+}
+
+// AcceptsProxy checks whether the PROXY protocol and forwarding HTTP header
+// fields are accepted from the specified IP.
+func (s *Server) AcceptsProxy(ip net.IP) bool {
+	cfg := s.Config()
+	if cfg.AcceptProxyIPs.Contains(ip) {
+		return true
+	}
+	resolved, _ := s.proxyHostIPs.Load().(map[string]config.IPSet)
+	for _, host := range cfg.AcceptProxyHosts {
+		if resolved[host].Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenerAcceptsProxy is like AcceptsProxy, but checks the listener-specific
+// trusted proxy IPs instead of the global ones if non-nil.
+func (s *Server) ListenerAcceptsProxy(ips config.IPSet, ip net.IP) bool {
+	if ips != nil {
+		return ips.Contains(ip)
+	}
+	return s.AcceptsProxy(ip)
 }
 
 func (s *Server) Start() error {
@@ -220,6 +314,17 @@ func (s *Server) Start() error {
 		return err
 	}
 
+	if err := s.loadAnnouncement(context.TODO()); err != nil {
+		return err
+	}
+
+	// The hosts are resolved below, no need to do it again in the loop
+	select {
+	case <-s.proxyHostsCh:
+	default:
+	}
+	s.resolveProxyHosts(context.TODO())
+
 	users, err := s.db.ListUsers(context.TODO())
 	if err != nil {
 		return err
@@ -237,6 +342,12 @@ func (s *Server) Start() error {
 		s.disableInactiveUsersLoop()
 	}()
 
+	s.stopWG.Add(1)
+	go func() {
+		defer s.stopWG.Done()
+		s.resolveProxyHostsLoop()
+	}()
+
 	return nil
 }
 
@@ -258,11 +369,23 @@ func (s *Server) registerMetrics() {
 		Help: "Current number of downstream connections",
 	}, s.metrics.downstreams.Float64)
 
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "soju_upstream_connect_queue_length",
+		Help: "Current number of upstream connection attempts waiting to start",
+	}, func() float64 {
+		return float64(s.dialQueue.Len())
+	})
+
 	factory.NewGaugeFunc(prometheus.GaugeOpts{
 		Name: "soju_upstreams_active",
 		Help: "Current number of upstream connections",
 	}, s.metrics.upstreams.Float64)
 
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "soju_upstreams_degraded",
+		Help: "Current number of networks whose connection is degraded",
+	}, s.metrics.degradedUpstreams.Float64)
+
 	s.metrics.upstreamOutMessagesTotal = factory.NewCounter(prometheus.CounterOpts{
 		Name: "soju_upstream_out_messages_total",
 		Help: "Total number of outgoing messages sent to upstream servers",
@@ -273,6 +396,16 @@ func (s *Server) registerMetrics() {
 		Help: "Total number of incoming messages received from upstream servers",
 	})
 
+	s.metrics.upstreamOutBytesTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "soju_upstream_out_bytes_total",
+		Help: "Total number of bytes sent to upstream servers",
+	})
+
+	s.metrics.upstreamInBytesTotal = factory.NewCounter(prometheus.CounterOpts{
+		Name: "soju_upstream_in_bytes_total",
+		Help: "Total number of bytes received from upstream servers",
+	})
+
 	s.metrics.downstreamOutMessagesTotal = factory.NewCounter(prometheus.CounterOpts{
 		Name: "soju_downstream_out_messages_total",
 		Help: "Total number of outgoing messages sent to downstream clients",
@@ -288,6 +421,12 @@ func (s *Server) registerMetrics() {
 		Help: "Total number of upstream connection errors",
 	})
 
+	s.metrics.upstreamLag = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "soju_upstream_lag_seconds",
+		Help:    "Round-trip time of PING commands sent to upstream servers",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	})
+
 	s.metrics.workerPanicsTotal = factory.NewCounter(prometheus.CounterOpts{
 		Name: "soju_worker_panics_total",
 		Help: "Total number of panics in worker goroutines",
@@ -412,6 +551,57 @@ func (s *Server) createUser(ctx context.Context, user *database.User) (*user, er
 	return s.addUserLocked(user), nil
 }
 
+func (s *Server) loadAnnouncement(ctx context.Context) error {
+	announcements, err := s.db.ListAnnouncements(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list announcements: %v", err)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(announcements) > 0 {
+		s.announcement = &announcements[len(announcements)-1]
+	}
+	return nil
+}
+
+// Announcement returns the current announcement text, or an empty string if
+// there is none.
+func (s *Server) Announcement() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.announcement == nil {
+		return ""
+	}
+	return s.announcement.Text
+}
+
+// SetAnnouncement replaces the current announcement. An empty text clears it.
+func (s *Server) SetAnnouncement(ctx context.Context, text string) error {
+	announcements, err := s.db.ListAnnouncements(ctx)
+	if err != nil {
+		return err
+	}
+	for _, announcement := range announcements {
+		if err := s.db.DeleteAnnouncement(ctx, announcement.ID); err != nil {
+			return err
+		}
+	}
+
+	var announcement *database.Announcement
+	if text != "" {
+		announcement = &database.Announcement{Text: text}
+		if err := s.db.StoreAnnouncement(ctx, announcement); err != nil {
+			return err
+		}
+	}
+
+	s.lock.Lock()
+	s.announcement = announcement
+	s.lock.Unlock()
+	return nil
+}
+
 func (s *Server) forEachUser(f func(*user)) {
 	s.lock.Lock()
 	for _, u := range s.users {
@@ -577,7 +767,7 @@ func (s *Server) HandleAdmin(ic ircConn) {
 			err := handleServicePRIVMSG(&serviceContext{
 				Context: ctx,
 				srv:     s,
-				admin:   true,
+				role:    database.RoleAdmin,
 				print: func(text string) {
 					c.SendMessage(ctx, &irc.Message{
 						Prefix:  s.prefix(),
@@ -646,33 +836,64 @@ func (s *Server) Serve(ln net.Listener, handler func(ircConn)) error {
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h := WebSocketHandler{Server: s}
+	h.ServeHTTP(w, req)
+}
+
+// WebSocketHandler is an HTTP handler accepting WebSocket connections, with
+// listener-specific settings.
+type WebSocketHandler struct {
+	Server *Server
+
+	// If non-nil, overrides the server's allowed HTTP origins
+	HTTPOrigins []string
+	// How forwarding HTTP header fields are handled
+	AcceptProxy config.ProxyPolicy
+	// If non-nil, overrides the server's trusted proxy IPs
+	AcceptProxyIPs config.IPSet
+}
+
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s := h.Server
+
+	originPatterns := h.HTTPOrigins
+	if originPatterns == nil {
+		originPatterns = s.Config().HTTPOrigins
+	}
+
+	var forwarded map[string]string
+	switch h.AcceptProxy {
+	case config.ProxyRequired:
+		forwarded = parseForwarded(req.Header)
+		if forwarded["for"] == "" {
+			http.Error(w, "missing forwarding header field", http.StatusBadRequest)
+			return
+		}
+	case config.ProxyOptional:
+		if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			if ip := net.ParseIP(host); ip != nil && s.ListenerAcceptsProxy(h.AcceptProxyIPs, ip) {
+				forwarded = parseForwarded(req.Header)
+			}
+		}
+	}
+
 	conn, err := websocket.Accept(w, req, &websocket.AcceptOptions{
 		Subprotocols:   []string{"text.ircv3.net"}, // non-compliant, fight me
-		OriginPatterns: s.Config().HTTPOrigins,
+		OriginPatterns: originPatterns,
 	})
 	if err != nil {
 		s.Logger.Printf("failed to serve HTTP connection: %v", err)
 		return
 	}
 
-	isProxy := false
-	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if ip := net.ParseIP(host); ip != nil {
-			isProxy = s.Config().AcceptProxyIPs.Contains(ip)
-		}
-	}
-
 	// Only trust the Forwarded header field if this is a trusted proxy IP
 	// to prevent users from spoofing the remote address
 	remoteAddr := req.RemoteAddr
-	if isProxy {
-		forwarded := parseForwarded(req.Header)
-		if forwarded["for"] != "" {
-			remoteAddr = forwarded["for"]
-		}
+	if forwarded["for"] != "" {
+		remoteAddr = forwarded["for"]
 	}
 
-	s.Handle(newWebsocketIRCConn(conn, remoteAddr))
+	s.Handle(newWebsocketIRCConn(conn, remoteAddr, s.Config().WebSocketReadTimeout))
 }
 
 func parseForwarded(h http.Header) map[string]string {
@@ -705,6 +926,72 @@ func (s *Server) Stats() *ServerStats {
 	return &stats
 }
 
+func (s *Server) resolveProxyHostsLoop() {
+	for {
+		interval := s.Config().AcceptProxyResolveInterval
+		if interval <= 0 {
+			interval = 5 * time.Minute
+		}
+		timer := time.NewTimer(interval)
+
+		select {
+		case <-s.stopCh:
+			timer.Stop()
+			return
+		case <-s.proxyHostsCh:
+			timer.Stop()
+		case <-timer.C:
+		}
+
+		s.resolveProxyHosts(context.TODO())
+	}
+}
+
+// resolveProxyHosts resolves the hostnames accepted as proxies. If a hostname
+// cannot be resolved, its last known addresses are kept.
+func (s *Server) resolveProxyHosts(ctx context.Context) {
+	hosts := s.Config().AcceptProxyHosts
+	prev, _ := s.proxyHostIPs.Load().(map[string]config.IPSet)
+
+	resolved := make(map[string]config.IPSet, len(hosts))
+	for _, host := range hosts {
+		ctx, cancel := context.WithTimeout(ctx, proxyHostResolveTimeout)
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		cancel()
+		if err != nil {
+			s.Logger.Printf("failed to resolve proxy host %q, keeping %v last known addresses: %v", host, len(prev[host]), err)
+			resolved[host] = prev[host]
+			continue
+		}
+
+		set := make(config.IPSet, 0, len(addrs))
+		for _, addr := range addrs {
+			ip := addr.IP
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			bits := len(ip) * 8
+			set = append(set, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		}
+		resolved[host] = set
+		s.Logger.Debugf("resolved proxy host %q to %v addresses", host, len(set))
+	}
+
+	s.proxyHostIPs.Store(resolved)
+}
+
+func stringSlicesEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) disableInactiveUsersLoop() {
 	ticker := time.NewTicker(4 * time.Hour)
 	defer ticker.Stop()
@@ -2,14 +2,26 @@ package soju
 
 import (
 	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"gopkg.in/irc.v4"
 
+	"git.sr.ht/~emersion/soju/config"
 	"git.sr.ht/~emersion/soju/database"
 	"git.sr.ht/~emersion/soju/xirc"
 )
@@ -77,6 +89,27 @@ func createTestDownstream(t *testing.T, srv *Server) ircConn {
 	return newNetIRCConn(c2)
 }
 
+// createTestTCPDownstream is like createTestDownstream, but uses a TCP
+// connection, for tests which need the client's IP address.
+func createTestTCPDownstream(t *testing.T, srv *Server) ircConn {
+	ln, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to create TCP listener: %v", err)
+	}
+	defer ln.Close()
+
+	c2, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to connect to TCP listener: %v", err)
+	}
+	c1, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("failed accepting connection: %v", err)
+	}
+	go srv.Handle(newNetIRCConn(c1))
+	return newNetIRCConn(c2)
+}
+
 func createTestUpstream(t *testing.T, db database.Database, user *database.User) (*database.Network, net.Listener) {
 	ln, err := net.Listen("tcp", "localhost:0")
 	if err != nil {
@@ -344,3 +377,2166 @@ func TestServer_chatHistory(t *testing.T) {
 		testChatHistory(t, "db", "")
 	})
 }
+
+func testDirectHistoryEvents(t *testing.T, msgStoreDriver, msgStorePath string) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+
+	cfg := *srv.Config()
+	cfg.MsgStoreDriver = msgStoreDriver
+	cfg.MsgStorePath = msgStorePath
+	srv.SetConfig(&cfg)
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	baseTime := time.Date(2023, 05, 23, 6, 0, 0, 0, time.UTC)
+	for i, nick := range []string{"foo", "baz"} {
+		uc.WriteMessage(&irc.Message{
+			Tags:    irc.Tags{"time": xirc.FormatServerTime(baseTime.Add(time.Duration(i) * time.Second))},
+			Prefix:  &irc.Prefix{Name: nick},
+			Command: "PRIVMSG",
+			Params:  []string{testUsername, "hi"},
+		})
+	}
+	roundtrip(t, uc)
+
+	// Acknowledge the messages, so that the conversations are known
+	for _, msg := range roundtrip(t, dc) {
+		if msg.Command == "PING" {
+			dc.WriteMessage(&irc.Message{Command: "PONG", Params: msg.Params})
+		}
+	}
+	roundtrip(t, dc)
+
+	uc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"time": xirc.FormatServerTime(baseTime.Add(2 * time.Second))},
+		Prefix:  &irc.Prefix{Name: "foo"},
+		Command: "NICK",
+		Params:  []string{"bar"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"time": xirc.FormatServerTime(baseTime.Add(3 * time.Second))},
+		Prefix:  &irc.Prefix{Name: "baz"},
+		Command: "QUIT",
+		Params:  []string{"bye"},
+	})
+	roundtrip(t, uc)
+
+	hdc := createTestDownstream(t, srv)
+	defer hdc.Close()
+	registerDownstreamConn(t, hdc, network)
+	roundtrip(t, hdc) // drain post-connection-registration messages
+	hdc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"REQ", "draft/event-playback"}})
+	if msg := expectMessage(t, hdc, "CAP"); msg.Params[1] != "ACK" {
+		t.Fatalf("unexpected CAP response: %v", msg)
+	}
+
+	for _, tc := range []struct {
+		target   string
+		commands []string
+	}{
+		{"foo", []string{"PRIVMSG", "NICK"}},
+		{"baz", []string{"PRIVMSG", "QUIT"}},
+	} {
+		hdc.WriteMessage(&irc.Message{
+			Command: "CHATHISTORY",
+			Params:  []string{"AFTER", tc.target, "timestamp=" + xirc.FormatServerTime(baseTime.Add(-time.Second)), "100"},
+		})
+
+		var got []string
+		for _, msg := range roundtrip(t, hdc) {
+			got = append(got, msg.Command)
+		}
+		if !reflect.DeepEqual(got, tc.commands) {
+			t.Errorf("history of %v: got %v, want %v", tc.target, got, tc.commands)
+		}
+	}
+}
+
+func TestServer_directHistoryEvents(t *testing.T) {
+	t.Run("fs", func(t *testing.T) {
+		testDirectHistoryEvents(t, "fs", t.TempDir())
+	})
+
+	t.Run("db", func(t *testing.T) {
+		testDirectHistoryEvents(t, "db", "")
+	})
+}
+
+func TestServer_channelMembership(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	joinTime := time.Now().Add(-time.Minute)
+	historyTime := joinTime.Add(-time.Hour)
+	chanServ := &irc.Prefix{Name: "ChanServ"}
+	for _, msg := range []*irc.Message{
+		{
+			Tags:    irc.Tags{"time": xirc.FormatServerTime(joinTime)},
+			Prefix:  &irc.Prefix{Name: testUsername},
+			Command: "JOIN",
+			Params:  []string{"#soju"},
+		},
+		{
+			Prefix:  testServerPrefix,
+			Command: irc.RPL_NAMREPLY,
+			Params:  []string{testUsername, "=", "#soju", testUsername + " @alice bob +carol"},
+		},
+		{
+			Prefix:  testServerPrefix,
+			Command: irc.RPL_ENDOFNAMES,
+			Params:  []string{testUsername, "#soju", "End of /NAMES list"},
+		},
+		// Prefix granted before the JOIN is relayed
+		{Prefix: chanServ, Command: "MODE", Params: []string{"#soju", "+v", "dave"}},
+		{Prefix: &irc.Prefix{Name: "dave"}, Command: "JOIN", Params: []string{"#soju"}},
+		// Pending prefix dropped when the user is removed from the channel
+		{Prefix: chanServ, Command: "MODE", Params: []string{"#soju", "+v", "erin"}},
+		{Prefix: chanServ, Command: "KICK", Params: []string{"#soju", "erin"}},
+		{Prefix: &irc.Prefix{Name: "erin"}, Command: "JOIN", Params: []string{"#soju"}},
+		// Several changes in a single message
+		{Prefix: chanServ, Command: "MODE", Params: []string{"#soju", "+o-o+b", "bob", "alice", "*!*@example.org"}},
+		// Changes replayed from the history
+		{
+			Tags:    irc.Tags{"time": xirc.FormatServerTime(historyTime)},
+			Prefix:  chanServ,
+			Command: "MODE",
+			Params:  []string{"#soju", "+o", "carol"},
+		},
+		{Command: "BATCH", Params: []string{"+history", "chathistory", "#soju"}},
+		{
+			Tags:    irc.Tags{"batch": "history", "time": xirc.FormatServerTime(historyTime)},
+			Prefix:  chanServ,
+			Command: "MODE",
+			Params:  []string{"#soju", "-o", "bob"},
+		},
+		{Command: "BATCH", Params: []string{"-history"}},
+	} {
+		uc.WriteMessage(msg)
+	}
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	dc.WriteMessage(&irc.Message{Command: "NAMES", Params: []string{"#soju"}})
+
+	var members []string
+	for _, msg := range roundtrip(t, dc) {
+		if msg.Command == irc.RPL_NAMREPLY {
+			members = append(members, strings.Fields(msg.Params[3])...)
+		}
+	}
+	sort.Strings(members)
+
+	want := []string{"+carol", "+dave", "@bob", "alice", "erin", testUsername}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("got members %v, want %v", members, want)
+	}
+}
+
+func TestServer_detachedChannelMembers(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	if err := db.StoreChannel(context.Background(), network.ID, &database.Channel{Name: "#soju"}); err != nil {
+		t.Fatalf("failed to store test channel: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: testUsername},
+		Command: "JOIN",
+		Params:  []string{"#soju"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_NAMREPLY,
+		Params:  []string{testUsername, "=", "#soju", testUsername + " @alice bob carol erin"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_ENDOFNAMES,
+		Params:  []string{testUsername, "#soju", "End of /NAMES list"},
+	})
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	sendServiceCommand := func(cmd string) []*irc.Message {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, cmd},
+		})
+		return roundtrip(t, dc)
+	}
+
+	sendServiceCommand("channel update #soju -detached true")
+
+	// Churn while no client has the channel open
+	for _, msg := range []*irc.Message{
+		{Prefix: &irc.Prefix{Name: "dave"}, Command: "JOIN", Params: []string{"#soju"}},
+		{Prefix: &irc.Prefix{Name: "alice"}, Command: "PART", Params: []string{"#soju", "bye"}},
+		{Prefix: &irc.Prefix{Name: "bob"}, Command: "QUIT", Params: []string{"Ping timeout"}},
+		{Prefix: &irc.Prefix{Name: "carol"}, Command: "NICK", Params: []string{"caroline"}},
+		{Prefix: &irc.Prefix{Name: "dave"}, Command: "KICK", Params: []string{"#soju", "erin", "spam"}},
+		{Prefix: &irc.Prefix{Name: "ChanServ"}, Command: "MODE", Params: []string{"#soju", "+o", "dave"}},
+	} {
+		uc.WriteMessage(msg)
+	}
+	roundtrip(t, uc)
+
+	var status string
+	for _, msg := range sendServiceCommand("channel status") {
+		if msg.Command == "PRIVMSG" && strings.HasPrefix(msg.Params[1], "#soju ") {
+			status = msg.Params[1]
+		}
+	}
+	if !strings.Contains(status, "detached, 3 members") {
+		t.Errorf("channel status: got %q, want the detached member count", status)
+	}
+
+	var members []string
+	for _, msg := range sendServiceCommand("channel update #soju -detached false") {
+		if msg.Command == irc.RPL_NAMREPLY {
+			members = append(members, strings.Fields(msg.Params[3])...)
+		}
+	}
+	sort.Strings(members)
+
+	want := []string{"@dave", "caroline", testUsername}
+	if !reflect.DeepEqual(members, want) {
+		t.Errorf("got members %v, want %v", members, want)
+	}
+}
+
+func TestServer_multiline(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: testUsername},
+		Command: "JOIN",
+		Params:  []string{"#soju"},
+	})
+	roundtrip(t, uc)
+
+	// dc1 supports draft/multiline, dc2 doesn't
+	dc1 := createTestDownstream(t, srv)
+	defer dc1.Close()
+	dc1.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"LS"}})
+	dc1.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"REQ", "batch draft/multiline"}})
+	expectMessage(t, dc1, "CAP") // LS
+	if msg := expectMessage(t, dc1, "CAP"); msg.Params[1] != "ACK" {
+		t.Fatalf("failed to enable draft/multiline: %v", msg)
+	}
+	dc1.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"END"}})
+	registerDownstreamConn(t, dc1, network)
+	roundtrip(t, dc1)
+
+	dc2 := createTestDownstream(t, srv)
+	defer dc2.Close()
+	registerDownstreamConn(t, dc2, network)
+	roundtrip(t, dc2)
+
+	texts := func(msgs []*irc.Message) []string {
+		var l []string
+		for _, msg := range msgs {
+			if msg.Command == "PRIVMSG" {
+				l = append(l, msg.Params[1])
+			}
+		}
+		return l
+	}
+
+	// Downstream to upstream, without upstream support
+	dc1.WriteMessage(&irc.Message{Command: "BATCH", Params: []string{"+a", "draft/multiline", "#soju"}})
+	for _, msg := range []*irc.Message{
+		{Tags: irc.Tags{"batch": "a"}, Command: "PRIVMSG", Params: []string{"#soju", "hello"}},
+		{Tags: irc.Tags{"batch": "a"}, Command: "PRIVMSG", Params: []string{"#soju", "world"}},
+		{Tags: irc.Tags{"batch": "a", "draft/multiline-concat": ""}, Command: "PRIVMSG", Params: []string{"#soju", "!"}},
+	} {
+		dc1.WriteMessage(msg)
+	}
+	dc1.WriteMessage(&irc.Message{Command: "BATCH", Params: []string{"-a"}})
+	roundtrip(t, dc1)
+
+	want := []string{"hello", "world!"}
+	if got := texts(roundtrip(t, uc)); !reflect.DeepEqual(got, want) {
+		t.Errorf("upstream: got %q, want %q", got, want)
+	}
+	if got := texts(roundtrip(t, dc2)); !reflect.DeepEqual(got, want) {
+		t.Errorf("downstream echo: got %q, want %q", got, want)
+	}
+
+	// Upstream to downstream
+	alice := &irc.Prefix{Name: "alice", User: "alice", Host: "example.org"}
+	uc.WriteMessage(&irc.Message{Prefix: alice, Command: "BATCH", Params: []string{"+b", "draft/multiline", "#soju"}})
+	uc.WriteMessage(&irc.Message{Tags: irc.Tags{"batch": "b"}, Prefix: alice, Command: "PRIVMSG", Params: []string{"#soju", "one"}})
+	uc.WriteMessage(&irc.Message{Tags: irc.Tags{"batch": "b"}, Prefix: alice, Command: "PRIVMSG", Params: []string{"#soju", "two"}})
+	uc.WriteMessage(&irc.Message{Command: "BATCH", Params: []string{"-b"}})
+	roundtrip(t, uc)
+
+	want = []string{"one", "two"}
+	msgs := roundtrip(t, dc1)
+	if len(msgs) != 4 || msgs[0].Command != "BATCH" || msgs[3].Command != "BATCH" {
+		t.Fatalf("multiline downstream: got %v, want a multiline batch", msgs)
+	}
+	if msgs[0].Params[1] != "draft/multiline" || msgs[1].Tags["batch"] != strings.TrimPrefix(msgs[0].Params[0], "+") {
+		t.Errorf("multiline downstream: invalid batch %v", msgs)
+	}
+	if got := texts(msgs); !reflect.DeepEqual(got, want) {
+		t.Errorf("multiline downstream: got %q, want %q", got, want)
+	}
+	if got := texts(roundtrip(t, dc2)); !reflect.DeepEqual(got, want) {
+		t.Errorf("downstream: got %q, want %q", got, want)
+	}
+}
+
+func TestServer_redact(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+
+	cfg := *srv.Config()
+	cfg.MsgStoreDriver = "db"
+	srv.SetConfig(&cfg)
+
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	baseTime := time.Date(2023, 05, 23, 6, 0, 0, 0, time.UTC)
+	for i, text := range []string{"one", "two", "three"} {
+		uc.WriteMessage(&irc.Message{
+			Tags: irc.Tags{
+				"time":  xirc.FormatServerTime(baseTime.Add(time.Duration(i) * time.Second)),
+				"msgid": text,
+			},
+			Prefix:  &irc.Prefix{Name: "foo"},
+			Command: "PRIVMSG",
+			Params:  []string{testUsername, text},
+		})
+	}
+	uc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"time": xirc.FormatServerTime(baseTime.Add(10 * time.Second))},
+		Prefix:  &irc.Prefix{Name: "foo"},
+		Command: "REDACT",
+		Params:  []string{testUsername, "two", "oops"},
+	})
+	// Redactions for unknown messages are ignored
+	uc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"time": xirc.FormatServerTime(baseTime.Add(11 * time.Second))},
+		Prefix:  &irc.Prefix{Name: "foo"},
+		Command: "REDACT",
+		Params:  []string{testUsername, "unknown"},
+	})
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	dc.WriteMessage(&irc.Message{
+		Command: "CHATHISTORY",
+		Params:  []string{"AFTER", "foo", "timestamp=" + xirc.FormatServerTime(baseTime.Add(-time.Second)), "100"},
+	})
+
+	var got []string
+	for _, msg := range roundtrip(t, dc) {
+		if msg.Command != "PRIVMSG" {
+			t.Fatalf("unexpected reply: %v", msg)
+		}
+		got = append(got, msg.Params[1])
+	}
+
+	want := []string{"one", "three"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestServer_channelRename(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	// A saved channel already uses the new name
+	for _, ch := range []*database.Channel{
+		{Name: "#old", Key: "secret"},
+		{Name: "#new"},
+	} {
+		if err := db.StoreChannel(context.Background(), network.ID, ch); err != nil {
+			t.Fatalf("failed to store test channel: %v", err)
+		}
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: testUsername},
+		Command: "JOIN",
+		Params:  []string{"#old"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_NAMREPLY,
+		Params:  []string{testUsername, "=", "#old", testUsername + " @alice"},
+	})
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_ENDOFNAMES,
+		Params:  []string{testUsername, "#old", "End of /NAMES list"},
+	})
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice"},
+		Command: "RENAME",
+		Params:  []string{"#old", "#new", "Moving on"},
+	})
+	roundtrip(t, uc)
+
+	msgs := roundtrip(t, dc)
+	if len(msgs) < 2 || msgs[0].Command != "PART" || msgs[0].Params[0] != "#old" || msgs[1].Command != "JOIN" || msgs[1].Params[0] != "#new" {
+		t.Fatalf("got %v, want PART #old and JOIN #new", msgs)
+	}
+	var members []string
+	for _, msg := range msgs {
+		if msg.Command == irc.RPL_NAMREPLY {
+			if msg.Params[2] != "#new" {
+				t.Errorf("got NAMES reply for %q, want #new", msg.Params[2])
+			}
+			members = append(members, strings.Fields(msg.Params[3])...)
+		}
+	}
+	sort.Strings(members)
+	if want := []string{"@alice", testUsername}; !reflect.DeepEqual(members, want) {
+		t.Errorf("got members %v, want %v", members, want)
+	}
+
+	channels, err := db.ListChannels(context.Background(), network.ID)
+	if err != nil {
+		t.Fatalf("failed to list channels: %v", err)
+	}
+	if len(channels) != 1 || channels[0].Name != "#new" || channels[0].Key != "secret" {
+		t.Errorf("got channels %+v, want the renamed channel only", channels)
+	}
+}
+
+func TestServer_lag(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	// CTCP PING to BouncerServ is answered directly
+	ctcpPing := "\x01PING 1234\x01"
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, ctcpPing},
+	})
+	if msg := expectMessage(t, dc, "NOTICE"); msg.Params[1] != ctcpPing {
+		t.Errorf("unexpected CTCP PING reply: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "network lag"},
+	})
+	var ping *irc.Message
+	for ping == nil {
+		msg, err := uc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command == "PING" {
+			ping = msg
+		}
+	}
+	token := ping.Params[len(ping.Params)-1]
+	if !strings.HasPrefix(token, lagCheckTokenPrefix) {
+		t.Fatalf("unexpected lag check PING token: %q", token)
+	}
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: "irc.example.org"},
+		Command: "PONG",
+		Params:  []string{"irc.example.org", token},
+	})
+
+	if msg := expectMessage(t, dc, "PRIVMSG"); !strings.HasPrefix(msg.Params[1], "lag to ") {
+		t.Errorf("unexpected lag check reply: %v", msg)
+	}
+}
+
+func TestServer_status(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"*status", "version"},
+	})
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Prefix.Name != statusNick || !strings.HasPrefix(msg.Params[1], "soju ") {
+		t.Errorf("unexpected version reply: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "ZNC",
+		Params:  []string{"AddNetwork", "libera"},
+	})
+	if msg := expectMessage(t, dc, "PRIVMSG"); !strings.Contains(msg.Params[1], `"network create"`) {
+		t.Errorf("unexpected reply to unsupported command: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"*controlpanel", "help"},
+	})
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Prefix.Name != "*controlpanel" || !strings.Contains(msg.Params[1], serviceNick) {
+		t.Errorf("unexpected reply from module: %v", msg)
+	}
+}
+
+func TestServer_summary(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	if err := db.StoreClient(context.Background(), user.ID, &database.Client{Name: "phone", Summary: true}); err != nil {
+		t.Fatalf("failed to store client: %v", err)
+	}
+	if err := db.StoreChannel(context.Background(), network.ID, &database.Channel{Name: "#soju", Highlights: []string{"bouncer"}}); err != nil {
+		t.Fatalf("failed to store channel: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	cfg := *srv.Config()
+	cfg.MsgStoreDriver = "db"
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	connect := func() ircConn {
+		dc := createTestDownstream(t, srv)
+		dc.WriteMessage(&irc.Message{
+			Command: "PASS",
+			Params:  []string{testPassword},
+		})
+		dc.WriteMessage(&irc.Message{
+			Command: "NICK",
+			Params:  []string{testUsername},
+		})
+		dc.WriteMessage(&irc.Message{
+			Command: "USER",
+			Params:  []string{testUsername + "/" + network.Name + "@phone", "0", "*", testUsername},
+		})
+		expectMessage(t, dc, irc.RPL_WELCOME)
+		return dc
+	}
+
+	sendPM := func(text string) {
+		uc.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "foo"},
+			Command: "PRIVMSG",
+			Params:  []string{testUsername, text},
+		})
+		roundtrip(t, uc)
+	}
+
+	dc := connect()
+	roundtrip(t, dc) // drain post-connection-registration messages
+	sendPM("hi")
+	expectMessage(t, dc, "PRIVMSG")
+	// Acknowledge delivery
+	ping := expectMessage(t, dc, "PING")
+	dc.WriteMessage(&irc.Message{
+		Command: "PONG",
+		Params:  []string{"localhost", ping.Params[0]},
+	})
+	roundtrip(t, dc)
+
+	// Wait for the bouncer to close the connection, so that the messages
+	// below are missed
+	dc.WriteMessage(&irc.Message{Command: "QUIT"})
+	for {
+		if _, err := dc.ReadMessage(); err != nil {
+			break
+		}
+	}
+	dc.Close()
+
+	sendPM("are you there?")
+	sendPM("ping " + testUsername)
+	for _, text := range []string{
+		testUsername + ": hi",     // highlight
+		"which bouncer is it?",    // channel keyword
+		"x" + testUsername + "x",  // not a word
+		"https://" + testUsername, // URL
+		"nothing to see",
+	} {
+		uc.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "foo"},
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", text},
+		})
+	}
+	roundtrip(t, uc)
+
+	dc = connect()
+	defer dc.Close()
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command != "NOTICE" || msg.Prefix.Name != serviceNick {
+			continue
+		}
+		if !strings.HasPrefix(msg.Params[1], "missed on ") {
+			t.Fatalf("unexpected summary: %v", msg)
+		}
+		if !strings.Contains(msg.Params[1], "2 highlights") || !strings.Contains(msg.Params[1], "2 private messages from 1 users") {
+			t.Errorf("unexpected summary: %v", msg)
+		}
+		break
+	}
+}
+
+func TestServer_playbackStyle(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	if err := db.StoreClient(context.Background(), user.ID, &database.Client{Name: "phone", PlaybackStyle: database.PlaybackPrefixed}); err != nil {
+		t.Fatalf("failed to store client: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	cfg := *srv.Config()
+	cfg.MsgStoreDriver = "db"
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	connect := func() ircConn {
+		dc := createTestDownstream(t, srv)
+		dc.WriteMessage(&irc.Message{
+			Command: "PASS",
+			Params:  []string{testPassword},
+		})
+		dc.WriteMessage(&irc.Message{
+			Command: "NICK",
+			Params:  []string{testUsername},
+		})
+		dc.WriteMessage(&irc.Message{
+			Command: "USER",
+			Params:  []string{testUsername + "/" + network.Name + "@phone", "0", "*", testUsername},
+		})
+		expectMessage(t, dc, irc.RPL_WELCOME)
+		return dc
+	}
+
+	sendPM := func(text string) {
+		uc.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "foo"},
+			Command: "PRIVMSG",
+			Params:  []string{testUsername, text},
+		})
+		roundtrip(t, uc)
+	}
+
+	dc := connect()
+	roundtrip(t, dc) // drain post-connection-registration messages
+	sendPM("hi")
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Params[1] != "hi" {
+		t.Errorf("live message has been altered: %v", msg)
+	}
+	// Acknowledge delivery
+	ping := expectMessage(t, dc, "PING")
+	dc.WriteMessage(&irc.Message{
+		Command: "PONG",
+		Params:  []string{"localhost", ping.Params[0]},
+	})
+	roundtrip(t, dc)
+
+	dc.WriteMessage(&irc.Message{Command: "QUIT"})
+	for {
+		if _, err := dc.ReadMessage(); err != nil {
+			break
+		}
+	}
+	dc.Close()
+
+	sendPM("are you there?")
+
+	dc = connect()
+	defer dc.Close()
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command != "PRIVMSG" {
+			continue
+		}
+		text := msg.Params[1]
+		if len(text) != len("[15:04:05] are you there?") || text[0] != '[' || !strings.HasSuffix(text, "] are you there?") {
+			t.Errorf("unexpected replayed message: %v", msg)
+		}
+		break
+	}
+}
+
+func testPlayback(t *testing.T, msgStoreDriver, msgStorePath string) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	cfg := *srv.Config()
+	cfg.MsgStoreDriver = msgStoreDriver
+	cfg.MsgStorePath = msgStorePath
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	texts := []string{"one", "two", "three"}
+	baseTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	for i, text := range texts {
+		uc.WriteMessage(&irc.Message{
+			Tags:    irc.Tags{"time": xirc.FormatServerTime(baseTime.Add(time.Duration(i) * time.Second))},
+			Prefix:  &irc.Prefix{Name: "foo"},
+			Command: "PRIVMSG",
+			Params:  []string{testUsername, text},
+		})
+	}
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"LS"}})
+	dc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"REQ", "znc.in/playback"}})
+	expectMessage(t, dc, "CAP") // LS
+	if msg := expectMessage(t, dc, "CAP"); msg.Params[1] != "ACK" {
+		t.Fatalf("failed to enable znc.in/playback: %v", msg)
+	}
+	dc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"END"}})
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{playbackNick, "PLAY foo 0"},
+	})
+
+	var got []string
+	for _, msg := range roundtrip(t, dc) {
+		if msg.Command != "PRIVMSG" {
+			t.Fatalf("unexpected reply: %v", msg)
+		}
+		got = append(got, msg.Params[1])
+	}
+	if !reflect.DeepEqual(got, texts) {
+		t.Errorf("got %v, want %v", got, texts)
+	}
+}
+
+func TestServer_playback(t *testing.T) {
+	t.Run("fs", func(t *testing.T) {
+		testPlayback(t, "fs", t.TempDir())
+	})
+
+	t.Run("db", func(t *testing.T) {
+		testPlayback(t, "db", "")
+	})
+}
+
+func TestServer_highlights(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	if err := db.StoreChannel(context.Background(), network.ID, &database.Channel{Name: "#soju"}); err != nil {
+		t.Fatalf("failed to store channel: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	highlightTime := time.Now().Add(-time.Minute)
+	uc.WriteMessage(&irc.Message{
+		Tags:    irc.Tags{"time": xirc.FormatServerTime(highlightTime)},
+		Prefix:  &irc.Prefix{Name: "foo"},
+		Command: "PRIVMSG",
+		Params:  []string{"#soju", testUsername + ": are you there?"},
+	})
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	listHighlights := func() string {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, "highlights"},
+		})
+		return expectMessage(t, dc, "PRIVMSG").Params[1]
+	}
+
+	if text := listHighlights(); !strings.Contains(text, "#soju/"+network.Name+" <foo> "+testUsername+": are you there?") {
+		t.Errorf("unexpected highlight: %q", text)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "MARKREAD",
+		Params:  []string{"#soju", "timestamp=" + xirc.FormatServerTime(highlightTime)},
+	})
+	roundtrip(t, dc)
+
+	if text := listHighlights(); text != "No pending highlights." {
+		t.Errorf("highlight not cleared by read marker: %q", text)
+	}
+}
+
+func TestServer_offlineEvents(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: "foo"},
+		Command: "INVITE",
+		Params:  []string{testUsername, "#soju"},
+	})
+	roundtrip(t, uc)
+
+	events, err := db.ListOfflineEvents(context.Background(), network.ID)
+	if err != nil {
+		t.Fatalf("failed to list offline events: %v", err)
+	} else if len(events) != 1 || events[0].Message.Command != "INVITE" {
+		t.Fatalf("invalid offline events: %v", events)
+	}
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+
+	found := false
+	for _, msg := range roundtrip(t, dc) {
+		if msg.Command == "INVITE" && msg.Params[1] == "#soju" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("offline INVITE not replayed")
+	}
+
+	events, err = db.ListOfflineEvents(context.Background(), network.ID)
+	if err != nil {
+		t.Fatalf("failed to list offline events: %v", err)
+	} else if len(events) != 0 {
+		t.Errorf("offline events not deleted after replay: %v", events)
+	}
+}
+
+func TestServer_networkDisconnect(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	readServiceReply := func() string {
+		for {
+			msg, err := dc.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read IRC message: %v", err)
+			}
+			if msg.Command == "PRIVMSG" {
+				return msg.Params[1]
+			}
+		}
+	}
+	serviceCommand := func(text string) string {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, text},
+		})
+		return readServiceReply()
+	}
+	networkStatus := func() string {
+		text := serviceCommand("network status")
+		readServiceReply() // nick, username and realname
+		return text
+	}
+
+	serviceCommand("network disconnect " + network.Name + " \"be right back\"")
+	for {
+		msg, err := uc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command != "QUIT" {
+			continue
+		}
+		if len(msg.Params) != 1 || msg.Params[0] != "be right back" {
+			t.Errorf("unexpected QUIT message: %v", msg)
+		}
+		break
+	}
+	uc.Close()
+
+	if text := networkStatus(); !strings.Contains(text, "manually disconnected") {
+		t.Errorf("unexpected network status: %q", text)
+	}
+
+	// Updating the network doesn't reconnect
+	serviceCommand("network update " + network.Name + " -realname updated")
+	if text := networkStatus(); !strings.Contains(text, "manually disconnected") {
+		t.Errorf("unexpected network status after update: %q", text)
+	}
+
+	serviceCommand("network connect " + network.Name)
+	uc = mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+	roundtrip(t, uc)
+
+	if text := networkStatus(); !strings.Contains(text, "[connected") {
+		t.Errorf("unexpected network status: %q", text)
+	}
+}
+
+func TestServer_replay(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	if err := db.StoreChannel(context.Background(), network.ID, &database.Channel{Name: "#soju"}); err != nil {
+		t.Fatalf("failed to store channel: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	cfg := *srv.Config()
+	cfg.MsgStoreDriver = "db"
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	for _, text := range []string{"one", "two", "three"} {
+		uc.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "foo"},
+			Command: "PRIVMSG",
+			Params:  []string{"#soju", text},
+		})
+	}
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "replay #soju/" + network.Name + " 2"},
+	})
+	for _, want := range []string{"two", "three"} {
+		if msg := expectMessage(t, dc, "PRIVMSG"); msg.Params[0] != "#soju" || msg.Params[1] != want {
+			t.Errorf("unexpected replayed message: want %q, got %v", want, msg)
+		}
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "replay #unknown 2"},
+	})
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Prefix.Name != serviceNick || !strings.Contains(msg.Params[1], "unknown target") {
+		t.Errorf("unexpected reply: %v", msg)
+	}
+
+	// Clients not bound to a network are rejected
+	bdc := createTestDownstream(t, srv)
+	defer bdc.Close()
+	bdc.WriteMessage(&irc.Message{Command: "PASS", Params: []string{testPassword}})
+	bdc.WriteMessage(&irc.Message{Command: "NICK", Params: []string{testUsername}})
+	bdc.WriteMessage(&irc.Message{Command: "USER", Params: []string{testUsername, "0", "*", testUsername}})
+	expectMessage(t, bdc, irc.RPL_WELCOME)
+	roundtrip(t, bdc) // drain post-connection-registration messages
+
+	bdc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "replay #soju/" + network.Name + " 1"},
+	})
+	if msg := expectMessage(t, bdc, "PRIVMSG"); !strings.HasPrefix(msg.Params[1], "error: ") {
+		t.Errorf("replay from a client not bound to a network wasn't rejected: %v", msg)
+	}
+}
+
+func TestServer_registration(t *testing.T) {
+	db := createTempSqliteDB(t)
+	createTestUser(t, db)
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	register := func(dc ircConn, account, email, password string) *irc.Message {
+		dc.WriteMessage(&irc.Message{
+			Command: "REGISTER",
+			Params:  []string{account, email, password},
+		})
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		return msg
+	}
+	expectFail := func(msg *irc.Message, code string) {
+		t.Helper()
+		if msg.Command != "FAIL" || msg.Params[1] != code {
+			t.Errorf("expected FAIL with code %v, got: %v", code, msg)
+		}
+	}
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+
+	if msg := register(dc, "alice", "*", "hunter2hunter2"); msg.Command != irc.ERR_UNKNOWNCOMMAND {
+		t.Errorf("expected registration to be disabled, got: %v", msg)
+	}
+
+	cfg := *srv.Config()
+	cfg.Registration = &config.Registration{
+		MaxUsers:      3,
+		PerIPPerHour:  10,
+		UsernameBlock: []string{"root"},
+	}
+	srv.SetConfig(&cfg)
+
+	expectFail(register(dc, "root", "*", "hunter2hunter2"), "BAD_ACCOUNT_NAME")
+	expectFail(register(dc, "ali/ce", "*", "hunter2hunter2"), "BAD_ACCOUNT_NAME")
+	expectFail(register(dc, "alice", "*", "hunter2"), "WEAK_PASSWORD")
+	expectFail(register(dc, testUsername, "*", "hunter2hunter2"), "ACCOUNT_EXISTS")
+
+	// Usernames stay reserved while their account is being created
+	placeholder := &pendingRegistration{user: &database.User{Username: "carol"}}
+	if err := srv.reserveRegistration(cfg.Registration, "carol", placeholder); err != nil {
+		t.Fatalf("failed to reserve username: %v", err)
+	}
+	expectFail(register(dc, "carol", "*", "hunter2hunter2"), "ACCOUNT_EXISTS")
+	srv.lock.Lock()
+	delete(srv.pendingRegistrations, "carol")
+	srv.lock.Unlock()
+
+	var regErr *accountRegistrationError
+	err := srv.createRegisteredUser(context.Background(), &pendingRegistration{user: &database.User{Username: testUsername}})
+	if !errors.As(err, &regErr) || regErr.code != "ACCOUNT_EXISTS" {
+		t.Errorf("expected ACCOUNT_EXISTS when creating an existing user, got: %v", err)
+	}
+
+	if msg := register(dc, "alice", "*", "hunter2hunter2"); msg.Command != "REGISTER" || msg.Params[0] != "SUCCESS" {
+		t.Fatalf("expected registration success, got: %v", msg)
+	}
+	dc.WriteMessage(&irc.Message{Command: "NICK", Params: []string{"alice"}})
+	dc.WriteMessage(&irc.Message{Command: "USER", Params: []string{"alice", "0", "*", "alice"}})
+	expectMessage(t, dc, irc.RPL_WELCOME)
+
+	codes := make(chan string, 1)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.FormValue("username") == "bob" && req.FormValue("email") == "bob@example.org" {
+			codes <- req.FormValue("code")
+		}
+	}))
+	defer callback.Close()
+
+	cfg = *srv.Config()
+	cfg.Registration = &config.Registration{
+		MaxUsers:     3,
+		PerIPPerHour: 10,
+		Verification: &config.Verification{CallbackURL: callback.URL},
+	}
+	srv.SetConfig(&cfg)
+
+	dc2 := createTestDownstream(t, srv)
+	defer dc2.Close()
+
+	expectFail(register(dc2, "bob", "*", "hunter2hunter2"), "INVALID_EMAIL")
+	if msg := register(dc2, "bob", "bob@example.org", "hunter2hunter2"); msg.Command != "REGISTER" || msg.Params[0] != "VERIFICATION_REQUIRED" {
+		t.Fatalf("expected verification to be required, got: %v", msg)
+	}
+	code := <-codes
+
+	dc2.WriteMessage(&irc.Message{Command: "VERIFY", Params: []string{"bob", "WRONG"}})
+	if msg := expectMessage(t, dc2, "FAIL"); msg.Params[1] != "INVALID_CODE" {
+		t.Errorf("expected invalid code, got: %v", msg)
+	}
+	dc2.WriteMessage(&irc.Message{Command: "VERIFY", Params: []string{"bob", code}})
+	if msg := expectMessage(t, dc2, "VERIFY"); msg.Params[0] != "SUCCESS" {
+		t.Errorf("expected verification success, got: %v", msg)
+	}
+	dc2.WriteMessage(&irc.Message{Command: "NICK", Params: []string{"bob"}})
+	dc2.WriteMessage(&irc.Message{Command: "USER", Params: []string{"bob", "0", "*", "bob"}})
+	expectMessage(t, dc2, irc.RPL_WELCOME)
+
+	dc3 := createTestDownstream(t, srv)
+	defer dc3.Close()
+
+	expectFail(register(dc3, "carol", "carol@example.org", "hunter2hunter2"), "TEMPORARILY_UNAVAILABLE")
+}
+
+func TestServer_disabledCaps(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	network.DisabledCaps = []string{"away-notify", "echo-message"}
+	if err := db.StoreNetwork(context.Background(), user.ID, network); err != nil {
+		t.Fatalf("failed to store network: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+
+	expectMessage(t, uc, "CAP") // LS
+	expectMessage(t, uc, "NICK")
+	expectMessage(t, uc, "USER")
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "CAP",
+		Params:  []string{"*", "LS", "away-notify echo-message labeled-response multi-prefix"},
+	})
+	msg := expectMessage(t, uc, "CAP")
+	if msg.Params[0] != "REQ" {
+		t.Fatalf("expected CAP REQ, got: %v", msg)
+	}
+	requested := strings.Fields(msg.Params[1])
+	sort.Strings(requested)
+	if want := []string{"labeled-response", "multi-prefix"}; !reflect.DeepEqual(requested, want) {
+		t.Errorf("requested caps: got %v, want %v", requested, want)
+	}
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "CAP",
+		Params:  []string{"*", "ACK", msg.Params[1]},
+	})
+	expectMessage(t, uc, "CAP") // END
+	for _, msg := range []*irc.Message{
+		{Command: irc.RPL_WELCOME, Params: []string{testUsername, "Welcome!"}},
+		{Command: irc.RPL_YOURHOST, Params: []string{testUsername, "Your host is soju-test-server"}},
+		{Command: irc.RPL_CREATED, Params: []string{testUsername, "Who cares when the server was created?"}},
+		{Command: irc.RPL_MYINFO, Params: []string{testUsername, testServerPrefix.Name, "soju", "aiwroO", "OovaimnqpsrtklbeI"}},
+		{Command: irc.ERR_NOMOTD, Params: []string{testUsername, "No MOTD"}},
+	} {
+		msg.Prefix = testServerPrefix
+		uc.WriteMessage(msg)
+	}
+	roundtrip(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	dc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"LS", "302"}})
+	msg = expectMessage(t, dc, "CAP")
+	advertised := make(map[string]bool)
+	for _, s := range strings.Fields(msg.Params[len(msg.Params)-1]) {
+		name, _, _ := strings.Cut(s, "=")
+		advertised[name] = true
+	}
+	if !advertised["multi-prefix"] || advertised["away-notify"] {
+		t.Errorf("unexpected downstream caps: %v", msg)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "network status"},
+	})
+	var lines []string
+	for _, msg := range roundtrip(t, dc) {
+		if msg.Command == "PRIVMSG" {
+			lines = append(lines, msg.Params[1])
+		}
+	}
+	text := strings.Join(lines, "\n")
+	if !strings.Contains(text, "enabled capabilities: labeled-response multi-prefix") || !strings.Contains(text, "disabled capabilities: away-notify echo-message") {
+		t.Errorf("unexpected network status: %q", text)
+	}
+}
+
+func TestServer_trafficStats(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	yesterday := database.TrafficStats{
+		Day:         time.Now().UTC().AddDate(0, 0, -1),
+		MessagesIn:  100,
+		MessagesOut: 10,
+		BytesIn:     2048,
+		BytesOut:    512,
+	}
+	if err := db.AddTrafficStats(context.Background(), network.ID, &yesterday); err != nil {
+		t.Fatalf("failed to store traffic stats: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+	roundtrip(t, uc)
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "stats " + network.Name},
+	})
+	var lines []string
+	for _, msg := range roundtrip(t, dc) {
+		if msg.Command == "PRIVMSG" {
+			lines = append(lines, msg.Params[1])
+		}
+	}
+	if len(lines) != 4 || lines[0] != network.Name+":" {
+		t.Fatalf("unexpected stats reply: %q", lines)
+	}
+	if !strings.HasPrefix(lines[1], "  today: 6 messages in (") {
+		t.Errorf("unexpected stats for today: %q", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "  last 7 days: 106 messages in (") {
+		t.Errorf("unexpected stats for the last 7 days: %q", lines[2])
+	}
+
+	// Updating the network persists the traffic of the previous connection
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "network update " + network.Name + " -realname updated"},
+	})
+	uc = mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+	roundtrip(t, dc)
+
+	l, err := db.ListTrafficStats(context.Background(), network.ID)
+	if err != nil {
+		t.Fatalf("failed to list traffic stats: %v", err)
+	}
+	if len(l) != 2 || l[1].MessagesIn < 6 {
+		t.Fatalf("traffic stats weren't persisted on network update: %+v", l)
+	}
+
+	srv.getUser(testUsername).events <- eventFlushTrafficStats{}
+	roundtrip(t, dc)
+
+	l, err = db.ListTrafficStats(context.Background(), network.ID)
+	if err != nil {
+		t.Fatalf("failed to list traffic stats: %v", err)
+	}
+	if len(l) != 2 {
+		t.Fatalf("expected 2 days of traffic stats, got %+v", l)
+	}
+	if today := l[1]; today.MessagesIn < 6 || today.MessagesOut == 0 || today.BytesIn == 0 || today.BytesOut == 0 {
+		t.Errorf("unexpected traffic stats for today: %+v", today)
+	}
+}
+
+func TestServer_lineLength(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	uc.SetMaxLineLength(1024)
+
+	registerUpstreamConn(t, uc)
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: irc.RPL_ISUPPORT,
+		Params:  []string{testUsername, "LINELEN=1024", "are supported"},
+	})
+	roundtrip(t, uc)
+
+	findLineLen := func(msgs []*irc.Message) string {
+		lineLen := ""
+		for _, msg := range msgs {
+			if msg.Command != irc.RPL_ISUPPORT {
+				continue
+			}
+			for _, token := range msg.Params[1 : len(msg.Params)-1] {
+				if strings.HasPrefix(token, "LINELEN=") {
+					lineLen = strings.TrimPrefix(token, "LINELEN=")
+				}
+			}
+		}
+		return lineLen
+	}
+
+	text := strings.Repeat("a", 900)
+
+	// Clients which didn't enable soju.im/linelen keep the standard limit
+	legacy := createTestDownstream(t, srv)
+	defer legacy.Close()
+	registerDownstreamConn(t, legacy, network)
+	if lineLen := findLineLen(roundtrip(t, legacy)); lineLen != "" {
+		t.Fatalf("got LINELEN %q, want none", lineLen)
+	}
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice", User: "alice", Host: "example.org"},
+		Command: "PRIVMSG",
+		Params:  []string{testUsername, text},
+	})
+	var split []*irc.Message
+	var got string
+	for len(got) < len(text) {
+		msg := expectMessage(t, legacy, "PRIVMSG")
+		split = append(split, msg)
+		got += msg.Params[1]
+	}
+	if len(split) < 2 || got != text {
+		t.Errorf("message relayed to downstream was not split: got %v messages", len(split))
+	}
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  testServerPrefix,
+		Command: "FOO",
+		Params:  []string{testUsername, text},
+	})
+	msg := expectMessage(t, legacy, "FOO")
+	msg.Tags = nil
+	if len(msg.String())+2 > xirc.DefaultLineLength || !strings.HasPrefix(text, msg.Params[1]) {
+		t.Errorf("message relayed to downstream was not truncated: got %v bytes", len(msg.Params[1]))
+	}
+
+	legacy.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"alice", strings.Repeat("a", 600)},
+	})
+	expectMessage(t, legacy, xirc.ERR_INPUTTOOLONG)
+
+	// Enabling soju.im/linelen after registration advertises the limit
+	legacy.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"REQ", "soju.im/linelen"}})
+	if msg := expectMessage(t, legacy, "CAP"); msg.Params[1] != "ACK" {
+		t.Fatalf("unexpected CAP response: %v", msg)
+	}
+	if lineLen := findLineLen([]*irc.Message{expectMessage(t, legacy, irc.RPL_ISUPPORT)}); lineLen != "1024" {
+		t.Fatalf("got LINELEN %q, want 1024", lineLen)
+	}
+	legacy.Close()
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	dc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"LS"}})
+	dc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"REQ", "soju.im/linelen"}})
+	expectMessage(t, dc, "CAP") // LS
+	if msg := expectMessage(t, dc, "CAP"); msg.Params[1] != "ACK" {
+		t.Fatalf("unexpected CAP response: %v", msg)
+	}
+	dc.WriteMessage(&irc.Message{Command: "CAP", Params: []string{"END"}})
+	registerDownstreamConn(t, dc, network)
+	if lineLen := findLineLen(roundtrip(t, dc)); lineLen != "1024" {
+		t.Fatalf("got LINELEN %q, want 1024", lineLen)
+	}
+	dc.SetMaxLineLength(1024)
+
+	uc.WriteMessage(&irc.Message{
+		Prefix:  &irc.Prefix{Name: "alice", User: "alice", Host: "example.org"},
+		Command: "PRIVMSG",
+		Params:  []string{testUsername, text},
+	})
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Params[1] != text {
+		t.Errorf("message relayed to downstream was altered: got %v bytes", len(msg.Params[1]))
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"alice", text},
+	})
+	msg, err := uc.ReadMessage()
+	for err == nil && msg.Command == "AWAY" {
+		msg, err = uc.ReadMessage()
+	}
+	if err != nil {
+		t.Fatalf("failed to read IRC message: %v", err)
+	} else if msg.Command != "PRIVMSG" || msg.Params[1] != text {
+		t.Errorf("message relayed to upstream was altered: got %v", msg.Command)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{"alice", strings.Repeat("a", 1100)},
+	})
+	expectMessage(t, dc, xirc.ERR_INPUTTOOLONG)
+}
+
+func TestServer_language(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	serviceReply := func(text string) string {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, text},
+		})
+		return expectMessage(t, dc, "PRIVMSG").Params[1]
+	}
+
+	if reply := serviceReply("user update -language xx"); !strings.Contains(reply, `unknown language "xx"`) {
+		t.Errorf("unexpected reply to invalid language: %q", reply)
+	}
+	if reply := serviceReply("user update -language de"); reply != `Benutzer "`+testUsername+`" geändert` {
+		t.Errorf("unexpected reply to language update: %q", reply)
+	}
+	if reply := serviceReply("channel delete #unknown/testnet"); !strings.HasPrefix(reply, "Fehler: Kanal konnte nicht gelöscht werden: ") {
+		t.Errorf("unexpected error reply: %q", reply)
+	}
+	if reply := serviceReply("network connect"); reply != "Fehler: genau ein Argument erwartet" {
+		t.Errorf("unexpected error reply: %q", reply)
+	}
+	if reply := serviceReply("help replay"); reply != "replay <target> <count|duration>: die letzten Nachrichten eines Kanals oder Benutzers erneut abspielen" {
+		t.Errorf("unexpected help reply: %q", reply)
+	}
+
+	record, err := db.GetUser(context.Background(), testUsername)
+	if err != nil {
+		t.Fatalf("failed to get user: %v", err)
+	} else if record.Language != "de" {
+		t.Errorf("stored language: got %q, want %q", record.Language, "de")
+	}
+
+	if reply := serviceReply("user update -language en"); reply != `updated user "`+testUsername+`"` {
+		t.Errorf("unexpected reply to language update: %q", reply)
+	}
+}
+
+func TestServer_dcc(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestTCPDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	serviceReply := func(text string) string {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, text},
+		})
+		return expectMessage(t, dc, "PRIVMSG").Params[1]
+	}
+	sendUpstream := func(text string) {
+		uc.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "alice", User: "alice", Host: "example.org"},
+			Command: "PRIVMSG",
+			Params:  []string{testUsername, text},
+		})
+	}
+	sendDownstream := func(text string) {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{"alice", text},
+		})
+	}
+	expectUpstream := func(text string) {
+		msg, err := uc.ReadMessage()
+		for err == nil && msg.Command == "AWAY" {
+			msg, err = uc.ReadMessage()
+		}
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		} else if msg.Command != "PRIVMSG" || msg.Params[1] != text {
+			t.Fatalf("unexpected upstream message: got %v, want PRIVMSG %q", msg, text)
+		}
+	}
+
+	offer := "\x01DCC CHAT chat 3325256705 5000\x01" // 198.51.100.1
+
+	sendUpstream(offer)
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Params[1] != offer {
+		t.Errorf("DCC offer not passed through: got %q", msg.Params[1])
+	}
+
+	if reply := serviceReply("user update -dcc block"); reply != `updated user "`+testUsername+`"` {
+		t.Fatalf("unexpected reply to DCC policy update: %q", reply)
+	}
+
+	sendUpstream(offer)
+	sendUpstream("hi")
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Params[1] != "hi" {
+		t.Errorf("blocked DCC offer relayed: got %q", msg.Params[1])
+	}
+
+	sendDownstream(offer)
+	if msg := expectMessage(t, dc, "NOTICE"); !strings.HasPrefix(msg.Params[1], "cannot send DCC request to alice: ") {
+		t.Errorf("unexpected notice for blocked DCC request: %q", msg.Params[1])
+	}
+	sendDownstream("hi")
+	expectUpstream("hi")
+
+	if reply := serviceReply("user update -dcc relay"); !strings.Contains(reply, "DCC relaying is disabled") {
+		t.Errorf("unexpected reply to DCC relay without configuration: %q", reply)
+	}
+
+	port := getFreeTCPPort(t)
+	setTestDCCRelay(srv, &config.DCCRelay{
+		PublicIP:      net.IPv4(203, 0, 113, 1),
+		MinPort:       port,
+		MaxPort:       port,
+		AcceptTimeout: 10 * time.Millisecond,
+	})
+	defer waitDCCRelayIdle(t, srv)
+
+	if reply := serviceReply("user update -dcc relay"); reply != `updated user "`+testUsername+`"` {
+		t.Fatalf("unexpected reply to DCC policy update: %q", reply)
+	}
+
+	sendUpstream("\x01DCC CHAT chat 3232235777 5000\x01") // 192.168.1.1
+	if msg := expectMessage(t, dc, "NOTICE"); !strings.Contains(msg.Params[1], "non-public address") {
+		t.Errorf("unexpected notice for DCC offer with a private address: %q", msg.Params[1])
+	}
+
+	sendUpstream(offer)
+	want := fmt.Sprintf("\x01DCC CHAT chat 3405803777 %v\x01", port) // 203.0.113.1
+	if msg := expectMessage(t, dc, "PRIVMSG"); msg.Params[1] != want {
+		t.Errorf("relayed DCC offer: got %q, want %q", msg.Params[1], want)
+	}
+}
+
+func TestServer_tofu(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+
+	newCert := func() (*tls.Certificate, string) {
+		privKeyBytes, certBytes, err := generateCertFP("ed25519", 0)
+		if err != nil {
+			t.Fatalf("failed to generate certificate: %v", err)
+		}
+		key, err := x509.ParsePKCS8PrivateKey(privKeyBytes)
+		if err != nil {
+			t.Fatalf("failed to parse private key: %v", err)
+		}
+		sum := sha256.Sum256(certBytes)
+		cert := &tls.Certificate{Certificate: [][]byte{certBytes}, PrivateKey: key}
+		return cert, "sha-256:" + hex.EncodeToString(sum[:])
+	}
+	cert1, certFP1 := newCert()
+	cert2, certFP2 := newCert()
+
+	var cert atomic.Pointer[tls.Certificate]
+	cert.Store(cert1)
+	tcpLn, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to create TCP listener: %v", err)
+	}
+	upstream := tls.NewListener(tcpLn, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cert.Load(), nil
+		},
+	})
+	defer upstream.Close()
+
+	network := database.NewNetwork("ircs://" + tcpLn.Addr().String())
+	network.Name = "testnet"
+	network.TOFU = true
+	if err := db.StoreNetwork(context.Background(), user.ID, network); err != nil {
+		t.Fatalf("failed to store test network: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	trustedCertFP := func() string {
+		networks, err := db.ListNetworks(context.Background(), user.ID)
+		if err != nil {
+			t.Fatalf("failed to list networks: %v", err)
+		}
+		return networks[0].TOFUCertFP
+	}
+	if fp := trustedCertFP(); fp != certFP1 {
+		t.Errorf("certificate trusted on first use: got %q, want %q", fp, certFP1)
+	}
+
+	// The server certificate changes: the connection must be refused
+	cert.Store(cert2)
+	uc.Close()
+
+	c, err := upstream.Accept()
+	if err != nil {
+		t.Fatalf("failed accepting connection: %v", err)
+	}
+	if err := c.(*tls.Conn).Handshake(); err == nil {
+		t.Errorf("TLS handshake with a changed certificate succeeded")
+	}
+	c.Close()
+
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command == "NOTICE" && strings.HasPrefix(msg.Params[1], "WARNING: ") {
+			if !strings.HasSuffix(msg.Params[1], "network trust-cert testnet "+certFP2) {
+				t.Errorf("unexpected warning: %q", msg.Params[1])
+			}
+			break
+		}
+	}
+
+	serviceReply := func(text string) string {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, text},
+		})
+		return expectMessage(t, dc, "PRIVMSG").Params[1]
+	}
+	if reply := serviceReply("network trust-cert testnet " + certFP1); !strings.Contains(reply, "doesn't match") {
+		t.Errorf("unexpected reply to trust-cert with the old fingerprint: %q", reply)
+	}
+	if reply := serviceReply("network trust-cert testnet " + strings.ToUpper(strings.TrimPrefix(certFP2, "sha-256:"))); reply != `trusted the new TLS certificate of network "testnet"` {
+		t.Errorf("unexpected reply to trust-cert: %q", reply)
+	}
+
+	uc = mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	if fp := trustedCertFP(); fp != certFP2 {
+		t.Errorf("trusted certificate: got %q, want %q", fp, certFP2)
+	}
+}
+
+func TestServer_networkHealth(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	cfg := *srv.Config()
+	cfg.NetworkHealth.MaxLag = time.Millisecond
+	srv.SetConfig(&cfg)
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	checkLag := func(delay time.Duration) {
+		dc.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, "network lag"},
+		})
+		var ping *irc.Message
+		for ping == nil {
+			msg, err := uc.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read IRC message: %v", err)
+			}
+			if msg.Command == "PING" {
+				ping = msg
+			}
+		}
+		time.Sleep(delay)
+		uc.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "irc.example.org"},
+			Command: "PONG",
+			Params:  []string{"irc.example.org", ping.Params[len(ping.Params)-1]},
+		})
+	}
+
+	checkLag(20 * time.Millisecond)
+	if msg := expectMessage(t, dc, "NOTICE"); !strings.Contains(msg.Params[1], "is degraded: lag of ") {
+		t.Errorf("unexpected degraded notice: %v", msg)
+	}
+	expectMessage(t, dc, "PRIVMSG") // lag check reply
+	if n := srv.metrics.degradedUpstreams.Value(); n != 1 {
+		t.Errorf("degraded upstreams metric: got %v, want 1", n)
+	}
+
+	dc.WriteMessage(&irc.Message{
+		Command: "PRIVMSG",
+		Params:  []string{serviceNick, "network status"},
+	})
+	if msg := expectMessage(t, dc, "PRIVMSG"); !strings.Contains(msg.Params[1], "degraded") {
+		t.Errorf("unexpected network status: %v", msg)
+	}
+	if msg := expectMessage(t, dc, "PRIVMSG"); !strings.HasPrefix(msg.Params[1], "  degraded: lag of ") {
+		t.Errorf("unexpected network status details: %v", msg)
+	}
+	expectMessage(t, dc, "PRIVMSG") // nick, username and realname
+
+	newCfg := *srv.Config()
+	newCfg.NetworkHealth.MaxLag = 0
+	srv.SetConfig(&newCfg)
+
+	checkLag(0)
+	if msg := expectMessage(t, dc, "NOTICE"); !strings.Contains(msg.Params[1], "back to normal") {
+		t.Errorf("unexpected recovery notice: %v", msg)
+	}
+	expectMessage(t, dc, "PRIVMSG") // lag check reply
+	if n := srv.metrics.degradedUpstreams.Value(); n != 0 {
+		t.Errorf("degraded upstreams metric: got %v, want 0", n)
+	}
+}
+
+func TestServer_userKick(t *testing.T) {
+	db := createTempSqliteDB(t)
+
+	user := createTestUser(t, db)
+	network, upstream := createTestUpstream(t, db, user)
+	defer upstream.Close()
+
+	admin := database.NewUser("admin")
+	admin.Role = database.RoleAdmin
+	if err := admin.SetPassword(testPassword); err != nil {
+		t.Fatalf("failed to generate bcrypt hash: %v", err)
+	}
+	if err := db.StoreUser(context.Background(), admin); err != nil {
+		t.Fatalf("failed to store admin user: %v", err)
+	}
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	uc := mustAccept(t, upstream)
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+
+	dc := createTestDownstream(t, srv)
+	defer dc.Close()
+	registerDownstreamConn(t, dc, network)
+	roundtrip(t, dc) // drain post-connection-registration messages
+
+	adminDC := createTestDownstream(t, srv)
+	defer adminDC.Close()
+	adminDC.WriteMessage(&irc.Message{Command: "PASS", Params: []string{testPassword}})
+	adminDC.WriteMessage(&irc.Message{Command: "NICK", Params: []string{admin.Username}})
+	adminDC.WriteMessage(&irc.Message{Command: "USER", Params: []string{admin.Username, "0", "*", admin.Username}})
+	expectMessage(t, adminDC, irc.RPL_WELCOME)
+	roundtrip(t, adminDC)
+
+	serviceCommand := func(c ircConn, text string) string {
+		c.WriteMessage(&irc.Message{
+			Command: "PRIVMSG",
+			Params:  []string{serviceNick, text},
+		})
+		for {
+			msg, err := c.ReadMessage()
+			if err != nil {
+				t.Fatalf("failed to read IRC message: %v", err)
+			}
+			if msg.Command == "PRIVMSG" {
+				return msg.Params[1]
+			}
+		}
+	}
+
+	if text := serviceCommand(dc, "user kick "+admin.Username); !strings.Contains(text, "permission") {
+		t.Errorf("unexpected reply to unprivileged user kick: %q", text)
+	}
+
+	text := serviceCommand(adminDC, "user kick "+testUsername+" -upstream be right back")
+	if text != `closed 0 downstream and 1 upstream connections of user "`+testUsername+`"` {
+		t.Errorf("unexpected reply to upstream user kick: %q", text)
+	}
+	for {
+		msg, err := uc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command != "QUIT" {
+			continue
+		}
+		if len(msg.Params) != 1 || msg.Params[0] != "be right back" {
+			t.Errorf("unexpected QUIT message: %v", msg)
+		}
+		break
+	}
+	uc.Close()
+
+	text = serviceCommand(adminDC, "user kick "+testUsername+" -downstream")
+	if !strings.HasPrefix(text, "closed 1 downstream and 0 upstream connections") {
+		t.Errorf("unexpected reply to downstream user kick: %q", text)
+	}
+	for {
+		msg, err := dc.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read IRC message: %v", err)
+		}
+		if msg.Command == "ERROR" {
+			break
+		}
+	}
+}
+
+func TestServer_starttls(t *testing.T) {
+	db := createTempSqliteDB(t)
+	user := createTestUser(t, db)
+
+	privKeyBytes, certBytes, err := generateCertFP("ed25519", 0)
+	if err != nil {
+		t.Fatalf("failed to generate certificate: %v", err)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(privKeyBytes)
+	if err != nil {
+		t.Fatalf("failed to parse private key: %v", err)
+	}
+	sum := sha256.Sum256(certBytes)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{certBytes}, PrivateKey: key}},
+	}
+
+	createStarttlsUpstream := func(name string) net.Listener {
+		ln, err := net.Listen("tcp", "localhost:0")
+		if err != nil {
+			t.Fatalf("failed to create TCP listener: %v", err)
+		}
+		network := database.NewNetwork("irc+starttls://" + ln.Addr().String())
+		network.Name = name
+		network.CertFP = "sha-256:" + hex.EncodeToString(sum[:])
+		if err := db.StoreNetwork(context.Background(), user.ID, network); err != nil {
+			t.Fatalf("failed to store test network: %v", err)
+		}
+		return ln
+	}
+	refusing := createStarttlsUpstream("refusing")
+	defer refusing.Close()
+	upstream := createStarttlsUpstream("testnet")
+	defer upstream.Close()
+
+	srv := NewServer(db)
+	srv.Logger = testingLogger{t}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer srv.Shutdown()
+
+	acceptStarttls := func(ln net.Listener, reply string) net.Conn {
+		c, err := ln.Accept()
+		if err != nil {
+			t.Fatalf("failed accepting connection: %v", err)
+		}
+		// Nothing must be sent in plain text besides STARTTLS
+		ic := newNetIRCConn(c)
+		expectMessage(t, ic, "STARTTLS")
+		ic.WriteMessage(&irc.Message{
+			Prefix:  &irc.Prefix{Name: "irc.example.org"},
+			Command: reply,
+			Params:  []string{"*", "STARTTLS"},
+		})
+		return c
+	}
+
+	c := acceptStarttls(refusing, irc.ERR_STARTTLS)
+	defer c.Close()
+	if msg, err := newNetIRCConn(c).ReadMessage(); err == nil {
+		t.Errorf("unexpected message after refusing STARTTLS: %v", msg)
+	}
+
+	c = acceptStarttls(upstream, irc.RPL_STARTTLS)
+	uc := newNetIRCConn(tls.Server(c, tlsConfig))
+	defer uc.Close()
+	registerUpstreamConn(t, uc)
+	roundtrip(t, uc)
+}
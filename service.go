@@ -17,7 +17,10 @@ import (
 
 	"gopkg.in/irc.v4"
 
+	"git.sr.ht/~emersion/soju/config"
 	"git.sr.ht/~emersion/soju/database"
+	"git.sr.ht/~emersion/soju/msgstore"
+	"git.sr.ht/~emersion/soju/xirc"
 )
 
 const serviceNick = "BouncerServ"
@@ -36,30 +39,49 @@ var servicePrefix = &irc.Prefix{
 
 type serviceContext struct {
 	context.Context
-	nick    string   // optional
-	network *network // optional
-	user    *user    // optional
-	srv     *Server
-	admin   bool
-	print   func(string)
+	nick       string          // optional
+	network    *network        // optional
+	user       *user           // optional
+	downstream *downstreamConn // optional
+	srv        *Server
+	role       database.Role
+	print      func(string)
+
+	// Optional, can be called after the command has returned
+	printLater func(string)
+
+	// Translations of messages, nil for the default language
+	catalog catalog
+}
+
+// sprintf formats a message translated in the language of the user.
+func (ctx *serviceContext) sprintf(format string, args ...interface{}) string {
+	return ctx.catalog.sprintf(format, args...)
+}
+
+// printf prints a message translated in the language of the user.
+func (ctx *serviceContext) printf(format string, args ...interface{}) {
+	ctx.print(ctx.sprintf(format, args...))
 }
 
 type serviceCommandSet map[string]*serviceCommand
 
 type serviceCommand struct {
-	usage    string
-	desc     string
-	handle   func(ctx *serviceContext, params []string) error
-	children serviceCommandSet
-	admin    bool
-	global   bool
+	usage      string
+	desc       string
+	handle     func(ctx *serviceContext, params []string) error
+	children   serviceCommandSet
+	permission permission
+	global     bool
 }
 
-func sendServiceNOTICE(dc *downstreamConn, text string) {
+// sendServiceNOTICE sends a notice from BouncerServ, translated in the user's
+// language.
+func sendServiceNOTICE(dc *downstreamConn, format string, args ...interface{}) {
 	dc.SendMessage(context.TODO(), &irc.Message{
 		Prefix:  servicePrefix,
 		Command: "NOTICE",
-		Params:  []string{dc.nick, text},
+		Params:  []string{dc.nick, catalogs[dc.user.Language].sprintf(format, args...)},
 	})
 }
 
@@ -115,19 +137,23 @@ func splitWords(s string) ([]string, error) {
 	}
 
 	if wordDelim != ' ' {
-		return nil, fmt.Errorf("unterminated quoted string")
+		return nil, serviceErrorf("unterminated quoted string")
 	}
 	if escape {
-		return nil, fmt.Errorf("unterminated backslash sequence")
+		return nil, serviceErrorf("unterminated backslash sequence")
 	}
 
 	return words, nil
 }
 
 func handleServicePRIVMSG(ctx *serviceContext, text string) error {
+	if ctx.user != nil && !ctx.srv.serviceLimiter.Allow(ctx.user.Username, ctx.srv.Config().Limits.ServiceCommandsPerMinute) {
+		return serviceErrorf("too many commands, try again later")
+	}
+
 	words, err := splitWords(text)
 	if err != nil {
-		return fmt.Errorf(`failed to parse command: %v`, err)
+		return serviceErrorf(`failed to parse command: %v`, err)
 	}
 	return handleServiceCommand(ctx, words)
 }
@@ -135,20 +161,20 @@ func handleServicePRIVMSG(ctx *serviceContext, text string) error {
 func handleServiceCommand(ctx *serviceContext, words []string) error {
 	cmd, params, err := serviceCommands.Get(words)
 	if err != nil {
-		return fmt.Errorf(`%v (type "help" for a list of commands)`, err)
+		return serviceErrorf(`%v (type "help" for a list of commands)`, err)
 	}
-	if cmd.admin && !ctx.admin {
-		return fmt.Errorf("you must be an admin to use this command")
+	if !hasPermission(ctx.role, cmd.permission) {
+		return serviceErrorf("you don't have the permission to use this command")
 	}
 	if !cmd.global && ctx.user == nil {
-		return fmt.Errorf("this command must be run as a user (try running with user run)")
+		return serviceErrorf("this command must be run as a user (try running with user run)")
 	}
 
 	if cmd.handle == nil {
 		if len(cmd.children) > 0 {
 			var l []string
-			appendServiceCommandSetHelp(cmd.children, words, ctx.admin, ctx.user == nil, &l)
-			ctx.print("available commands: " + strings.Join(l, ", "))
+			appendServiceCommandSetHelp(cmd.children, words, ctx.role, ctx.user == nil, &l)
+			ctx.printf("available commands: %v", strings.Join(l, ", "))
 			return nil
 		}
 		// Pretend the command does not exist if it has neither children nor handler.
@@ -160,7 +186,7 @@ func handleServiceCommand(ctx *serviceContext, words []string) error {
 			logger = ctx.srv.Logger
 		}
 		logger.Printf("command without handler and subcommands invoked:", words[0])
-		return fmt.Errorf("command %q not found", words[0])
+		return serviceErrorf("command %q not found", words[0])
 	}
 
 	return cmd.handle(ctx, params)
@@ -168,7 +194,7 @@ func handleServiceCommand(ctx *serviceContext, words []string) error {
 
 func (cmds serviceCommandSet) Get(params []string) (*serviceCommand, []string, error) {
 	if len(params) == 0 {
-		return nil, nil, fmt.Errorf("no command specified")
+		return nil, nil, serviceErrorf("no command specified")
 	}
 
 	name := params[0]
@@ -181,13 +207,13 @@ func (cmds serviceCommandSet) Get(params []string) (*serviceCommand, []string, e
 				continue
 			}
 			if cmd != nil {
-				return nil, params, fmt.Errorf("command %q is ambiguous", name)
+				return nil, params, serviceErrorf("command %q is ambiguous", name)
 			}
 			cmd = cmds[k]
 		}
 	}
 	if cmd == nil {
-		return nil, params, fmt.Errorf("command %q not found", name)
+		return nil, params, serviceErrorf("command %q not found", name)
 	}
 
 	if len(params) == 0 || len(cmd.children) == 0 {
@@ -218,7 +244,7 @@ func init() {
 		"network": {
 			children: serviceCommandSet{
 				"create": {
-					usage:  "-addr <addr> [-name name] [-username username] [-pass pass] [-realname realname] [-certfp fingerprint] [-nick nick] [-auto-away auto-away] [-enabled enabled] [-connect-command command]...",
+					usage:  "-addr <addr> [-name name] [-username username] [-pass pass] [-realname realname] [-certfp fingerprint] [-tls-min-version version] [-resolver system] [-socket-options options] [-sasl-failure abort|continue] [-nick nick] [-auto-away auto-away] [-enabled enabled] [-connect-command command]... [-disable-cap cap]... [-tofu true|false] [-max-lag duration|default|none] [-max-reconnects count|default|none]",
 					desc:   "add a new network",
 					handle: handleServiceNetworkCreate,
 				},
@@ -227,7 +253,7 @@ func init() {
 					handle: handleServiceNetworkStatus,
 				},
 				"update": {
-					usage:  "[name] [-addr addr] [-name name] [-username username] [-pass pass] [-realname realname] [-certfp fingerprint] [-nick nick] [-auto-away auto-away] [-enabled enabled] [-connect-command command]...",
+					usage:  "[name] [-addr addr] [-name name] [-username username] [-pass pass] [-realname realname] [-certfp fingerprint] [-tls-min-version version] [-resolver system] [-socket-options options] [-sasl-failure abort|continue] [-nick nick] [-auto-away auto-away] [-enabled enabled] [-connect-command command]... [-disable-cap cap]... [-tofu true|false] [-max-lag duration|default|none] [-max-reconnects count|default|none]",
 					desc:   "update a network",
 					handle: handleServiceNetworkUpdate,
 				},
@@ -236,11 +262,31 @@ func init() {
 					desc:   "delete a network",
 					handle: handleServiceNetworkDelete,
 				},
+				"connect": {
+					usage:  "<name>",
+					desc:   "connect to a network now",
+					handle: handleServiceNetworkConnect,
+				},
+				"disconnect": {
+					usage:  "<name> [reason]",
+					desc:   "disconnect from a network until the next connect or restart",
+					handle: handleServiceNetworkDisconnect,
+				},
+				"lag": {
+					usage:  "[name]",
+					desc:   "measure the lag to a network",
+					handle: handleServiceNetworkLag,
+				},
 				"quote": {
 					usage:  "[name] <command>",
 					desc:   "send a raw line to a network",
 					handle: handleServiceNetworkQuote,
 				},
+				"trust-cert": {
+					usage:  "[name] <fingerprint>",
+					desc:   "trust the new TLS certificate of a network using trust-on-first-use",
+					handle: handleServiceNetworkTrustCert,
+				},
 			},
 		},
 		"certfp": {
@@ -279,20 +325,20 @@ func init() {
 		"user": {
 			children: serviceCommandSet{
 				"status": {
-					desc:   "show a list of users and their current status",
-					handle: handleUserStatus,
-					admin:  true,
-					global: true,
+					desc:       "show a list of users and their current status",
+					handle:     handleUserStatus,
+					permission: permissionViewStatus,
+					global:     true,
 				},
 				"create": {
-					usage:  "-username <username> -password <password> [-disable-password] [-admin true|false] [-nick <nick>] [-realname <realname>] [-enabled true|false]",
-					desc:   "create a new soju user",
-					handle: handleUserCreate,
-					admin:  true,
-					global: true,
+					usage:      "-username <username> -password <password> [-disable-password] [-role admin|user-manager|observer|user] [-nick <nick>] [-realname <realname>] [-enabled true|false]",
+					desc:       "create a new soju user",
+					handle:     handleUserCreate,
+					permission: permissionCreateUsers,
+					global:     true,
 				},
 				"update": {
-					usage:  "[username] [-password <password>] [-disable-password] [-admin true|false] [-nick <nick>] [-realname <realname>] [-enabled true|false]",
+					usage:  "[username] [-password <password>] [-disable-password] [-role admin|user-manager|observer|user] [-nick <nick>] [-realname <realname>] [-enabled true|false] [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration>] [-detach-on <default|none|highlight|message>] [-auto-detach-idle <days>] [-language <language>] [-dcc pass|block|relay]",
 					desc:   "update a user",
 					handle: handleUserUpdate,
 					global: true,
@@ -303,12 +349,19 @@ func init() {
 					handle: handleUserDelete,
 					global: true,
 				},
+				"kick": {
+					usage:      "<username> [-downstream] [-upstream] [reason]",
+					desc:       "close the connections of a user",
+					handle:     handleUserKick,
+					permission: permissionManageUsers,
+					global:     true,
+				},
 				"run": {
-					usage:  "<username> <command>",
-					desc:   "run a command as another user",
-					handle: handleUserRun,
-					admin:  true,
-					global: true,
+					usage:      "<username> <command>",
+					desc:       "run a command as another user",
+					handle:     handleUserRun,
+					permission: permissionManageUsers,
+					global:     true,
 				},
 			},
 			global: true,
@@ -321,7 +374,7 @@ func init() {
 					handle: handleServiceChannelStatus,
 				},
 				"update": {
-					usage:  "<name> [-detached <true|false>] [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration>] [-detach-on <default|none|highlight|message>]",
+					usage:  "<name> [-detached <true|false>] [-relay-detached <default|none|highlight|message>] [-reattach-on <default|none|highlight|message>] [-detach-after <duration>] [-detach-on <default|none|highlight|message>] [-highlight-add <keyword>]... [-highlight-del <keyword>]... [-highlight-nick <true|false>]",
 					desc:   "update a channel",
 					handle: handleServiceChannelUpdate,
 				},
@@ -330,44 +383,106 @@ func init() {
 					desc:   "delete a channel",
 					handle: handleServiceChannelDelete,
 				},
+				"detach": {
+					usage:  "<pattern> [-network name]",
+					desc:   "detach all channels matching a pattern",
+					handle: handleServiceChannelDetach,
+				},
+				"reattach": {
+					usage:  "<pattern> [-network name]",
+					desc:   "reattach all channels matching a pattern",
+					handle: handleServiceChannelReattach,
+				},
+			},
+		},
+		"client": {
+			children: serviceCommandSet{
+				"status": {
+					desc:   "show a list of clients and their settings",
+					handle: handleServiceClientStatus,
+				},
+				"update": {
+					usage:  "<name> [-summary <true|false>] [-playback-style privmsg|notice|prefixed]",
+					desc:   "update a client",
+					handle: handleServiceClientUpdate,
+				},
+			},
+		},
+		"highlights": {
+			desc:   "show highlights which happened while no client was active",
+			handle: handleServiceHighlights,
+			children: serviceCommandSet{
+				"clear": {
+					desc:   "clear pending highlights",
+					handle: handleServiceHighlightsClear,
+				},
 			},
 		},
+		"replay": {
+			usage:  "<target> <count|duration>",
+			desc:   "replay the latest messages of a channel or user",
+			handle: handleServiceReplay,
+		},
+		"stats": {
+			usage:  "[network]",
+			desc:   "show traffic statistics of networks",
+			handle: handleServiceStats,
+		},
 		"server": {
 			children: serviceCommandSet{
 				"status": {
-					desc:   "show server statistics",
-					handle: handleServiceServerStatus,
-					admin:  true,
-					global: true,
+					desc:       "show server statistics",
+					handle:     handleServiceServerStatus,
+					permission: permissionViewStatus,
+					global:     true,
 				},
 				"notice": {
-					usage:  "<notice>",
-					desc:   "broadcast a notice to all connected bouncer users",
-					handle: handleServiceServerNotice,
-					admin:  true,
-					global: true,
+					usage:      "<notice>",
+					desc:       "broadcast a notice to all connected bouncer users",
+					handle:     handleServiceServerNotice,
+					permission: permissionBroadcast,
+					global:     true,
+				},
+				"announce": {
+					children: serviceCommandSet{
+						"set": {
+							usage:      "<announcement>",
+							desc:       "set an announcement shown in the MOTD and broadcast it to all connected bouncer users",
+							handle:     handleServiceServerAnnounceSet,
+							permission: permissionBroadcast,
+							global:     true,
+						},
+						"clear": {
+							desc:       "clear the current announcement",
+							handle:     handleServiceServerAnnounceClear,
+							permission: permissionBroadcast,
+							global:     true,
+						},
+					},
+					permission: permissionBroadcast,
 				},
 			},
-			admin: true,
+			permission: permissionViewStatus,
 		},
 	}
 }
 
-func appendServiceCommandSetHelp(cmds serviceCommandSet, prefix []string, admin bool, global bool, l *[]string) {
+func appendServiceCommandSetHelp(cmds serviceCommandSet, prefix []string, role database.Role, global bool, l *[]string) {
 	for _, name := range cmds.Names() {
 		cmd := cmds[name]
-		if cmd.admin && !admin {
+		if !hasPermission(role, cmd.permission) {
 			continue
 		}
 		if !cmd.global && global {
 			continue
 		}
 		words := append(prefix, name)
-		if len(cmd.children) == 0 {
+		if len(cmd.children) == 0 || cmd.handle != nil {
 			s := strings.Join(words, " ")
 			*l = append(*l, s)
-		} else {
-			appendServiceCommandSetHelp(cmd.children, words, admin, global, l)
+		}
+		if len(cmd.children) > 0 {
+			appendServiceCommandSetHelp(cmd.children, words, role, global, l)
 		}
 	}
 }
@@ -382,21 +497,21 @@ func handleServiceHelp(ctx *serviceContext, params []string) error {
 
 		if len(cmd.children) > 0 {
 			var l []string
-			appendServiceCommandSetHelp(cmd.children, words, ctx.admin, ctx.user == nil, &l)
-			ctx.print("available commands: " + strings.Join(l, ", "))
+			appendServiceCommandSetHelp(cmd.children, words, ctx.role, ctx.user == nil, &l)
+			ctx.printf("available commands: %v", strings.Join(l, ", "))
 		} else {
 			text := strings.Join(words, " ")
 			if cmd.usage != "" {
 				text += " " + cmd.usage
 			}
-			text += ": " + cmd.desc
+			text += ": " + ctx.catalog.translate(cmd.desc)
 
 			ctx.print(text)
 		}
 	} else {
 		var l []string
-		appendServiceCommandSetHelp(serviceCommands, nil, ctx.admin, ctx.user == nil, &l)
-		ctx.print("available commands: " + strings.Join(l, ", "))
+		appendServiceCommandSetHelp(serviceCommands, nil, ctx.role, ctx.user == nil, &l)
+		ctx.printf("available commands: %v", strings.Join(l, ", "))
 	}
 	return nil
 }
@@ -461,13 +576,13 @@ func getNetworkFromArg(ctx *serviceContext, params []string) (*network, []string
 	name, params := popArg(params)
 	if name == "" {
 		if ctx.network == nil {
-			return nil, params, fmt.Errorf("no network selected, a name argument is required")
+			return nil, params, serviceErrorf("no network selected, a name argument is required")
 		}
 		return ctx.network, params, nil
 	} else {
 		net := ctx.user.getNetwork(name)
 		if net == nil {
-			return nil, params, fmt.Errorf("unknown network %q", name)
+			return nil, params, serviceErrorf("unknown network %q", name)
 		}
 		return net, params, nil
 	}
@@ -476,8 +591,11 @@ func getNetworkFromArg(ctx *serviceContext, params []string) (*network, []string
 type networkFlagSet struct {
 	*flag.FlagSet
 	Addr, Name, Nick, Username, Pass, Realname, CertFP *string
-	AutoAway, Enabled                                  *bool
+	TLSMinVersion, SASLFailure, Resolver               *string
+	SocketOptions, MaxLag, MaxReconnects               *string
+	AutoAway, Enabled, TOFU                            *bool
 	ConnectCommands                                    []string
+	DisabledCaps                                       []string
 }
 
 func newNetworkFlagSet() *networkFlagSet {
@@ -489,9 +607,17 @@ func newNetworkFlagSet() *networkFlagSet {
 	fs.Var(stringPtrFlag{&fs.Pass}, "pass", "")
 	fs.Var(stringPtrFlag{&fs.Realname}, "realname", "")
 	fs.Var(stringPtrFlag{&fs.CertFP}, "certfp", "")
+	fs.Var(stringPtrFlag{&fs.TLSMinVersion}, "tls-min-version", "")
+	fs.Var(stringPtrFlag{&fs.SASLFailure}, "sasl-failure", "")
+	fs.Var(stringPtrFlag{&fs.Resolver}, "resolver", "")
+	fs.Var(stringPtrFlag{&fs.SocketOptions}, "socket-options", "")
 	fs.Var(boolPtrFlag{&fs.AutoAway}, "auto-away", "")
 	fs.Var(boolPtrFlag{&fs.Enabled}, "enabled", "")
+	fs.Var(boolPtrFlag{&fs.TOFU}, "tofu", "")
+	fs.Var(stringPtrFlag{&fs.MaxLag}, "max-lag", "")
+	fs.Var(stringPtrFlag{&fs.MaxReconnects}, "max-reconnects", "")
 	fs.Var((*stringSliceFlag)(&fs.ConnectCommands), "connect-command", "")
+	fs.Var((*stringSliceFlag)(&fs.DisabledCaps), "disable-cap", "")
 	return fs
 }
 
@@ -500,16 +626,20 @@ func (fs *networkFlagSet) update(network *database.Network) error {
 		if addrParts := strings.SplitN(*fs.Addr, "://", 2); len(addrParts) == 2 {
 			scheme := addrParts[0]
 			switch scheme {
-			case "ircs", "irc+insecure", "unix":
+			case "ircs", "irc+insecure", "irc+starttls", "irc+unix", "ircs+unix", "unix":
 			default:
-				return fmt.Errorf("unknown scheme %q (supported schemes: ircs, irc+insecure, unix)", scheme)
+				return serviceErrorf("unknown scheme %q (supported schemes: ircs, irc+insecure, irc+starttls, irc+unix, ircs+unix)", scheme)
 			}
 		}
+		if *fs.Addr != network.Addr {
+			// The certificate trusted on first use belongs to the old server
+			network.TOFUCertFP = ""
+		}
 		network.Addr = *fs.Addr
 	}
 	if fs.Name != nil {
 		if *fs.Name == "*" {
-			return fmt.Errorf("the network name %q is reserved for multi-upstream mode", *fs.Name)
+			return serviceErrorf("the network name %q is reserved for multi-upstream mode", *fs.Name)
 		}
 		network.Name = *fs.Name
 	}
@@ -528,7 +658,7 @@ func (fs *networkFlagSet) update(network *database.Network) error {
 	if fs.CertFP != nil {
 		certFP := strings.ToLower(strings.ReplaceAll(*fs.CertFP, ":", ""))
 		if _, err := hex.DecodeString(certFP); err != nil {
-			return fmt.Errorf("the certificate fingerprint must be hex-encoded")
+			return serviceErrorf("the certificate fingerprint must be hex-encoded")
 		}
 		if len(certFP) == 0 {
 			network.CertFP = ""
@@ -537,31 +667,109 @@ func (fs *networkFlagSet) update(network *database.Network) error {
 		} else if len(certFP) == 128 {
 			network.CertFP = "sha-512:" + certFP
 		} else {
-			return fmt.Errorf("the certificate fingerprint must be a SHA256 or SHA512 hash")
+			return serviceErrorf("the certificate fingerprint must be a SHA256 or SHA512 hash")
 		}
 	}
+	if fs.TLSMinVersion != nil {
+		if *fs.TLSMinVersion != "" {
+			if _, err := config.ParseTLSVersion(*fs.TLSMinVersion); err != nil {
+				return err
+			}
+		}
+		network.TLSMinVersion = *fs.TLSMinVersion
+	}
+	if fs.Resolver != nil {
+		// Arbitrary resolver addresses would let users make the bouncer send
+		// traffic to any host, only the server configuration can set them
+		if *fs.Resolver != "" && *fs.Resolver != "system" {
+			return serviceErrorf("the resolver must be \"system\" or empty")
+		}
+		network.Resolver = *fs.Resolver
+	}
+	if fs.SocketOptions != nil {
+		opts, err := config.ParseSocketOptions(*fs.SocketOptions)
+		if err != nil {
+			return err
+		}
+		network.SocketOptions = opts.String()
+	}
+	if fs.SASLFailure != nil {
+		policy, err := parseSASLFailurePolicy(*fs.SASLFailure)
+		if err != nil {
+			return err
+		}
+		network.SASLFailure = policy
+	}
 	if fs.AutoAway != nil {
 		network.AutoAway = *fs.AutoAway
 	}
 	if fs.Enabled != nil {
 		network.Enabled = *fs.Enabled
 	}
+	if fs.TOFU != nil {
+		network.TOFU = *fs.TOFU
+		if !network.TOFU {
+			network.TOFUCertFP = ""
+		}
+	}
+	if fs.MaxLag != nil {
+		switch *fs.MaxLag {
+		case "default":
+			network.HealthMaxLag = 0
+		case "none":
+			network.HealthMaxLag = -1
+		default:
+			dur, err := time.ParseDuration(*fs.MaxLag)
+			if err != nil || dur < time.Second {
+				return serviceErrorf("invalid value for -max-lag %q (expected a duration of at least 1s, default or none)", *fs.MaxLag)
+			}
+			network.HealthMaxLag = dur
+		}
+	}
+	if fs.MaxReconnects != nil {
+		switch *fs.MaxReconnects {
+		case "default":
+			network.HealthMaxReconnects = 0
+		case "none":
+			network.HealthMaxReconnects = -1
+		default:
+			n, err := strconv.Atoi(*fs.MaxReconnects)
+			if err != nil || n <= 0 {
+				return serviceErrorf("invalid value for -max-reconnects %q (expected a positive number, default or none)", *fs.MaxReconnects)
+			}
+			network.HealthMaxReconnects = n
+		}
+	}
 	if fs.ConnectCommands != nil {
 		if len(fs.ConnectCommands) == 1 && fs.ConnectCommands[0] == "" {
 			network.ConnectCommands = nil
 		} else {
 			if len(fs.ConnectCommands) > 20 {
-				return fmt.Errorf("too many -connect-command flags supplied")
+				return serviceErrorf("too many -connect-command flags supplied")
 			}
 			for _, command := range fs.ConnectCommands {
 				_, err := irc.ParseMessage(command)
 				if err != nil {
-					return fmt.Errorf("flag -connect-command must be a valid raw irc command string: %q: %v", command, err)
+					return serviceErrorf("flag -connect-command must be a valid raw irc command string: %q: %v", command, err)
 				}
 			}
 			network.ConnectCommands = fs.ConnectCommands
 		}
 	}
+	if fs.DisabledCaps != nil {
+		if len(fs.DisabledCaps) == 1 && fs.DisabledCaps[0] == "" {
+			network.DisabledCaps = nil
+		} else {
+			var caps []string
+			for _, name := range fs.DisabledCaps {
+				if name == "" || strings.ContainsAny(name, " =") {
+					return serviceErrorf("flag -disable-cap must be a capability name: %q", name)
+				}
+				caps = append(caps, strings.ToLower(name))
+			}
+			network.DisabledCaps = caps
+		}
+	}
 	return nil
 }
 
@@ -571,10 +779,10 @@ func handleServiceNetworkCreate(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 	if fs.Addr == nil {
-		return fmt.Errorf("flag -addr is required")
+		return serviceErrorf("flag -addr is required")
 	}
 
 	record := database.NewNetwork(*fs.Addr)
@@ -584,40 +792,48 @@ func handleServiceNetworkCreate(ctx *serviceContext, params []string) error {
 
 	network, err := ctx.user.createNetwork(ctx, record)
 	if err != nil {
-		return fmt.Errorf("could not create network: %v", err)
+		return serviceErrorf("could not create network: %v", err)
 	}
 
-	ctx.print(fmt.Sprintf("created network %q", network.GetName()))
+	ctx.printf("created network %q", network.GetName())
 	return nil
 }
 
 func handleServiceNetworkStatus(ctx *serviceContext, params []string) error {
 	if len(params) != 0 {
-		return fmt.Errorf("expected no argument")
+		return serviceErrorf("expected no argument")
 	}
 
 	n := 0
 	for _, net := range ctx.user.networks {
 		var statuses []string
 		var details string
-		if uc := net.conn; uc != nil {
+		if net.manuallyDisconnected.Load() {
+			statuses = append(statuses, ctx.sprintf("manually disconnected"))
+		} else if uc := net.conn; uc != nil {
 			if ctx.nick != "" && ctx.nick != uc.nick {
-				statuses = append(statuses, "connected as "+uc.nick)
+				statuses = append(statuses, ctx.sprintf("connected as %v", uc.nick))
 			} else {
-				statuses = append(statuses, "connected")
+				statuses = append(statuses, ctx.sprintf("connected"))
+			}
+			details = ctx.sprintf("%v channels", uc.channels.Len())
+			if uc.lag != 0 {
+				details = ctx.sprintf("%v channels, lag %v", uc.channels.Len(), uc.lag.Round(time.Millisecond))
 			}
-			details = fmt.Sprintf("%v channels", uc.channels.Len())
 		} else if !net.Enabled {
-			statuses = append(statuses, "disabled")
+			statuses = append(statuses, ctx.sprintf("disabled"))
 		} else {
-			statuses = append(statuses, "disconnected")
+			statuses = append(statuses, ctx.sprintf("disconnected"))
 			if net.lastError != nil {
 				details = net.lastError.Error()
 			}
 		}
 
+		if net.health.report.degraded() {
+			statuses = append(statuses, ctx.sprintf("degraded"))
+		}
 		if net == ctx.network {
-			statuses = append(statuses, "current")
+			statuses = append(statuses, ctx.sprintf("current"))
 		}
 
 		name := net.GetName()
@@ -631,11 +847,38 @@ func handleServiceNetworkStatus(ctx *serviceContext, params []string) error {
 		}
 		ctx.print(s)
 
+		if net.lastServerError != "" {
+			ctx.printf("  last server error (%v): %v", net.lastServerErrorTime.Format(time.RFC3339), net.lastServerError)
+		}
+		if report := &net.health.report; report.lag != 0 {
+			ctx.printf("  degraded: lag of %v exceeds %v", report.lag.Round(time.Millisecond), report.maxLag)
+		}
+		if report := &net.health.report; report.reconnects != 0 {
+			ctx.printf("  degraded: reconnected %v times in the last hour (limit %v)", report.reconnects, report.maxReconnects)
+		}
+
+		ctx.printf("  nick %v, username %v, realname %v",
+			database.GetNick(&ctx.user.User, &net.Network),
+			database.GetUsername(&ctx.user.User, &net.Network),
+			database.GetRealname(&ctx.user.User, &net.Network))
+
+		if uc := net.conn; uc != nil && len(uc.caps.Enabled) > 0 {
+			caps := make([]string, 0, len(uc.caps.Enabled))
+			for name := range uc.caps.Enabled {
+				caps = append(caps, name)
+			}
+			sort.Strings(caps)
+			ctx.printf("  enabled capabilities: %v", strings.Join(caps, " "))
+		}
+		if len(net.DisabledCaps) > 0 {
+			ctx.printf("  disabled capabilities: %v", strings.Join(net.DisabledCaps, " "))
+		}
+
 		n++
 	}
 
 	if n == 0 {
-		ctx.print(`No network configured, add one with "network create".`)
+		ctx.printf(`No network configured, add one with "network create".`)
 	}
 
 	return nil
@@ -652,7 +895,7 @@ func handleServiceNetworkUpdate(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 
 	record := net.Network // copy network record because we'll mutate it
@@ -662,16 +905,16 @@ func handleServiceNetworkUpdate(ctx *serviceContext, params []string) error {
 
 	network, err := ctx.user.updateNetwork(ctx, &record)
 	if err != nil {
-		return fmt.Errorf("could not update network: %v", err)
+		return serviceErrorf("could not update network: %v", err)
 	}
 
-	ctx.print(fmt.Sprintf("updated network %q", network.GetName()))
+	ctx.printf("updated network %q", network.GetName())
 	return nil
 }
 
 func handleServiceNetworkDelete(ctx *serviceContext, params []string) error {
 	if len(params) != 1 {
-		return fmt.Errorf("expected exactly one argument")
+		return serviceErrorf("expected exactly one argument")
 	}
 	net, params, err := getNetworkFromArg(ctx, params)
 	if err != nil {
@@ -682,13 +925,83 @@ func handleServiceNetworkDelete(ctx *serviceContext, params []string) error {
 		return err
 	}
 
-	ctx.print(fmt.Sprintf("deleted network %q", net.GetName()))
+	ctx.printf("deleted network %q", net.GetName())
+	return nil
+}
+
+func handleServiceNetworkConnect(ctx *serviceContext, params []string) error {
+	if len(params) != 1 {
+		return serviceErrorf("expected exactly one argument")
+	}
+	net, _, err := getNetworkFromArg(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	if !net.Enabled {
+		return serviceErrorf("network %q is disabled", net.GetName())
+	}
+	if net.conn != nil && !net.manuallyDisconnected.Load() {
+		ctx.printf("already connected to network %q", net.GetName())
+		return nil
+	}
+
+	net.connect()
+
+	ctx.printf("connecting to network %q", net.GetName())
+	return nil
+}
+
+func handleServiceNetworkDisconnect(ctx *serviceContext, params []string) error {
+	if len(params) != 1 && len(params) != 2 {
+		return serviceErrorf("expected one or two arguments")
+	}
+	net, params, err := getNetworkFromArg(ctx, params)
+	if err != nil {
+		return err
+	}
+	reason, _ := popArg(params)
+
+	if !net.Enabled {
+		return serviceErrorf("network %q is disabled", net.GetName())
+	}
+	if net.manuallyDisconnected.Load() {
+		return serviceErrorf("network %q is already manually disconnected", net.GetName())
+	}
+
+	net.disconnect(reason)
+
+	ctx.printf("disconnected from network %q", net.GetName())
+	return nil
+}
+
+func handleServiceNetworkLag(ctx *serviceContext, params []string) error {
+	net, params, err := getNetworkFromArg(ctx, params)
+	if err != nil {
+		return err
+	}
+	if len(params) != 0 {
+		return serviceErrorf("expected at most one argument")
+	}
+
+	uc := net.conn
+	if uc == nil {
+		return serviceErrorf("network %q is not currently connected", net.GetName())
+	}
+	if ctx.printLater == nil {
+		return serviceErrorf("lag checks are only supported from IRC clients")
+	}
+
+	name, printLater, cat := net.GetName(), ctx.printLater, ctx.catalog
+	uc.checkLag(ctx, func(rtt time.Duration) {
+		printLater(cat.sprintf("lag to %q: %v", name, rtt.Round(time.Millisecond)))
+	})
 	return nil
 }
 
 func handleServiceNetworkQuote(ctx *serviceContext, params []string) error {
 	if len(params) != 1 && len(params) != 2 {
-		return fmt.Errorf("expected one or two arguments")
+		return serviceErrorf("expected one or two arguments")
 	}
 
 	raw := params[len(params)-1]
@@ -701,38 +1014,70 @@ func handleServiceNetworkQuote(ctx *serviceContext, params []string) error {
 
 	uc := net.conn
 	if uc == nil {
-		return fmt.Errorf("network %q is not currently connected", net.GetName())
+		return serviceErrorf("network %q is not currently connected", net.GetName())
 	}
 
 	m, err := irc.ParseMessage(raw)
 	if err != nil {
-		return fmt.Errorf("failed to parse command %q: %v", raw, err)
+		return serviceErrorf("failed to parse command %q: %v", raw, err)
 	}
 	uc.SendMessage(ctx, m)
 
-	ctx.print(fmt.Sprintf("sent command to %q", net.GetName()))
+	ctx.printf("sent command to %q", net.GetName())
+	return nil
+}
+
+func handleServiceNetworkTrustCert(ctx *serviceContext, params []string) error {
+	if len(params) != 1 && len(params) != 2 {
+		return serviceErrorf("expected one or two arguments")
+	}
+
+	certFP := params[len(params)-1]
+	params = params[:len(params)-1]
+
+	net, params, err := getNetworkFromArg(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	if net.untrustedCertFP == "" {
+		return serviceErrorf("the TLS certificate of network %q didn't change", net.GetName())
+	}
+	certFP = strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(certFP, "sha-256:"), ":", ""))
+	if certFP != strings.TrimPrefix(net.untrustedCertFP, "sha-256:") {
+		return serviceErrorf("the fingerprint doesn't match the new TLS certificate of network %q", net.GetName())
+	}
+
+	record := net.Network // copy network record because we'll mutate it
+	record.TOFUCertFP = net.untrustedCertFP
+	network, err := ctx.user.updateNetwork(ctx, &record)
+	if err != nil {
+		return serviceErrorf("could not update network: %v", err)
+	}
+
+	ctx.printf("trusted the new TLS certificate of network %q", network.GetName())
 	return nil
 }
 
 func sendCertfpFingerprints(ctx *serviceContext, cert []byte) {
 	sha1Sum := sha1.Sum(cert)
-	ctx.print("SHA-1 fingerprint: " + hex.EncodeToString(sha1Sum[:]))
+	ctx.printf("SHA-1 fingerprint: %v", hex.EncodeToString(sha1Sum[:]))
 	sha256Sum := sha256.Sum256(cert)
-	ctx.print("SHA-256 fingerprint: " + hex.EncodeToString(sha256Sum[:]))
+	ctx.printf("SHA-256 fingerprint: %v", hex.EncodeToString(sha256Sum[:]))
 	sha512Sum := sha512.Sum512(cert)
-	ctx.print("SHA-512 fingerprint: " + hex.EncodeToString(sha512Sum[:]))
+	ctx.printf("SHA-512 fingerprint: %v", hex.EncodeToString(sha512Sum[:]))
 }
 
 func getNetworkFromFlag(ctx *serviceContext, name string) (*network, error) {
 	if name == "" {
 		if ctx.network == nil {
-			return nil, fmt.Errorf("no network selected, -network is required")
+			return nil, serviceErrorf("no network selected, -network is required")
 		}
 		return ctx.network, nil
 	} else {
 		net := ctx.user.getNetwork(name)
 		if net == nil {
-			return nil, fmt.Errorf("unknown network %q", name)
+			return nil, serviceErrorf("unknown network %q", name)
 		}
 		return net, nil
 	}
@@ -748,11 +1093,11 @@ func handleServiceCertFPGenerate(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 
 	if *bits <= 0 || *bits > maxRSABits {
-		return fmt.Errorf("invalid value for -bits")
+		return serviceErrorf("invalid value for -bits")
 	}
 
 	net, err := getNetworkFromFlag(ctx, *netName)
@@ -773,7 +1118,7 @@ func handleServiceCertFPGenerate(ctx *serviceContext, params []string) error {
 		return err
 	}
 
-	ctx.print("certificate generated")
+	ctx.printf("certificate generated")
 	sendCertfpFingerprints(ctx, cert)
 	return nil
 }
@@ -786,7 +1131,7 @@ func handleServiceCertFPFingerprints(ctx *serviceContext, params []string) error
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 
 	net, err := getNetworkFromFlag(ctx, *netName)
@@ -795,7 +1140,7 @@ func handleServiceCertFPFingerprints(ctx *serviceContext, params []string) error
 	}
 
 	if net.SASL.Mechanism != "EXTERNAL" {
-		return fmt.Errorf("CertFP not set up")
+		return serviceErrorf("CertFP not set up")
 	}
 
 	sendCertfpFingerprints(ctx, net.SASL.External.CertBlob)
@@ -810,7 +1155,7 @@ func handleServiceSASLStatus(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 
 	net, err := getNetworkFromFlag(ctx, *netName)
@@ -820,21 +1165,21 @@ func handleServiceSASLStatus(ctx *serviceContext, params []string) error {
 
 	switch net.SASL.Mechanism {
 	case "PLAIN":
-		ctx.print(fmt.Sprintf("SASL PLAIN enabled with username %q", net.SASL.Plain.Username))
+		ctx.printf("SASL PLAIN enabled with username %q", net.SASL.Plain.Username)
 	case "EXTERNAL":
-		ctx.print("SASL EXTERNAL (CertFP) enabled")
+		ctx.printf("SASL EXTERNAL (CertFP) enabled")
 	case "":
-		ctx.print("SASL is disabled")
+		ctx.printf("SASL is disabled")
 	}
 
 	if uc := net.conn; uc != nil {
 		if uc.account != "" {
-			ctx.print(fmt.Sprintf("Authenticated on upstream network with account %q", uc.account))
+			ctx.printf("Authenticated on upstream network with account %q", uc.account)
 		} else {
-			ctx.print("Unauthenticated on upstream network")
+			ctx.printf("Unauthenticated on upstream network")
 		}
 	} else {
-		ctx.print("Disconnected from upstream network")
+		ctx.printf("Disconnected from upstream network")
 	}
 
 	return nil
@@ -849,7 +1194,7 @@ func handleServiceSASLSetPlain(ctx *serviceContext, params []string) error {
 	}
 
 	if fs.NArg() != 2 {
-		return fmt.Errorf("expected exactly 2 arguments")
+		return serviceErrorf("expected exactly 2 arguments")
 	}
 
 	net, err := getNetworkFromFlag(ctx, *netName)
@@ -865,7 +1210,7 @@ func handleServiceSASLSetPlain(ctx *serviceContext, params []string) error {
 		return err
 	}
 
-	ctx.print("credentials saved")
+	ctx.printf("credentials saved")
 	return nil
 }
 
@@ -877,7 +1222,7 @@ func handleServiceSASLReset(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 
 	net, err := getNetworkFromFlag(ctx, *netName)
@@ -895,13 +1240,13 @@ func handleServiceSASLReset(ctx *serviceContext, params []string) error {
 		return err
 	}
 
-	ctx.print("credentials reset")
+	ctx.printf("credentials reset")
 	return nil
 }
 
 func handleUserStatus(ctx *serviceContext, params []string) error {
 	if len(params) != 0 {
-		return fmt.Errorf("expected no argument")
+		return serviceErrorf("expected no argument")
 	}
 
 	// Limit to a small amount of users to avoid sending
@@ -920,11 +1265,11 @@ func handleUserStatus(ctx *serviceContext, params []string) error {
 
 	for _, user := range users {
 		var attrs []string
-		if user.Admin {
-			attrs = append(attrs, "admin")
+		if user.Role != database.RoleUser {
+			attrs = append(attrs, string(user.Role))
 		}
 		if !user.Enabled {
-			attrs = append(attrs, "disabled")
+			attrs = append(attrs, ctx.sprintf("disabled"))
 		}
 
 		line := user.Username
@@ -933,13 +1278,12 @@ func handleUserStatus(ctx *serviceContext, params []string) error {
 		}
 		networks, err := ctx.srv.db.ListNetworks(ctx, user.ID)
 		if err != nil {
-			return fmt.Errorf("could not get networks of user %q: %v", user.Username, err)
+			return serviceErrorf("could not get networks of user %q: %v", user.Username, err)
 		}
-		line += fmt.Sprintf(": %d networks", len(networks))
-		ctx.print(line)
+		ctx.printf("%v: %d networks", line, len(networks))
 	}
 	if n > len(users) {
-		ctx.print(fmt.Sprintf("(%d more users omitted)", n-len(users)))
+		ctx.printf("(%d more users omitted)", n-len(users))
 	}
 
 	return nil
@@ -952,6 +1296,8 @@ func handleUserCreate(ctx *serviceContext, params []string) error {
 	disablePassword := fs.Bool("disable-password", false, "")
 	nick := fs.String("nick", "", "")
 	realname := fs.String("realname", "", "")
+	var roleStr *string
+	fs.Var(stringPtrFlag{&roleStr}, "role", "")
 	admin := fs.Bool("admin", false, "")
 	enabled := fs.Bool("enabled", true, "")
 
@@ -959,22 +1305,38 @@ func handleUserCreate(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 	if *username == "" {
-		return fmt.Errorf("flag -username is required")
+		return serviceErrorf("flag -username is required")
 	}
 	if *password != "" && *disablePassword {
-		return fmt.Errorf("flags -password and -disable-password are mutually exclusive")
+		return serviceErrorf("flags -password and -disable-password are mutually exclusive")
 	}
 	if *password == "" && !*disablePassword {
-		return fmt.Errorf("flag -password is required")
+		return serviceErrorf("flag -password is required")
+	}
+	if roleStr != nil && *admin {
+		return serviceErrorf("flags -role and -admin are mutually exclusive")
+	}
+
+	role := database.RoleUser
+	if *admin {
+		role = database.RoleAdmin
+	} else if roleStr != nil {
+		var err error
+		if role, err = parseRole(*roleStr); err != nil {
+			return err
+		}
+	}
+	if role != database.RoleUser && !hasPermission(ctx.role, permissionManageUsers) {
+		return serviceErrorf("you don't have the permission to create users with a role")
 	}
 
 	user := database.NewUser(*username)
 	user.Nick = *nick
 	user.Realname = *realname
-	user.Admin = *admin
+	user.Role = role
 	user.Enabled = *enabled
 	if !*disablePassword {
 		if err := user.SetPassword(*password); err != nil {
@@ -982,10 +1344,10 @@ func handleUserCreate(ctx *serviceContext, params []string) error {
 		}
 	}
 	if _, err := ctx.srv.createUser(ctx, user); err != nil {
-		return fmt.Errorf("could not create user: %v", err)
+		return serviceErrorf("could not create user: %v", err)
 	}
 
-	ctx.print(fmt.Sprintf("created user %q", *username))
+	ctx.printf("created user %q", *username)
 	return nil
 }
 
@@ -997,7 +1359,7 @@ func popArg(params []string) (string, []string) {
 }
 
 func handleUserUpdate(ctx *serviceContext, params []string) error {
-	var password, nick, realname *string
+	var password, nick, realname, roleStr, language, dccStr, autoDetachIdleStr *string
 	var admin, enabled *bool
 	var disablePassword bool
 	fs := newFlagSet()
@@ -1005,33 +1367,95 @@ func handleUserUpdate(ctx *serviceContext, params []string) error {
 	fs.BoolVar(&disablePassword, "disable-password", false, "")
 	fs.Var(stringPtrFlag{&nick}, "nick", "")
 	fs.Var(stringPtrFlag{&realname}, "realname", "")
+	fs.Var(stringPtrFlag{&roleStr}, "role", "")
 	fs.Var(boolPtrFlag{&admin}, "admin", "")
 	fs.Var(boolPtrFlag{&enabled}, "enabled", "")
+	fs.Var(stringPtrFlag{&autoDetachIdleStr}, "auto-detach-idle", "")
+	fs.Var(stringPtrFlag{&language}, "language", "")
+	fs.Var(stringPtrFlag{&dccStr}, "dcc", "")
+	filters := newChannelFilterFlags(fs)
 
 	username, params := popArg(params)
 	if err := fs.Parse(params); err != nil {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 	if username == "" && ctx.user == nil {
-		return fmt.Errorf("cannot determine the user to update")
+		return serviceErrorf("cannot determine the user to update")
 	}
 
 	if password != nil && disablePassword {
-		return fmt.Errorf("flags -password and -disable-password are mutually exclusive")
+		return serviceErrorf("flags -password and -disable-password are mutually exclusive")
+	}
+	var autoDetachIdle *time.Duration
+	if autoDetachIdleStr != nil {
+		days, err := strconv.Atoi(*autoDetachIdleStr)
+		if err != nil || days < 0 {
+			return serviceErrorf("flag -auto-detach-idle must be a non-negative number of days")
+		}
+		d := time.Duration(days) * 24 * time.Hour
+		autoDetachIdle = &d
+	}
+	if roleStr != nil && admin != nil {
+		return serviceErrorf("flags -role and -admin are mutually exclusive")
+	}
+	if language != nil && !isSupportedLanguage(*language) {
+		return serviceErrorf("unknown language %q (supported languages: %v)", *language, strings.Join(supportedLanguages(), ", "))
+	}
+
+	var dccPolicy *database.DCCPolicy
+	if dccStr != nil {
+		policy, err := parseDCCPolicy(*dccStr)
+		if err != nil {
+			return err
+		}
+		if policy == database.DCCRelay && ctx.srv.Config().DCCRelay == nil {
+			return serviceErrorf("DCC relaying is disabled on this server")
+		}
+		dccPolicy = &policy
+	}
+
+	var role *database.Role
+	if roleStr != nil {
+		r, err := parseRole(*roleStr)
+		if err != nil {
+			return err
+		}
+		role = &r
+	} else if admin != nil {
+		r := database.RoleUser
+		if *admin {
+			r = database.RoleAdmin
+		}
+		role = &r
 	}
 
 	if username != "" && (ctx.user == nil || username != ctx.user.Username) {
-		if !ctx.admin {
-			return fmt.Errorf("you must be an admin to update other users")
+		if !hasPermission(ctx.role, permissionResetPasswords) && !hasPermission(ctx.role, permissionManageUsers) {
+			return serviceErrorf("you don't have the permission to update other users")
+		}
+		if (role != nil || enabled != nil) && !hasPermission(ctx.role, permissionManageUsers) {
+			return serviceErrorf("you don't have the permission to update -role or -enabled of other users")
 		}
 		if nick != nil {
-			return fmt.Errorf("cannot update -nick of other user")
+			return serviceErrorf("cannot update -nick of other user")
 		}
 		if realname != nil {
-			return fmt.Errorf("cannot update -realname of other user")
+			return serviceErrorf("cannot update -realname of other user")
+		}
+		if filters.isSet() {
+			return serviceErrorf("cannot update channel defaults of other user")
+		}
+		if autoDetachIdle != nil {
+			return serviceErrorf("cannot update -auto-detach-idle of other user")
+		}
+		if language != nil {
+			return serviceErrorf("cannot update -language of other user")
+		}
+		if dccPolicy != nil {
+			return serviceErrorf("cannot update -dcc of other user")
 		}
 
 		var hashed *string
@@ -1049,13 +1473,18 @@ func handleUserUpdate(ctx *serviceContext, params []string) error {
 
 		u := ctx.srv.getUser(username)
 		if u == nil {
-			return fmt.Errorf("unknown username %q", username)
+			return serviceErrorf("unknown username %q", username)
+		}
+		// Resetting the password of a privileged user would allow taking over
+		// their role
+		if hashed != nil && u.Role != database.RoleUser && !hasPermission(ctx.role, permissionManageUsers) {
+			return serviceErrorf("you don't have the permission to reset the password of user %q", username)
 		}
 
 		done := make(chan error, 1)
 		event := eventUserUpdate{
 			password: hashed,
-			admin:    admin,
+			role:     role,
 			enabled:  enabled,
 			done:     done,
 		}
@@ -1069,13 +1498,13 @@ func handleUserUpdate(ctx *serviceContext, params []string) error {
 			return err
 		}
 
-		ctx.print(fmt.Sprintf("updated user %q", username))
+		ctx.printf("updated user %q", username)
 	} else {
-		if admin != nil {
-			return fmt.Errorf("cannot update -admin of own user")
+		if role != nil {
+			return serviceErrorf("cannot update -role of own user")
 		}
 		if enabled != nil {
-			return fmt.Errorf("cannot update -enabled of own user")
+			return serviceErrorf("cannot update -enabled of own user")
 		}
 
 		err := ctx.user.updateUser(ctx, func(record *database.User) error {
@@ -1093,13 +1522,25 @@ func handleUserUpdate(ctx *serviceContext, params []string) error {
 			if realname != nil {
 				record.Realname = *realname
 			}
-			return nil
+			if autoDetachIdle != nil {
+				record.AutoDetachIdle = *autoDetachIdle
+			}
+			if language != nil {
+				record.Language = *language
+			}
+			if dccPolicy != nil {
+				record.DCC = *dccPolicy
+			}
+			return filters.updateUser(record)
 		})
 		if err != nil {
 			return err
 		}
+		if language != nil {
+			ctx.catalog = catalogs[*language]
+		}
 
-		ctx.print(fmt.Sprintf("updated user %q", ctx.user.Username))
+		ctx.printf("updated user %q", ctx.user.Username)
 	}
 
 	return nil
@@ -1107,7 +1548,7 @@ func handleUserUpdate(ctx *serviceContext, params []string) error {
 
 func handleUserDelete(ctx *serviceContext, params []string) error {
 	if len(params) != 1 && len(params) != 2 {
-		return fmt.Errorf("expected one or two arguments")
+		return serviceErrorf("expected one or two arguments")
 	}
 
 	username := params[0]
@@ -1116,50 +1557,110 @@ func handleUserDelete(ctx *serviceContext, params []string) error {
 
 	self := ctx.user != nil && ctx.user.Username == username
 
-	if !ctx.admin && !self {
-		return fmt.Errorf("only admins may delete other users")
+	if !self && !hasPermission(ctx.role, permissionManageUsers) {
+		return serviceErrorf("you don't have the permission to delete other users")
 	}
 
 	u := ctx.srv.getUser(username)
 	if u == nil {
-		return fmt.Errorf("unknown username %q", username)
+		return serviceErrorf("unknown username %q", username)
 	}
 
 	if len(params) < 2 {
-		ctx.print(fmt.Sprintf(`To confirm user deletion, send "user delete %s %s"`, username, hash))
+		ctx.printf(`To confirm user deletion, send "user delete %s %s"`, username, hash)
 		return nil
 	}
 
 	if token := params[1]; token != hash {
-		return fmt.Errorf("provided confirmation token doesn't match user")
+		return serviceErrorf("provided confirmation token doesn't match user")
 	}
 
 	var deleteCtx context.Context = ctx
 	if self {
-		ctx.print(fmt.Sprintf("Goodbye %s, deleting your account. There will be no further confirmation.", username))
+		ctx.printf("Goodbye %s, deleting your account. There will be no further confirmation.", username)
 		// We can't use ctx here, because it'll be cancelled once we close the
 		// downstream connection
 		deleteCtx = context.TODO()
 	}
 
 	if err := u.stop(deleteCtx); err != nil {
-		return fmt.Errorf("failed to stop user: %v", err)
+		return serviceErrorf("failed to stop user: %v", err)
 	}
 
 	if err := ctx.srv.db.DeleteUser(deleteCtx, u.ID); err != nil {
-		return fmt.Errorf("failed to delete user: %v", err)
+		return serviceErrorf("failed to delete user: %v", err)
 	}
 
 	if !self {
-		ctx.print(fmt.Sprintf("deleted user %q", username))
+		ctx.printf("deleted user %q", username)
+	}
+
+	return nil
+}
+
+func handleUserKick(ctx *serviceContext, params []string) error {
+	var downstream, upstream bool
+	fs := newFlagSet()
+	fs.BoolVar(&downstream, "downstream", false, "")
+	fs.BoolVar(&upstream, "upstream", false, "")
+
+	username, params := popArg(params)
+	if username == "" {
+		return serviceErrorf("expected a username")
+	}
+	if err := fs.Parse(params); err != nil {
+		return err
+	}
+	if !downstream && !upstream {
+		downstream, upstream = true, true
+	}
+	reason := strings.Join(fs.Args(), " ")
+	if reason == "" {
+		reason = "Kicked by a server administrator"
+	}
+
+	u := ctx.srv.getUser(username)
+	if u == nil {
+		return serviceErrorf("unknown username %q", username)
+	}
+
+	var count userKickCount
+	if u == ctx.user {
+		// We're running in the user goroutine already
+		count = u.kick(downstream, upstream, reason)
+	} else {
+		done := make(chan userKickCount, 1)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u.events <- eventUserKick{
+			downstream: downstream,
+			upstream:   upstream,
+			reason:     reason,
+			done:       done,
+		}:
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case count = <-done:
+		}
 	}
 
+	var logger Logger
+	if ctx.user != nil {
+		logger = ctx.user.logger
+	} else {
+		logger = ctx.srv.Logger
+	}
+	logger.Printf("kicked user %q (reason: %q): closed %v downstream and %v upstream connections", username, reason, count.downstreams, count.upstreams)
+	ctx.printf("closed %v downstream and %v upstream connections of user %q", count.downstreams, count.upstreams, username)
 	return nil
 }
 
 func handleUserRun(ctx *serviceContext, params []string) error {
 	if len(params) < 2 {
-		return fmt.Errorf("expected at least two arguments")
+		return serviceErrorf("expected at least two arguments")
 	}
 
 	username := params[0]
@@ -1170,15 +1671,16 @@ func handleUserRun(ctx *serviceContext, params []string) error {
 
 	u := ctx.srv.getUser(username)
 	if u == nil {
-		return fmt.Errorf("unknown username %q", username)
+		return serviceErrorf("unknown username %q", username)
 	}
 
 	printCh := make(chan string, 1)
 	retCh := make(chan error, 1)
 	ev := eventUserRun{
-		params: params,
-		print:  printCh,
-		ret:    retCh,
+		params:  params,
+		print:   printCh,
+		ret:     retCh,
+		catalog: ctx.catalog,
 	}
 	select {
 	case <-ctx.Done():
@@ -1196,7 +1698,7 @@ func handleUserRun(ctx *serviceContext, params []string) error {
 			// in case the event is never processed.
 			// TODO: Properly fix this condition by flushing the u.events queue
 			//       and running close(ev.print) in a defer
-			return fmt.Errorf("timeout executing command")
+			return serviceErrorf("timeout executing command")
 		case text, ok := <-printCh:
 			if ok {
 				ctx.print(text)
@@ -1220,7 +1722,7 @@ func handleServiceChannelStatus(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 
 	n := 0
@@ -1249,18 +1751,34 @@ func handleServiceChannelStatus(ctx *serviceContext, params []string) error {
 
 			var status string
 			if uch != nil {
-				status = "joined"
+				status = ctx.sprintf("joined")
 			} else if net.conn != nil {
-				status = "parted"
+				status = ctx.sprintf("parted")
+				if state := net.conn.joinStates.Get(ch.Name); state != nil {
+					if state.err == "" {
+						status = ctx.sprintf("joining")
+					} else if state.permanent {
+						status = ctx.sprintf("join failed: %v", state.err)
+					} else {
+						retryIn := time.Until(state.retryAt).Round(time.Second)
+						status = ctx.sprintf("join failed: %v, retrying in %v", state.err, retryIn)
+					}
+				}
 			} else {
-				status = "disconnected"
+				status = ctx.sprintf("disconnected")
 			}
 
 			if ch.Detached {
-				status += ", detached"
+				status += ", " + ctx.sprintf("detached")
+				if uch != nil && uch.complete {
+					status += ", " + ctx.sprintf("%v members", uch.Members.Len())
+				}
 			}
 
 			s := fmt.Sprintf("%v [%v]", name, status)
+			if ch.Topic != "" {
+				s += " " + ch.Topic
+			}
 			ctx.print(s)
 
 			n++
@@ -1274,18 +1792,59 @@ func handleServiceChannelStatus(ctx *serviceContext, params []string) error {
 	} else {
 		net := ctx.user.getNetwork(*networkName)
 		if net == nil {
-			return fmt.Errorf("unknown network %q", *networkName)
+			return serviceErrorf("unknown network %q", *networkName)
 		}
 		sendNetwork(net)
 	}
 
 	if n == 0 {
-		ctx.print("No channel configured.")
+		ctx.printf("No channel configured.")
 	}
 
 	return nil
 }
 
+func parseSASLFailurePolicy(policy string) (database.SASLFailurePolicy, error) {
+	switch policy {
+	case "continue":
+		return database.SASLFailureContinue, nil
+	case "abort":
+		return database.SASLFailureAbort, nil
+	}
+	return "", serviceErrorf("unknown SASL failure policy: %q", policy)
+}
+
+func parsePlaybackStyle(style string) (database.PlaybackStyle, error) {
+	switch style {
+	case "privmsg":
+		return database.PlaybackPRIVMSG, nil
+	case "notice":
+		return database.PlaybackNotice, nil
+	case "prefixed":
+		return database.PlaybackPrefixed, nil
+	}
+	return "", serviceErrorf("unknown playback style: %q", style)
+}
+
+func parseDCCPolicy(policy string) (database.DCCPolicy, error) {
+	switch policy {
+	case "pass":
+		return database.DCCPass, nil
+	case "block":
+		return database.DCCBlock, nil
+	case "relay":
+		return database.DCCRelay, nil
+	}
+	return "", serviceErrorf("unknown DCC policy: %q", policy)
+}
+
+func formatPlaybackStyle(style database.PlaybackStyle) string {
+	if style == database.PlaybackPRIVMSG {
+		return "privmsg"
+	}
+	return string(style)
+}
+
 func parseFilter(filter string) (database.MessageFilter, error) {
 	switch filter {
 	case "default":
@@ -1297,53 +1856,118 @@ func parseFilter(filter string) (database.MessageFilter, error) {
 	case "message":
 		return database.FilterMessage, nil
 	}
-	return 0, fmt.Errorf("unknown filter: %q", filter)
+	return 0, serviceErrorf("unknown filter: %q", filter)
 }
 
-type channelFlagSet struct {
-	*flag.FlagSet
-	Detached                                         *bool
+// channelFilterFlags holds the flags shared by channel settings and the
+// user-wide channel defaults.
+type channelFilterFlags struct {
 	RelayDetached, ReattachOn, DetachAfter, DetachOn *string
 }
 
-func newChannelFlagSet() *channelFlagSet {
-	fs := &channelFlagSet{FlagSet: newFlagSet()}
-	fs.Var(boolPtrFlag{&fs.Detached}, "detached", "")
-	fs.Var(stringPtrFlag{&fs.RelayDetached}, "relay-detached", "")
-	fs.Var(stringPtrFlag{&fs.ReattachOn}, "reattach-on", "")
-	fs.Var(stringPtrFlag{&fs.DetachAfter}, "detach-after", "")
-	fs.Var(stringPtrFlag{&fs.DetachOn}, "detach-on", "")
-	return fs
+func newChannelFilterFlags(fs *flag.FlagSet) *channelFilterFlags {
+	f := &channelFilterFlags{}
+	fs.Var(stringPtrFlag{&f.RelayDetached}, "relay-detached", "")
+	fs.Var(stringPtrFlag{&f.ReattachOn}, "reattach-on", "")
+	fs.Var(stringPtrFlag{&f.DetachAfter}, "detach-after", "")
+	fs.Var(stringPtrFlag{&f.DetachOn}, "detach-on", "")
+	return f
 }
 
-func (fs *channelFlagSet) update(channel *database.Channel) error {
-	if fs.RelayDetached != nil {
-		filter, err := parseFilter(*fs.RelayDetached)
+func (f *channelFilterFlags) isSet() bool {
+	return f.RelayDetached != nil || f.ReattachOn != nil || f.DetachAfter != nil || f.DetachOn != nil
+}
+
+func (f *channelFilterFlags) parse(relayDetached, reattachOn *database.MessageFilter, detachAfter *time.Duration, detachOn *database.MessageFilter) error {
+	if f.RelayDetached != nil {
+		filter, err := parseFilter(*f.RelayDetached)
 		if err != nil {
 			return err
 		}
-		channel.RelayDetached = filter
+		*relayDetached = filter
 	}
-	if fs.ReattachOn != nil {
-		filter, err := parseFilter(*fs.ReattachOn)
+	if f.ReattachOn != nil {
+		filter, err := parseFilter(*f.ReattachOn)
 		if err != nil {
 			return err
 		}
-		channel.ReattachOn = filter
+		*reattachOn = filter
 	}
-	if fs.DetachAfter != nil {
-		dur, err := time.ParseDuration(*fs.DetachAfter)
+	if f.DetachAfter != nil {
+		dur, err := time.ParseDuration(*f.DetachAfter)
 		if err != nil || dur < 0 {
-			return fmt.Errorf("unknown duration for -detach-after %q (duration format: 0, 300s, 22h30m, ...)", *fs.DetachAfter)
+			return serviceErrorf("unknown duration for -detach-after %q (duration format: 0, 300s, 22h30m, ...)", *f.DetachAfter)
 		}
-		channel.DetachAfter = dur
+		*detachAfter = dur
 	}
-	if fs.DetachOn != nil {
-		filter, err := parseFilter(*fs.DetachOn)
+	if f.DetachOn != nil {
+		filter, err := parseFilter(*f.DetachOn)
 		if err != nil {
 			return err
 		}
-		channel.DetachOn = filter
+		*detachOn = filter
+	}
+	return nil
+}
+
+func (f *channelFilterFlags) updateUser(user *database.User) error {
+	return f.parse(&user.RelayDetached, &user.ReattachOn, &user.DetachAfter, &user.DetachOn)
+}
+
+type channelFlagSet struct {
+	*flag.FlagSet
+	*channelFilterFlags
+	Detached                   *bool
+	HighlightAdd, HighlightDel []string
+	HighlightNick              *bool
+}
+
+func newChannelFlagSet() *channelFlagSet {
+	fs := &channelFlagSet{FlagSet: newFlagSet()}
+	fs.Var(boolPtrFlag{&fs.Detached}, "detached", "")
+	fs.Var((*stringSliceFlag)(&fs.HighlightAdd), "highlight-add", "")
+	fs.Var((*stringSliceFlag)(&fs.HighlightDel), "highlight-del", "")
+	fs.Var(boolPtrFlag{&fs.HighlightNick}, "highlight-nick", "")
+	fs.channelFilterFlags = newChannelFilterFlags(fs.FlagSet)
+	return fs
+}
+
+func (fs *channelFlagSet) update(channel *database.Channel) error {
+	if err := fs.parse(&channel.RelayDetached, &channel.ReattachOn, &channel.DetachAfter, &channel.DetachOn); err != nil {
+		return err
+	}
+
+	highlights := channel.Highlights
+	for _, keyword := range fs.HighlightDel {
+		for i, kw := range highlights {
+			if kw == keyword {
+				highlights = append(highlights[:i:i], highlights[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, keyword := range fs.HighlightAdd {
+		if keyword == "" || strings.ContainsAny(keyword, "\r\n") {
+			return serviceErrorf("invalid highlight keyword %q", keyword)
+		}
+		found := false
+		for _, kw := range highlights {
+			if kw == keyword {
+				found = true
+				break
+			}
+		}
+		if !found {
+			highlights = append(highlights, keyword)
+		}
+	}
+	if len(highlights) > 50 {
+		return serviceErrorf("too many highlight keywords")
+	}
+	channel.Highlights = highlights
+
+	if fs.HighlightNick != nil {
+		channel.DisableNickHighlight = !*fs.HighlightNick
 	}
 	return nil
 }
@@ -1355,7 +1979,7 @@ func stripNetworkSuffix(ctx *serviceContext, name string) (string, *network, err
 
 	l := strings.SplitN(name, "/", 2)
 	if len(l) != 2 {
-		return "", nil, fmt.Errorf("missing network name")
+		return "", nil, serviceErrorf("missing network name")
 	}
 	name = l[0]
 	netName := l[1]
@@ -1366,12 +1990,12 @@ func stripNetworkSuffix(ctx *serviceContext, name string) (string, *network, err
 		}
 	}
 
-	return "", nil, fmt.Errorf("unknown network %q", netName)
+	return "", nil, serviceErrorf("unknown network %q", netName)
 }
 
 func handleServiceChannelUpdate(ctx *serviceContext, params []string) error {
 	if len(params) < 1 {
-		return fmt.Errorf("expected at least one argument")
+		return serviceErrorf("expected at least one argument")
 	}
 	name := params[0]
 
@@ -1380,7 +2004,7 @@ func handleServiceChannelUpdate(ctx *serviceContext, params []string) error {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return fmt.Errorf("unexpected argument: %v", fs.Arg(0))
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
 	}
 
 	name, network, err := stripNetworkSuffix(ctx, name)
@@ -1390,7 +2014,7 @@ func handleServiceChannelUpdate(ctx *serviceContext, params []string) error {
 
 	ch := network.channels.Get(name)
 	if ch == nil {
-		return fmt.Errorf("unknown channel %q", name)
+		return serviceErrorf("unknown channel %q", name)
 	}
 
 	if err := fs.update(ch); err != nil {
@@ -1410,16 +2034,16 @@ func handleServiceChannelUpdate(ctx *serviceContext, params []string) error {
 	}
 
 	if err := ctx.srv.db.StoreChannel(ctx, network.ID, ch); err != nil {
-		return fmt.Errorf("failed to update channel: %v", err)
+		return serviceErrorf("failed to update channel: %v", err)
 	}
 
-	ctx.print(fmt.Sprintf("updated channel %q", name))
+	ctx.printf("updated channel %q", name)
 	return nil
 }
 
 func handleServiceChannelDelete(ctx *serviceContext, params []string) error {
 	if len(params) != 1 {
-		return fmt.Errorf("expected exactly one argument")
+		return serviceErrorf("expected exactly one argument")
 	}
 	name := params[0]
 
@@ -1429,7 +2053,7 @@ func handleServiceChannelDelete(ctx *serviceContext, params []string) error {
 	}
 
 	if err := network.deleteChannel(ctx, name); err != nil {
-		return fmt.Errorf("failed to delete channel: %v", err)
+		return serviceErrorf("failed to delete channel: %v", err)
 	}
 
 	if uc := network.conn; uc != nil && uc.channels.Has(name) {
@@ -1439,13 +2063,300 @@ func handleServiceChannelDelete(ctx *serviceContext, params []string) error {
 		})
 	}
 
-	ctx.print(fmt.Sprintf("deleted channel %q", name))
+	ctx.printf("deleted channel %q", name)
+	return nil
+}
+
+func handleServiceChannelDetach(ctx *serviceContext, params []string) error {
+	return updateChannelsDetached(ctx, params, true)
+}
+
+func handleServiceChannelReattach(ctx *serviceContext, params []string) error {
+	return updateChannelsDetached(ctx, params, false)
+}
+
+func updateChannelsDetached(ctx *serviceContext, params []string, detached bool) error {
+	if len(params) < 1 {
+		return serviceErrorf("expected at least one argument")
+	}
+	pattern := params[0]
+
+	var defaultNetworkName string
+	if ctx.network != nil {
+		defaultNetworkName = ctx.network.GetName()
+	}
+
+	fs := newFlagSet()
+	networkName := fs.String("network", defaultNetworkName, "")
+
+	if err := fs.Parse(params[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
+	}
+
+	var networks []*network
+	if *networkName == "" {
+		networks = ctx.user.networks
+	} else {
+		net := ctx.user.getNetwork(*networkName)
+		if net == nil {
+			return serviceErrorf("unknown network %q", *networkName)
+		}
+		networks = []*network{net}
+	}
+
+	n := 0
+	var failures []string
+	for _, net := range networks {
+		var channels []*database.Channel
+		net.channels.ForEach(func(name string, ch *database.Channel) {
+			if ch.Detached == detached {
+				return
+			}
+			if xirc.MatchMask(net.casemap, pattern, name) {
+				channels = append(channels, ch)
+			}
+		})
+
+		for _, ch := range channels {
+			if detached {
+				net.detach(ch)
+			} else {
+				net.attach(ctx, ch)
+			}
+
+			if err := ctx.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+				failures = append(failures, fmt.Sprintf("%v/%v: %v", ch.Name, net.GetName(), err))
+				continue
+			}
+			n++
+		}
+	}
+
+	if detached {
+		ctx.printf("detached %v channels", n)
+	} else {
+		ctx.printf("reattached %v channels", n)
+	}
+	for _, failure := range failures {
+		ctx.printf("failed to update channel %v", failure)
+	}
+	return nil
+}
+
+func handleServiceClientStatus(ctx *serviceContext, params []string) error {
+	if len(params) != 0 {
+		return serviceErrorf("expected no argument")
+	}
+
+	clients, err := ctx.srv.db.ListClients(ctx, ctx.user.ID)
+	if err != nil {
+		return serviceErrorf("failed to list clients: %v", err)
+	}
+
+	for _, client := range clients {
+		ctx.printf("%v: summary %v, playback style %v", client.Name, client.Summary, formatPlaybackStyle(client.PlaybackStyle))
+	}
+
+	if len(clients) == 0 {
+		ctx.printf(`No client configured, add one with "client update".`)
+	}
+
+	return nil
+}
+
+func handleServiceClientUpdate(ctx *serviceContext, params []string) error {
+	if len(params) < 1 {
+		return serviceErrorf("expected at least one argument")
+	}
+	name := params[0]
+
+	var summary *bool
+	var playbackStyle *string
+	fs := newFlagSet()
+	fs.Var(boolPtrFlag{&summary}, "summary", "")
+	fs.Var(stringPtrFlag{&playbackStyle}, "playback-style", "")
+	if err := fs.Parse(params[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return serviceErrorf("unexpected argument: %v", fs.Arg(0))
+	}
+
+	client, err := ctx.srv.db.GetClient(ctx, ctx.user.ID, name)
+	if err != nil {
+		return serviceErrorf("failed to get client: %v", err)
+	} else if client == nil {
+		client = &database.Client{Name: name}
+	}
+
+	if summary != nil {
+		client.Summary = *summary
+	}
+	if playbackStyle != nil {
+		style, err := parsePlaybackStyle(*playbackStyle)
+		if err != nil {
+			return err
+		}
+		client.PlaybackStyle = style
+	}
+
+	if err := ctx.srv.db.StoreClient(ctx, ctx.user.ID, client); err != nil {
+		return serviceErrorf("failed to update client: %v", err)
+	}
+
+	ctx.printf("updated client %q", name)
+	return nil
+}
+
+func handleServiceHighlights(ctx *serviceContext, params []string) error {
+	if len(params) != 0 {
+		return serviceErrorf("expected no argument")
+	}
+
+	ctx.user.expireHighlights(ctx)
+
+	for _, highlight := range ctx.user.highlights {
+		target := highlight.Target
+		if net := ctx.user.getNetworkByID(highlight.NetworkID); net != nil {
+			target = fmt.Sprintf("%v/%v", target, net.GetName())
+		}
+		ctx.printf("[%v] %v <%v> %v", highlight.Time.UTC().Format(time.RFC3339), target, highlight.Sender, highlight.Text)
+	}
+
+	if len(ctx.user.highlights) == 0 {
+		ctx.printf("No pending highlights.")
+	}
+
+	return nil
+}
+
+func handleServiceHighlightsClear(ctx *serviceContext, params []string) error {
+	if len(params) != 0 {
+		return serviceErrorf("expected no argument")
+	}
+
+	n := ctx.user.deleteHighlights(ctx, func(*database.Highlight) bool {
+		return true
+	})
+
+	ctx.printf("cleared %v highlights", n)
+	return nil
+}
+
+func handleServiceReplay(ctx *serviceContext, params []string) error {
+	if len(params) != 2 {
+		return serviceErrorf("expected exactly two arguments")
+	}
+
+	dc := ctx.downstream
+	if dc == nil {
+		return serviceErrorf("replay is only supported from IRC clients")
+	} else if dc.network == nil {
+		return serviceErrorf("replay is only supported from clients bound to a network")
+	}
+	store, ok := ctx.user.msgStore.(msgstore.ChatHistoryStore)
+	if !ok {
+		return serviceErrorf("chat history is disabled")
+	}
+
+	target, net := params[0], ctx.network
+	if i := strings.LastIndexByte(target, '/'); i >= 0 {
+		if n := ctx.user.getNetwork(target[i+1:]); n != nil {
+			target, net = target[:i], n
+		}
+	}
+	if net == nil {
+		return serviceErrorf("no network selected, use %v/<network> as target", target)
+	} else if net != dc.network {
+		return serviceErrorf("this client isn't connected to network %q", net.GetName())
+	}
+	if !net.channels.Has(target) && !net.delivered.HasTarget(target) {
+		return serviceErrorf(`unknown target %q on network %q (use "channel status" to list channels)`, target, net.GetName())
+	}
+
+	limit := chatHistoryLimit
+	var end time.Time
+	if n, err := strconv.Atoi(params[1]); err == nil {
+		if n <= 0 {
+			return serviceErrorf("message count must be positive")
+		}
+		if n < limit {
+			limit = n
+		}
+	} else if d, err := time.ParseDuration(params[1]); err == nil && d > 0 {
+		end = time.Now().Add(-d)
+	} else {
+		return serviceErrorf("invalid message count or duration: %q", params[1])
+	}
+
+	loadCtx, cancel := context.WithTimeout(ctx, backlogTimeout)
+	defer cancel()
+
+	history, err := store.LoadBeforeTime(loadCtx, time.Now(), end, &msgstore.LoadMessageOptions{
+		Network: &net.Network,
+		Entity:  net.casemap(target),
+		Limit:   limit,
+	})
+	if err != nil {
+		ctx.user.logger.Printf("failed to load history of %q for replay: %v", target, err)
+		return serviceErrorf("failed to load history of %v", target)
+	}
+	if len(history) == 0 {
+		ctx.printf("no history for %v", target)
+		return nil
+	}
+
+	dc.replayHistory(ctx, target, history)
+	return nil
+}
+
+func handleServiceStats(ctx *serviceContext, params []string) error {
+	if len(params) > 1 {
+		return serviceErrorf("expected at most one argument")
+	}
+
+	networks := ctx.user.networks
+	if len(params) == 1 {
+		net := ctx.user.getNetwork(params[0])
+		if net == nil {
+			return serviceErrorf("unknown network %q", params[0])
+		}
+		networks = []*network{net}
+	}
+	if len(networks) == 0 {
+		ctx.printf(`No network configured, add one with "network create".`)
+		return nil
+	}
+
+	printSummary := func(name string, sum *trafficSummary) {
+		ctx.printf("%v:", name)
+		ctx.printf("  today: %v", formatTrafficStats(ctx.catalog, &sum.today))
+		ctx.printf("  last 7 days: %v", formatTrafficStats(ctx.catalog, &sum.week))
+		ctx.printf("  total: %v", formatTrafficStats(ctx.catalog, &sum.total))
+	}
+
+	var total trafficSummary
+	for _, net := range networks {
+		sum, err := net.summarizeTraffic(ctx)
+		if err != nil {
+			ctx.user.logger.Printf("failed to load traffic statistics of network %q: %v", net.GetName(), err)
+			return serviceErrorf("failed to load traffic statistics of network %q", net.GetName())
+		}
+		printSummary(net.GetName(), sum)
+		total.add(sum)
+	}
+	if len(networks) > 1 {
+		printSummary(ctx.sprintf("all networks"), &total)
+	}
 	return nil
 }
 
 func handleServiceServerStatus(ctx *serviceContext, params []string) error {
 	if len(params) != 0 {
-		return fmt.Errorf("expected no argument")
+		return serviceErrorf("expected no argument")
 	}
 
 	dbStats, err := ctx.srv.db.Stats(ctx)
@@ -1453,16 +2364,50 @@ func handleServiceServerStatus(ctx *serviceContext, params []string) error {
 		return err
 	}
 	serverStats := ctx.srv.Stats()
-	ctx.print(fmt.Sprintf("%v/%v users, %v downstreams, %v upstreams, %v networks, %v channels", serverStats.Users, dbStats.Users, serverStats.Downstreams, serverStats.Upstreams, dbStats.Networks, dbStats.Channels))
+	ctx.printf("%v/%v users, %v downstreams, %v upstreams, %v networks, %v channels", serverStats.Users, dbStats.Users, serverStats.Downstreams, serverStats.Upstreams, dbStats.Networks, dbStats.Channels)
 	return nil
 }
 
 func handleServiceServerNotice(ctx *serviceContext, params []string) error {
 	if len(params) != 1 {
-		return fmt.Errorf("expected exactly one argument")
+		return serviceErrorf("expected exactly one argument")
+	}
+	return broadcastServiceNotice(ctx, params[0])
+}
+
+func handleServiceServerAnnounceSet(ctx *serviceContext, params []string) error {
+	if len(params) != 1 {
+		return serviceErrorf("expected exactly one argument")
 	}
 	text := params[0]
+	if text == "" {
+		return serviceErrorf("announcement cannot be empty")
+	}
+
+	if err := ctx.srv.SetAnnouncement(ctx, text); err != nil {
+		return serviceErrorf("failed to store announcement: %v", err)
+	}
+	ctx.printf("announcement set")
+
+	return broadcastServiceNotice(ctx, "Announcement: "+text)
+}
+
+func handleServiceServerAnnounceClear(ctx *serviceContext, params []string) error {
+	if len(params) != 0 {
+		return serviceErrorf("expected no argument")
+	}
+
+	if ctx.srv.Announcement() == "" {
+		return serviceErrorf("no announcement is currently set")
+	}
+	if err := ctx.srv.SetAnnouncement(ctx, ""); err != nil {
+		return serviceErrorf("failed to clear announcement: %v", err)
+	}
+	ctx.printf("announcement cleared")
+	return nil
+}
 
+func broadcastServiceNotice(ctx *serviceContext, text string) error {
 	var logger Logger
 	if ctx.user != nil {
 		logger = ctx.user.logger
@@ -1490,7 +2435,7 @@ func handleServiceServerNotice(ctx *serviceContext, params []string) error {
 	})
 
 	logger.Printf("broadcast bouncer-wide NOTICE to %v/%v downstreams", sent, total)
-	ctx.print(fmt.Sprintf("sent to %v/%v downstream connections", sent, total))
+	ctx.printf("sent to %v/%v downstream connections", sent, total)
 
 	return err
 }
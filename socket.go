@@ -0,0 +1,69 @@
+package soju
+
+import (
+	"net"
+	"strings"
+	"syscall"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+// SocketControl returns a function applying socket options, suitable for
+// net.Dialer.Control and net.ListenConfig.Control. It returns nil if no
+// option needs to be set before the connection is established. Options
+// unsupported by the platform are ignored.
+func SocketControl(opts config.SocketOptions) func(network, address string, c syscall.RawConn) error {
+	if opts.SendBuffer == 0 && opts.ReceiveBuffer == 0 && opts.UserTimeout == 0 {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		if !strings.HasPrefix(network, "tcp") {
+			return nil
+		}
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = setSocketOptions(fd, opts)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
+
+// setNoDelay applies the TCP_NODELAY option to a connection, if set. This
+// can't be done in SocketControl because Go enables TCP_NODELAY once the
+// connection is established.
+func setNoDelay(conn net.Conn, opts config.SocketOptions) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if opts.NoDelay == nil || !ok {
+		return nil
+	}
+	return tcpConn.SetNoDelay(*opts.NoDelay)
+}
+
+type socketOptionsListener struct {
+	net.Listener
+	opts config.SocketOptions
+}
+
+// NewSocketOptionsListener wraps a listener to apply the socket options which
+// can't be set by SocketControl to accepted connections.
+func NewSocketOptionsListener(ln net.Listener, opts config.SocketOptions) net.Listener {
+	if opts.NoDelay == nil {
+		return ln
+	}
+	return &socketOptionsListener{ln, opts}
+}
+
+func (ln *socketOptionsListener) Accept() (net.Conn, error) {
+	conn, err := ln.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if err := setNoDelay(conn, ln.opts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
@@ -0,0 +1,27 @@
+package soju
+
+import (
+	"golang.org/x/sys/unix"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+func setSocketOptions(fd uintptr, opts config.SocketOptions) error {
+	if opts.SendBuffer != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.ReceiveBuffer != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, opts.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.UserTimeout != 0 {
+		ms := int(opts.UserTimeout.Milliseconds())
+		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_TCP, unix.TCP_USER_TIMEOUT, ms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
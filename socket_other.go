@@ -0,0 +1,11 @@
+//go:build !unix
+
+package soju
+
+import (
+	"git.sr.ht/~emersion/soju/config"
+)
+
+func setSocketOptions(fd uintptr, opts config.SocketOptions) error {
+	return nil
+}
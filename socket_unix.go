@@ -0,0 +1,24 @@
+//go:build unix && !linux
+
+package soju
+
+import (
+	"golang.org/x/sys/unix"
+
+	"git.sr.ht/~emersion/soju/config"
+)
+
+// TCP_USER_TIMEOUT is Linux-specific, it's ignored here.
+func setSocketOptions(fd uintptr, opts config.SocketOptions) error {
+	if opts.SendBuffer != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_SNDBUF, opts.SendBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.ReceiveBuffer != 0 {
+		if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_RCVBUF, opts.ReceiveBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
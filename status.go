@@ -0,0 +1,314 @@
+package soju
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/irc.v4"
+)
+
+// ZNC users are used to talking to the bouncer via *status. Translate the
+// most common *status commands into the corresponding BouncerServ
+// operations, see:
+// https://wiki.znc.in/Using_commands
+
+const statusNick = "*status"
+const statusNickCM = "*status"
+
+func sendStatusPRIVMSG(dc *downstreamConn, from, text string) {
+	dc.SendMessage(context.TODO(), &irc.Message{
+		Prefix:  &irc.Prefix{Name: from, User: "znc", Host: "znc.in"},
+		Command: "PRIVMSG",
+		Params:  []string{dc.nick, text},
+	})
+}
+
+type statusCommand struct {
+	usage  string
+	desc   string
+	handle func(ctx *serviceContext, params []string) error
+}
+
+var statusCommands map[string]*statusCommand
+
+// statusEquivalents maps ZNC commands soju doesn't implement to the closest
+// BouncerServ command.
+var statusEquivalents = map[string]string{
+	"addnetwork":  "network create",
+	"delnetwork":  "network delete",
+	"setnetwork":  "network update",
+	"addserver":   "network update -addr",
+	"delserver":   "network update -addr",
+	"listservers": "network status",
+	"listchans":   "channel status",
+	"delchan":     "channel delete",
+	"listusers":   "user status",
+	"adduser":     "user create",
+	"deluser":     "user delete",
+	"broadcast":   "server notice",
+	"uptime":      "server status",
+}
+
+func init() {
+	statusCommands = map[string]*statusCommand{
+		"help": {
+			desc:   "print this help message",
+			handle: handleStatusHelp,
+		},
+		"version": {
+			desc:   "print the soju version",
+			handle: handleStatusVersion,
+		},
+		"listnetworks": {
+			desc:   "list networks",
+			handle: handleStatusListNetworks,
+		},
+		"connect": {
+			usage:  "[network]",
+			desc:   "connect to a network",
+			handle: handleStatusConnect,
+		},
+		"disconnect": {
+			usage:  "[network]",
+			desc:   "disconnect from a network",
+			handle: handleStatusDisconnect,
+		},
+		"jump": {
+			usage:  "[network]",
+			desc:   "reconnect to a network",
+			handle: handleStatusJump,
+		},
+		"detach": {
+			usage:  "<#chans|masks>",
+			desc:   "detach from channels",
+			handle: handleStatusDetach,
+		},
+		"attach": {
+			usage:  "<#chans|masks>",
+			desc:   "reattach to channels",
+			handle: handleStatusAttach,
+		},
+	}
+}
+
+// handleStatusPRIVMSG handles a message sent to *status or any other ZNC
+// module pseudo-user. It's also used for the ZNC command.
+func (dc *downstreamConn) handleStatusPRIVMSG(ctx context.Context, target, text string) {
+	reply := func(text string) {
+		sendStatusPRIVMSG(dc, target, text)
+	}
+
+	if dc.casemap(target) != statusNickCM {
+		reply(fmt.Sprintf("soju doesn't support ZNC modules, use %v instead (/msg %v help)", serviceNick, serviceNick))
+		return
+	}
+
+	srv := dc.user.srv
+	if !srv.serviceLimiter.Allow(dc.user.Username, srv.Config().Limits.ServiceCommandsPerMinute) {
+		reply("error: too many commands, try again later")
+		return
+	}
+
+	words, err := splitWords(text)
+	if err != nil {
+		reply(fmt.Sprintf("error: failed to parse command: %v", err))
+		return
+	} else if len(words) == 0 {
+		return
+	}
+
+	name := strings.ToLower(words[0])
+	cmd, ok := statusCommands[name]
+	if !ok {
+		if equiv, ok := statusEquivalents[name]; ok {
+			reply(fmt.Sprintf("soju doesn't support %v, use %q instead (/msg %v help %v)", words[0], equiv, serviceNick, strings.Fields(equiv)[0]))
+		} else {
+			reply(fmt.Sprintf("Unknown command [%v]. Try 'help' or /msg %v help", words[0], serviceNick))
+		}
+		return
+	}
+
+	svcCtx := &serviceContext{
+		Context:    ctx,
+		nick:       dc.nick,
+		network:    dc.network,
+		user:       dc.user,
+		downstream: dc,
+		srv:        srv,
+		role:       dc.user.Role,
+		print:      reply,
+		printLater: reply,
+		catalog:    catalogs[dc.user.Language],
+	}
+	err = cmd.handle(svcCtx, words[1:])
+	if err != nil {
+		reply(svcCtx.sprintf("error: %v", err))
+	}
+}
+
+func handleStatusHelp(ctx *serviceContext, params []string) error {
+	names := make([]string, 0, len(statusCommands))
+	for name := range statusCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := [][]string{{"Command", "Arguments", "Description"}}
+	for _, name := range names {
+		cmd := statusCommands[name]
+		rows = append(rows, []string{name, cmd.usage, cmd.desc})
+	}
+	printStatusTable(ctx, rows)
+	ctx.print(fmt.Sprintf("Other commands are available via %v (/msg %v help)", serviceNick, serviceNick))
+	return nil
+}
+
+func handleStatusVersion(ctx *serviceContext, params []string) error {
+	version := "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		version = info.Main.Version
+	}
+	ctx.print(fmt.Sprintf("soju %v - https://soju.im", version))
+	return nil
+}
+
+func handleStatusListNetworks(ctx *serviceContext, params []string) error {
+	if len(ctx.user.networks) == 0 {
+		ctx.print("You have no networks")
+		return nil
+	}
+
+	rows := [][]string{{"Network", "OnIRC", "IRC Server", "IRC User", "Channels"}}
+	for _, net := range ctx.user.networks {
+		onIRC, server, ircUser := "No", "", ""
+		channels := net.channels.Len()
+		if uc := net.conn; uc != nil {
+			onIRC = "Yes"
+			server = net.Addr
+			ircUser = fmt.Sprintf("%v!%v@%v", uc.nick, uc.username, uc.hostname)
+			channels = uc.channels.Len()
+		}
+		rows = append(rows, []string{net.GetName(), onIRC, server, ircUser, strconv.Itoa(channels)})
+	}
+	printStatusTable(ctx, rows)
+	return nil
+}
+
+func setStatusNetworkEnabled(ctx *serviceContext, params []string, enabled bool) error {
+	net, params, err := getNetworkFromArg(ctx, params)
+	if err != nil {
+		return err
+	}
+	if len(params) != 0 {
+		return fmt.Errorf("expected at most one argument")
+	}
+
+	record := net.Network // copy network record because we'll mutate it
+	record.Enabled = enabled
+	if _, err := ctx.user.updateNetwork(ctx, &record); err != nil {
+		return fmt.Errorf("could not update network: %v", err)
+	}
+	return nil
+}
+
+func handleStatusConnect(ctx *serviceContext, params []string) error {
+	net, _, err := getNetworkFromArg(ctx, params)
+	if err != nil {
+		return err
+	}
+	if net.Enabled && net.conn != nil {
+		ctx.print("You are already connected with current server.")
+		return nil
+	}
+
+	if err := setStatusNetworkEnabled(ctx, params, true); err != nil {
+		return err
+	}
+	ctx.print("Connecting...")
+	return nil
+}
+
+func handleStatusDisconnect(ctx *serviceContext, params []string) error {
+	if err := setStatusNetworkEnabled(ctx, params, false); err != nil {
+		return err
+	}
+	ctx.print("Disconnected from IRC. Use 'connect' to reconnect.")
+	return nil
+}
+
+func handleStatusJump(ctx *serviceContext, params []string) error {
+	net, _, err := getNetworkFromArg(ctx, params)
+	if err != nil {
+		return err
+	}
+	if !net.Enabled {
+		return fmt.Errorf("network %q is disabled, use 'connect' first", net.GetName())
+	}
+
+	// Updating the network restarts the connection
+	if err := setStatusNetworkEnabled(ctx, params, true); err != nil {
+		return err
+	}
+	ctx.print("Jumping to the next server in the list...")
+	return nil
+}
+
+func handleStatusDetach(ctx *serviceContext, params []string) error {
+	return updateStatusChannelsDetached(ctx, params, true)
+}
+
+func handleStatusAttach(ctx *serviceContext, params []string) error {
+	return updateStatusChannelsDetached(ctx, params, false)
+}
+
+func updateStatusChannelsDetached(ctx *serviceContext, params []string, detached bool) error {
+	if len(params) != 1 {
+		return fmt.Errorf("expected exactly one argument")
+	}
+	// ZNC accepts a comma-separated list of channels and masks
+	for _, pattern := range strings.Split(params[0], ",") {
+		if pattern == "" {
+			continue
+		}
+		if err := updateChannelsDetached(ctx, []string{pattern}, detached); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printStatusTable prints rows in a table, the first row being the header.
+func printStatusTable(ctx *serviceContext, rows [][]string) {
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if len(cell) > widths[i] {
+				widths[i] = len(cell)
+			}
+		}
+	}
+
+	var sep strings.Builder
+	sep.WriteString("+")
+	for _, w := range widths {
+		sep.WriteString(strings.Repeat("-", w+2) + "+")
+	}
+
+	ctx.print(sep.String())
+	for i, row := range rows {
+		var sb strings.Builder
+		sb.WriteString("|")
+		for j, cell := range row {
+			sb.WriteString(" " + cell + strings.Repeat(" ", widths[j]-len(cell)) + " |")
+		}
+		ctx.print(sb.String())
+		if i == 0 {
+			ctx.print(sep.String())
+		}
+	}
+	ctx.print(sep.String())
+}
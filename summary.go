@@ -0,0 +1,152 @@
+package soju
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/irc.v4"
+
+	"git.sr.ht/~emersion/soju/database"
+	"git.sr.ht/~emersion/soju/msgstore"
+)
+
+// maxSummaryChannels is the number of busiest channels listed in the summary
+// of missed activity.
+const maxSummaryChannels = 3
+
+// summarizeMissedActivity returns a summary of the activity missed since the
+// client was last connected, or nil if the client hasn't opted in. It must be
+// called before the delivery receipts are fast-forwarded.
+func (dc *downstreamConn) summarizeMissedActivity(ctx context.Context) []string {
+	if dc.clientName == "" || dc.user.msgStore == nil {
+		return nil
+	}
+
+	client, err := dc.srv.db.GetClient(ctx, dc.user.ID, dc.clientName)
+	if err != nil {
+		dc.logger.Printf("failed to get client settings: %v", err)
+		return nil
+	} else if client == nil || !client.Summary {
+		return nil
+	}
+
+	cat := catalogs[dc.user.Language]
+
+	store, ok := dc.user.msgStore.(msgstore.SummaryStore)
+	if !ok {
+		return []string{cat.sprintf("summary of missed activity unavailable: not supported by the message store")}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, backlogTimeout)
+	defer cancel()
+
+	since := dc.user.clientsSeen[dc.clientName]
+
+	var lines []string
+	dc.forEachNetwork(func(net *network) {
+		var ids []string
+		net.delivered.ForEachTarget(func(target string) {
+			if id := net.delivered.LoadID(target, dc.clientName); id != "" {
+				ids = append(ids, id)
+			}
+		})
+
+		nick := database.GetNick(&dc.user.User, &net.Network)
+		if uc := net.conn; uc != nil {
+			nick = uc.nick
+		}
+
+		// Count highlights with the same rules as live messages
+		highlights := msgstore.HighlightMatcher{
+			Keywords: make(map[string][]string),
+			IsHighlight: func(target string, msg *irc.Message) bool {
+				ch := net.channels.Get(target)
+				return ch != nil && net.isChannelHighlight(ch, msg)
+			},
+		}
+		net.channels.ForEach(func(name string, ch *database.Channel) {
+			var keywords []string
+			if !ch.DisableNickHighlight {
+				keywords = append(keywords, nick)
+			}
+			keywords = append(keywords, ch.Highlights...)
+			highlights.Keywords[net.casemap(name)] = keywords
+		})
+
+		var targets []msgstore.TargetSummary
+		if len(ids) > 0 {
+			targets, err = store.CountMissedMessages(ctx, &net.Network, ids, nick, &highlights)
+			if err != nil {
+				dc.logger.Printf("failed to count missed messages on %q: %v", net.GetName(), err)
+				return
+			}
+		}
+
+		lines = append(lines, summarizeNetwork(cat, net, targets, since)...)
+	})
+
+	if len(lines) == 0 {
+		lines = append(lines, cat.sprintf("no missed activity since last connection"))
+	}
+	return lines
+}
+
+func summarizeNetwork(cat catalog, net *network, targets []msgstore.TargetSummary, since time.Time) []string {
+	isChannel := func(name string) bool {
+		if uc := net.conn; uc != nil {
+			return uc.isChannel(name)
+		}
+		return net.channels.Has(name)
+	}
+
+	var highlights, privMsgs, privTargets int
+	var channels []msgstore.TargetSummary
+	for _, target := range targets {
+		if isChannel(target.Name) {
+			highlights += target.Highlights
+			channels = append(channels, target)
+		} else {
+			privMsgs += target.Messages
+			privTargets++
+		}
+	}
+
+	var connErrors []networkConnError
+	for _, e := range net.connErrors {
+		if e.time.After(since) {
+			connErrors = append(connErrors, e)
+		}
+	}
+
+	if highlights == 0 && privMsgs == 0 && len(channels) == 0 && len(connErrors) == 0 {
+		return nil
+	}
+
+	details := []string{
+		cat.sprintf("%v highlights", highlights),
+		cat.sprintf("%v private messages from %v users", privMsgs, privTargets),
+	}
+	if len(channels) > 0 {
+		sort.SliceStable(channels, func(i, j int) bool {
+			return channels[i].Messages > channels[j].Messages
+		})
+		if len(channels) > maxSummaryChannels {
+			channels = channels[:maxSummaryChannels]
+		}
+		var l []string
+		for _, ch := range channels {
+			l = append(l, fmt.Sprintf("%v (%v)", ch.Name, ch.Messages))
+		}
+		details = append(details, cat.sprintf("busiest channels: %v", strings.Join(l, ", ")))
+	}
+
+	lines := []string{cat.sprintf("missed on %v: %v", net.GetName(), strings.Join(details, "; "))}
+	if len(connErrors) > 0 {
+		last := connErrors[len(connErrors)-1]
+		lines = append(lines, "  "+cat.sprintf("%v connection failures, last at %v: %v", len(connErrors), last.time.Format(time.RFC3339), last.err))
+	}
+	return lines
+}
@@ -0,0 +1,175 @@
+package soju
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"git.sr.ht/~emersion/soju/database"
+)
+
+// trafficCounters counts the traffic exchanged with an upstream server since
+// the statistics were last persisted. It's safe for concurrent use.
+type trafficCounters struct {
+	messagesIn, messagesOut atomic.Int64
+	bytesIn, bytesOut       atomic.Int64
+}
+
+// take resets the counters and returns their previous values.
+func (tc *trafficCounters) take() database.TrafficStats {
+	return database.TrafficStats{
+		MessagesIn:  tc.messagesIn.Swap(0),
+		MessagesOut: tc.messagesOut.Swap(0),
+		BytesIn:     tc.bytesIn.Swap(0),
+		BytesOut:    tc.bytesOut.Swap(0),
+	}
+}
+
+// load returns the current values of the counters.
+func (tc *trafficCounters) load() database.TrafficStats {
+	return database.TrafficStats{
+		MessagesIn:  tc.messagesIn.Load(),
+		MessagesOut: tc.messagesOut.Load(),
+		BytesIn:     tc.bytesIn.Load(),
+		BytesOut:    tc.bytesOut.Load(),
+	}
+}
+
+// add adds statistics back to the counters.
+func (tc *trafficCounters) add(stats *database.TrafficStats) {
+	tc.messagesIn.Add(stats.MessagesIn)
+	tc.messagesOut.Add(stats.MessagesOut)
+	tc.bytesIn.Add(stats.BytesIn)
+	tc.bytesOut.Add(stats.BytesOut)
+}
+
+// countingConn wraps a connection to count the bytes read and written.
+type countingConn struct {
+	net.Conn
+	srv      *Server
+	counters *trafficCounters
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.counters.bytesIn.Add(int64(n))
+		c.srv.metrics.upstreamInBytesTotal.Add(float64(n))
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.counters.bytesOut.Add(int64(n))
+		c.srv.metrics.upstreamOutBytesTotal.Add(float64(n))
+	}
+	return n, err
+}
+
+// flushTrafficStats persists the traffic counted since the last flush.
+func (net *network) flushTrafficStats(ctx context.Context) {
+	stats := net.traffic.take()
+	if stats == (database.TrafficStats{}) {
+		return
+	}
+
+	stats.Day = trafficStatsDay(time.Now())
+	if err := net.user.srv.db.AddTrafficStats(ctx, net.ID, &stats); err != nil {
+		net.logger.Printf("failed to store traffic statistics: %v", err)
+		net.traffic.add(&stats)
+	}
+}
+
+func (u *user) trafficStatsFlushLoop() {
+	ticker := time.NewTicker(trafficStatsFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+
+		select {
+		case <-u.done:
+			return
+		case u.events <- eventFlushTrafficStats{}:
+		}
+	}
+}
+
+func trafficStatsDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// trafficSummary holds the traffic statistics of a network, aggregated over
+// several periods.
+type trafficSummary struct {
+	today, week, total database.TrafficStats
+}
+
+func (sum *trafficSummary) add(other *trafficSummary) {
+	addTrafficStats(&sum.today, &other.today)
+	addTrafficStats(&sum.week, &other.week)
+	addTrafficStats(&sum.total, &other.total)
+}
+
+// summarizeTraffic aggregates the persisted traffic statistics of a network
+// along with the traffic which hasn't been persisted yet.
+func (net *network) summarizeTraffic(ctx context.Context) (*trafficSummary, error) {
+	l, err := net.user.srv.db.ListTrafficStats(ctx, net.ID)
+	if err != nil {
+		return nil, err
+	}
+	pending := net.traffic.load()
+	pending.Day = trafficStatsDay(time.Now())
+	l = append(l, pending)
+
+	today := trafficStatsDay(time.Now())
+	weekStart := today.AddDate(0, 0, -6)
+
+	var sum trafficSummary
+	for i := range l {
+		stats := &l[i]
+		if !stats.Day.Before(today) {
+			addTrafficStats(&sum.today, stats)
+		}
+		if !stats.Day.Before(weekStart) {
+			addTrafficStats(&sum.week, stats)
+		}
+		addTrafficStats(&sum.total, stats)
+	}
+	return &sum, nil
+}
+
+func addTrafficStats(dst, src *database.TrafficStats) {
+	dst.MessagesIn += src.MessagesIn
+	dst.MessagesOut += src.MessagesOut
+	dst.BytesIn += src.BytesIn
+	dst.BytesOut += src.BytesOut
+}
+
+func formatTrafficStats(cat catalog, stats *database.TrafficStats) string {
+	return cat.sprintf("%v messages in (%v), %v messages out (%v)",
+		stats.MessagesIn, formatByteSize(stats.BytesIn),
+		stats.MessagesOut, formatByteSize(stats.BytesOut))
+}
+
+func formatByteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
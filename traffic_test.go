@@ -0,0 +1,34 @@
+package soju
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatByteSize(t *testing.T) {
+	testCases := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 * 1024 * 1024, "5.0 MiB"},
+		{3 * 1024 * 1024 * 1024 * 1024, "3.0 TiB"},
+	}
+	for _, tc := range testCases {
+		if got := formatByteSize(tc.n); got != tc.want {
+			t.Errorf("formatByteSize(%v) = %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestTrafficStatsDay(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	got := trafficStatsDay(time.Date(2024, 3, 1, 1, 30, 0, 0, loc))
+	want := time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)
+	if !got.Equal(want) {
+		t.Errorf("trafficStatsDay() = %v, want %v", got, want)
+	}
+}
@@ -16,24 +16,22 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/emersion/go-sasl"
 	"gopkg.in/irc.v4"
 
+	"git.sr.ht/~emersion/soju/config"
 	"git.sr.ht/~emersion/soju/database"
+	"git.sr.ht/~emersion/soju/msgstore"
 	"git.sr.ht/~emersion/soju/xirc"
 )
 
 // permanentUpstreamCaps is the static list of upstream capabilities always
 // requested when supported.
 var permanentUpstreamCaps = map[string]bool{
-	"account-notify":   true,
-	"account-tag":      true,
-	"away-notify":      true,
 	"batch":            true,
-	"chghost":          true,
-	"extended-join":    true,
 	"extended-monitor": true,
 	"invite-notify":    true,
 	"labeled-response": true,
@@ -44,7 +42,23 @@ var permanentUpstreamCaps = map[string]bool{
 	"setname":          true,
 
 	"draft/account-registration": true,
+	"draft/channel-rename":       true,
 	"draft/extended-monitor":     true,
+	"draft/message-redaction":    true,
+	"draft/multiline":            true,
+}
+
+// presenceUpstreamCaps is the list of upstream capabilities keeping track of
+// users' away status, account and host. They are requested when supported,
+// unless disabled in the configuration: they are used to keep our state
+// accurate regardless of whether downstream clients are connected, and
+// forwarded to the clients which enabled the corresponding capability.
+var presenceUpstreamCaps = map[string]bool{
+	"account-notify": true,
+	"account-tag":    true,
+	"away-notify":    true,
+	"chghost":        true,
+	"extended-join":  true,
 }
 
 // storableMessageTags is the static list of message tags that will cause
@@ -69,6 +83,15 @@ func (err registrationError) Reason() string {
 	return err.Command
 }
 
+func isSASLFailure(cmd string) bool {
+	switch cmd {
+	case irc.ERR_NICKLOCKED, irc.ERR_SASLFAIL, irc.ERR_SASLTOOLONG, irc.ERR_SASLABORTED:
+		return true
+	default:
+		return false
+	}
+}
+
 func (err registrationError) Temporary() bool {
 	// Only return false if we're 100% sure that fixing the error requires a
 	// network configuration change
@@ -82,6 +105,59 @@ func (err registrationError) Temporary() bool {
 	}
 }
 
+// upstreamFatalError is returned when the server closes a registered
+// connection with an ERROR message.
+type upstreamFatalError struct {
+	Reason string
+}
+
+func (err upstreamFatalError) Error() string {
+	return fmt.Sprintf("fatal server error: %v", err.Reason)
+}
+
+type upstreamErrorKind int
+
+const (
+	upstreamErrorOther upstreamErrorKind = iota
+	// The server banned us (K-line, G-line, etc), reconnecting right away
+	// is pointless and may extend the ban
+	upstreamErrorBanned
+	// The server is shutting down or restarting
+	upstreamErrorShutdown
+)
+
+var upstreamBanPatterns = []string{
+	"k-line", "g-line", "z-line", "d-line",
+	"kline", "gline", "zline", "dline",
+	"akill", "autokill",
+	"banned",
+}
+
+var upstreamShutdownPatterns = []string{
+	"shutting down",
+	"server shutdown",
+	"server is going down",
+	"restarting",
+	"server restart",
+}
+
+// classifyUpstreamError guesses the cause of an ERROR message from its text.
+// Servers don't use standard reasons, so this is a best-effort heuristic.
+func classifyUpstreamError(reason string) upstreamErrorKind {
+	reason = strings.ToLower(reason)
+	for _, pattern := range upstreamBanPatterns {
+		if strings.Contains(reason, pattern) {
+			return upstreamErrorBanned
+		}
+	}
+	for _, pattern := range upstreamShutdownPatterns {
+		if strings.Contains(reason, pattern) {
+			return upstreamErrorShutdown
+		}
+	}
+	return upstreamErrorOther
+}
+
 type upstreamChannel struct {
 	Name         string
 	conn         *upstreamConn
@@ -94,6 +170,11 @@ type upstreamChannel struct {
 	Members      xirc.CaseMappingMap[*xirc.MembershipSet]
 	complete     bool
 	detachTimer  *time.Timer
+	joinTime     time.Time
+
+	// Memberships granted to users who aren't in Members yet, applied when
+	// they join
+	pendingMembers xirc.CaseMappingMap[*xirc.MembershipSet]
 }
 
 func (uc *upstreamChannel) updateAutoDetach(dur time.Duration) {
@@ -114,11 +195,41 @@ func (uc *upstreamChannel) updateAutoDetach(dur time.Duration) {
 	})
 }
 
+// channelJoinState tracks an automatic channel join in progress.
+type channelJoinState struct {
+	err        string // last join error, if any
+	permanent  bool   // if set, the join won't be retried
+	backoff    *backoffer
+	retryTimer *time.Timer
+	retryAt    time.Time
+}
+
+func (state *channelJoinState) stopRetry() {
+	if state.retryTimer != nil {
+		state.retryTimer.Stop()
+		state.retryTimer = nil
+	}
+}
+
 type upstreamBatch struct {
-	Type   string
-	Params []string
-	Outer  *upstreamBatch // if not-nil, this batch is nested in Outer
-	Label  string
+	Type      string
+	Params    []string
+	Outer     *upstreamBatch // if not-nil, this batch is nested in Outer
+	OuterName string
+	Label     string
+	Multiline *multilineBuffer // if not-nil, this is a draft/multiline batch
+}
+
+// isHistory returns true if the batch contains messages replayed from the
+// history, which must not be applied to the current state.
+func (b *upstreamBatch) isHistory() bool {
+	for ; b != nil; b = b.Outer {
+		switch b.Type {
+		case "chathistory", "znc.in/playback":
+			return true
+		}
+	}
+	return false
 }
 
 type upstreamUser struct {
@@ -219,6 +330,11 @@ type upstreamConn struct {
 	account     string
 	nextLabelID uint64
 	monitored   xirc.CaseMappingMap[bool]
+	joinStates  xirc.CaseMappingMap[*channelJoinState]
+
+	// Capabilities which must not be requested, snapshot of the network
+	// settings at connection time
+	disabledCaps map[string]bool
 
 	saslClient  sasl.Client
 	saslStarted bool
@@ -235,6 +351,18 @@ type upstreamConn struct {
 	gotMotd bool
 
 	hasDesiredNick bool
+
+	// Used to generate the reference tags of outgoing batches
+	nextBatchRef uint64
+
+	// Smoothed round-trip time to the server, zero if unknown
+	lag time.Duration
+	// Callbacks waiting for the PONG reply to a lag check, by token
+	lagCheckCallbacks map[string][]func(time.Duration)
+
+	// Set for irc+starttls:// connections, until upgraded to TLS
+	starttlsConn   *upgradableConn
+	starttlsConfig *tls.Config
 }
 
 func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, error) {
@@ -249,6 +377,8 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 	}
 
 	var netConn net.Conn
+	var starttlsConn *upgradableConn
+	var starttlsConfig *tls.Config
 	switch u.Scheme {
 	case "ircs":
 		addr := u.Host
@@ -258,63 +388,13 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 			addr = u.Host + ":6697"
 		}
 
-		tlsConfig := &tls.Config{ServerName: host, NextProtos: []string{"irc"}}
-		if network.SASL.Mechanism == "EXTERNAL" {
-			if network.SASL.External.CertBlob == nil {
-				return nil, fmt.Errorf("missing certificate for authentication")
-			}
-			if network.SASL.External.PrivKeyBlob == nil {
-				return nil, fmt.Errorf("missing private key for authentication")
-			}
-			key, err := x509.ParsePKCS8PrivateKey(network.SASL.External.PrivKeyBlob)
-			if err != nil {
-				return nil, fmt.Errorf("failed to parse private key: %v", err)
-			}
-			tlsConfig.Certificates = []tls.Certificate{
-				{
-					Certificate: [][]byte{network.SASL.External.CertBlob},
-					PrivateKey:  key.(crypto.PrivateKey),
-				},
-			}
-			logger.Printf("using TLS client certificate %x", sha256.Sum256(network.SASL.External.CertBlob))
-		}
-
-		if network.CertFP != "" {
-			tlsConfig.InsecureSkipVerify = true
-			tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-				if len(rawCerts) == 0 {
-					return fmt.Errorf("the server didn't present any TLS certificate")
-				}
-
-				parts := strings.SplitN(network.CertFP, ":", 2)
-				algo, localCertFP := parts[0], parts[1]
-
-				for _, rawCert := range rawCerts {
-					var remoteCertFP string
-					switch algo {
-					case "sha-512":
-						sum := sha512.Sum512(rawCert)
-						remoteCertFP = hex.EncodeToString(sum[:])
-					case "sha-256":
-						sum := sha256.Sum256(rawCert)
-						remoteCertFP = hex.EncodeToString(sum[:])
-					}
-
-					if remoteCertFP == localCertFP {
-						return nil // fingerprints match
-					}
-				}
-
-				// Fingerprints don't match, let's give the user a fingerprint
-				// they can use to connect
-				sum := sha512.Sum512(rawCerts[0])
-				remoteCertFP := hex.EncodeToString(sum[:])
-				return fmt.Errorf("the configured TLS certificate fingerprint doesn't match the server's - %s", remoteCertFP)
-			}
+		tlsConfig, err := newUpstreamTLSConfig(network, logger, host)
+		if err != nil {
+			return nil, err
 		}
 
 		logger.Printf("connecting to TLS server at address %q", addr)
-		netConn, err = dialTCP(ctx, network.user, addr)
+		netConn, err = dialTCP(ctx, network, addr)
 		if err != nil {
 			return nil, err
 		}
@@ -330,10 +410,33 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 		}
 
 		logger.Printf("connecting to plain-text server at address %q", addr)
-		netConn, err = dialTCP(ctx, network.user, addr)
+		netConn, err = dialTCP(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+	case "irc+starttls":
+		addr := u.Host
+		host, _, err := net.SplitHostPort(u.Host)
+		if err != nil {
+			host = u.Host
+			addr = u.Host + ":6667"
+		}
+
+		starttlsConfig, err = newUpstreamTLSConfig(network, logger, host)
 		if err != nil {
 			return nil, err
 		}
+
+		logger.Printf("connecting to STARTTLS server at address %q", addr)
+		netConn, err = dialTCP(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		// The TLS upgrade is performed by startTLS, once registered with
+		// identd
+		starttlsConn = newUpgradableConn(netConn)
+		netConn = starttlsConn
 	case "irc+unix", "unix":
 		var dialer net.Dialer
 		logger.Printf("connecting to Unix socket at path %q", u.Path)
@@ -341,16 +444,44 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 		if err != nil {
 			return nil, fmt.Errorf("failed to connect to Unix socket %q: %v", u.Path, err)
 		}
+	case "ircs+unix":
+		// The host is only used as the TLS server name. Without it, the
+		// certificate can only be checked against a pinned fingerprint.
+		if u.Host == "" && network.CertFP == "" {
+			return nil, fmt.Errorf("failed to dial %q: a TLS server name or certificate fingerprint is required", network.Addr)
+		}
+		tlsConfig, err := newUpstreamTLSConfig(network, logger, u.Host)
+		if err != nil {
+			return nil, err
+		}
+
+		var dialer net.Dialer
+		logger.Printf("connecting to TLS server on Unix socket at path %q", u.Path)
+		netConn, err = dialer.DialContext(ctx, "unix", u.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to Unix socket %q: %v", u.Path, err)
+		}
+		netConn = tls.Client(netConn, tlsConfig)
 	default:
 		return nil, fmt.Errorf("failed to dial %q: unknown scheme: %v", network.Addr, u.Scheme)
 	}
 
+	srv := network.user.srv
 	options := connOptions{
-		Logger:         logger,
-		RateLimitDelay: upstreamMessageDelay,
-		RateLimitBurst: upstreamMessageBurst,
+		Logger: logger,
+		RateLimit: func() (time.Duration, int) {
+			limits := srv.Config().Limits
+			return limits.UpstreamMessageDelay, limits.UpstreamBurst
+		},
+	}
+
+	disabledCaps := make(map[string]bool)
+	for _, name := range network.DisabledCaps {
+		disabledCaps[strings.ToLower(name)] = true
 	}
 
+	netConn = &countingConn{netConn, srv, &network.traffic}
+
 	cm := stdCaseMapping
 	uc := &upstreamConn{
 		conn:                  *newConn(network.user.srv, newNetIRCConn(netConn), &options),
@@ -360,6 +491,7 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 		users:                 xirc.NewCaseMappingMap[*upstreamUser](cm),
 		caps:                  xirc.NewCapRegistry(),
 		batches:               make(map[string]upstreamBatch),
+		disabledCaps:          disabledCaps,
 		serverPrefix:          &irc.Prefix{Name: "*"},
 		availableChannelTypes: stdChannelTypes,
 		availableStatusMsg:    "",
@@ -368,26 +500,304 @@ func connectToUpstream(ctx context.Context, network *network) (*upstreamConn, er
 		isupport:              make(map[string]*string),
 		pendingCmds:           make(map[string][]pendingUpstreamCommand),
 		monitored:             xirc.NewCaseMappingMap[bool](cm),
+		joinStates:            xirc.NewCaseMappingMap[*channelJoinState](cm),
 		hasDesiredNick:        true,
+		starttlsConn:          starttlsConn,
+		starttlsConfig:        starttlsConfig,
 	}
 	return uc, nil
 }
 
-func dialTCP(ctx context.Context, user *user, addr string) (net.Conn, error) {
-	var dialer net.Dialer
-	upstreamUserIPs := user.srv.Config().UpstreamUserIPs
+// upgradableConn is a net.Conn whose underlying connection can be replaced,
+// to upgrade a plain-text connection to TLS.
+type upgradableConn struct {
+	conn atomic.Pointer[net.Conn]
+}
+
+func newUpgradableConn(c net.Conn) *upgradableConn {
+	uc := &upgradableConn{}
+	uc.conn.Store(&c)
+	return uc
+}
+
+func (c *upgradableConn) get() net.Conn {
+	return *c.conn.Load()
+}
+
+// upgrade replaces the plain-text connection with a TLS client connection
+// wrapping it, and performs the TLS handshake.
+func (c *upgradableConn) upgrade(ctx context.Context, tlsConfig *tls.Config) error {
+	tlsConn := tls.Client(c.get(), tlsConfig)
+	var nc net.Conn = tlsConn
+	c.conn.Store(&nc)
+	return tlsConn.HandshakeContext(ctx)
+}
+
+func (c *upgradableConn) Read(b []byte) (int, error) {
+	return c.get().Read(b)
+}
+
+func (c *upgradableConn) Write(b []byte) (int, error) {
+	return c.get().Write(b)
+}
+
+func (c *upgradableConn) Close() error {
+	return c.get().Close()
+}
+
+func (c *upgradableConn) LocalAddr() net.Addr {
+	return c.get().LocalAddr()
+}
+
+func (c *upgradableConn) RemoteAddr() net.Addr {
+	return c.get().RemoteAddr()
+}
+
+func (c *upgradableConn) SetDeadline(t time.Time) error {
+	return c.get().SetDeadline(t)
+}
+
+func (c *upgradableConn) SetReadDeadline(t time.Time) error {
+	return c.get().SetReadDeadline(t)
+}
+
+func (c *upgradableConn) SetWriteDeadline(t time.Time) error {
+	return c.get().SetWriteDeadline(t)
+}
+
+// startTLS upgrades an irc+starttls:// connection to TLS. It does nothing for
+// other connections. It must be called before registration, so that
+// credentials are never sent in plain text: if the server doesn't support
+// STARTTLS, an error is returned instead of continuing in plain text.
+func (uc *upstreamConn) startTLS(ctx context.Context) error {
+	if uc.starttlsConn == nil {
+		return nil
+	}
+
+	uc.SendMessage(ctx, &irc.Message{Command: "STARTTLS"})
+
+	var reply *irc.Message
+	for reply == nil {
+		msg, err := uc.ReadMessage()
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+		switch {
+		case msg.Command == irc.RPL_STARTTLS, msg.Command == irc.ERR_STARTTLS, msg.Command == "ERROR":
+			reply = msg
+		case isNumeric(msg.Command) && (msg.Command[0] == '4' || msg.Command[0] == '5'):
+			// e.g. ERR_UNKNOWNCOMMAND if STARTTLS isn't supported
+			reply = msg
+		}
+		// Ignore anything else, e.g. NOTICE messages sent on connection
+	}
+	if reply.Command != irc.RPL_STARTTLS {
+		return fmt.Errorf("STARTTLS failed: %w", registrationError{reply})
+	}
+
+	// Data received after RPL_STARTTLS but before the TLS handshake hasn't
+	// been encrypted, and may have been injected by an attacker
+	if nc, ok := uc.conn.conn.(*netIRCConn); !ok || nc.reader.Buffered() > 0 {
+		return fmt.Errorf("STARTTLS failed: unexpected data received before the TLS handshake")
+	}
+
+	if err := uc.starttlsConn.upgrade(ctx, uc.starttlsConfig); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	uc.logger.Printf("upgraded connection to TLS")
+	return nil
+}
+
+// newUpstreamTLSConfig builds the TLS configuration used to connect to an
+// upstream server. If the network has a pinned certificate fingerprint, it is
+// checked instead of the certificate chain and serverName. If the network uses
+// trust-on-first-use, see verifyTOFU.
+func newUpstreamTLSConfig(network *network, logger Logger, serverName string) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:   serverName,
+		NextProtos:   []string{"irc"},
+		MinVersion:   network.user.srv.Config().UpstreamTLSMinVersion,
+		CipherSuites: network.user.srv.Config().UpstreamTLSCipherSuites,
+	}
+	if network.TLSMinVersion != "" {
+		v, err := config.ParseTLSVersion(network.TLSMinVersion)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.MinVersion = v
+	}
+	if tlsConfig.MinVersion != 0 || tlsConfig.CipherSuites != nil {
+		logger.Debugf("using TLS minimum version %v and cipher suites %v", config.FormatTLSVersion(tlsConfig.MinVersion), config.CipherSuiteNames(tlsConfig.CipherSuites))
+	}
+	if network.SASL.Mechanism == "EXTERNAL" {
+		if network.SASL.External.CertBlob == nil {
+			return nil, fmt.Errorf("missing certificate for authentication")
+		}
+		if network.SASL.External.PrivKeyBlob == nil {
+			return nil, fmt.Errorf("missing private key for authentication")
+		}
+		key, err := x509.ParsePKCS8PrivateKey(network.SASL.External.PrivKeyBlob)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{
+			{
+				Certificate: [][]byte{network.SASL.External.CertBlob},
+				PrivateKey:  key.(crypto.PrivateKey),
+			},
+		}
+		logger.Printf("using TLS client certificate %x", sha256.Sum256(network.SASL.External.CertBlob))
+	}
+
+	if network.CertFP != "" {
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("the server didn't present any TLS certificate")
+			}
+
+			parts := strings.SplitN(network.CertFP, ":", 2)
+			algo, localCertFP := parts[0], parts[1]
+
+			for _, rawCert := range rawCerts {
+				var remoteCertFP string
+				switch algo {
+				case "sha-512":
+					sum := sha512.Sum512(rawCert)
+					remoteCertFP = hex.EncodeToString(sum[:])
+				case "sha-256":
+					sum := sha256.Sum256(rawCert)
+					remoteCertFP = hex.EncodeToString(sum[:])
+				}
+
+				if remoteCertFP == localCertFP {
+					return nil // fingerprints match
+				}
+			}
+
+			// Fingerprints don't match, let's give the user a fingerprint
+			// they can use to connect
+			sum := sha512.Sum512(rawCerts[0])
+			remoteCertFP := hex.EncodeToString(sum[:])
+			return fmt.Errorf("the configured TLS certificate fingerprint doesn't match the server's - %s", remoteCertFP)
+		}
+	} else if network.TOFU {
+		trustedCertFP := network.TOFUCertFP
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			return verifyTOFU(network, serverName, trustedCertFP, rawCerts)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// tofuMismatchError is returned when the TLS certificate of a server doesn't
+// match the one trusted on first use.
+type tofuMismatchError struct {
+	CertFP string // fingerprint of the new certificate
+}
+
+func (err tofuMismatchError) Error() string {
+	return fmt.Sprintf("the server's TLS certificate changed since it was trusted on first use (new fingerprint: %v)", err.CertFP)
+}
+
+// verifyTOFU checks the certificate chain presented by an upstream server
+// with trust-on-first-use. Certificates chaining to a trusted root are
+// verified as usual. Other certificates must match the fingerprint trusted on
+// first use. If there is none yet, the certificate is trusted and the user
+// goroutine is asked to store its fingerprint.
+func verifyTOFU(network *network, serverName, trustedCertFP string, rawCerts [][]byte) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("the server didn't present any TLS certificate")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, rawCert := range rawCerts {
+		cert, err := x509.ParseCertificate(rawCert)
+		if err != nil {
+			return fmt.Errorf("failed to parse TLS certificate: %v", err)
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := certs[0].Verify(opts); err == nil {
+		return nil
+	}
+
+	sum := sha256.Sum256(rawCerts[0])
+	certFP := "sha-256:" + hex.EncodeToString(sum[:])
+	switch trustedCertFP {
+	case certFP:
+		return nil
+	case "":
+		network.user.events <- eventUpstreamCertTrusted{network, certFP}
+		return nil
+	default:
+		return tofuMismatchError{certFP}
+	}
+}
+
+// upstreamResolver returns the DNS resolver used to connect to a network,
+// along with a human-readable description for error messages.
+func upstreamResolver(network *network) (*net.Resolver, string, error) {
+	addr := network.user.srv.Config().UpstreamResolver
+	if network.Resolver == "system" {
+		addr = ""
+	}
+	if addr == "" {
+		return net.DefaultResolver, "system resolver", nil
+	}
+
+	resolver := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+	return resolver, fmt.Sprintf("resolver %v", addr), nil
+}
+
+func dialTCP(ctx context.Context, network *network, addr string) (net.Conn, error) {
+	resolver, resolverName, err := upstreamResolver(network)
+	if err != nil {
+		return nil, err
+	}
+
+	socketOpts := network.user.srv.Config().UpstreamSocketOptions
+	if network.SocketOptions != "" {
+		override, err := config.ParseSocketOptions(network.SocketOptions)
+		if err != nil {
+			return nil, err
+		}
+		socketOpts = socketOpts.Merge(override)
+	}
+
+	dialer := net.Dialer{
+		Resolver: resolver,
+		Control:  SocketControl(socketOpts),
+	}
+	upstreamUserIPs := network.user.srv.Config().UpstreamUserIPs
 	if len(upstreamUserIPs) > 0 {
 		host, port, err := net.SplitHostPort(addr)
 		if err != nil {
 			return nil, err
 		}
 
-		ipAddr, err := resolveIPAddr(ctx, host)
+		ipAddr, err := resolveIPAddr(ctx, resolver, host)
 		if err != nil {
-			return nil, fmt.Errorf("failed to resolve host %q: %v", host, err)
+			return nil, fmt.Errorf("failed to resolve host %q using %v: %v", host, resolverName, err)
 		}
 
-		localAddr, err := user.localTCPAddr(ipAddr.IP)
+		localAddr, err := network.user.localTCPAddr(ipAddr.IP)
 		if err != nil {
 			return nil, fmt.Errorf("failed to pick local IP for remote host %q: %v", host, err)
 		}
@@ -396,7 +806,59 @@ func dialTCP(ctx context.Context, user *user, addr string) (net.Conn, error) {
 		dialer.LocalAddr = localAddr
 	}
 
-	return dialer.DialContext(ctx, "tcp", addr)
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return nil, fmt.Errorf("failed to resolve host %q using %v: %v", dnsErr.Name, resolverName, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := setNoDelay(conn, socketOpts); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+const lagCheckTokenPrefix = "soju-lag-"
+
+// checkLag sends a PING to the server to measure the round-trip time. If
+// non-nil, done is called with the result once the PONG reply is received.
+func (uc *upstreamConn) checkLag(ctx context.Context, done func(time.Duration)) {
+	token := lagCheckTokenPrefix + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if done != nil {
+		if uc.lagCheckCallbacks == nil {
+			uc.lagCheckCallbacks = make(map[string][]func(time.Duration))
+		}
+		uc.lagCheckCallbacks[token] = append(uc.lagCheckCallbacks[token], done)
+	}
+	uc.SendMessage(ctx, &irc.Message{
+		Command: "PING",
+		Params:  []string{token},
+	})
+}
+
+func (uc *upstreamConn) handleLagCheckPong(token string) {
+	sent, err := strconv.ParseInt(strings.TrimPrefix(token, lagCheckTokenPrefix), 10, 64)
+	if err != nil {
+		uc.logger.Printf("received invalid lag check PONG token %q", token)
+		return
+	}
+	rtt := time.Since(time.Unix(0, sent))
+
+	if uc.lag == 0 {
+		uc.lag = rtt
+	} else {
+		uc.lag += (rtt - uc.lag) / 4
+	}
+	uc.network.user.srv.metrics.upstreamLag.Observe(rtt.Seconds())
+	uc.network.checkHealth()
+
+	for _, done := range uc.lagCheckCallbacks[token] {
+		done(rtt)
+	}
+	delete(uc.lagCheckCallbacks, token)
 }
 
 func (uc *upstreamConn) forEachDownstream(f func(*downstreamConn)) {
@@ -588,7 +1050,8 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 	}
 
 	var msgBatch *upstreamBatch
-	if batchName, ok := msg.Tags["batch"]; ok {
+	batchName, hasBatch := msg.Tags["batch"]
+	if hasBatch {
 		b, ok := uc.batches[batchName]
 		if !ok {
 			return fmt.Errorf("unexpected batch reference: batch was not defined: %q", batchName)
@@ -631,7 +1094,21 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			Params:  msg.Params,
 		})
 		return nil
+	case "PONG":
+		if len(msg.Params) == 0 {
+			return newNeedMoreParamsError(msg.Command)
+		}
+		token := msg.Params[len(msg.Params)-1]
+		if strings.HasPrefix(token, lagCheckTokenPrefix) {
+			uc.handleLagCheckPong(token)
+		}
+		return nil
 	case "NOTICE", "PRIVMSG", "TAGMSG":
+		if msgBatch != nil && msgBatch.Multiline != nil {
+			// The logical message is handled at the end of the batch
+			return msgBatch.Multiline.add(msg)
+		}
+
 		var target, text string
 		if msg.Command != "TAGMSG" {
 			if err := parseMessageParams(msg, &target, &text); err != nil {
@@ -676,6 +1153,12 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 
 		self := uc.isOurNick(msg.Prefix.Name)
 
+		if cmd, params, ok := xirc.ParseCTCPMessage(msg); ok && cmd == "DCC" && msg.Command == "PRIVMSG" && !self {
+			if msg = uc.filterIncomingDCC(msg, params); msg == nil {
+				break
+			}
+		}
+
 		ch := uc.network.channels.Get(bufferName)
 		highlight := false
 		if ch != nil && msg.Command != "TAGMSG" && !self {
@@ -684,7 +1167,11 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			}
 
 			highlight = uc.network.isHighlight(msg)
-			if ch.DetachOn == database.FilterMessage || ch.DetachOn == database.FilterDefault || (ch.DetachOn == database.FilterHighlight && highlight) {
+			if highlight && !uc.network.hasActiveDownstream() {
+				uc.user.queueHighlight(ctx, uc.network, bufferName, msg)
+			}
+			detachOn := database.GetDetachOn(&uc.user.User, ch)
+			if detachOn == database.FilterMessage || (detachOn == database.FilterHighlight && highlight) {
 				uc.updateChannelAutoDetach(bufferName)
 			}
 		}
@@ -696,6 +1183,19 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			}
 		}
 
+		uc.produce(bufferName, msg, downstreamID)
+	case "REDACT":
+		var target, redactedID string
+		if err := parseMessageParams(msg, &target, &redactedID); err != nil {
+			return err
+		}
+
+		bufferName := target
+		if uc.isOurNick(target) {
+			bufferName = msg.Prefix.Name
+		}
+
+		uc.redactMessage(bufferName, redactedID)
 		uc.produce(bufferName, msg, downstreamID)
 	case "CAP":
 		var subCmd string
@@ -892,6 +1392,16 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			}
 
 			dc.endSASL(ctx, msg)
+		} else if msg.Command == irc.RPL_SASLSUCCESS {
+			uc.network.saslFailures.Store(0)
+		} else if !uc.registered {
+			// SASL with the network credentials failed. We're not running
+			// in the user goroutine yet, so we can send events.
+			uc.network.saslFailures.Add(1)
+			if uc.network.SASLFailure == database.SASLFailureAbort {
+				return registrationError{msg}
+			}
+			uc.network.user.events <- eventUpstreamSASLFailed{uc.network, info}
 		}
 
 		if !uc.registered {
@@ -923,18 +1433,6 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		uc.registered = true
 		uc.serverPrefix = msg.Prefix
 		uc.logger.Printf("connection registered with nick %q", uc.nick)
-
-		if uc.network.channels.Len() > 0 {
-			var channels, keys []string
-			uc.network.channels.ForEach(func(_ string, ch *database.Channel) {
-				channels = append(channels, ch.Name)
-				keys = append(keys, ch.Key)
-			})
-
-			for _, msg := range xirc.GenerateJoin(channels, keys) {
-				uc.SendMessage(ctx, msg)
-			}
-		}
 	case irc.RPL_MYINFO:
 		if err := parseMessageParams(msg, nil, &uc.serverName, nil, &uc.availableUserModes, nil); err != nil {
 			return err
@@ -945,6 +1443,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		}
 
 		var downstreamIsupport []string
+		lineLenChanged := false
 		for _, token := range msg.Params[1 : len(msg.Params)-1] {
 			parameter := token
 			var negate, hasValue bool
@@ -999,6 +1498,8 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				} else {
 					uc.availableMemberships = stdMemberships
 				}
+			case "LINELEN":
+				lineLenChanged = true
 			}
 			if err != nil {
 				return err
@@ -1016,6 +1517,9 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			for _, msg := range msgs {
 				dc.SendMessage(ctx, msg)
 			}
+			if lineLenChanged && dc.caps.IsEnabled("soju.im/linelen") {
+				dc.updateLineLen(ctx)
+			}
 		})
 	case irc.ERR_NOMOTD, irc.RPL_ENDOFMOTD:
 		if !uc.gotMotd {
@@ -1035,6 +1539,10 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				uc.startRegainNickTimer()
 			}
 
+			// Wait for ISUPPORT before joining channels, to figure out
+			// the maximum number of channels per JOIN command
+			uc.autoJoinChannels(ctx)
+
 			return nil
 		}
 
@@ -1058,18 +1566,44 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			if label == "" && msgBatch != nil {
 				label = msgBatch.Label
 			}
-			uc.batches[tag] = upstreamBatch{
-				Type:   batchType,
-				Params: msg.Params[2:],
-				Outer:  msgBatch,
-				Label:  label,
+			b := upstreamBatch{
+				Type:      batchType,
+				Params:    msg.Params[2:],
+				Outer:     msgBatch,
+				OuterName: batchName,
+				Label:     label,
+			}
+			if batchType == "draft/multiline" {
+				var target string
+				if err := parseMessageParams(msg, nil, nil, &target); err != nil {
+					return err
+				}
+				b.Multiline = &multilineBuffer{target: target, tags: msg.Tags}
 			}
+			uc.batches[tag] = b
 		} else if strings.HasPrefix(tag, "-") {
 			tag = tag[1:]
-			if _, ok := uc.batches[tag]; !ok {
+			b, ok := uc.batches[tag]
+			if !ok {
 				return fmt.Errorf("unknown BATCH reference tag: %q", tag)
 			}
 			delete(uc.batches, tag)
+
+			if b.Multiline != nil {
+				// Handle the reassembled message as if it was sent on its
+				// own
+				logical := b.Multiline.message()
+				if logical == nil {
+					break
+				}
+				if b.Outer != nil {
+					logical.Tags["batch"] = b.OuterName
+				}
+				if b.Label != "" {
+					logical.Tags["label"] = b.Label
+				}
+				return uc.handleMessage(ctx, logical)
+			}
 		} else {
 			return fmt.Errorf("unexpected BATCH reference tag: missing +/- prefix: %q", tag)
 		}
@@ -1096,6 +1630,10 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		}
 
 		uc.channels.ForEach(func(_ string, ch *upstreamChannel) {
+			if pending := ch.pendingMembers.Get(msg.Prefix.Name); pending != nil {
+				ch.pendingMembers.Del(msg.Prefix.Name)
+				ch.pendingMembers.Set(newNick, pending)
+			}
 			memberships := ch.Members.Get(msg.Prefix.Name)
 			if memberships != nil {
 				ch.Members.Del(msg.Prefix.Name)
@@ -1103,6 +1641,11 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				uc.appendLog(ch.Name, msg)
 			}
 		})
+		// Also record the nick change in the direct conversation with the
+		// user, so that the history shows who the messages are from
+		if !me && uc.network.delivered.HasTarget(msg.Prefix.Name) {
+			uc.appendLog(msg.Prefix.Name, msg)
+		}
 
 		uc.cacheUserInfo(msg.Prefix.Name, &upstreamUser{
 			Nickname: newNick,
@@ -1195,11 +1738,20 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		for _, ch := range strings.Split(channels, ",") {
 			if uc.isOurNick(msg.Prefix.Name) {
 				uc.logger.Printf("joined channel %q", ch)
-				members := xirc.NewCaseMappingMap[*xirc.MembershipSet](uc.network.casemap)
+				if state := uc.joinStates.Get(ch); state != nil {
+					state.stopRetry()
+					uc.joinStates.Del(ch)
+				}
+				joinTime, err := time.Parse(xirc.ServerTimeLayout, string(msg.Tags["time"]))
+				if err != nil {
+					joinTime = time.Now()
+				}
 				uc.channels.Set(ch, &upstreamChannel{
-					Name:    ch,
-					conn:    uc,
-					Members: members,
+					Name:           ch,
+					conn:           uc,
+					Members:        xirc.NewCaseMappingMap[*xirc.MembershipSet](uc.network.casemap),
+					joinTime:       joinTime,
+					pendingMembers: xirc.NewCaseMappingMap[*xirc.MembershipSet](uc.network.casemap),
 				})
 				uc.updateChannelAutoDetach(ch)
 
@@ -1212,7 +1764,12 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				if err != nil {
 					return err
 				}
-				ch.Members.Set(msg.Prefix.Name, &xirc.MembershipSet{})
+				memberships := ch.pendingMembers.Get(msg.Prefix.Name)
+				if memberships == nil {
+					memberships = &xirc.MembershipSet{}
+				}
+				ch.pendingMembers.Del(msg.Prefix.Name)
+				ch.Members.Set(msg.Prefix.Name, memberships)
 			}
 
 			chMsg := msg.Copy()
@@ -1231,6 +1788,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				if uch := uc.channels.Get(ch); uch != nil {
 					uc.channels.Del(ch)
 					uch.updateAutoDetach(0)
+					uch.pendingMembers = xirc.NewCaseMappingMap[*xirc.MembershipSet](uc.network.casemap)
 					uch.Members.ForEach(func(nick string, memberships *xirc.MembershipSet) {
 						if !uc.shouldCacheUserInfo(nick) {
 							uc.users.Del(nick)
@@ -1243,6 +1801,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 					return err
 				}
 				ch.Members.Del(msg.Prefix.Name)
+				ch.pendingMembers.Del(msg.Prefix.Name)
 				if !uc.shouldCacheUserInfo(msg.Prefix.Name) {
 					uc.users.Del(msg.Prefix.Name)
 				}
@@ -1252,6 +1811,62 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			chMsg.Params[0] = ch
 			uc.produce(ch, chMsg, 0)
 		}
+	case "RENAME":
+		var oldName, newName string
+		if err := parseMessageParams(msg, &oldName, &newName); err != nil {
+			return err
+		}
+		var reason string
+		if len(msg.Params) > 2 {
+			reason = msg.Params[2]
+		}
+
+		uc.logger.Printf("channel %q renamed to %q", oldName, newName)
+
+		uch := uc.channels.Get(oldName)
+		if uch != nil {
+			uc.channels.Del(oldName)
+			uch.Name = newName
+			uc.channels.Set(newName, uch)
+		}
+
+		detached := false
+		if ch := uc.network.channels.Get(oldName); ch != nil {
+			detached = ch.Detached
+		}
+		if err := uc.network.renameChannel(ctx, oldName, newName); err != nil {
+			uc.logger.Printf("failed to rename channel %q to %q: %v", oldName, newName, err)
+		}
+
+		if detached {
+			break
+		}
+
+		partReason := "Channel renamed to " + newName
+		if reason != "" {
+			partReason += ": " + reason
+		}
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			if dc.caps.IsEnabled("draft/channel-rename") {
+				dc.SendMessage(ctx, msg)
+				return
+			}
+
+			// Emulate the rename for clients which don't support it
+			dc.SendMessage(ctx, &irc.Message{
+				Prefix:  dc.prefix(),
+				Command: "PART",
+				Params:  []string{oldName, partReason},
+			})
+			dc.SendMessage(ctx, &irc.Message{
+				Prefix:  dc.prefix(),
+				Command: "JOIN",
+				Params:  []string{newName},
+			})
+			if uch != nil && uch.complete {
+				forwardChannel(ctx, dc, uch)
+			}
+		})
 	case "KICK":
 		var channel, user string
 		if err := parseMessageParams(msg, &channel, &user); err != nil {
@@ -1262,6 +1877,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			uc.logger.Printf("kicked from channel %q by %s", channel, msg.Prefix.Name)
 			if uch := uc.channels.Get(channel); uch != nil {
 				uc.channels.Del(channel)
+				uch.pendingMembers = xirc.NewCaseMappingMap[*xirc.MembershipSet](uc.network.casemap)
 				uch.Members.ForEach(func(nick string, memberships *xirc.MembershipSet) {
 					if !uc.shouldCacheUserInfo(nick) {
 						uc.users.Del(nick)
@@ -1274,6 +1890,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				return err
 			}
 			ch.Members.Del(user)
+			ch.pendingMembers.Del(user)
 			if !uc.shouldCacheUserInfo(user) {
 				uc.users.Del(user)
 			}
@@ -1286,11 +1903,15 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		}
 
 		uc.channels.ForEach(func(_ string, ch *upstreamChannel) {
+			ch.pendingMembers.Del(msg.Prefix.Name)
 			if ch.Members.Has(msg.Prefix.Name) {
 				ch.Members.Del(msg.Prefix.Name)
 				uc.appendLog(ch.Name, msg)
 			}
 		})
+		if !uc.isOurNick(msg.Prefix.Name) && uc.network.delivered.HasTarget(msg.Prefix.Name) {
+			uc.appendLog(msg.Prefix.Name, msg)
+		}
 
 		uc.users.Del(msg.Prefix.Name)
 
@@ -1311,6 +1932,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			} else {
 				ch.Topic = ""
 			}
+			uc.network.updateChannelTopic(ctx, ch.Name, ch.Topic)
 		}
 	case "TOPIC":
 		var name string
@@ -1328,7 +1950,14 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		} else {
 			ch.Topic = ""
 		}
+		uc.network.updateChannelTopic(ctx, ch.Name, ch.Topic)
 		uc.produce(ch.Name, msg, 0)
+
+		if c := uc.network.channels.Get(ch.Name); c != nil && c.Detached && uc.network.detachedMessageNeedsRelay(c, msg) {
+			uc.forEachDownstream(func(dc *downstreamConn) {
+				dc.relayDetachedMessage(uc.network, msg)
+			})
+		}
 	case "MODE":
 		var name, modeStr string
 		if err := parseMessageParams(msg, &name, &modeStr); err != nil {
@@ -1351,14 +1980,32 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 				return err
 			}
 
-			err = applyChannelModes(ch, modeStr, msg.Params[2:])
-			if err != nil {
-				return err
+			// Mode changes replayed from the history (e.g. by a bouncer)
+			// have already been accounted for in NAMES and
+			// RPL_CHANNELMODEIS: applying them again would corrupt our
+			// state
+			historical := msgBatch.isHistory()
+			if t, err := time.Parse(xirc.ServerTimeLayout, string(msg.Tags["time"])); err == nil && t.Before(ch.joinTime) {
+				historical = true
+			}
+
+			var key *string
+			if !historical {
+				key, err = applyChannelModes(ch, modeStr, msg.Params[2:])
+				if err != nil {
+					return err
+				}
 			}
 
 			uc.appendLog(ch.Name, msg)
 
 			c := uc.network.channels.Get(name)
+			if c != nil && key != nil && c.Key != *key {
+				c.Key = *key
+				if err := uc.srv.db.StoreChannel(ctx, uc.network.ID, c); err != nil {
+					uc.logger.Printf("failed to update channel %q key: %v", c.Name, err)
+				}
+			}
 			if c == nil || !c.Detached {
 				uc.forwardMessage(ctx, msg)
 			}
@@ -1398,7 +2045,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 
 		firstMode := ch.modes == nil
 		ch.modes = make(map[byte]string)
-		if err := applyChannelModes(ch, modeStr, modeArgs); err != nil {
+		if _, err := applyChannelModes(ch, modeStr, modeArgs); err != nil {
 			return err
 		}
 
@@ -1489,6 +2136,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		for _, s := range splitSpace(members) {
 			memberships, nick := uc.parseMembershipPrefix(s)
 			ch.Members.Set(nick, &memberships)
+			ch.pendingMembers.Del(nick)
 		}
 	case irc.RPL_ENDOFNAMES:
 		var name string
@@ -1618,7 +2266,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 			c := uc.network.channels.Get(channel)
 			if !joined && c != nil {
 				// Automatically join a saved channel when we are invited
-				for _, msg := range xirc.GenerateJoin([]string{c.Name}, []string{c.Key}) {
+				for _, msg := range xirc.GenerateJoin([]string{c.Name}, []string{c.Key}, 0) {
 					uc.SendMessage(ctx, msg)
 				}
 				break
@@ -1633,6 +2281,7 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		})
 
 		if weAreInvited {
+			uc.network.queueOfflineEvent(ctx, msg)
 			go uc.network.broadcastWebPush(msg)
 		}
 	case irc.RPL_INVITING:
@@ -1806,7 +2455,23 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		if err := parseMessageParams(msg, &text); err != nil {
 			return err
 		}
-		return fmt.Errorf("fatal server error: %v", text)
+		if !uc.registered {
+			return registrationError{msg}
+		}
+		if uc.network.manuallyDisconnected.Load() {
+			// Reply to our QUIT
+			break
+		}
+
+		uc.produce("", &irc.Message{
+			Tags:    irc.Tags{"time": msg.Tags["time"]},
+			Prefix:  uc.serverPrefix,
+			Command: "NOTICE",
+			Params:  []string{uc.nick, "ERROR: " + text},
+		}, 0)
+		uc.network.lastServerError = text
+		uc.network.lastServerErrorTime = time.Now()
+		uc.user.handleUpstreamError(uc, upstreamFatalError{text})
 	case irc.ERR_NICKNAMEINUSE:
 		// At this point, we haven't received ISUPPORT so we don't know the
 		// maximum nickname length or whether the server supports MONITOR. Many
@@ -1838,6 +2503,19 @@ func (uc *upstreamConn) handleMessage(ctx context.Context, msg *irc.Message) err
 		if !uc.registered {
 			return registrationError{msg}
 		}
+		uc.forwardMsgByID(ctx, downstreamID, msg)
+	case irc.ERR_INVITEONLYCHAN, irc.ERR_BADCHANNELKEY, irc.ERR_CHANNELISFULL, irc.ERR_BANNEDFROMCHAN, irc.ERR_TOOMANYCHANNELS, xirc.ERR_NEEDREGGEDNICK:
+		var channel string
+		if err := parseMessageParams(msg, nil, &channel); err != nil {
+			return err
+		}
+
+		// Keep track of auto-join failures for clients connecting later
+		if downstreamID == 0 && uc.network.channels.Get(channel) != nil {
+			uc.network.queueOfflineEvent(ctx, msg)
+			uc.handleJoinFailure(channel, msg)
+		}
+
 		uc.forwardMsgByID(ctx, downstreamID, msg)
 	default:
 		uc.logger.Debugf("unhandled message: %v", msg)
@@ -1852,7 +2530,8 @@ func (uc *upstreamConn) handleDetachedMessage(ctx context.Context, ch *database.
 			dc.relayDetachedMessage(uc.network, msg)
 		})
 	}
-	if ch.ReattachOn == database.FilterMessage || (ch.ReattachOn == database.FilterHighlight && uc.network.isHighlight(msg)) {
+	reattachOn := database.GetReattachOn(&uc.user.User, ch)
+	if reattachOn == database.FilterMessage || (reattachOn == database.FilterHighlight && uc.network.isChannelHighlight(ch, msg)) {
 		uc.network.attach(ctx, ch)
 		if err := uc.srv.db.StoreChannel(ctx, uc.network.ID, ch); err != nil {
 			uc.logger.Printf("failed to update channel %q: %v", ch.Name, err)
@@ -1905,6 +2584,11 @@ func (uc *upstreamConn) handleSupportedCaps(capsStr string) {
 	for _, s := range caps {
 		kv := strings.SplitN(s, "=", 2)
 		k := strings.ToLower(kv[0])
+		if uc.disabledCaps[k] {
+			// Pretend the server doesn't support it, so that we neither
+			// request it nor rely on it
+			continue
+		}
 		var v string
 		if len(kv) == 2 {
 			v = kv[1]
@@ -1920,8 +2604,15 @@ func (uc *upstreamConn) updateCaps(ctx context.Context) {
 			requestCaps = append(requestCaps, c)
 		}
 	}
+	if uc.srv.Config().UpstreamPresenceCaps {
+		for c := range presenceUpstreamCaps {
+			if uc.caps.IsAvailable(c) && !uc.caps.IsEnabled(c) {
+				requestCaps = append(requestCaps, c)
+			}
+		}
+	}
 
-	echoMessage := uc.caps.IsAvailable("labeled-response")
+	echoMessage := uc.caps.IsAvailable("labeled-response") && !uc.disabledCaps["echo-message"]
 	if !uc.caps.IsEnabled("echo-message") && echoMessage {
 		requestCaps = append(requestCaps, "echo-message")
 	} else if uc.caps.IsEnabled("echo-message") && !echoMessage {
@@ -1958,7 +2649,7 @@ func (uc *upstreamConn) supportsSASL(mech string) bool {
 }
 
 func (uc *upstreamConn) requestSASL() bool {
-	if uc.network.SASL.Mechanism == "" {
+	if uc.network.SASL.Mechanism == "" || uc.network.saslFailures.Load() >= maxSASLFailures {
 		return false
 	}
 	return uc.supportsSASL(uc.network.SASL.Mechanism)
@@ -1995,7 +2686,7 @@ func (uc *upstreamConn) handleCapAck(ctx context.Context, name string, ok bool)
 		})
 	case "echo-message":
 	default:
-		if permanentUpstreamCaps[name] {
+		if permanentUpstreamCaps[name] || presenceUpstreamCaps[name] {
 			break
 		}
 		uc.logger.Printf("received CAP ACK/NAK for a cap we don't support: %v", name)
@@ -2037,19 +2728,59 @@ func (uc *upstreamConn) register(ctx context.Context) {
 }
 
 func (uc *upstreamConn) ReadMessage() (*irc.Message, error) {
-	msg, err := uc.conn.ReadMessage()
-	if err != nil {
-		return nil, err
+	for {
+		msg, err := uc.conn.ReadMessage()
+		if errors.Is(err, errLineTooLong) {
+			uc.logger.Printf("discarding incoming line exceeding the maximum length")
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		uc.srv.metrics.upstreamInMessagesTotal.Inc()
+		uc.network.traffic.messagesIn.Add(1)
+
+		// The user goroutine handles ISUPPORT asynchronously: apply the
+		// line length limit right away, before reading the next message
+		if lineLen, ok := parseIsupportLineLen(msg); ok {
+			uc.conn.SetMaxLineLength(lineLen)
+		}
+		return msg, nil
+	}
+}
+
+// parseIsupportLineLen extracts the line length limit from an RPL_ISUPPORT
+// message. It returns false if the message doesn't change the limit.
+func parseIsupportLineLen(msg *irc.Message) (lineLen int, ok bool) {
+	if msg.Command != irc.RPL_ISUPPORT || len(msg.Params) < 2 {
+		return 0, false
+	}
+	for _, token := range msg.Params[1 : len(msg.Params)-1] {
+		if strings.EqualFold(token, "-LINELEN") {
+			lineLen, ok = xirc.DefaultLineLength, true
+		} else if k, v, _ := strings.Cut(token, "="); strings.EqualFold(k, "LINELEN") {
+			n, _ := strconv.Atoi(v)
+			lineLen, ok = clampLineLen(n), true
+		}
+	}
+	return lineLen, ok
+}
+
+// clampLineLen restricts a line length limit advertised by an upstream server
+// to sane values.
+func clampLineLen(n int) int {
+	if n < xirc.DefaultLineLength {
+		return xirc.DefaultLineLength
+	} else if n > upstreamMaxLineLength {
+		return upstreamMaxLineLength
 	}
-	uc.srv.metrics.upstreamInMessagesTotal.Inc()
-	return msg, nil
+	return n
 }
 
 func (uc *upstreamConn) runUntilRegistered(ctx context.Context) error {
 	for !uc.registered {
 		msg, err := uc.ReadMessage()
 		if err != nil {
-			return fmt.Errorf("failed to read message: %v", err)
+			return fmt.Errorf("failed to read message: %w", err)
 		}
 
 		if err := uc.handleMessage(ctx, msg); err != nil {
@@ -2075,18 +2806,39 @@ func (uc *upstreamConn) runUntilRegistered(ctx context.Context) error {
 }
 
 func (uc *upstreamConn) readMessages(ch chan<- event) error {
+	// The ERROR message is also handled by the user goroutine, but we need
+	// to know about it here to pick the reconnection delay
+	var fatalErr error
 	for {
 		msg, err := uc.ReadMessage()
-		if errors.Is(err, io.EOF) {
+		if errors.Is(err, io.EOF) || (err != nil && fatalErr != nil) {
 			break
 		} else if err != nil {
 			return fmt.Errorf("failed to read IRC command: %v", err)
 		}
 
+		if msg.Command == "ERROR" && len(msg.Params) > 0 {
+			fatalErr = upstreamFatalError{msg.Params[len(msg.Params)-1]}
+		}
+
 		ch <- eventUpstreamMessage{msg, uc}
 	}
 
-	return nil
+	return fatalErr
+}
+
+// quit sends a QUIT message, and closes the connection if the server doesn't
+// close it in time.
+func (uc *upstreamConn) quit(reason string) {
+	msg := &irc.Message{Command: "QUIT"}
+	if reason != "" {
+		msg.Params = []string{reason}
+	}
+	uc.SendMessage(context.TODO(), msg)
+
+	time.AfterFunc(upstreamQuitTimeout, func() {
+		uc.Close()
+	})
 }
 
 func (uc *upstreamConn) SendMessage(ctx context.Context, msg *irc.Message) {
@@ -2096,6 +2848,7 @@ func (uc *upstreamConn) SendMessage(ctx context.Context, msg *irc.Message) {
 	}
 
 	uc.srv.metrics.upstreamOutMessagesTotal.Inc()
+	uc.network.traffic.messagesOut.Add(1)
 	uc.conn.SendMessage(ctx, msg)
 }
 
@@ -2110,6 +2863,31 @@ func (uc *upstreamConn) SendMessageLabeled(ctx context.Context, downstreamID uin
 	uc.SendMessage(ctx, msg)
 }
 
+// sendMultilineLabeled sends a message whose text contains line breaks as a
+// draft/multiline batch. It returns false if the upstream doesn't support
+// draft/multiline or if the message exceeds the upstream limits.
+func (uc *upstreamConn) sendMultilineLabeled(ctx context.Context, downstreamID uint64, msg *irc.Message) bool {
+	if !uc.caps.IsEnabled("draft/multiline") || !uc.caps.IsEnabled("batch") {
+		return false
+	}
+
+	ref := fmt.Sprintf("sd%v", uc.nextBatchRef)
+	maxLen := uc.maxTextLength(msg.Command, msg.Params[0])
+	msgs := xirc.GenerateMultilineBatch(ref, msg, maxLen)
+
+	maxBytes, maxLines := parseMultilineLimits(uc.caps.Available["draft/multiline"])
+	if (maxBytes > 0 && len(msg.Params[1]) > maxBytes) || (maxLines > 0 && len(msgs)-2 > maxLines) {
+		return false
+	}
+
+	uc.nextBatchRef++
+	uc.SendMessageLabeled(ctx, downstreamID, msgs[0])
+	for _, msg := range msgs[1:] {
+		uc.SendMessage(ctx, msg)
+	}
+	return true
+}
+
 // appendLog appends a message to the log file.
 //
 // The internal message ID is returned. If the message isn't recorded in the
@@ -2167,6 +2945,19 @@ func (uc *upstreamConn) appendLog(entity string, msg *irc.Message) (msgID string
 	return msgID
 }
 
+// redactMessage marks a message as redacted in the message store.
+func (uc *upstreamConn) redactMessage(entity, msgID string) {
+	store, ok := uc.user.msgStore.(msgstore.RedactStore)
+	if !ok {
+		return
+	}
+
+	entityCM := uc.network.casemap(entity)
+	if err := store.RedactMessage(&uc.network.Network, entityCM, msgID); err != nil {
+		uc.logger.Printf("failed to redact message %q: %v", msgID, err)
+	}
+}
+
 // produce appends a message to the logs and forwards it to connected downstream
 // connections.
 //
@@ -2236,7 +3027,7 @@ func (uc *upstreamConn) updateChannelAutoDetach(name string) {
 	if ch == nil || ch.Detached {
 		return
 	}
-	uch.updateAutoDetach(ch.DetachAfter)
+	uch.updateAutoDetach(database.GetDetachAfter(&uc.user.User, ch))
 }
 
 func (uc *upstreamConn) updateMonitor() {
@@ -2308,6 +3099,164 @@ func (uc *upstreamConn) updateMonitor() {
 	}
 }
 
+func (uc *upstreamConn) maxTargets(cmd string) int {
+	targMax := uc.isupport["TARGMAX"]
+	if targMax == nil {
+		return 0
+	}
+	for _, s := range strings.Split(*targMax, ",") {
+		k, v, _ := strings.Cut(s, ":")
+		if !strings.EqualFold(k, cmd) {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return 0
+		}
+		return n
+	}
+	return 0
+}
+
+// maxTextLength returns the maximum length of the text of a PRIVMSG or NOTICE
+// sent to target, taking into account the prefix the server will prepend when
+// relaying it.
+func (uc *upstreamConn) maxTextLength(cmd, target string) int {
+	prefix := &irc.Prefix{
+		Name: uc.nick,
+		User: uc.username,
+		Host: uc.hostname,
+	}
+	if prefix.Host == "" {
+		// We don't know our hostname yet: assume the worst. The server may
+		// also prepend a tilde to our username.
+		prefix.User = strings.Repeat("x", uc.isupportLen("USERLEN", 10)+1)
+		prefix.Host = strings.Repeat("x", uc.isupportLen("HOSTLEN", 63))
+	}
+	return xirc.MaxTextLength(prefix, cmd, target, uc.lineLen())
+}
+
+// lineLen returns the maximum length of messages exchanged with the upstream
+// server, excluding their tags.
+func (uc *upstreamConn) lineLen() int {
+	return clampLineLen(uc.isupportLen("LINELEN", xirc.DefaultLineLength))
+}
+
+// splitText splits the text of a PRIVMSG or NOTICE into chunks fitting in the
+// line length limit.
+func (uc *upstreamConn) splitText(cmd, target, text string) []string {
+	return splitText(text, uc.maxTextLength(cmd, target))
+}
+
+// splitText splits the text of a PRIVMSG or NOTICE into chunks of at most
+// maxLen bytes. CTCP messages other than ACTION are never split.
+func splitText(text string, maxLen int) []string {
+	if len(text) <= maxLen {
+		return []string{text}
+	}
+
+	if !strings.HasPrefix(text, "\x01") {
+		return xirc.SplitText(text, maxLen)
+	}
+
+	const actionPrefix = "\x01ACTION "
+	if !strings.HasPrefix(text, actionPrefix) {
+		return []string{text}
+	}
+	action := strings.TrimSuffix(strings.TrimPrefix(text, actionPrefix), "\x01")
+	chunks := xirc.SplitText(action, maxLen-len(actionPrefix)-1)
+	for i, chunk := range chunks {
+		chunks[i] = actionPrefix + chunk + "\x01"
+	}
+	return chunks
+}
+
+func (uc *upstreamConn) isupportLen(key string, def int) int {
+	if v := uc.isupport[key]; v != nil {
+		if n, err := strconv.Atoi(*v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return def
+}
+
+func (uc *upstreamConn) autoJoinChannels(ctx context.Context) {
+	var channels, keys []string
+	uc.network.channels.ForEach(func(_ string, ch *database.Channel) {
+		if uc.channels.Get(ch.Name) != nil {
+			return
+		}
+		channels = append(channels, ch.Name)
+		keys = append(keys, ch.Key)
+		uc.joinStates.Set(ch.Name, &channelJoinState{})
+	})
+
+	// Messages are paced by the connection rate limiter
+	for _, msg := range xirc.GenerateJoin(channels, keys, uc.maxTargets("JOIN")) {
+		uc.SendMessage(ctx, msg)
+	}
+}
+
+func (uc *upstreamConn) handleJoinFailure(channel string, msg *irc.Message) {
+	state := uc.joinStates.Get(channel)
+	if state == nil {
+		return
+	}
+
+	state.stopRetry()
+	state.err = fmt.Sprintf("%v %v", msg.Command, msg.Params[len(msg.Params)-1])
+
+	switch msg.Command {
+	case irc.ERR_BANNEDFROMCHAN, irc.ERR_INVITEONLYCHAN, irc.ERR_BADCHANNELKEY:
+		state.permanent = true
+
+		format := "failed to join %v on %v: %v"
+		if msg.Command == irc.ERR_BADCHANNELKEY {
+			format = "failed to join %v on %v: %v (join the channel with the new key to update it)"
+		}
+		uc.forEachDownstream(func(dc *downstreamConn) {
+			sendServiceNOTICE(dc, format, channel, uc.network.GetName(), state.err)
+		})
+		return
+	}
+
+	if state.backoff == nil {
+		state.backoff = newBackoffer(joinRetryMinDelay, joinRetryMaxDelay, joinRetryJitter)
+		state.backoff.Next() // skip the initial zero delay
+	}
+	delay := state.backoff.Next()
+	state.retryAt = time.Now().Add(delay)
+	state.retryTimer = time.AfterFunc(delay, func() {
+		e := eventChannelJoinRetry{uc: uc, name: channel}
+		select {
+		case uc.network.user.events <- e:
+			// ok
+		case <-uc.network.stopped:
+		case <-uc.network.user.done:
+		}
+	})
+}
+
+func (uc *upstreamConn) retryJoin(name string) {
+	ctx := context.TODO()
+
+	state := uc.joinStates.Get(name)
+	if state == nil || state.retryTimer == nil {
+		return
+	}
+	state.retryTimer = nil
+
+	ch := uc.network.channels.Get(name)
+	if ch == nil || uc.channels.Get(name) != nil {
+		uc.joinStates.Del(name)
+		return
+	}
+
+	for _, msg := range xirc.GenerateJoin([]string{ch.Name}, []string{ch.Key}, 0) {
+		uc.SendMessage(ctx, msg)
+	}
+}
+
 func (uc *upstreamConn) stopRegainNickTimer() {
 	if uc.regainNickTimer != nil {
 		uc.regainNickTimer.Stop()
@@ -2463,8 +3412,8 @@ func (uc *upstreamConn) shouldCacheUserInfo(nick string) bool {
 // available IP addresses than to find the fastest link.
 //
 // See: https://todo.sr.ht/~emersion/soju/221
-func resolveIPAddr(ctx context.Context, host string) (*net.IPAddr, error) {
-	ipAddrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+func resolveIPAddr(ctx context.Context, resolver *net.Resolver, host string) (*net.IPAddr, error) {
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,138 @@
+package soju
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"gopkg.in/irc.v4"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	testCases := []struct {
+		name   string
+		reason string
+		kind   upstreamErrorKind
+	}{
+		{"klined", "Closing Link: 192.0.2.1 (K-Lined)", upstreamErrorBanned},
+		{"glined", "Closing Link: soju[192.0.2.1] (G-Lined: spam)", upstreamErrorBanned},
+		{"zlined", "Closing Link: 192.0.2.1 (Z-lined: Tor exit node)", upstreamErrorBanned},
+		{"dline", "Closing Link: 192.0.2.1 (D-line active)", upstreamErrorBanned},
+		{"kline", "You are banned from this server- kline", upstreamErrorBanned},
+		{"akill", "Closing Link: soju (AKILL ID: 1234)", upstreamErrorBanned},
+		{"autokill", "Closing Link: soju (Autokilled: abuse)", upstreamErrorBanned},
+		{"banned", "Closing Link: soju (Banned)", upstreamErrorBanned},
+		{"youAreBanned", "You are banned from this server: Evading a ban", upstreamErrorBanned},
+		{"shuttingDown", "Closing Link: soju (Server shutting down)", upstreamErrorShutdown},
+		{"shutdownUpper", "SERVER SHUTTING DOWN", upstreamErrorShutdown},
+		{"restarting", "Closing Link: soju (Server is restarting)", upstreamErrorShutdown},
+		{"restart", "Server Restart by oper", upstreamErrorShutdown},
+		{"goingDown", "Closing Link: soju (This server is going down)", upstreamErrorShutdown},
+		{"pingTimeout", "Closing Link: soju (Ping timeout: 240 seconds)", upstreamErrorOther},
+		{"quit", "Closing Link: soju (Quit: bye)", upstreamErrorOther},
+		{"killed", "Closing Link: soju (Killed (oper (stop flooding)))", upstreamErrorOther},
+		{"throttled", "Trying to reconnect too fast.", upstreamErrorOther},
+		{"excessFlood", "Closing Link: soju (Excess Flood)", upstreamErrorOther},
+		{"empty", "", upstreamErrorOther},
+	}
+
+	for _, tc := range testCases {
+		tc := tc // capture range variable
+		t.Run(tc.name, func(t *testing.T) {
+			kind := classifyUpstreamError(tc.reason)
+			if kind != tc.kind {
+				t.Errorf("classifyUpstreamError(%q) = %v, want %v", tc.reason, kind, tc.kind)
+			}
+		})
+	}
+}
+
+func TestUpstreamSplitText(t *testing.T) {
+	uc := &upstreamConn{
+		nick:     "soju",
+		username: "soju",
+		hostname: "example.org",
+		isupport: make(map[string]*string),
+	}
+	maxLen := uc.maxTextLength("PRIVMSG", "#soju")
+	if want := 512 - len(":soju!soju@example.org PRIVMSG #soju :\r\n"); maxLen != want {
+		t.Fatalf("maxTextLength() = %v, want %v", maxLen, want)
+	}
+
+	words := strings.Repeat("hello ", 200)
+	runes := strings.Repeat("é", 400)
+	testCases := []struct {
+		name string
+		text string
+		join string
+	}{
+		{"short", "hello", ""},
+		{"words", words, " "},
+		{"runes", runes, ""},
+		{"action", "\x01ACTION " + words + "\x01", ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			chunks := uc.splitText("PRIVMSG", "#soju", tc.text)
+			if len(tc.text) > maxLen && len(chunks) < 2 {
+				t.Fatalf("splitText() returned %v chunks", len(chunks))
+			}
+			for _, chunk := range chunks {
+				if len(chunk) > maxLen {
+					t.Errorf("chunk too long: %v > %v bytes", len(chunk), maxLen)
+				}
+				if !utf8.ValidString(chunk) {
+					t.Errorf("chunk contains invalid UTF-8: %q", chunk)
+				}
+			}
+			if strings.HasPrefix(tc.text, "\x01") {
+				for _, chunk := range chunks {
+					if !strings.HasPrefix(chunk, "\x01ACTION ") || !strings.HasSuffix(chunk, "\x01") {
+						t.Errorf("chunk isn't an ACTION: %q", chunk)
+					}
+				}
+				return
+			}
+			if got := strings.Join(chunks, tc.join); got != strings.TrimSuffix(tc.text, " ") && got != tc.text {
+				t.Errorf("joined chunks don't match the original text")
+			}
+		})
+	}
+
+	// Other CTCP messages are left untouched
+	ctcp := "\x01PING " + words + "\x01"
+	if chunks := uc.splitText("PRIVMSG", "#soju", ctcp); len(chunks) != 1 {
+		t.Errorf("splitText() split a CTCP PING message")
+	}
+
+	lineLen := "1024"
+	uc.isupport["LINELEN"] = &lineLen
+	if want := 1024 - len(":soju!soju@example.org PRIVMSG #soju :\r\n"); uc.maxTextLength("PRIVMSG", "#soju") != want {
+		t.Errorf("maxTextLength() with LINELEN=1024 = %v, want %v", uc.maxTextLength("PRIVMSG", "#soju"), want)
+	}
+}
+
+func TestParseIsupportLineLen(t *testing.T) {
+	testCases := []struct {
+		name    string
+		params  []string
+		lineLen int
+		ok      bool
+	}{
+		{"absent", []string{"soju", "CHANTYPES=#", "are supported"}, 0, false},
+		{"set", []string{"soju", "LINELEN=2048", "are supported"}, 2048, true},
+		{"unset", []string{"soju", "-LINELEN", "are supported"}, 512, true},
+		{"tooSmall", []string{"soju", "LINELEN=100", "are supported"}, 512, true},
+		{"tooLarge", []string{"soju", "LINELEN=1000000", "are supported"}, upstreamMaxLineLength, true},
+		{"invalid", []string{"soju", "LINELEN=x", "are supported"}, 512, true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &irc.Message{Command: irc.RPL_ISUPPORT, Params: tc.params}
+			lineLen, ok := parseIsupportLineLen(msg)
+			if ok != tc.ok || lineLen != tc.lineLen {
+				t.Errorf("parseIsupportLineLen() = %v, %v, want %v, %v", lineLen, ok, tc.lineLen, tc.ok)
+			}
+		})
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -50,6 +51,16 @@ type eventUpstreamError struct {
 	err error
 }
 
+type eventUpstreamSASLFailed struct {
+	net    *network
+	reason string
+}
+
+type eventUpstreamCertTrusted struct {
+	net    *network
+	certFP string
+}
+
 type eventDownstreamMessage struct {
 	msg *irc.Message
 	dc  *downstreamConn
@@ -68,28 +79,50 @@ type eventChannelDetach struct {
 	name string
 }
 
+type eventChannelJoinRetry struct {
+	uc   *upstreamConn
+	name string
+}
+
 type eventBroadcast struct {
 	msg *irc.Message
 }
 
 type eventStop struct{}
 
+type eventDetachIdleChannels struct{}
+
+type eventUpstreamLagCheck struct{}
+
+type eventFlushTrafficStats struct{}
+
 type eventUserUpdate struct {
 	password *string
-	admin    *bool
+	role     *database.Role
 	enabled  *bool
 	done     chan error
 }
 
+type eventUserKick struct {
+	downstream, upstream bool
+	reason               string
+	done                 chan userKickCount
+}
+
+type userKickCount struct {
+	downstreams, upstreams int
+}
+
 type eventTryRegainNick struct {
 	uc   *upstreamConn
 	nick string
 }
 
 type eventUserRun struct {
-	params []string
-	print  chan string
-	ret    chan error
+	params  []string
+	print   chan string
+	ret     chan error
+	catalog catalog
 }
 
 type deliveredClientMap map[string]string // client name -> msg ID
@@ -154,8 +187,50 @@ type network struct {
 	pushTargets xirc.CaseMappingMap[time.Time]
 	lastError   error
 	casemap     xirc.CaseMapping
+
+	// Text of the last ERROR message sent by the server
+	lastServerError     string
+	lastServerErrorTime time.Time
+
+	// Number of consecutive SASL authentication failures
+	saslFailures atomic.Int32
+
+	// Fingerprint of the server certificate which didn't match the one
+	// trusted on first use, empty if none
+	untrustedCertFP string
+
+	// Events received while no downstream connection was bound, mirrored
+	// from the database
+	offlineEvents []database.OfflineEvent
+
+	// Recent connection errors, oldest first
+	connErrors []networkConnError
+
+	health networkHealth
+
+	// Set by the user to stay disconnected without disabling the network,
+	// cleared on restart
+	manuallyDisconnected atomic.Bool
+	// Wakes up the connection loop to skip the reconnection delay
+	wakeup chan struct{}
+
+	// Traffic which hasn't been persisted yet
+	traffic trafficCounters
 }
 
+const maxOfflineEvents = 100
+
+type networkConnError struct {
+	time time.Time
+	err  error
+}
+
+const maxNetworkConnErrors = 16
+
+// maxSASLFailures is the number of consecutive SASL authentication failures
+// after which SASL is no longer attempted.
+const maxSASLFailures = 3
+
 func newNetwork(user *user, record *database.Network, channels []database.Channel) *network {
 	logger := &prefixLogger{user.logger, fmt.Sprintf("network %q: ", record.GetName())}
 
@@ -174,6 +249,7 @@ func newNetwork(user *user, record *database.Network, channels []database.Channe
 		user:        user,
 		logger:      logger,
 		stopped:     make(chan struct{}),
+		wakeup:      make(chan struct{}, 1),
 		channels:    m,
 		delivered:   newDeliveredStore(cm),
 		pushTargets: xirc.NewCaseMappingMap[time.Time](cm),
@@ -190,6 +266,81 @@ func (net *network) forEachDownstream(f func(*downstreamConn)) {
 	}
 }
 
+// queueOfflineEvent saves a message for later replay, if no downstream
+// connection is bound to the network.
+func (net *network) queueOfflineEvent(ctx context.Context, msg *irc.Message) {
+	hasDownstream := false
+	net.forEachDownstream(func(dc *downstreamConn) {
+		hasDownstream = true
+	})
+	if hasDownstream {
+		return
+	}
+
+	event := database.OfflineEvent{
+		Time:    time.Now(),
+		Message: msg.Copy(),
+	}
+	if err := net.user.srv.db.StoreOfflineEvent(ctx, net.ID, &event); err != nil {
+		net.logger.Printf("failed to store offline event: %v", err)
+		return
+	}
+	net.offlineEvents = append(net.offlineEvents, event)
+	net.expireOfflineEvents(ctx)
+}
+
+// deleteOfflineEvents deletes the first n offline events.
+func (net *network) deleteOfflineEvents(ctx context.Context, n int) {
+	for i := 0; i < n; i++ {
+		if err := net.user.srv.db.DeleteOfflineEvent(ctx, net.offlineEvents[i].ID); err != nil {
+			net.logger.Printf("failed to delete offline event: %v", err)
+		}
+	}
+	net.offlineEvents = net.offlineEvents[n:]
+}
+
+// expireOfflineEvents drops old offline events and the oldest ones above the
+// limit.
+func (net *network) expireOfflineEvents(ctx context.Context) {
+	n := 0
+	if len(net.offlineEvents) > maxOfflineEvents {
+		n = len(net.offlineEvents) - maxOfflineEvents
+	}
+	if maxAge := net.user.srv.Config().OfflineEventMaxAge; maxAge > 0 {
+		for n < len(net.offlineEvents) && time.Since(net.offlineEvents[n].Time) > maxAge {
+			n++
+		}
+	}
+	net.deleteOfflineEvents(ctx, n)
+}
+
+// replayOfflineEvents sends queued offline events to a downstream connection,
+// then clears the queue.
+func (net *network) replayOfflineEvents(ctx context.Context, dc *downstreamConn) {
+	net.expireOfflineEvents(ctx)
+	events := net.offlineEvents
+	net.deleteOfflineEvents(ctx, len(events))
+
+	var joinFailures []string
+	for _, ev := range events {
+		msg := ev.Message
+		switch msg.Command {
+		case "INVITE":
+			dc.SendMessage(ctx, msg)
+		default:
+			var channel, reason string
+			if err := parseMessageParams(msg, nil, &channel, &reason); err != nil {
+				continue
+			}
+			joinFailures = append(joinFailures, fmt.Sprintf("%v (%v: %v)", channel, msg.Command, reason))
+		}
+	}
+
+	if len(joinFailures) > 0 {
+		sendServiceNOTICE(dc, "failed to join channels on %v: %v", net.GetName(), strings.Join(joinFailures, ", "))
+	}
+}
+
 func (net *network) isStopped() bool {
 	select {
 	case <-net.stopped:
@@ -215,8 +366,18 @@ func userIdent(u *database.User) string {
 }
 
 func (net *network) runConn(ctx context.Context) error {
-	net.user.srv.metrics.upstreams.Add(1)
-	defer net.user.srv.metrics.upstreams.Add(-1)
+	srv := net.user.srv
+
+	// Wait for our turn before starting the timeouts below
+	release, err := srv.dialQueue.Acquire(ctx, net.user.Username, srv.Config().Limits.UpstreamConnectAttempts)
+	if err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+	var releaseOnce sync.Once
+	defer releaseOnce.Do(release)
+
+	srv.metrics.upstreams.Add(1)
+	defer srv.metrics.upstreams.Add(-1)
 
 	done := ctx.Done()
 	ctx, cancel := context.WithTimeout(ctx, time.Minute)
@@ -239,12 +400,17 @@ func (net *network) runConn(ctx context.Context) error {
 		defer net.user.srv.Identd.Delete(uc.RemoteAddr().String(), uc.LocalAddr().String())
 	}
 
+	if err := uc.startTLS(ctx); err != nil {
+		return fmt.Errorf("failed to connect: %w", err)
+	}
+
 	// TODO: this is racy, we're not running in the user goroutine yet
 	// uc.register accesses user/network DB records
 	uc.register(ctx)
 	if err := uc.runUntilRegistered(ctx); err != nil {
 		return fmt.Errorf("failed to register: %w", err)
 	}
+	releaseOnce.Do(release)
 
 	net.user.events <- eventUpstreamConnected{uc}
 	defer func() {
@@ -270,41 +436,144 @@ func (net *network) run() {
 	}()
 
 	var lastTry time.Time
+	banned, saslFailed := false, false
 	backoff := newBackoffer(retryConnectMinDelay, retryConnectMaxDelay, retryConnectJitter)
 	for {
 		if net.isStopped() {
 			return
 		}
 
-		delay := backoff.Next() - time.Now().Sub(lastTry)
+		if net.manuallyDisconnected.Load() {
+			select {
+			case <-net.wakeup:
+				backoff.Reset()
+				lastTry = time.Time{}
+				banned, saslFailed = false, false
+				continue
+			case <-net.stopped:
+				return
+			}
+		}
+
+		delay := backoff.Next()
+		if banDelay := net.user.srv.Config().UpstreamBanRetryDelay; banned && banDelay > 0 {
+			delay = banDelay
+		} else if saslFailed {
+			// Don't hammer the services with invalid credentials
+			delay = time.Duration(net.saslFailures.Load()) * retrySASLDelay
+		}
+		delay -= time.Now().Sub(lastTry)
 		if delay > 0 {
 			net.logger.Printf("waiting %v before trying to reconnect to %q", delay.Truncate(time.Second), net.Addr)
-			time.Sleep(delay)
+			select {
+			case <-time.After(delay):
+			case <-net.wakeup:
+				// Manually connected or disconnected
+				backoff.Reset()
+				lastTry = time.Time{}
+				banned, saslFailed = false, false
+				continue
+			case <-net.stopped:
+				return
+			}
 		}
 		lastTry = time.Now()
 
-		if err := net.runConn(ctx); err != nil {
+		err := net.runConn(ctx)
+		if net.manuallyDisconnected.Load() {
+			// The connection was closed on purpose
+			net.logger.Printf("manually disconnected from %q", net.Addr)
+			continue
+		}
+		errKind := upstreamErrorOther
+		saslFailed = false
+		var fatalErr upstreamFatalError
+		if err == nil {
+			backoff.Reset()
+		} else if errors.As(err, &fatalErr) {
+			// The error has already been reported by the user goroutine
+			net.logger.Printf("disconnected from %q: %v", net.Addr, fatalErr.Reason)
+			errKind = classifyUpstreamError(fatalErr.Reason)
+			backoff.Reset()
+		} else {
 			text := err.Error()
 			temp := true
 			var regErr registrationError
 			if errors.As(err, &regErr) {
 				text = "failed to register: " + regErr.Reason()
 				temp = regErr.Temporary()
+				if regErr.Command == "ERROR" {
+					errKind = classifyUpstreamError(regErr.Reason())
+				}
+				saslFailed = isSASLFailure(regErr.Command)
+				if saslFailed && net.saslFailures.Load() >= maxSASLFailures {
+					temp = false
+					err = fmt.Errorf("%w (giving up after %v SASL failures, update the network to retry)", err, maxSASLFailures)
+				}
+			}
+
+			var tofuErr tofuMismatchError
+			if errors.As(err, &tofuErr) {
+				// Retrying won't help until the user trusts the new
+				// certificate
+				temp = false
 			}
 
 			net.logger.Printf("connection error to %q: %v", net.Addr, text)
-			net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("connection error: %v", err)}
+			net.user.events <- eventUpstreamConnectionError{net, fmt.Errorf("connection error: %w", err)}
 			net.user.srv.metrics.upstreamConnectErrorsTotal.Inc()
 
 			if !temp {
 				return
 			}
-		} else {
-			backoff.Reset()
+		}
+
+		banned = errKind == upstreamErrorBanned
+		if banned {
+			net.logger.Printf("banned from %q, waiting longer before reconnecting", net.Addr)
 		}
 	}
 }
 
+// sendUntrustedCertWarning warns the user that the server certificate doesn't
+// match the one trusted on first use.
+func (net *network) sendUntrustedCertWarning(dc *downstreamConn) {
+	sendServiceNOTICE(dc, "WARNING: the TLS certificate of %s changed since it was trusted on first use, someone may be intercepting the connection! "+
+		"Connections are refused until the new certificate is trusted with: network trust-cert %s %s",
+		net.GetName(), net.GetName(), net.untrustedCertFP)
+}
+
+func (net *network) recordConnError(err error) {
+	net.connErrors = append(net.connErrors, networkConnError{time.Now(), err})
+	if len(net.connErrors) > maxNetworkConnErrors {
+		net.connErrors = net.connErrors[len(net.connErrors)-maxNetworkConnErrors:]
+	}
+}
+
+// disconnect closes the connection to the network and stops reconnecting
+// until connect is called.
+func (net *network) disconnect(reason string) {
+	net.manuallyDisconnected.Store(true)
+	if uc := net.conn; uc != nil {
+		uc.quit(reason)
+	}
+	net.wake()
+}
+
+// connect reverts disconnect, and connects immediately if the connection loop
+// is waiting to reconnect.
+func (net *network) connect() {
+	net.manuallyDisconnected.Store(false)
+	net.wake()
+}
+
+func (net *network) wake() {
+	select {
+	case net.wakeup <- struct{}{}:
+	default:
+	}
+}
+
 func (net *network) stop() {
 	if !net.isStopped() {
 		close(net.stopped)
@@ -355,6 +624,8 @@ func (net *network) attach(ctx context.Context, ch *database.Channel) {
 	detachedMsgID := ch.DetachedInternalMsgID
 	ch.Detached = false
 	ch.DetachedInternalMsgID = ""
+	// Don't auto-detach the channel again right away
+	ch.DownstreamInteractedAt = time.Now()
 
 	var uch *upstreamChannel
 	if net.conn != nil {
@@ -370,7 +641,7 @@ func (net *network) attach(ctx context.Context, ch *database.Channel) {
 			Params:  []string{ch.Name},
 		})
 
-		if uch != nil {
+		if uch != nil && uch.complete {
 			forwardChannel(ctx, dc, uch)
 		}
 
@@ -399,6 +670,46 @@ func (net *network) deleteChannel(ctx context.Context, name string) error {
 	return nil
 }
 
+// renameChannel updates the state of a channel renamed by the server. If a
+// channel with the new name is already saved, it's replaced by the renamed
+// one.
+func (net *network) renameChannel(ctx context.Context, oldName, newName string) error {
+	if clients := net.delivered.m.Get(oldName); clients != nil {
+		net.delivered.m.Del(oldName)
+		net.delivered.m.Set(newName, clients)
+	}
+	if net.pushTargets.Has(oldName) {
+		t := net.pushTargets.Get(oldName)
+		net.pushTargets.Del(oldName)
+		net.pushTargets.Set(newName, t)
+	}
+
+	if store, ok := net.user.msgStore.(msgstore.RenameTargetStore); ok {
+		oldCM, newCM := net.casemap(oldName), net.casemap(newName)
+		if oldCM != newCM {
+			if err := store.RenameTarget(&net.Network, oldCM, newCM); err != nil {
+				net.logger.Printf("failed to rename channel %q to %q in message store: %v", oldName, newName, err)
+			}
+		}
+	}
+
+	ch := net.channels.Get(oldName)
+	if ch == nil {
+		return nil
+	}
+	if other := net.channels.Get(newName); other != nil && other != ch {
+		// Names are unique per network: keep the settings of the channel
+		// we've joined
+		if err := net.user.srv.db.DeleteChannel(ctx, other.ID); err != nil {
+			return err
+		}
+	}
+	net.channels.Del(oldName)
+	ch.Name = newName
+	net.channels.Set(newName, ch)
+	return net.user.srv.db.StoreChannel(ctx, net.ID, ch)
+}
+
 func (net *network) updateCasemapping(newCasemap xirc.CaseMapping) {
 	net.casemap = newCasemap
 	net.channels.SetCaseMapping(newCasemap)
@@ -408,9 +719,11 @@ func (net *network) updateCasemapping(newCasemap xirc.CaseMapping) {
 		uc.channels.SetCaseMapping(newCasemap)
 		uc.channels.ForEach(func(_ string, uch *upstreamChannel) {
 			uch.Members.SetCaseMapping(newCasemap)
+			uch.pendingMembers.SetCaseMapping(newCasemap)
 		})
 		uc.users.SetCaseMapping(newCasemap)
 		uc.monitored.SetCaseMapping(newCasemap)
+		uc.joinStates.SetCaseMapping(newCasemap)
 	}
 	net.forEachDownstream(func(dc *downstreamConn) {
 		dc.updateCasemapping()
@@ -439,7 +752,33 @@ func (net *network) storeClientDeliveryReceipts(ctx context.Context, clientName
 	}
 }
 
+// bumpChannelInteractionTime records that a downstream client has interacted
+// with a channel. To avoid excessive database writes, the time is only stored
+// if the previous one is old enough.
+func (net *network) bumpChannelInteractionTime(ctx context.Context, name string) {
+	ch := net.channels.Get(name)
+	if ch == nil {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(ch.DownstreamInteractedAt) < time.Hour {
+		return
+	}
+
+	ch.DownstreamInteractedAt = now
+	if err := net.user.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+		net.logger.Printf("failed to update channel %q: %v", ch.Name, err)
+	}
+}
+
 func (net *network) isHighlight(msg *irc.Message) bool {
+	return net.isChannelHighlight(nil, msg)
+}
+
+// isChannelHighlight is like isHighlight, but also takes into account the
+// highlight settings of the provided channel, if any.
+func (net *network) isChannelHighlight(ch *database.Channel, msg *irc.Message) bool {
 	if msg.Command != "PRIVMSG" && msg.Command != "NOTICE" {
 		return false
 	}
@@ -452,12 +791,38 @@ func (net *network) isHighlight(msg *irc.Message) bool {
 	}
 
 	// TODO: use case-mapping aware comparison here
-	return msg.Prefix.Name != nick && isHighlight(text, nick)
+	if msg.Prefix.Name == nick {
+		return false
+	}
+	if (ch == nil || !ch.DisableNickHighlight) && isHighlight(text, nick) {
+		return true
+	}
+	if ch != nil {
+		for _, keyword := range ch.Highlights {
+			if isHighlight(text, keyword) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
 func (net *network) detachedMessageNeedsRelay(ch *database.Channel, msg *irc.Message) bool {
-	highlight := net.isHighlight(msg)
-	return ch.RelayDetached == database.FilterMessage || ((ch.RelayDetached == database.FilterHighlight || ch.RelayDetached == database.FilterDefault) && highlight)
+	highlight := net.isChannelHighlight(ch, msg)
+	relayDetached := database.GetRelayDetached(&net.user.User, ch)
+	return relayDetached == database.FilterMessage || (relayDetached == database.FilterHighlight && highlight)
+}
+
+// updateChannelTopic saves the topic of a saved channel, if it has changed.
+func (net *network) updateChannelTopic(ctx context.Context, name, topic string) {
+	ch := net.channels.Get(name)
+	if ch == nil || ch.Topic == topic {
+		return
+	}
+	ch.Topic = topic
+	if err := net.user.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+		net.logger.Printf("failed to store topic for channel %q: %v", ch.Name, err)
+	}
 }
 
 func (net *network) autoSaveSASLPlain(ctx context.Context, username, password string) {
@@ -531,6 +896,12 @@ type user struct {
 	networks        []*network
 	downstreamConns []*downstreamConn
 	msgStore        msgstore.Store
+
+	// Last disconnection time of each client name
+	clientsSeen map[string]time.Time
+
+	// Highlights which happened while no client was active, oldest first
+	highlights []database.Highlight
 }
 
 func newUser(srv *Server, record *database.User) *user {
@@ -539,7 +910,7 @@ func newUser(srv *Server, record *database.User) *user {
 	var msgStore msgstore.Store
 	switch srv.Config().MsgStoreDriver {
 	case "fs":
-		msgStore = msgstore.NewFSStore(srv.Config().MsgStorePath, record)
+		msgStore = msgstore.NewFSStore(srv.Config().MsgStorePath, srv.Config().MsgStoreFSLayout, record)
 	case "db":
 		msgStore = msgstore.NewDBStore(srv.db)
 	case "memory":
@@ -547,12 +918,13 @@ func newUser(srv *Server, record *database.User) *user {
 	}
 
 	return &user{
-		User:     *record,
-		srv:      srv,
-		logger:   logger,
-		events:   make(chan event, 64),
-		done:     make(chan struct{}),
-		msgStore: msgStore,
+		User:        *record,
+		srv:         srv,
+		logger:      logger,
+		events:      make(chan event, 64),
+		done:        make(chan struct{}),
+		msgStore:    msgStore,
+		clientsSeen: make(map[string]time.Time),
 	}
 }
 
@@ -617,6 +989,13 @@ func (u *user) run() {
 		network := newNetwork(u, &record, channels)
 		u.networks = append(u.networks, network)
 
+		offlineEvents, err := u.srv.db.ListOfflineEvents(context.TODO(), record.ID)
+		if err != nil {
+			u.logger.Printf("failed to load offline events for user %q, network %q: %v", u.Username, network.GetName(), err)
+		}
+		network.offlineEvents = offlineEvents
+		network.expireOfflineEvents(context.TODO())
+
 		if u.hasPersistentMsgStore() {
 			receipts, err := u.srv.db.ListDeliveryReceipts(context.TODO(), record.ID)
 			if err != nil {
@@ -632,11 +1011,27 @@ func (u *user) run() {
 		go network.run()
 	}
 
+	highlights, err := u.srv.db.ListHighlights(context.TODO(), u.ID)
+	if err != nil {
+		u.logger.Printf("failed to load highlights for user %q: %v", u.Username, err)
+	}
+	u.highlights = highlights
+	u.expireHighlights(context.TODO())
+
+	go u.detachIdleChannelsLoop()
+	go u.upstreamLagCheckLoop()
+	go u.trafficStatsFlushLoop()
+
 	for e := range u.events {
 		switch e := e.(type) {
 		case eventUpstreamConnected:
 			uc := e.uc
 
+			if uc.network.manuallyDisconnected.Load() {
+				// Disconnected while the connection was being registered
+				uc.quit("")
+			}
+
 			uc.network.conn = uc
 
 			uc.updateAway()
@@ -647,7 +1042,7 @@ func (u *user) run() {
 				dc.updateSupportedCaps(ctx)
 
 				if !dc.caps.IsEnabled("soju.im/bouncer-networks") {
-					sendServiceNOTICE(dc, fmt.Sprintf("connected to %s", uc.network.GetName()))
+					sendServiceNOTICE(dc, "connected to %s", uc.network.GetName())
 				}
 
 				dc.updateNick(ctx)
@@ -675,22 +1070,53 @@ func (u *user) run() {
 
 			if !stopped && (net.lastError == nil || net.lastError.Error() != e.err.Error()) {
 				net.forEachDownstream(func(dc *downstreamConn) {
-					sendServiceNOTICE(dc, fmt.Sprintf("failed connecting/registering to %s: %v", net.GetName(), e.err))
+					sendServiceNOTICE(dc, "failed connecting/registering to %s: %v", net.GetName(), e.err)
+				})
+			}
+			if !stopped {
+				net.recordConnError(e.err)
+			}
+			var tofuErr tofuMismatchError
+			if !stopped && errors.As(e.err, &tofuErr) {
+				net.untrustedCertFP = tofuErr.CertFP
+				net.forEachDownstream(func(dc *downstreamConn) {
+					net.sendUntrustedCertWarning(dc)
 				})
 			}
 			net.lastError = e.err
+			var regErr registrationError
+			if errors.As(e.err, &regErr) && regErr.Command == "ERROR" {
+				net.lastServerError = regErr.Reason()
+				net.lastServerErrorTime = time.Now()
+			}
 			u.notifyBouncerNetworkState(net.ID, irc.Tags{
 				"error": net.lastError.Error(),
 			})
 		case eventUpstreamError:
-			uc := e.uc
-
-			uc.forEachDownstream(func(dc *downstreamConn) {
-				sendServiceNOTICE(dc, fmt.Sprintf("disconnected from %s: %v", uc.network.GetName(), e.err))
+			u.handleUpstreamError(e.uc, e.err)
+		case eventUpstreamSASLFailed:
+			net := e.net
+			format := "SASL authentication to %s failed: %v"
+			if net.saslFailures.Load() >= maxSASLFailures {
+				format = "SASL authentication to %s failed: %v (giving up on SASL until the network is updated)"
+			}
+			net.forEachDownstream(func(dc *downstreamConn) {
+				sendServiceNOTICE(dc, format, net.GetName(), e.reason)
 			})
-			uc.network.lastError = e.err
-			u.notifyBouncerNetworkState(uc.network.ID, irc.Tags{
-				"error": uc.network.lastError.Error(),
+		case eventUpstreamCertTrusted:
+			net := e.net
+			if u.getNetworkByID(net.ID) != net || !net.TOFU || net.TOFUCertFP != "" {
+				// Stale event, e.g. the network has been updated meanwhile
+				break
+			}
+			net.TOFUCertFP = e.certFP
+			if err := u.srv.db.StoreNetwork(context.TODO(), u.ID, &net.Network); err != nil {
+				net.logger.Printf("failed to store certificate trusted on first use: %v", err)
+				break
+			}
+			net.logger.Printf("trusted TLS certificate on first use: %v", e.certFP)
+			net.forEachDownstream(func(dc *downstreamConn) {
+				sendServiceNOTICE(dc, "trusted the TLS certificate of %s on first use, fingerprint: %v", net.GetName(), e.certFP)
 			})
 		case eventUpstreamMessage:
 			msg, uc := e.msg, e.uc
@@ -759,8 +1185,12 @@ func (u *user) run() {
 
 			dc.forEachNetwork(func(network *network) {
 				if network.lastError != nil {
-					sendServiceNOTICE(dc, fmt.Sprintf("disconnected from %s: %v", network.GetName(), network.lastError))
+					sendServiceNOTICE(dc, "disconnected from %s: %v", network.GetName(), network.lastError)
+				}
+				if network.untrustedCertFP != "" {
+					network.sendUntrustedCertWarning(dc)
 				}
+				network.replayOfflineEvents(ctx, dc)
 			})
 
 			u.forEachUpstream(func(uc *upstreamConn) {
@@ -776,6 +1206,7 @@ func (u *user) run() {
 				if u.downstreamConns[i] == dc {
 					u.downstreamConns = append(u.downstreamConns[:i], u.downstreamConns[i+1:]...)
 					u.numDownstreamConns.Add(-1)
+					u.clientsSeen[dc.clientName] = time.Now()
 					break
 				}
 			}
@@ -805,6 +1236,19 @@ func (u *user) run() {
 				dc.logger.Printf("failed to handle message %q: %v", msg, err)
 				dc.Close()
 			}
+		case eventDetachIdleChannels:
+			u.detachIdleChannels(context.TODO())
+		case eventUpstreamLagCheck:
+			for _, net := range u.networks {
+				net.checkHealth()
+				if uc := net.conn; uc != nil {
+					uc.checkLag(context.TODO(), nil)
+				}
+			}
+		case eventFlushTrafficStats:
+			for _, net := range u.networks {
+				net.flushTrafficStats(context.TODO())
+			}
 		case eventBroadcast:
 			msg := e.msg
 			for _, dc := range u.downstreamConns {
@@ -815,8 +1259,8 @@ func (u *user) run() {
 				if e.password != nil {
 					record.Password = *e.password
 				}
-				if e.admin != nil {
-					record.Admin = *e.admin
+				if e.role != nil {
+					record.Role = *e.role
 				}
 				if e.enabled != nil {
 					record.Enabled = *e.enabled
@@ -831,15 +1275,20 @@ func (u *user) run() {
 					dc.Close()
 				}
 			}
+		case eventUserKick:
+			e.done <- u.kick(e.downstream, e.upstream, e.reason)
 		case eventTryRegainNick:
 			e.uc.tryRegainNick(e.nick)
+		case eventChannelJoinRetry:
+			e.uc.retryJoin(e.name)
 		case eventUserRun:
 			ctx := context.TODO()
 			err := handleServiceCommand(&serviceContext{
 				Context: ctx,
 				user:    u,
 				srv:     u.srv,
-				admin:   u.Admin,
+				role:    u.Role,
+				catalog: e.catalog,
 				print: func(text string) {
 					// Avoid blocking on e.print in case our context is canceled.
 					// This is a no-op right now because we use context.TODO(),
@@ -864,6 +1313,8 @@ func (u *user) run() {
 				n.delivered.ForEachClient(func(clientName string) {
 					n.storeClientDeliveryReceipts(context.TODO(), clientName)
 				})
+				n.flushTrafficStats(context.TODO())
+				n.resetHealth()
 			}
 			return
 		default:
@@ -872,6 +1323,17 @@ func (u *user) run() {
 	}
 }
 
+func (u *user) handleUpstreamError(uc *upstreamConn, err error) {
+	uc.forEachDownstream(func(dc *downstreamConn) {
+		sendServiceNOTICE(dc, "disconnected from %s: %v", uc.network.GetName(), err)
+	})
+	uc.network.lastError = err
+	uc.network.recordConnError(err)
+	u.notifyBouncerNetworkState(uc.network.ID, irc.Tags{
+		"error": uc.network.lastError.Error(),
+	})
+}
+
 func (u *user) handleUpstreamDisconnected(uc *upstreamConn) {
 	uc.network.conn = nil
 
@@ -881,6 +1343,9 @@ func (u *user) handleUpstreamDisconnected(uc *upstreamConn) {
 	uc.channels.ForEach(func(_ string, uch *upstreamChannel) {
 		uch.updateAutoDetach(0)
 	})
+	uc.joinStates.ForEach(func(_ string, state *channelJoinState) {
+		state.stopRetry()
+	})
 
 	uc.forEachDownstream(func(dc *downstreamConn) {
 		dc.updateSupportedCaps(context.TODO())
@@ -900,15 +1365,70 @@ func (u *user) handleUpstreamDisconnected(uc *upstreamConn) {
 
 	u.notifyBouncerNetworkState(uc.network.ID, irc.Tags{"state": "disconnected"})
 
+	if !uc.network.isStopped() && !uc.network.manuallyDisconnected.Load() {
+		uc.network.recordReconnect()
+	}
+
 	if uc.network.lastError == nil {
 		uc.forEachDownstream(func(dc *downstreamConn) {
 			if !dc.caps.IsEnabled("soju.im/bouncer-networks") {
-				sendServiceNOTICE(dc, fmt.Sprintf("disconnected from %s", uc.network.GetName()))
+				sendServiceNOTICE(dc, "disconnected from %s", uc.network.GetName())
 			}
 		})
 	}
 }
 
+// kick closes the downstream and/or upstream connections of the user, without
+// stopping it: clients can connect again, and networks are re-connected.
+func (u *user) kick(downstream, upstream bool, reason string) userKickCount {
+	var count userKickCount
+	if downstream {
+		for _, dc := range u.downstreamConns {
+			dc.SendMessage(context.TODO(), &irc.Message{
+				Prefix:  u.srv.prefix(),
+				Command: "ERROR",
+				Params:  []string{reason},
+			})
+			dc.Shutdown(context.TODO())
+			count.downstreams++
+		}
+	}
+	if upstream {
+		for _, net := range u.networks {
+			if uc := net.conn; uc != nil {
+				uc.quit(reason)
+				count.upstreams++
+			}
+		}
+	}
+	return count
+}
+
+// motd assembles the message of the day sent to a downstream connection of
+// this user: the server-wide MOTD, the current announcement and a short
+// status line.
+func (u *user) motd() string {
+	var lines []string
+	if motd := u.srv.Config().MOTD; motd != "" {
+		lines = append(lines, motd)
+	}
+	if announcement := u.srv.Announcement(); announcement != "" {
+		lines = append(lines, "Announcement: "+announcement)
+	}
+
+	connected, disconnected := 0, 0
+	for _, network := range u.networks {
+		if network.conn != nil {
+			connected++
+		} else if network.Enabled {
+			disconnected++
+		}
+	}
+	lines = append(lines, fmt.Sprintf("%v networks connected, %v disconnected", connected, disconnected))
+
+	return strings.Join(lines, "\n")
+}
+
 func (u *user) notifyBouncerNetworkState(netID int64, attrs irc.Tags) {
 	// Don't send state updates for removed networks
 	found := false
@@ -945,6 +1465,7 @@ func (u *user) addNetwork(network *network) {
 
 func (u *user) removeNetwork(network *network) {
 	network.stop()
+	network.resetHealth()
 
 	for _, dc := range u.downstreamConns {
 		if dc.network != nil && dc.network == network {
@@ -977,7 +1498,7 @@ func (u *user) checkNetwork(record *database.Network) error {
 		return fmt.Errorf("%v:// URL must not have a fragment", url.Scheme)
 	}
 	switch url.Scheme {
-	case "ircs", "irc+insecure":
+	case "ircs", "irc+insecure", "irc+starttls":
 		if url.Host == "" {
 			return fmt.Errorf("%v:// URL must have a host", url.Scheme)
 		}
@@ -991,6 +1512,16 @@ func (u *user) checkNetwork(record *database.Network) error {
 		if url.Path == "" {
 			return fmt.Errorf("%v:// URL must have a path", url.Scheme)
 		}
+	case "ircs+unix":
+		if url.Port() != "" {
+			return fmt.Errorf("%v:// URL must not have a port", url.Scheme)
+		}
+		if url.Path == "" {
+			return fmt.Errorf("%v:// URL must have a path", url.Scheme)
+		}
+		if url.Host == "" && record.CertFP == "" {
+			return fmt.Errorf("%v:// URL without a host requires a TLS certificate fingerprint", url.Scheme)
+		}
 	default:
 		return fmt.Errorf("unknown URL scheme %q", url.Scheme)
 	}
@@ -1012,11 +1543,44 @@ func (u *user) checkNetwork(record *database.Network) error {
 	return nil
 }
 
+// applyNetworkDefaults fills the empty nickname, username and realname fields
+// of a network from the instance templates. Per-user defaults take precedence
+// over the templates.
+//
+// The templates are copied into the network record when it's created, so
+// later template changes don't affect existing networks.
+func (u *user) applyNetworkDefaults(record *database.Network) error {
+	cfg := u.srv.Config()
+	name := record.GetName()
+
+	var err error
+	if record.Nick == "" && u.Nick == "" && cfg.DefaultNick != "" {
+		if record.Nick, err = cfg.DefaultNick.Expand(u.Username, name); err != nil {
+			return err
+		}
+	}
+	if record.Username == "" && cfg.DefaultUsername != "" {
+		if record.Username, err = cfg.DefaultUsername.Expand(u.Username, name); err != nil {
+			return err
+		}
+	}
+	if record.Realname == "" && u.Realname == "" && cfg.DefaultRealname != "" {
+		if record.Realname, err = cfg.DefaultRealname.Expand(u.Username, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (u *user) createNetwork(ctx context.Context, record *database.Network) (*network, error) {
 	if record.ID != 0 {
 		panic("tried creating an already-existing network")
 	}
 
+	if err := u.applyNetworkDefaults(record); err != nil {
+		return nil, err
+	}
+
 	if err := u.checkNetwork(record); err != nil {
 		return nil, err
 	}
@@ -1074,6 +1638,11 @@ func (u *user) updateNetwork(ctx context.Context, record *database.Network) (*ne
 	})
 
 	updatedNetwork := newNetwork(u, record, channels)
+	updatedNetwork.connErrors = network.connErrors
+	updatedNetwork.health = network.health
+	updatedNetwork.offlineEvents = network.offlineEvents
+	updatedNetwork.manuallyDisconnected.Store(network.manuallyDisconnected.Load())
+	network.health = networkHealth{}
 
 	// If we're currently connected, disconnect and perform the necessary
 	// bookkeeping
@@ -1082,6 +1651,7 @@ func (u *user) updateNetwork(ctx context.Context, record *database.Network) (*ne
 		// Note: this will set network.conn to nil
 		u.handleUpstreamDisconnected(network.conn)
 	}
+	network.flushTrafficStats(ctx)
 
 	// Patch downstream connections to use our fresh updated network
 	for _, dc := range u.downstreamConns {
@@ -1106,6 +1676,9 @@ func (u *user) updateNetwork(ctx context.Context, record *database.Network) (*ne
 	// This will re-connect to the upstream server
 	u.addNetwork(updatedNetwork)
 
+	// Thresholds may have changed
+	updatedNetwork.checkHealth()
+
 	// TODO: only broadcast attributes that have changed
 	attrs := getNetworkAttrs(updatedNetwork)
 	u.notifyBouncerNetworkState(updatedNetwork.ID, attrs)
@@ -1125,6 +1698,15 @@ func (u *user) deleteNetwork(ctx context.Context, id int64) error {
 
 	u.removeNetwork(network)
 
+	// Highlights have been deleted from the database along with the network
+	var highlights []database.Highlight
+	for _, highlight := range u.highlights {
+		if highlight.NetworkID != network.ID {
+			highlights = append(highlights, highlight)
+		}
+	}
+	u.highlights = highlights
+
 	idStr := fmt.Sprintf("%v", network.ID)
 	for _, dc := range u.downstreamConns {
 		if dc.caps.IsEnabled("soju.im/bouncer-networks-notify") {
@@ -1147,11 +1729,25 @@ func (u *user) updateUser(ctx context.Context, update UserUpdateFunc) error {
 	nickUpdated := u.Nick != record.Nick
 	realnameUpdated := u.Realname != record.Realname
 	enabledUpdated := u.Enabled != record.Enabled
+	detachAfterUpdated := u.DetachAfter != record.DetachAfter
 	if err := u.srv.db.StoreUser(ctx, &record); err != nil {
 		return fmt.Errorf("failed to update user %q: %v", u.Username, err)
 	}
 	u.User = record
 
+	if detachAfterUpdated {
+		// Reset the timers of channels using the user-wide default
+		for _, net := range u.networks {
+			uc := net.conn
+			if uc == nil {
+				continue
+			}
+			uc.channels.ForEach(func(name string, _ *upstreamChannel) {
+				uc.updateChannelAutoDetach(name)
+			})
+		}
+	}
+
 	if nickUpdated {
 		for _, net := range u.networks {
 			if net.Nick != "" {
@@ -1280,6 +1876,87 @@ func (u *user) localTCPAddr(remoteIP net.IP) (*net.TCPAddr, error) {
 	return &net.TCPAddr{IP: ip}, nil
 }
 
+func (u *user) detachIdleChannelsLoop() {
+	ticker := time.NewTicker(idleChannelsCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+
+		select {
+		case <-u.done:
+			return
+		case u.events <- eventDetachIdleChannels{}:
+		}
+	}
+}
+
+func (u *user) upstreamLagCheckLoop() {
+	ticker := time.NewTicker(upstreamLagCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case <-ticker.C:
+		}
+
+		select {
+		case <-u.done:
+			return
+		case u.events <- eventUpstreamLagCheck{}:
+		}
+	}
+}
+
+// detachIdleChannels detaches all channels no downstream client has
+// interacted with for the user's auto-detach idle delay.
+func (u *user) detachIdleChannels(ctx context.Context) {
+	delay := u.AutoDetachIdle
+	if delay == 0 {
+		return
+	}
+
+	now := time.Now()
+	n := 0
+	for _, net := range u.networks {
+		net.channels.ForEach(func(_ string, ch *database.Channel) {
+			if ch.Detached {
+				return
+			}
+
+			if ch.DownstreamInteractedAt.IsZero() {
+				// We don't know when this channel has last been used: start
+				// counting from now
+				ch.DownstreamInteractedAt = now
+			} else if now.Sub(ch.DownstreamInteractedAt) < delay {
+				return
+			} else {
+				net.detach(ch)
+				n++
+			}
+
+			if err := u.srv.db.StoreChannel(ctx, net.ID, ch); err != nil {
+				net.logger.Printf("failed to update channel %q: %v", ch.Name, err)
+			}
+		})
+	}
+
+	if n == 0 {
+		return
+	}
+
+	u.logger.Printf("auto-detached %v idle channels", n)
+	for _, dc := range u.downstreamConns {
+		sendServiceNOTICE(dc, "auto-detached %v idle channels", n)
+	}
+}
+
 func (u *user) bumpDownstreamInteractionTime(ctx context.Context) {
 	err := u.updateUser(ctx, func(record *database.User) error {
 		record.DownstreamInteractedAt = time.Now()
@@ -67,6 +67,58 @@ func ParseCaseMapping(s string) CaseMapping {
 	return cm
 }
 
+// MatchMask reports whether a name matches an IRC mask. In the mask, "*"
+// matches any sequence of characters, "?" matches any single character and
+// "\" escapes the next character. Other characters are compared according to
+// the case-mapping.
+func MatchMask(cm CaseMapping, mask, name string) bool {
+	type maskToken struct {
+		wildcard byte // '*', '?' or zero for a literal
+		literal  byte
+	}
+	// Case-mappings map bytes one to one, so wildcards and escapes are
+	// looked up in the original mask and literals in the mapped one
+	mapped := cm(mask)
+	tokens := make([]maskToken, 0, len(mask))
+	for i := 0; i < len(mask); i++ {
+		switch c := mask[i]; c {
+		case '*', '?':
+			tokens = append(tokens, maskToken{wildcard: c})
+		case '\\':
+			if i+1 < len(mask) {
+				i++
+			}
+			fallthrough
+		default:
+			tokens = append(tokens, maskToken{literal: mapped[i]})
+		}
+	}
+	name = cm(name)
+
+	// Only backtrack to the last "*" to keep the matching time linear
+	t, n := 0, 0
+	starT, starN := -1, 0
+	for n < len(name) {
+		switch {
+		case t < len(tokens) && tokens[t].wildcard == '*':
+			starT, starN = t, n
+			t++
+		case t < len(tokens) && (tokens[t].wildcard == '?' || (tokens[t].wildcard == 0 && tokens[t].literal == name[n])):
+			t++
+			n++
+		case starT >= 0:
+			starN++
+			t, n = starT+1, starN
+		default:
+			return false
+		}
+	}
+	for t < len(tokens) && tokens[t].wildcard == '*' {
+		t++
+	}
+	return t == len(tokens)
+}
+
 type CaseMappingMap[V interface{}] struct {
 	m       map[string]caseMappingEntry[V]
 	casemap CaseMapping
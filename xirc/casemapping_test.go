@@ -0,0 +1,45 @@
+package xirc
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchMask(t *testing.T) {
+	testCases := []struct {
+		cm         CaseMapping
+		mask, name string
+		want       bool
+	}{
+		{CaseMappingASCII, "*", "#soju", true},
+		{CaseMappingASCII, "#soju-*", "#soju-dev", true},
+		{CaseMappingASCII, "#soju-*", "#soju", false},
+		{CaseMappingASCII, "#SOJU", "#soju", true},
+		{CaseMappingASCII, "#s?ju", "#soju", true},
+		{CaseMappingASCII, "#*", "#a/b", true},
+		{CaseMappingASCII, "#a\\*", "#a*", true},
+		{CaseMappingASCII, "#a\\*", "#ab", false},
+		{CaseMappingASCII, "#a\\?", "#ab", false},
+		{CaseMappingASCII, "#a\\\\", "#a\\", true},
+		{CaseMappingASCII, "#a[bc]", "#ab", false},
+		{CaseMappingASCII, "#a[bc]", "#a[bc]", true},
+		{CaseMappingASCII, "#a[bc]", "#a{bc}", false},
+		{CaseMappingRFC1459, "#a[bc]", "#a{BC}", true},
+		{CaseMappingRFC1459, "#a\\*", "#a*", true},
+		{CaseMappingRFC1459, "#a\\*", "#a|b", false},
+		{CaseMappingRFC1459, "#a|*", "#a\\b", true},
+		{CaseMappingASCII, "#café", "#café", true},
+		{CaseMappingASCII, "#CAFÉ", "#café", false},
+		{CaseMappingASCII, "#caf*", "#café", true},
+		{CaseMappingRFC1459, "#Ünì*", "#Ünìcode", true},
+		{CaseMappingRFC1459, "#Ünì\\*", "#Ünì*", true},
+		{CaseMappingASCII, "#日本*", "#日本語", true},
+		{CaseMappingASCII, "#日本", "#日本語", false},
+		{CaseMappingASCII, strings.Repeat("*a", 32) + "*b", strings.Repeat("a", 256), false},
+	}
+	for _, tc := range testCases {
+		if got := MatchMask(tc.cm, tc.mask, tc.name); got != tc.want {
+			t.Errorf("MatchMask(%q, %q) = %v, want %v", tc.mask, tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package xirc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// dccOfferTypes lists the DCC request types advertising an address, with the
+// "<argument> <ip> <port> [params...]" syntax.
+var dccOfferTypes = map[string]bool{
+	"CHAT":  true,
+	"SEND":  true,
+	"SCHAT": true, // over TLS
+	"SSEND": true, // over TLS
+}
+
+// DCCOffer is a CTCP DCC request offering a direct connection to another
+// user, e.g. "DCC SEND" or "DCC CHAT".
+type DCCOffer struct {
+	Type     string // upper-case, e.g. "SEND"
+	Argument string // file name for SEND, protocol (usually "chat") for CHAT
+	IP       net.IP
+	Port     int      // zero for passive DCC
+	Params   []string // remaining parameters, e.g. the file size and token
+}
+
+// ParseDCCOffer parses the parameters of a CTCP DCC request offering a
+// connection.
+//
+// IPv4 addresses can be either formatted as an integer or in dot-decimal
+// notation. The argument can be quoted with double quotes.
+func ParseDCCOffer(params string) (*DCCOffer, error) {
+	typ, rest, _ := strings.Cut(params, " ")
+	typ = strings.ToUpper(typ)
+	if !dccOfferTypes[typ] {
+		return nil, fmt.Errorf("unsupported DCC request type %q", typ)
+	}
+
+	rest = strings.TrimLeft(rest, " ")
+	var arg string
+	if strings.HasPrefix(rest, `"`) {
+		var ok bool
+		arg, rest, ok = strings.Cut(rest[1:], `"`)
+		if !ok {
+			return nil, fmt.Errorf("unterminated quoted DCC argument")
+		}
+		if rest != "" && !strings.HasPrefix(rest, " ") {
+			return nil, fmt.Errorf("missing space after quoted DCC argument")
+		}
+	} else {
+		arg, rest, _ = strings.Cut(rest, " ")
+	}
+	if arg == "" {
+		return nil, fmt.Errorf("missing DCC argument")
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 2 {
+		return nil, fmt.Errorf("missing DCC address")
+	}
+
+	ip, err := parseDCCIP(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DCC port %q", fields[1])
+	}
+
+	offer := &DCCOffer{
+		Type:     typ,
+		Argument: arg,
+		IP:       ip,
+		Port:     int(port),
+	}
+	if len(fields) > 2 {
+		offer.Params = fields[2:]
+	}
+	return offer, nil
+}
+
+func parseDCCIP(s string) (net.IP, error) {
+	if v, err := strconv.ParseUint(s, 10, 32); err == nil {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, uint32(v))
+		return ip, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid DCC IP address %q", s)
+	}
+	return ip, nil
+}
+
+// String formats the DCC request parameters. IPv4 addresses are formatted as
+// integers, for compatibility with older clients.
+func (offer *DCCOffer) String() string {
+	arg := offer.Argument
+	if strings.Contains(arg, " ") {
+		arg = `"` + arg + `"`
+	}
+
+	var ip string
+	if ip4 := offer.IP.To4(); ip4 != nil {
+		ip = strconv.FormatUint(uint64(binary.BigEndian.Uint32(ip4)), 10)
+	} else {
+		ip = offer.IP.String()
+	}
+
+	l := append([]string{offer.Type, arg, ip, strconv.Itoa(offer.Port)}, offer.Params...)
+	return strings.Join(l, " ")
+}
@@ -0,0 +1,87 @@
+package xirc
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestParseDCCOffer(t *testing.T) {
+	testCases := []struct {
+		params string
+		want   *DCCOffer
+		str    string
+	}{
+		{
+			params: "SEND file.txt 3232235777 5000 1234",
+			want: &DCCOffer{
+				Type:     "SEND",
+				Argument: "file.txt",
+				IP:       net.IPv4(192, 168, 1, 1).To4(),
+				Port:     5000,
+				Params:   []string{"1234"},
+			},
+		},
+		{
+			params: `SEND "my file.txt" 3232235777 0 1234 42`,
+			want: &DCCOffer{
+				Type:     "SEND",
+				Argument: "my file.txt",
+				IP:       net.IPv4(192, 168, 1, 1).To4(),
+				Port:     0,
+				Params:   []string{"1234", "42"},
+			},
+		},
+		{
+			params: "chat chat 192.168.1.1 5000",
+			want: &DCCOffer{
+				Type:     "CHAT",
+				Argument: "chat",
+				IP:       net.IPv4(192, 168, 1, 1),
+				Port:     5000,
+			},
+			str: "CHAT chat 3232235777 5000",
+		},
+		{
+			params: "CHAT chat 2001:db8::1 5000",
+			want: &DCCOffer{
+				Type:     "CHAT",
+				Argument: "chat",
+				IP:       net.ParseIP("2001:db8::1"),
+				Port:     5000,
+			},
+		},
+		{params: "RESUME file.txt 5000 1024"},
+		{params: "SEND file.txt 3232235777"},
+		{params: `SEND "file.txt 3232235777 5000`},
+		{params: `SEND "file"txt 3232235777 5000`},
+		{params: "SEND file.txt 192.168.1 5000"},
+		{params: "SEND file.txt 3232235777 65536"},
+		{params: "SEND  3232235777 5000"},
+	}
+
+	for _, tc := range testCases {
+		offer, err := ParseDCCOffer(tc.params)
+		if tc.want == nil {
+			if err == nil {
+				t.Errorf("ParseDCCOffer(%q) = %+v, want an error", tc.params, offer)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseDCCOffer(%q): %v", tc.params, err)
+			continue
+		}
+		if !reflect.DeepEqual(offer, tc.want) {
+			t.Errorf("ParseDCCOffer(%q) = %+v, want %+v", tc.params, offer, tc.want)
+		}
+
+		str := tc.str
+		if str == "" {
+			str = tc.params
+		}
+		if s := offer.String(); s != str {
+			t.Errorf("ParseDCCOffer(%q).String() = %q, want %q", tc.params, s, str)
+		}
+	}
+}
@@ -5,20 +5,25 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"gopkg.in/irc.v4"
 )
 
-func GenerateJoin(channels, keys []string) []*irc.Message {
+// GenerateJoin generates JOIN messages for the specified channels and keys.
+// If maxTargets is positive, each message contains at most maxTargets
+// channels.
+func GenerateJoin(channels, keys []string, maxTargets int) []*irc.Message {
 	// Put channels with a key first
 	js := joinSorter{channels, keys}
 	sort.Sort(&js)
 
 	// Two spaces because there are three words (JOIN, channels and keys)
-	maxLength := maxMessageLength - (len("JOIN") + 2)
+	maxLength := DefaultLineLength - (len("JOIN") + 2)
 
 	var msgs []*irc.Message
 	var channelsBuf, keysBuf strings.Builder
+	numTargets := 0
 	for i, channel := range channels {
 		key := keys[i]
 
@@ -27,7 +32,7 @@ func GenerateJoin(channels, keys []string) []*irc.Message {
 			n += 1 + len(key)
 		}
 
-		if channelsBuf.Len() > 0 && n > maxLength {
+		if channelsBuf.Len() > 0 && (n > maxLength || (maxTargets > 0 && numTargets >= maxTargets)) {
 			// No room for the new channel in this message
 			params := []string{channelsBuf.String()}
 			if keysBuf.Len() > 0 {
@@ -36,12 +41,14 @@ func GenerateJoin(channels, keys []string) []*irc.Message {
 			msgs = append(msgs, &irc.Message{Command: "JOIN", Params: params})
 			channelsBuf.Reset()
 			keysBuf.Reset()
+			numTargets = 0
 		}
 
 		if channelsBuf.Len() > 0 {
 			channelsBuf.WriteByte(',')
 		}
 		channelsBuf.WriteString(channel)
+		numTargets++
 		if key != "" {
 			if keysBuf.Len() > 0 {
 				keysBuf.WriteByte(',')
@@ -85,7 +92,7 @@ func (js *joinSorter) Swap(i, j int) {
 func GenerateIsupport(tokens []string) []*irc.Message {
 	maxTokens := maxMessageParams - 2 // 2 reserved params: nick + text
 
-	// TODO: take into account maxMessageLength as well
+	// TODO: take into account DefaultLineLength as well
 	var msgs []*irc.Message
 	for len(tokens) > 0 {
 		var msgTokens []string
@@ -136,7 +143,7 @@ func GenerateMOTD(motd string) []*irc.Message {
 }
 
 func GenerateMonitor(subcmd string, targets []string) []*irc.Message {
-	maxLength := maxMessageLength - len("MONITOR "+subcmd+" ")
+	maxLength := DefaultLineLength - len("MONITOR "+subcmd+" ")
 
 	var msgs []*irc.Message
 	var buf []string
@@ -170,7 +177,7 @@ func GenerateNamesReply(channel string, status ChannelStatus, members []string)
 		Command: irc.RPL_NAMREPLY,
 		Params:  []string{"*", string(status), channel, ""},
 	}
-	maxLength := maxMessageLength - len(emptyNameReply.String())
+	maxLength := DefaultLineLength - len(emptyNameReply.String())
 
 	var msgs []*irc.Message
 	var buf strings.Builder
@@ -229,3 +236,119 @@ func GenerateSASL(resp []byte) []*irc.Message {
 	}
 	return msgs
 }
+
+// MaxTextLength returns the maximum length in bytes of the text of a message
+// sent to target, so that the message relayed by the server with the specified
+// prefix fits in lineLen bytes.
+func MaxTextLength(prefix *irc.Prefix, cmd, target string, lineLen int) int {
+	emptyMsg := irc.Message{
+		Prefix:  prefix,
+		Command: cmd,
+		Params:  []string{target, ""},
+	}
+	// Two bytes for the trailing CRLF
+	return lineLen - len(emptyMsg.String()) - 2
+}
+
+// SplitText splits text into chunks of at most maxLen bytes. Text is split on
+// word boundaries if possible, and never in the middle of a UTF-8 sequence.
+func SplitText(text string, maxLen int) []string {
+	if maxLen <= 0 || len(text) <= maxLen {
+		return []string{text}
+	}
+
+	var chunks []string
+	for len(text) > maxLen {
+		n := runeBoundary(text, maxLen)
+		if i := strings.LastIndexByte(text[:n], ' '); i > 0 && text[n] != ' ' {
+			n = i
+		}
+
+		chunks = append(chunks, text[:n])
+		text = text[n:]
+		if text[0] == ' ' {
+			// The space is replaced by the message boundary
+			text = text[1:]
+		}
+	}
+	if text != "" {
+		chunks = append(chunks, text)
+	}
+	return chunks
+}
+
+// runeBoundary returns the largest index lower than or equal to n which
+// doesn't cut a UTF-8 sequence in half. At least one rune is always included.
+// TruncateText truncates text to at most maxLen bytes, without cutting a
+// UTF-8 sequence.
+func TruncateText(text string, maxLen int) string {
+	if len(text) <= maxLen {
+		return text
+	} else if maxLen <= 0 {
+		return ""
+	}
+	i := maxLen
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	return text[:i]
+}
+
+func runeBoundary(s string, n int) int {
+	i := n
+	for i > 0 && !utf8.RuneStart(s[i]) {
+		i--
+	}
+	if i == 0 {
+		// A single rune doesn't fit, don't loop forever
+		_, i = utf8.DecodeRuneInString(s)
+	}
+	return i
+}
+
+// GenerateMultilineBatch generates a draft/multiline batch for a PRIVMSG or
+// NOTICE message whose text contains line breaks. The message tags are sent
+// with the BATCH command. If maxLen is positive, lines longer than maxLen bytes
+// are split and the continuations are sent with the draft/multiline-concat tag.
+func GenerateMultilineBatch(ref string, msg *irc.Message, maxLen int) []*irc.Message {
+	target, text := msg.Params[0], msg.Params[1]
+
+	msgs := []*irc.Message{{
+		Tags:    msg.Tags,
+		Prefix:  msg.Prefix,
+		Command: "BATCH",
+		Params:  []string{"+" + ref, "draft/multiline", target},
+	}}
+	for _, line := range strings.Split(text, "\n") {
+		concat := false
+		for {
+			chunk := line
+			if maxLen > 0 && len(line) > maxLen {
+				chunk = line[:runeBoundary(line, maxLen)]
+			}
+			line = line[len(chunk):]
+
+			tags := irc.Tags{"batch": ref}
+			if concat {
+				tags["draft/multiline-concat"] = ""
+			}
+			msgs = append(msgs, &irc.Message{
+				Tags:    tags,
+				Prefix:  msg.Prefix,
+				Command: msg.Command,
+				Params:  []string{target, chunk},
+			})
+
+			if line == "" {
+				break
+			}
+			concat = true
+		}
+	}
+	msgs = append(msgs, &irc.Message{
+		Command: "BATCH",
+		Params:  []string{"-" + ref},
+	})
+
+	return msgs
+}
@@ -10,30 +10,38 @@ import (
 )
 
 const (
-	maxMessageLength = 512
+	// DefaultLineLength is the standard maximum length of a message, excluding
+	// its tags and including the trailing CRLF.
+	DefaultLineLength = 512
+	// MaxTagsLength is the maximum length of the tags of a message, including
+	// the leading '@' and the trailing space.
+	MaxTagsLength = 8191
+
 	maxMessageParams = 15
 )
 
 const MaxSASLLength = 400
 
 const (
-	RPL_STATSPING     = "246"
-	RPL_LOCALUSERS    = "265"
-	RPL_GLOBALUSERS   = "266"
-	RPL_WHOISCERTFP   = "276"
-	RPL_WHOISREGNICK  = "307"
-	RPL_WHOISSPECIAL  = "320"
-	RPL_CREATIONTIME  = "329"
-	RPL_WHOISACCOUNT  = "330"
-	RPL_TOPICWHOTIME  = "333"
-	RPL_WHOISACTUALLY = "338"
-	RPL_WHOSPCRPL     = "354"
-	RPL_WHOISHOST     = "378"
-	RPL_WHOISMODES    = "379"
-	RPL_VISIBLEHOST   = "396"
-	ERR_UNKNOWNERROR  = "400"
-	ERR_INVALIDCAPCMD = "410"
-	RPL_WHOISSECURE   = "671"
+	RPL_STATSPING      = "246"
+	RPL_LOCALUSERS     = "265"
+	RPL_GLOBALUSERS    = "266"
+	RPL_WHOISCERTFP    = "276"
+	RPL_WHOISREGNICK   = "307"
+	RPL_WHOISSPECIAL   = "320"
+	RPL_CREATIONTIME   = "329"
+	RPL_WHOISACCOUNT   = "330"
+	RPL_TOPICWHOTIME   = "333"
+	RPL_WHOISACTUALLY  = "338"
+	RPL_WHOSPCRPL      = "354"
+	RPL_WHOISHOST      = "378"
+	RPL_WHOISMODES     = "379"
+	RPL_VISIBLEHOST    = "396"
+	ERR_UNKNOWNERROR   = "400"
+	ERR_INVALIDCAPCMD  = "410"
+	ERR_INPUTTOOLONG   = "417"
+	ERR_NEEDREGGEDNICK = "477"
+	RPL_WHOISSECURE    = "671"
 
 	// https://ircv3.net/specs/extensions/bot-mode
 	RPL_WHOISBOT = "335"